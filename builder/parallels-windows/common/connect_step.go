@@ -38,10 +38,5 @@ func WinRMAddressFunc(config wincommon.WinRMConfig) func(state multistep.StateBa
 
 // Creates a generic WinRM connect step from a Parallels builder config
 func NewConnectStep(winrmConfig wincommon.WinRMConfig) multistep.Step {
-	return &wincommon.StepConnectWinRM{
-		WinRMAddress:     WinRMAddressFunc(winrmConfig),
-		WinRMUser:        winrmConfig.WinRMUser,
-		WinRMPassword:    winrmConfig.WinRMPassword,
-		WinRMWaitTimeout: winrmConfig.WinRMWaitTimeout,
-	}
+	return wincommon.NewStepConnectWinRM(&winrmConfig, WinRMAddressFunc(winrmConfig))
 }
@@ -28,10 +28,22 @@ func WinRMAddressFunc(config wincommon.WinRMConfig) func(state multistep.StateBa
 
 // Creates a generic WinRM connect step from a Virtualbox builder config
 func NewConnectStep(winrmConfig wincommon.WinRMConfig) multistep.Step {
-	return &wincommon.StepConnectWinRM{
-		WinRMAddress:     WinRMAddressFunc(winrmConfig),
-		WinRMUser:        winrmConfig.WinRMUser,
-		WinRMPassword:    winrmConfig.WinRMPassword,
-		WinRMWaitTimeout: winrmConfig.WinRMWaitTimeout,
+	step := wincommon.NewStepConnectWinRM(&winrmConfig, WinRMAddressFunc(winrmConfig))
+	step.WinRMHTTPUploadHost = httpUploadHost(winrmConfig)
+	return step
+}
+
+// httpUploadHost returns the address the guest reaches the host on for
+// HTTP uploads. A guest reached through a forwarded port on 127.0.0.1 is
+// behind VirtualBox NAT, where the host is always 10.0.2.2.
+func httpUploadHost(config wincommon.WinRMConfig) string {
+	if config.WinRMHTTPUploadHost != "" {
+		return config.WinRMHTTPUploadHost
 	}
+
+	if config.WinRMHost == "" || config.WinRMHost == "127.0.0.1" {
+		return "10.0.2.2"
+	}
+
+	return ""
 }
@@ -27,3 +27,24 @@ func TestWinRMAddressFunc_UsesPortForwarding(t *testing.T) {
 		t.Errorf("should have forwarded to port 123, but was %s", address)
 	}
 }
+
+func TestHTTPUploadHost(t *testing.T) {
+	cases := []struct {
+		host, uploadHost, expected string
+	}{
+		{"", "", "10.0.2.2"},
+		{"127.0.0.1", "", "10.0.2.2"},
+		{"127.0.0.1", "192.168.56.1", "192.168.56.1"},
+		{"192.168.56.10", "", ""},
+	}
+
+	for _, tc := range cases {
+		config := wincommon.WinRMConfig{
+			WinRMHost:           tc.host,
+			WinRMHTTPUploadHost: tc.uploadHost,
+		}
+		if actual := httpUploadHost(config); actual != tc.expected {
+			t.Errorf("bad upload host for %q, %q: %q", tc.host, tc.uploadHost, actual)
+		}
+	}
+}
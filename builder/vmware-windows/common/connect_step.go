@@ -7,15 +7,10 @@ import (
 )
 
 // Creates a generic SSH or WinRM connect step from a VMWare builder config
-func NewConnectStep(communicatorType string, driver Driver, sshConfig *SSHConfig, winrmConfig *WinRMConfig) multistep.Step {
+func NewConnectStep(communicatorType string, driver Driver, sshConfig *SSHConfig, winrmConfig *wincommon.WinRMConfig) multistep.Step {
 	//if communicatorType == packer.WinRMCommunicatorType {
 	if communicatorType == "winrm" {
-		return &wincommon.StepConnectWinRM{
-			WinRMAddress:     WinRMAddressFunc(winrmConfig, driver),
-			WinRMUser:        winrmConfig.WinRMUser,
-			WinRMPassword:    winrmConfig.WinRMPassword,
-			WinRMWaitTimeout: winrmConfig.WinRMWaitTimeout,
-		}
+		return wincommon.NewStepConnectWinRM(winrmConfig, WinRMAddressFunc(winrmConfig, driver))
 	} else {
 		return &common.StepConnectSSH{
 			SSHAddress:     SSHAddressFunc(sshConfig, driver),
@@ -4,9 +4,12 @@ import (
 	"fmt"
 
 	"github.com/mitchellh/multistep"
+	"github.com/mitchellh/packer/packer"
+	"github.com/mitchellh/packer/template/interpolate"
+	wincommon "github.com/packer-community/packer-windows-plugins/common"
 )
 
-func WinRMAddressFunc(config *WinRMConfig, driver Driver) func(multistep.StateBag) (string, error) {
+func WinRMAddressFunc(config *wincommon.WinRMConfig, driver Driver) func(multistep.StateBag) (string, error) {
 	return func(state multistep.StateBag) (string, error) {
 		if config.WinRMHost != "" {
 			return fmt.Sprintf("%s:%d", config.WinRMHost, config.WinRMPort), nil
@@ -20,3 +23,48 @@ func WinRMAddressFunc(config *WinRMConfig, driver Driver) func(multistep.StateBa
 		return fmt.Sprintf("%s:%d", ipAddress, config.WinRMPort), nil
 	}
 }
+
+// PrepareWinRMConfig processes the templates in the WinRM settings and
+// then prepares them. The shared WinRMConfig doesn't process templates, so
+// that has to happen before its values are parsed and checked.
+func PrepareWinRMConfig(c *wincommon.WinRMConfig, t *packer.ConfigTemplate) []error {
+	templates := map[string]*string{
+		"winrm_password":            &c.WinRMPassword,
+		"winrm_username":            &c.WinRMUser,
+		"winrm_wait_timeout":        &c.RawWinRMWaitTimeout,
+		"winrm_connect_delay":       &c.RawWinRMConnectDelay,
+		"winrm_connect_backoff":     &c.RawWinRMConnectBackoff,
+		"winrm_connect_max_backoff": &c.RawWinRMConnectMaxBackoff,
+		"winrm_operation_timeout":   &c.RawWinRMOperationTimeout,
+		"winrm_ca_cert":             &c.WinRMCACert,
+		"winrm_cert_thumbprint":     &c.WinRMThumbprint,
+		"winrm_auth":                &c.WinRMAuth,
+		"winrm_shell_idle_timeout":  &c.RawWinRMShellIdle,
+		"winrm_http_upload_host":    &c.WinRMHTTPUploadHost,
+		"winrm_retry_backoff":       &c.RawWinRMBackoff,
+		"winrm_retry_max_backoff":   &c.RawWinRMMaxBackoff,
+		"winrm_trace_file":          &c.WinRMTraceFile,
+		"winrm_ready_command":       &c.WinRMReadyCommand,
+		"winrm_ready_interval":      &c.RawWinRMReadyInterval,
+	}
+
+	errs := make([]error, 0)
+	for n, ptr := range templates {
+		var err error
+		*ptr, err = t.Process(*ptr, nil)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("Error processing %s: %s", n, err))
+		}
+	}
+
+	for i, service := range c.WinRMReadyServices {
+		var err error
+		c.WinRMReadyServices[i], err = t.Process(service, nil)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("Error processing winrm_ready_services[%d]: %s", i, err))
+		}
+	}
+
+	errs = append(errs, c.Prepare(&interpolate.Context{UserVariables: t.UserVars})...)
+	return errs
+}
@@ -0,0 +1,55 @@
+package common
+
+import (
+	"testing"
+	"time"
+
+	wincommon "github.com/packer-community/packer-windows-plugins/common"
+)
+
+func TestPrepareWinRMConfig(t *testing.T) {
+	tpl := testConfigTemplate(t)
+	tpl.UserVars = map[string]string{
+		"user":     "admin",
+		"password": "secret",
+		"timeout":  "5m",
+	}
+
+	c := &wincommon.WinRMConfig{
+		WinRMUser:           "{{user `user`}}",
+		WinRMPassword:       "{{user `password`}}",
+		RawWinRMWaitTimeout: "{{user `timeout`}}",
+		WinRMReadyServices:  []string{"{{user `user`}}-svc"},
+	}
+	errs := PrepareWinRMConfig(c, tpl)
+	if len(errs) > 0 {
+		t.Fatalf("should not have error: %#v", errs)
+	}
+
+	if c.WinRMUser != "admin" || c.WinRMPassword != "secret" {
+		t.Fatalf("bad winrm credentials: %s, %s", c.WinRMUser, c.WinRMPassword)
+	}
+	if c.WinRMWaitTimeout != 5*time.Minute {
+		t.Fatalf("bad winrm wait timeout: %s", c.WinRMWaitTimeout)
+	}
+	if c.WinRMReadyServices[0] != "admin-svc" {
+		t.Fatalf("bad winrm ready services: %#v", c.WinRMReadyServices)
+	}
+
+	// The shared config is still prepared
+	if c.WinRMPort != 5985 {
+		t.Fatalf("bad winrm port: %d", c.WinRMPort)
+	}
+
+	c = &wincommon.WinRMConfig{WinRMUser: "{{"}
+	errs = PrepareWinRMConfig(c, testConfigTemplate(t))
+	if len(errs) == 0 {
+		t.Fatal("should have error")
+	}
+
+	c = &wincommon.WinRMConfig{}
+	errs = PrepareWinRMConfig(c, testConfigTemplate(t))
+	if len(errs) == 0 {
+		t.Fatal("should have error")
+	}
+}
@@ -509,3 +509,56 @@ func TestBuilderPrepare_VNCPort(t *testing.T) {
 		t.Fatalf("should not have error: %s", err)
 	}
 }
+
+func TestBuilderPrepare_WinRM(t *testing.T) {
+	var b Builder
+	config := testConfig()
+
+	// Good
+	config["winrm_username"] = "{{user `winrm_user`}}"
+	config["winrm_password"] = "{{user `winrm_pass`}}"
+	config["winrm_use_ssl"] = true
+	config["winrm_cert_thumbprint"] = "d1 a5 0b 4f 4f 3e 7b 1e 93 16 5e 5a 57 70 a4 2e 3c 0d 9f 21"
+	config["winrm_max_shells"] = 2
+	config["winrm_retry_backoff"] = "{{user `backoff`}}"
+	config[packer.UserVariablesConfigKey] = map[string]string{
+		"winrm_user": "admin",
+		"winrm_pass": "secret",
+		"backoff":    "3s",
+	}
+	warns, err := b.Prepare(config)
+	if len(warns) > 0 {
+		t.Fatalf("bad: %#v", warns)
+	}
+	if err != nil {
+		t.Fatalf("should not have error: %s", err)
+	}
+
+	if b.config.WinRMUser != "admin" || b.config.WinRMPassword != "secret" {
+		t.Errorf("bad winrm credentials: %s, %s", b.config.WinRMUser, b.config.WinRMPassword)
+	}
+	if b.config.WinRMPort != 5986 {
+		t.Errorf("bad winrm port: %d", b.config.WinRMPort)
+	}
+	if b.config.WinRMThumbprint != "D1A50B4F4F3E7B1E93165E5A5770A42E3C0D9F21" {
+		t.Errorf("bad winrm thumbprint: %s", b.config.WinRMThumbprint)
+	}
+	if b.config.WinRMMaxShells != 2 {
+		t.Errorf("bad winrm max shells: %d", b.config.WinRMMaxShells)
+	}
+	if b.config.WinRMRetryBackoff != 3*time.Second {
+		t.Errorf("bad winrm retry backoff: %s", b.config.WinRMRetryBackoff)
+	}
+
+	// Bad
+	config = testConfig()
+	config["winrm_auth"] = "kerberos"
+	b = Builder{}
+	warns, err = b.Prepare(config)
+	if len(warns) > 0 {
+		t.Fatalf("bad: %#v", warns)
+	}
+	if err == nil {
+		t.Fatal("should have error")
+	}
+}
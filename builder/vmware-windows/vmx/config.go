@@ -7,6 +7,7 @@ import (
 	"github.com/mitchellh/packer/common"
 	"github.com/mitchellh/packer/packer"
 	vmwcommon "github.com/packer-community/packer-windows-plugins/builder/vmware-windows/common"
+	wincommon "github.com/packer-community/packer-windows-plugins/common"
 )
 
 // Config is the configuration structure for the builder.
@@ -19,7 +20,7 @@ type Config struct {
 	vmwcommon.SSHConfig      `mapstructure:",squash"`
 	vmwcommon.ToolsConfig    `mapstructure:",squash"`
 	vmwcommon.VMXConfig      `mapstructure:",squash"`
-	vmwcommon.WinRMConfig    `mapstructure:",squash"`
+	wincommon.WinRMConfig    `mapstructure:",squash"`
 
 	BootCommand    []string `mapstructure:"boot_command"`
 	FloppyFiles    []string `mapstructure:"floppy_files"`
@@ -57,7 +58,7 @@ func NewConfig(raws ...interface{}) (*Config, []string, error) {
 	errs = packer.MultiErrorAppend(errs, c.ShutdownConfig.Prepare(c.tpl)...)
 	errs = packer.MultiErrorAppend(errs, c.ToolsConfig.Prepare(c.tpl)...)
 	errs = packer.MultiErrorAppend(errs, c.VMXConfig.Prepare(c.tpl)...)
-	errs = packer.MultiErrorAppend(errs, c.WinRMConfig.Prepare(c.tpl)...)
+	errs = packer.MultiErrorAppend(errs, vmwcommon.PrepareWinRMConfig(&c.WinRMConfig, c.tpl)...)
 	//errs = packer.MultiErrorAppend(errs, c.SSHConfig.Prepare(c.tpl)...)
 
 	templates := map[string]*string{
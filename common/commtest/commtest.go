@@ -0,0 +1,92 @@
+// Package commtest provides communicators for testing code that runs
+// remote commands, such as the provisioners.
+package commtest
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/mitchellh/packer/packer"
+	"github.com/packer-community/packer-windows-plugins/communicator/winrm"
+	"github.com/packer-community/packer-windows-plugins/communicator/winrm/winrmtest"
+)
+
+// ConnectWinRM returns a WinRM communicator connected to r. It lives here
+// rather than in winrmtest, which the tests of package winrm import.
+func ConnectWinRM(t *testing.T, r *winrmtest.Remote) *winrm.Communicator {
+	config := &winrm.Config{
+		User:     "vagrant",
+		Password: "vagrant",
+	}
+	config.Host, config.Port = r.HostPort()
+
+	comm, err := winrm.New(config)
+	if err != nil {
+		t.Fatalf("error connecting to WinRM: %s", err)
+	}
+	return comm
+}
+
+// HangingCommunicator starts commands that don't exit on their own. An
+// encoded PowerShell command, such as the one RunRemoteCmd sends to stop
+// them, makes them exit with 1, and so are commands started after it.
+type HangingCommunicator struct {
+	packer.MockCommunicator
+
+	lock    sync.Mutex
+	hanging []*packer.RemoteCmd
+	stopped string
+}
+
+func (c *HangingCommunicator) Start(rc *packer.RemoteCmd) error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if !strings.HasPrefix(rc.Command, "powershell.exe -EncodedCommand ") {
+		if c.stopped != "" {
+			rc.SetExited(1)
+		} else {
+			c.hanging = append(c.hanging, rc)
+		}
+		return nil
+	}
+
+	for _, hanging := range c.hanging {
+		hanging.SetExited(1)
+	}
+	c.hanging = nil
+	c.stopped = rc.Command
+	rc.SetExited(0)
+	return nil
+}
+
+// Stopped returns the command that stopped the hanging ones, if any.
+func (c *HangingCommunicator) Stopped() string {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.stopped
+}
+
+// UploadsCommunicator keeps the content of every file uploaded to it, by
+// destination.
+type UploadsCommunicator struct {
+	packer.MockCommunicator
+	Uploads map[string]string
+}
+
+func (c *UploadsCommunicator) Upload(path string, r io.Reader, fi *os.FileInfo) error {
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	if c.Uploads == nil {
+		c.Uploads = make(map[string]string)
+	}
+	c.Uploads[path] = string(data)
+	return c.MockCommunicator.Upload(path, bytes.NewReader(data), fi)
+}
@@ -0,0 +1,24 @@
+// Package powershell builds the command lines that run PowerShell scripts
+// on a Windows guest. It is shared by the communicator, the connect step
+// and the provisioners, and imports nothing outside the standard library.
+package powershell
+
+import (
+	"encoding/base64"
+	"unicode/utf16"
+)
+
+// EncodedCommand returns the command line that runs script with
+// powershell.exe as an encoded command, which is base64 encoded UTF-16LE,
+// so the script needs no quoting for cmd.exe. The command line is limited
+// to 8191 characters, which leaves room for a script of about 3000
+// characters; longer scripts should be uploaded and run as a file.
+func EncodedCommand(script string) string {
+	units := utf16.Encode([]rune(script))
+	b := make([]byte, 2*len(units))
+	for i, u := range units {
+		b[2*i] = byte(u)
+		b[2*i+1] = byte(u >> 8)
+	}
+	return "powershell.exe -EncodedCommand " + base64.StdEncoding.EncodeToString(b)
+}
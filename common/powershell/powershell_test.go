@@ -0,0 +1,33 @@
+package powershell
+
+import (
+	"encoding/base64"
+	"strings"
+	"testing"
+	"unicode/utf16"
+)
+
+func TestEncodedCommand(t *testing.T) {
+	script := "echo \"café ${env:COMPUTERNAME} \U0001F600\"\r\nexit 3"
+
+	command := EncodedCommand(script)
+	prefix := "powershell.exe -EncodedCommand "
+	if !strings.HasPrefix(command, prefix) {
+		t.Fatalf("bad command: %s", command)
+	}
+
+	b, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(command, prefix))
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if len(b)%2 != 0 {
+		t.Fatalf("odd length: %d", len(b))
+	}
+	u := make([]uint16, len(b)/2)
+	for i := range u {
+		u[i] = uint16(b[2*i]) | uint16(b[2*i+1])<<8
+	}
+	if actual := string(utf16.Decode(u)); actual != script {
+		t.Fatalf("bad script: %q", actual)
+	}
+}
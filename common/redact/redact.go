@@ -0,0 +1,150 @@
+// Package redact masks secrets, such as the WinRM password, the elevated
+// password and sensitive environment variables, before they are written
+// to the log or the Packer UI.
+//
+// Packer runs every builder and provisioner in a process of its own, and
+// each process only knows the secrets it was configured with. The plugins
+// add those to Default and send the standard logger through it with
+// SetLogOutput.
+package redact
+
+import (
+	"io"
+	"log"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/mitchellh/packer/packer"
+)
+
+// Mask replaces secrets.
+const Mask = "[REDACTED]"
+
+// Default is the filter used by the package-level functions.
+var Default = new(Filter)
+
+// Filter replaces the secrets added to it with Mask. The zero value is a
+// filter without secrets, and it is safe for concurrent use.
+type Filter struct {
+	lock    sync.RWMutex
+	secrets []string
+}
+
+// Add adds secrets to the filter. Empty secrets are ignored.
+func (f *Filter) Add(secrets ...string) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	for _, s := range secrets {
+		if s == "" || f.contains(s) {
+			continue
+		}
+		f.secrets = append(f.secrets, s)
+	}
+
+	// Longer secrets first, so that a secret containing another one is
+	// masked as a whole
+	sort.Stable(byLength(f.secrets))
+}
+
+func (f *Filter) contains(secret string) bool {
+	for _, s := range f.secrets {
+		if s == secret {
+			return true
+		}
+	}
+	return false
+}
+
+// byLength sorts secrets longest first.
+type byLength []string
+
+func (s byLength) Len() int           { return len(s) }
+func (s byLength) Less(i, j int) bool { return len(s[i]) > len(s[j]) }
+func (s byLength) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+
+// String returns s with the secrets masked.
+func (f *Filter) String(s string) string {
+	f.lock.RLock()
+	defer f.lock.RUnlock()
+
+	for _, secret := range f.secrets {
+		s = strings.Replace(s, secret, Mask, -1)
+	}
+	return s
+}
+
+// Writer returns a writer that masks the secrets in each write before
+// passing it to w. A secret split across writes is not masked, which is
+// fine for the standard logger as it writes whole lines.
+func (f *Filter) Writer(w io.Writer) io.Writer {
+	return &writer{filter: f, w: w}
+}
+
+// Ui returns a Ui that masks the secrets in everything passed to ui.
+func (f *Filter) Ui(ui packer.Ui) packer.Ui {
+	return &filterUi{filter: f, ui: ui}
+}
+
+type writer struct {
+	filter *Filter
+	w      io.Writer
+}
+
+func (w *writer) Write(p []byte) (int, error) {
+	if _, err := io.WriteString(w.w, w.filter.String(string(p))); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+type filterUi struct {
+	filter *Filter
+	ui     packer.Ui
+}
+
+func (u *filterUi) Ask(query string) (string, error) {
+	return u.ui.Ask(u.filter.String(query))
+}
+
+func (u *filterUi) Say(message string) {
+	u.ui.Say(u.filter.String(message))
+}
+
+func (u *filterUi) Message(message string) {
+	u.ui.Message(u.filter.String(message))
+}
+
+func (u *filterUi) Error(message string) {
+	u.ui.Error(u.filter.String(message))
+}
+
+func (u *filterUi) Machine(t string, args ...string) {
+	masked := make([]string, len(args))
+	for i, arg := range args {
+		masked[i] = u.filter.String(arg)
+	}
+	u.ui.Machine(t, masked...)
+}
+
+// Add adds secrets to Default.
+func Add(secrets ...string) {
+	Default.Add(secrets...)
+}
+
+// String returns s with the secrets added to Default masked.
+func String(s string) string {
+	return Default.String(s)
+}
+
+// Ui returns a Ui that masks the secrets added to Default.
+func Ui(ui packer.Ui) packer.Ui {
+	return Default.Ui(ui)
+}
+
+// SetLogOutput sends the output of the standard logger to w, with the
+// secrets added to Default masked.
+func SetLogOutput(w io.Writer) {
+	log.SetOutput(Default.Writer(w))
+}
@@ -0,0 +1,65 @@
+package redact
+
+import (
+	"bytes"
+	"log"
+	"strings"
+	"testing"
+
+	"github.com/mitchellh/packer/packer"
+)
+
+func TestFilter_String(t *testing.T) {
+	f := new(Filter)
+	if actual := f.String("password: s3cret"); actual != "password: s3cret" {
+		t.Fatalf("should not change without secrets: %s", actual)
+	}
+
+	f.Add("s3cret", "", "s3cret-too", "s3cret")
+	cases := map[string]string{
+		"password: s3cret":            "password: [REDACTED]",
+		"s3cret-too and s3cret":       "[REDACTED] and [REDACTED]",
+		"-Password 's3crets3cret' -X": "-Password '[REDACTED][REDACTED]' -X",
+		"nothing to hide":             "nothing to hide",
+	}
+	for input, expected := range cases {
+		if actual := f.String(input); actual != expected {
+			t.Errorf("bad result for %q: %q", input, actual)
+		}
+	}
+
+	if len(f.secrets) != 2 {
+		t.Fatalf("empty and duplicate secrets should be ignored: %q", f.secrets)
+	}
+}
+
+func TestFilter_Writer(t *testing.T) {
+	f := new(Filter)
+	f.Add("hunter2")
+
+	var buf bytes.Buffer
+	logger := log.New(f.Writer(&buf), "", 0)
+	logger.Printf("starting remote command: net user packer hunter2")
+
+	if actual := buf.String(); actual != "starting remote command: net user packer [REDACTED]\n" {
+		t.Fatalf("bad log output: %q", actual)
+	}
+}
+
+func TestFilter_Ui(t *testing.T) {
+	f := new(Filter)
+	f.Add("hunter2")
+
+	var buf bytes.Buffer
+	ui := f.Ui(&packer.BasicUi{Reader: strings.NewReader(""), Writer: &buf})
+	ui.Say("Say hunter2")
+	ui.Message("Message hunter2")
+	ui.Error("Error hunter2")
+
+	if strings.Contains(buf.String(), "hunter2") {
+		t.Fatalf("secret should be masked: %q", buf.String())
+	}
+	if strings.Count(buf.String(), Mask) != 3 {
+		t.Fatalf("bad output: %q", buf.String())
+	}
+}
@@ -0,0 +1,131 @@
+package common
+
+import (
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/mitchellh/packer/packer"
+	"github.com/packer-community/packer-windows-plugins/common/powershell"
+)
+
+// Terminator is implemented by communicators that can stop a remote
+// command before it exits, such as the WinRM communicator.
+type Terminator interface {
+	Terminate(*packer.RemoteCmd) error
+}
+
+// stopWait is how long RunRemoteCmd waits for a command it stopped to
+// exit.
+var stopWait = 30 * time.Second
+
+// maxStopMatch is the longest part of a command line, from its end, that
+// the stop script looks for. It keeps the encoded script well below the
+// limit of a command line.
+const maxStopMatch = 1024
+
+// stopScript ends the processes whose command line contains the base64
+// encoded text it is formatted with, and the processes they started. The
+// text is encoded so that it needs no quoting, and so that it doesn't
+// appear in the command line of the script, which would then match too.
+// Processes already ended with the tree of another are not an error.
+const stopScript = `$ErrorActionPreference = 'Stop'
+$text = [Text.Encoding]::UTF8.GetString([Convert]::FromBase64String('%s'))
+Get-WmiObject Win32_Process | Where-Object { $_.ProcessId -ne $PID -and $_.CommandLine -and $_.CommandLine.Contains($text) } | ForEach-Object {
+  cmd.exe /c "taskkill /T /F /PID $($_.ProcessId) >nul 2>&1"
+}
+exit 0`
+
+// RemoteCmdStoppedError is returned by RunRemoteCmd when a command did
+// not exit before its timeout, or was cancelled.
+type RemoteCmdStoppedError struct {
+	// Timeout is the timeout that expired, or zero if the command was
+	// cancelled.
+	Timeout time.Duration
+}
+
+func (e *RemoteCmdStoppedError) Error() string {
+	if e.Timeout > 0 {
+		return fmt.Sprintf("Remote command did not finish within %s", e.Timeout)
+	}
+	return "Remote command was cancelled"
+}
+
+// RunRemoteCmd starts a command with its output going to the UI, and
+// waits for it to exit. If the timeout expires or cancel is closed first,
+// the command is stopped and a *RemoteCmdStoppedError is returned. A zero
+// timeout waits forever.
+//
+// The command is stopped by running another one that kills the processes
+// started for it on the guest, found by their command line. This works
+// with any communicator, including the one provisioners reach over RPC,
+// but also kills other processes that run the same command at the time.
+func RunRemoteCmd(comm packer.Communicator, cmd *packer.RemoteCmd, ui packer.Ui, timeout time.Duration, cancel <-chan struct{}) error {
+	done := make(chan error, 1)
+	go func() {
+		done <- cmd.StartWithUi(comm, ui)
+	}()
+
+	var expired <-chan time.Time
+	if timeout > 0 {
+		timer := time.NewTimer(timeout)
+		defer timer.Stop()
+		expired = timer.C
+	}
+
+	var stopped *RemoteCmdStoppedError
+	select {
+	case err := <-done:
+		return err
+	case <-expired:
+		stopped = &RemoteCmdStoppedError{Timeout: timeout}
+	case <-cancel:
+		stopped = &RemoteCmdStoppedError{}
+	}
+
+	log.Printf("%s, stopping it", stopped)
+	if err := stopRemoteCmd(comm, cmd.Command); err != nil {
+		log.Printf("Error stopping remote command: %s", err)
+		return stopped
+	}
+
+	// Wait for the rest of the output before returning
+	select {
+	case <-done:
+	case <-time.After(stopWait):
+		log.Printf("Remote command did not exit within %s of being stopped", stopWait)
+	}
+	return stopped
+}
+
+// stopRemoteCmd kills the processes running command on the guest.
+func stopRemoteCmd(comm packer.Communicator, command string) error {
+	var stderr bytes.Buffer
+	rc := &packer.RemoteCmd{Command: stopCommand(command), Stderr: &stderr}
+	if err := comm.Start(rc); err != nil {
+		return err
+	}
+	rc.Wait()
+
+	if rc.ExitStatus != 0 {
+		return fmt.Errorf("stop command exited with %d: %s", rc.ExitStatus, strings.TrimSpace(stderr.String()))
+	}
+	return nil
+}
+
+// stopCommand returns the command line that kills the processes running
+// command.
+func stopCommand(command string) string {
+	if len(command) > maxStopMatch {
+		i := len(command) - maxStopMatch
+		for i < len(command) && !utf8.RuneStart(command[i]) {
+			i++
+		}
+		command = command[i:]
+	}
+	return powershell.EncodedCommand(fmt.Sprintf(stopScript, base64.StdEncoding.EncodeToString([]byte(command))))
+}
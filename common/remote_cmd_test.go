@@ -0,0 +1,84 @@
+package common
+
+import (
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/mitchellh/packer/packer"
+	"github.com/packer-community/packer-windows-plugins/common/commtest"
+	"github.com/packer-community/packer-windows-plugins/common/powershell"
+	"github.com/packer-community/packer-windows-plugins/communicator/winrm/winrmtest"
+)
+
+func testUi() *packer.BasicUi {
+	return &packer.BasicUi{
+		Reader: new(bytes.Buffer),
+		Writer: new(bytes.Buffer),
+	}
+}
+
+// stopText matches the text the stop script looks for.
+var stopText = regexp.MustCompile(`FromBase64String\('([^']*)'\)`)
+
+func TestRunRemoteCmd_Timeout(t *testing.T) {
+	r := winrmtest.NewRemote()
+	defer r.Close()
+
+	stop := make(chan struct{})
+	r.CommandFunc(winrmtest.MatchText("setup.exe /quiet"), func(cmd *winrmtest.Cmd) int {
+		<-stop
+		return 1
+	})
+	stopped := make(chan string, 1)
+	r.CommandFunc(winrmtest.MatchScript(`taskkill`), func(cmd *winrmtest.Cmd) int {
+		text, _ := base64.StdEncoding.DecodeString(stopText.FindStringSubmatch(cmd.Script)[1])
+		stopped <- string(text)
+		close(stop)
+		return 0
+	})
+
+	comm := commtest.ConnectWinRM(t, r)
+	defer comm.Close()
+
+	cmd := &packer.RemoteCmd{Command: "setup.exe /quiet"}
+	err := RunRemoteCmd(comm, cmd, testUi(), 50*time.Millisecond, nil)
+	if e, ok := err.(*RemoteCmdStoppedError); !ok || e.Timeout != 50*time.Millisecond {
+		t.Fatalf("should have timed out: %#v", err)
+	}
+	if text := <-stopped; text != cmd.Command {
+		t.Fatalf("bad command stopped: %q", text)
+	}
+	if !cmd.Exited || cmd.ExitStatus != 1 {
+		t.Fatalf("command should have exited: %#v", cmd)
+	}
+}
+
+func TestRunRemoteCmd_Cancel(t *testing.T) {
+	comm := new(commtest.HangingCommunicator)
+	cancel := make(chan struct{})
+	close(cancel)
+
+	cmd := &packer.RemoteCmd{Command: "setup.exe /quiet"}
+	err := RunRemoteCmd(comm, cmd, testUi(), 0, cancel)
+	if e, ok := err.(*RemoteCmdStoppedError); !ok || e.Timeout != 0 {
+		t.Fatalf("should have been cancelled: %#v", err)
+	}
+	if comm.Stopped() != stopCommand(cmd.Command) {
+		t.Fatalf("bad stop command: %s", comm.Stopped())
+	}
+}
+
+func TestStopCommand_Long(t *testing.T) {
+	// The tail starts at a whole character
+	command := "é" + strings.Repeat("x", maxStopMatch-1)
+	expected := powershell.EncodedCommand(fmt.Sprintf(stopScript,
+		base64.StdEncoding.EncodeToString([]byte(strings.Repeat("x", maxStopMatch-1)))))
+	if actual := stopCommand(command); actual != expected {
+		t.Fatalf("bad command: %s", actual)
+	}
+}
@@ -3,26 +3,50 @@ package common
 import (
 	"errors"
 	"fmt"
+	"io/ioutil"
 	"log"
 	"net"
+	"os"
 	"strconv"
+	"sync"
 	"time"
 
-	"github.com/masterzen/winrm/winrm"
 	"github.com/mitchellh/multistep"
 	"github.com/mitchellh/packer/packer"
+	"github.com/packer-community/packer-windows-plugins/common/redact"
 	plugin "github.com/packer-community/packer-windows-plugins/communicator/winrm"
 )
 
+const (
+	// defaultConnectDelay is the wait before the first attempt to connect
+	defaultConnectDelay = 5 * time.Second
+
+	// defaultConnectBackoff is the wait after the first failed attempt,
+	// which doubles up to defaultConnectMaxBackoff
+	defaultConnectBackoff    = 5 * time.Second
+	defaultConnectMaxBackoff = 30 * time.Second
+
+	// connectReportInterval is the least time between the messages
+	// reporting failed attempts
+	connectReportInterval = 30 * time.Second
+
+	// defaultAttemptTimeout bounds an attempt to connect, so a service
+	// that accepts connections but never answers doesn't hold up the
+	// next one
+	defaultAttemptTimeout = 30 * time.Second
+)
+
 // StepConnectWinRM is a multistep Step implementation that waits for WinRM
 // to become available. It gets the connection information from a single
 // configuration when creating the step.
 //
 // Uses:
-//   ui packer.Ui
+//
+//	ui packer.Ui
 //
 // Produces:
-//   communicator packer.Communicator
+//
+//	communicator packer.Communicator
 type StepConnectWinRM struct {
 	// WinRMAddress is a function that returns the TCP address to connect to
 	// for WinRM. This is a function so that you can query information
@@ -38,23 +62,199 @@ type StepConnectWinRM struct {
 	// WinRMWaitTimeout is the total timeout to wait for WinRM to become available.
 	WinRMWaitTimeout time.Duration
 
-	comm packer.Communicator
+	// WinRMConnectDelay is the wait before the first attempt to connect,
+	// none if zero
+	WinRMConnectDelay time.Duration
+
+	// WinRMConnectBackoff is the wait after the first failed attempt,
+	// doubling up to WinRMConnectMaxBackoff
+	WinRMConnectBackoff    time.Duration
+	WinRMConnectMaxBackoff time.Duration
+
+	// WinRMUseSSL connects to the HTTPS listener rather than plain HTTP
+	WinRMUseSSL bool
+
+	// WinRMInsecure skips validation of the server certificate
+	WinRMInsecure bool
+
+	// WinRMCACert is the path to a PEM encoded CA certificate that is
+	// trusted, in addition to the system roots, when validating the server
+	// certificate
+	WinRMCACert string
+
+	// WinRMThumbprint pins the server certificate to this thumbprint
+	WinRMThumbprint string
+
+	// WinRMAuth is the authentication method, basic or ntlm
+	WinRMAuth string
+
+	// WinRMOperationTimeout is the WS-Management operation timeout of each
+	// request
+	WinRMOperationTimeout time.Duration
+
+	// WinRMMaxShells is the number of shells the communicator keeps open
+	WinRMMaxShells int
+
+	// WinRMShellIdleTimeout is how long an unused shell is kept open
+	WinRMShellIdleTimeout time.Duration
+
+	// WinRMHTTPUpload has the guest download large files from the host
+	// over HTTP
+	WinRMHTTPUpload bool
+
+	// WinRMHTTPUploadHost is the address the guest reaches the host on
+	WinRMHTTPUploadHost string
+
+	// WinRMHTTPUploadPort is the port files are served on, zero for any
+	WinRMHTTPUploadPort int
+
+	// WinRMCodepage is the code page of the guest's console output
+	WinRMCodepage int
+
+	// WinRMMaxAttempts is how many times a request that fails with a
+	// transient error is sent
+	WinRMMaxAttempts int
+
+	// WinRMRetryBackoff is the wait before the first retry, doubling up
+	// to WinRMRetryMaxBackoff
+	WinRMRetryBackoff    time.Duration
+	WinRMRetryMaxBackoff time.Duration
+
+	// WinRMTraceFile is the path of a file that every request and response
+	// is appended to, if set
+	WinRMTraceFile string
+
+	// WinRMReadyCommand is a command that must exit with zero for the
+	// guest to be ready
+	WinRMReadyCommand string
+
+	// WinRMReadyServices are services that must be running for the guest
+	// to be ready
+	WinRMReadyServices []string
+
+	// WinRMReadyNoPendingReboot requires Windows setup to be finished and
+	// no reboot to be pending for the guest to be ready
+	WinRMReadyNoPendingReboot bool
+
+	// WinRMReadySuccesses is the number of times in a row the readiness
+	// checks must pass, every WinRMReadyInterval
+	WinRMReadySuccesses int
+	WinRMReadyInterval  time.Duration
+
+	comm      packer.Communicator
+	traceFile *os.File
+
+	// lock guards the outcome of the attempts to connect and of the
+	// readiness checks, which is reported if waiting times out
+	lock        sync.Mutex
+	attempts    int
+	lastAddress string
+	lastErr     error
+	connected   bool
+	checks      int
+	notReady    error
+
+	// abandoned is set once Run stops waiting, after which a
+	// communicator the wait comes up with is closed
+	abandoned bool
+
+	// attemptTimeout replaces defaultAttemptTimeout in tests
+	attemptTimeout time.Duration
+}
+
+// NewStepConnectWinRM returns a step that connects to the address returned
+// by address with the settings of a prepared WinRMConfig.
+func NewStepConnectWinRM(c *WinRMConfig, address func(multistep.StateBag) (string, error)) *StepConnectWinRM {
+	return &StepConnectWinRM{
+		WinRMAddress:              address,
+		WinRMUser:                 c.WinRMUser,
+		WinRMPassword:             c.WinRMPassword,
+		WinRMWaitTimeout:          c.WinRMWaitTimeout,
+		WinRMConnectDelay:         c.WinRMConnectDelay,
+		WinRMConnectBackoff:       c.WinRMConnectBackoff,
+		WinRMConnectMaxBackoff:    c.WinRMConnectMaxBackoff,
+		WinRMUseSSL:               c.WinRMUseSSL,
+		WinRMInsecure:             c.WinRMInsecure,
+		WinRMCACert:               c.WinRMCACert,
+		WinRMThumbprint:           c.WinRMThumbprint,
+		WinRMAuth:                 c.WinRMAuth,
+		WinRMOperationTimeout:     c.WinRMOperationTimeout,
+		WinRMMaxShells:            c.WinRMMaxShells,
+		WinRMShellIdleTimeout:     c.WinRMShellIdleTimeout,
+		WinRMHTTPUpload:           c.WinRMHTTPUpload,
+		WinRMHTTPUploadHost:       c.WinRMHTTPUploadHost,
+		WinRMHTTPUploadPort:       c.WinRMHTTPUploadPort,
+		WinRMCodepage:             c.WinRMCodepage,
+		WinRMMaxAttempts:          c.WinRMMaxAttempts,
+		WinRMRetryBackoff:         c.WinRMRetryBackoff,
+		WinRMRetryMaxBackoff:      c.WinRMRetryMaxBackoff,
+		WinRMTraceFile:            c.WinRMTraceFile,
+		WinRMReadyCommand:         c.WinRMReadyCommand,
+		WinRMReadyServices:        c.WinRMReadyServices,
+		WinRMReadyNoPendingReboot: c.WinRMReadyNoPendingReboot,
+		WinRMReadySuccesses:       c.WinRMReadySuccesses,
+		WinRMReadyInterval:        c.WinRMReadyInterval,
+	}
 }
 
 func (s *StepConnectWinRM) Run(state multistep.StateBag) multistep.StepAction {
 	ui := state.Get("ui").(packer.Ui)
+	redact.Add(s.WinRMPassword)
 
 	var comm packer.Communicator
 	var err error
 
+	if s.WinRMTraceFile != "" {
+		s.traceFile, err = os.OpenFile(s.WinRMTraceFile, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+		if err != nil {
+			err := fmt.Errorf("Error opening WinRM trace file: %s", err)
+			state.Put("error", err)
+			ui.Error(err.Error())
+			return multistep.ActionHalt
+		}
+		log.Printf("Tracing WinRM requests to %s", s.WinRMTraceFile)
+	}
+
 	cancel := make(chan struct{})
 	waitDone := make(chan bool, 1)
 	go func() {
 		ui.Say("Waiting for WinRM to become available...")
-		comm, err = s.waitForWinRM(state, cancel)
+		c, e := s.waitForWinRM(state, cancel)
+		if checks := s.readinessChecks(); e == nil && len(checks) > 0 {
+			if e = s.waitForReady(ui, c, checks, cancel); e != nil {
+				closeCommunicator(c)
+			}
+		}
+
+		s.lock.Lock()
+		defer s.lock.Unlock()
+		if s.abandoned {
+			if e == nil {
+				closeCommunicator(c)
+			}
+			return
+		}
+		comm, err = c, e
 		waitDone <- true
 	}()
 
+	// abandon stops waiting. A communicator that is already waiting to
+	// be taken is closed, and so is one the wait comes up with later.
+	abandon := func() {
+		close(cancel)
+
+		s.lock.Lock()
+		defer s.lock.Unlock()
+		s.abandoned = true
+		select {
+		case <-waitDone:
+			if err == nil {
+				closeCommunicator(comm)
+			}
+		default:
+		}
+	}
+
 	log.Printf("Waiting for WinRM, up to timeout: %s", s.WinRMWaitTimeout)
 	timeout := time.After(s.WinRMWaitTimeout)
 WaitLoop:
@@ -73,16 +273,20 @@ WaitLoop:
 			state.Put("communicator", comm)
 			break WaitLoop
 		case <-timeout:
-			err := fmt.Errorf("Timeout waiting for WinRM.")
+			err := s.timeoutError()
 			state.Put("error", err)
 			ui.Error(err.Error())
-			close(cancel)
+			abandon()
+			if s.isConnected() {
+				return multistep.ActionHalt
+			}
+			s.diagnose(state, ui)
 			return multistep.ActionHalt
 		case <-time.After(1 * time.Second):
 			if _, ok := state.GetOk(multistep.StateCancelled); ok {
 				// The step sequence was cancelled, so cancel waiting for WinRM
 				// and just start the halting process.
-				close(cancel)
+				abandon()
 				log.Println("Interrupt detected, quitting waiting for WinRM.")
 				return multistep.ActionHalt
 			}
@@ -93,53 +297,227 @@ WaitLoop:
 }
 
 func (s *StepConnectWinRM) Cleanup(multistep.StateBag) {
+	// Stops anything still running on the guest, such as a provisioner's
+	// command when the build was cancelled, and closes the shells.
+	if comm, ok := s.comm.(*plugin.Communicator); ok {
+		if err := comm.Close(); err != nil {
+			log.Printf("Error closing WinRM communicator: %s", err)
+		}
+	}
+
+	if s.traceFile != nil {
+		s.traceFile.Close()
+	}
 }
 
 func (s *StepConnectWinRM) waitForWinRM(state multistep.StateBag, cancel <-chan struct{}) (packer.Communicator, error) {
-	var comm packer.Communicator
-	for {
+	var caCert []byte
+	if s.WinRMCACert != "" {
+		var err error
+		caCert, err = ioutil.ReadFile(s.WinRMCACert)
+		if err != nil {
+			return nil, fmt.Errorf("Error reading WinRM CA certificate: %s", err)
+		}
+	}
+
+	ui := state.Get("ui").(packer.Ui)
+
+	backoff := s.WinRMConnectBackoff
+	if backoff <= 0 {
+		backoff = defaultConnectBackoff
+	}
+	maxBackoff := s.WinRMConnectMaxBackoff
+	if maxBackoff < backoff {
+		maxBackoff = backoff
+	}
+
+	// failed records a failed attempt, and reports it unless another one
+	// was reported recently
+	var reported time.Time
+	failed := func(attempt int, address string, err error, class string) {
+		log.Printf("WinRM connection attempt %d failed: %s", attempt, err)
+
+		s.lock.Lock()
+		s.attempts = attempt
+		if address != "" {
+			s.lastAddress = address
+		}
+		s.lastErr = err
+		s.lock.Unlock()
+
+		if time.Since(reported) < connectReportInterval {
+			return
+		}
+		reported = time.Now()
+		if address != "" {
+			ui.Message(fmt.Sprintf("WinRM connection attempt %d to %s failed: %s", attempt, address, class))
+		} else {
+			ui.Message(fmt.Sprintf("WinRM connection attempt %d failed: %s", attempt, class))
+		}
+	}
+
+	wait := s.WinRMConnectDelay
+	for attempt := 1; ; attempt++ {
 		select {
 		case <-cancel:
 			log.Println("WinRM wait cancelled. Exiting loop.")
-			return nil, errors.New("WinRM wait cancelled")
-		case <-time.After(5 * time.Second):
+			return nil, errWaitCancelled
+		case <-time.After(wait):
+		}
+
+		wait = backoff
+		if backoff *= 2; backoff > maxBackoff {
+			backoff = maxBackoff
 		}
 
 		address, err := s.WinRMAddress(state)
 		if err != nil {
-			log.Printf("Error getting WinRM address: %s", err)
+			err = fmt.Errorf("Error getting WinRM address: %s", err)
+			failed(attempt, "", err, err.Error())
 			continue
 		}
 
-		endpoint, err := newEndpoint(address)
+		host, port, err := splitAddress(address)
 		if err != nil {
-			log.Printf("Incorrect format for WinRM address: %s", err)
+			err = fmt.Errorf("Incorrect format for WinRM address: %s", err)
+			failed(attempt, "", err, err.Error())
 			continue
 		}
 
-		log.Printf("Attempting WinRM connection (timeout: %s)", s.WinRMWaitTimeout)
+		log.Printf("Attempting WinRM connection to %s (timeout: %s)", address, s.WinRMWaitTimeout)
 
-		comm, err = plugin.New(endpoint, s.WinRMUser, s.WinRMPassword, s.WinRMWaitTimeout)
+		config := s.winrmConfig(state, host, port, caCert)
+		config.ConnectTimeout = s.attemptTimeout
+		if config.ConnectTimeout <= 0 {
+			config.ConnectTimeout = defaultAttemptTimeout
+		}
+		comm, err := plugin.New(config)
 		if err != nil {
-			log.Printf("WinRM connection err: %s", err)
+			failed(attempt, address, err, plugin.ClassifyError(err))
 			continue
 		}
 
-		break
+		s.lock.Lock()
+		s.attempts = attempt
+		s.lastAddress = address
+		s.connected = true
+		s.lock.Unlock()
+		return comm, nil
+	}
+}
+
+// timeoutError returns the error reported when waiting for WinRM timed
+// out, with the outcome of the last attempt to connect.
+func (s *StepConnectWinRM) timeoutError() error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if s.connected {
+		if s.notReady == nil {
+			return fmt.Errorf("Timeout waiting for the guest at %s to be ready.", s.lastAddress)
+		}
+
+		checks := fmt.Sprintf("%d checks", s.checks)
+		if s.checks == 1 {
+			checks = "1 check"
+		}
+		return fmt.Errorf("Timeout waiting for the guest at %s to be ready after %s, last failure: %s", s.lastAddress, checks, s.notReady)
+	}
+
+	if s.lastErr == nil {
+		return errors.New("Timeout waiting for WinRM.")
+	}
+
+	attempts := fmt.Sprintf("%d attempts", s.attempts)
+	if s.attempts == 1 {
+		attempts = "1 attempt"
+	}
+	if s.lastAddress == "" {
+		return fmt.Errorf("Timeout waiting for WinRM after %s, last error: %s", attempts, s.lastErr)
+	}
+	return fmt.Errorf("Timeout waiting for WinRM at %s after %s, last error: %s", s.lastAddress, attempts, s.lastErr)
+}
+
+// winrmConfig returns the configuration of the communicator for the WinRM
+// service at host and port.
+func (s *StepConnectWinRM) winrmConfig(state multistep.StateBag, host string, port int, caCert []byte) *plugin.Config {
+	config := &plugin.Config{
+		Host:             host,
+		Port:             port,
+		User:             s.WinRMUser,
+		Password:         s.WinRMPassword,
+		Timeout:          s.WinRMOperationTimeout,
+		MaxShells:        s.WinRMMaxShells,
+		ShellIdleTimeout: s.WinRMShellIdleTimeout,
+		Auth:             s.WinRMAuth,
+		Https:            s.WinRMUseSSL,
+		Insecure:         s.WinRMInsecure,
+		CACert:           caCert,
+		Thumbprint:       s.WinRMThumbprint,
+		HTTPUpload:       s.WinRMHTTPUpload,
+		HTTPUploadHost:   s.WinRMHTTPUploadHost,
+		HTTPUploadPort:   s.WinRMHTTPUploadPort,
+		Ui:               state.Get("ui").(packer.Ui),
+		Codepage:         s.WinRMCodepage,
+		Retry: plugin.RetryPolicy{
+			MaxAttempts:    s.WinRMMaxAttempts,
+			InitialBackoff: s.WinRMRetryBackoff,
+			MaxBackoff:     s.WinRMRetryMaxBackoff,
+		},
+	}
+	if s.traceFile != nil {
+		config.Trace = s.traceFile
+	}
+
+	return config
+}
+
+// isConnected reports whether a connection was made, so the timeout was
+// waiting for the guest to be ready and the connection needs no diagnosis.
+func (s *StepConnectWinRM) isConnected() bool {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.connected
+}
+
+// diagnose probes the WinRM service after waiting for it timed out, and
+// reports which layer of the connection failed and how to fix it.
+func (s *StepConnectWinRM) diagnose(state multistep.StateBag, ui packer.Ui) {
+	address, err := s.WinRMAddress(state)
+	if err != nil {
+		log.Printf("Error getting WinRM address: %s", err)
+		return
+	}
+
+	host, port, err := splitAddress(address)
+	if err != nil {
+		log.Printf("Incorrect format for WinRM address: %s", err)
+		return
+	}
+
+	var caCert []byte
+	if s.WinRMCACert != "" {
+		caCert, err = ioutil.ReadFile(s.WinRMCACert)
+		if err != nil {
+			log.Printf("Error reading WinRM CA certificate: %s", err)
+			return
+		}
 	}
 
-	return comm, nil
+	ui.Say("Diagnosing the WinRM connection...")
+	diagnosis := plugin.Diagnose(s.winrmConfig(state, host, port, caCert))
+	ui.Message(diagnosis.String())
 }
 
-func newEndpoint(address string) (*winrm.Endpoint, error) {
+func splitAddress(address string) (string, int, error) {
 	host, port, err := net.SplitHostPort(address)
 	if err != nil {
-		return nil, err
+		return "", 0, err
 	}
 
 	iport, err := strconv.Atoi(port)
 	if err != nil {
-		return nil, err
+		return "", 0, err
 	}
-	return &winrm.Endpoint{Host: host, Port: iport}, nil
+	return host, iport, nil
 }
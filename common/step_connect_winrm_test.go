@@ -0,0 +1,397 @@
+package common
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/mitchellh/multistep"
+	"github.com/mitchellh/packer/packer"
+	"github.com/packer-community/packer-windows-plugins/common/commtest"
+	"github.com/packer-community/packer-windows-plugins/communicator/winrm/winrmtest"
+)
+
+func TestStepConnectWinRM_Impl(t *testing.T) {
+	var _ multistep.Step = new(StepConnectWinRM)
+}
+
+func TestNewStepConnectWinRM(t *testing.T) {
+	c := &WinRMConfig{
+		WinRMUser:          "vagrant",
+		WinRMReadyServices: []string{"WinRM"},
+	}
+	if errs := c.Prepare(nil); len(errs) > 0 {
+		t.Fatalf("err: %#v", errs)
+	}
+
+	step := NewStepConnectWinRM(c, func(multistep.StateBag) (string, error) {
+		return "127.0.0.1:5985", nil
+	})
+	if step.WinRMUser != "vagrant" || step.WinRMWaitTimeout != 20*time.Minute || step.WinRMOperationTimeout != time.Minute || step.WinRMConnectBackoff != 5*time.Second {
+		t.Fatalf("bad step: %#v", step)
+	}
+	if len(step.WinRMReadyServices) != 1 || step.WinRMReadySuccesses != 1 {
+		t.Fatalf("bad readiness: %#v", step)
+	}
+	if address, _ := step.WinRMAddress(nil); address != "127.0.0.1:5985" {
+		t.Fatalf("bad address: %s", address)
+	}
+}
+
+func TestStepConnectWinRM(t *testing.T) {
+	r := winrmtest.NewRemote()
+	defer r.Close()
+	r.Command(winrmtest.MatchText("hostname"), "WIN-PACKER\r\n", 0)
+
+	state := new(multistep.BasicStateBag)
+	state.Put("ui", &packer.BasicUi{
+		Reader: new(bytes.Buffer),
+		Writer: new(bytes.Buffer),
+	})
+
+	step := &StepConnectWinRM{
+		WinRMAddress: func(multistep.StateBag) (string, error) {
+			return r.Address(), nil
+		},
+		WinRMUser:        "vagrant",
+		WinRMPassword:    "vagrant",
+		WinRMWaitTimeout: time.Minute,
+	}
+
+	if action := step.Run(state); action != multistep.ActionContinue {
+		t.Fatalf("bad action: %#v", action)
+	}
+
+	comm, ok := state.Get("communicator").(packer.Communicator)
+	if !ok {
+		t.Fatal("should have a communicator")
+	}
+
+	var stdout bytes.Buffer
+	cmd := &packer.RemoteCmd{Command: "hostname", Stdout: &stdout}
+	if err := comm.Start(cmd); err != nil {
+		t.Fatalf("error starting cmd: %s", err)
+	}
+	cmd.Wait()
+
+	if cmd.ExitStatus != 0 || stdout.String() != "WIN-PACKER\r\n" {
+		t.Fatalf("bad result: %d, %q", cmd.ExitStatus, stdout.String())
+	}
+
+	// Cleanup closes the shells left on the guest
+	step.Cleanup(state)
+	if n := r.Shells(); n != 0 {
+		t.Fatalf("%d shells left open", n)
+	}
+}
+
+func TestStepConnectWinRM_Timeout(t *testing.T) {
+	r := winrmtest.NewRemote()
+	defer r.Close()
+	r.RequireBasicAuth("vagrant", "secret")
+
+	var output bytes.Buffer
+	state := new(multistep.BasicStateBag)
+	state.Put("ui", &packer.BasicUi{
+		Reader: new(bytes.Buffer),
+		Writer: &output,
+	})
+
+	step := &StepConnectWinRM{
+		WinRMAddress: func(multistep.StateBag) (string, error) {
+			return r.Address(), nil
+		},
+		WinRMUser:           "vagrant",
+		WinRMPassword:       "vagrant",
+		WinRMWaitTimeout:    500 * time.Millisecond,
+		WinRMConnectBackoff: 10 * time.Millisecond,
+	}
+
+	if action := step.Run(state); action != multistep.ActionHalt {
+		t.Fatalf("bad action: %#v", action)
+	}
+	defer step.Cleanup(state)
+
+	// The error has the address and the last error
+	err := state.Get("error").(error)
+	expected := "Timeout waiting for WinRM at " + r.Address() + " after "
+	if !strings.HasPrefix(err.Error(), expected) || !strings.HasSuffix(err.Error(), "http response code 401") {
+		t.Fatalf("bad error: %s", err)
+	}
+
+	for _, expected := range []string{
+		// The first failed attempt is reported
+		"WinRM connection attempt 1 to " + r.Address() + " failed: authentication failed (HTTP 401)",
+
+		// The diagnosis points at the layer that failed
+		"FAIL  Authentication",
+		`@{AllowUnencrypted="true"}`,
+	} {
+		if !strings.Contains(output.String(), expected) {
+			t.Fatalf("output should contain %q: %s", expected, output.String())
+		}
+	}
+}
+
+func TestStepConnectWinRM_TimeoutAddress(t *testing.T) {
+	var output bytes.Buffer
+	state := new(multistep.BasicStateBag)
+	state.Put("ui", &packer.BasicUi{
+		Reader: new(bytes.Buffer),
+		Writer: &output,
+	})
+
+	step := &StepConnectWinRM{
+		WinRMAddress: func(multistep.StateBag) (string, error) {
+			return "", errors.New("no IP address yet")
+		},
+		WinRMUser:           "vagrant",
+		WinRMPassword:       "vagrant",
+		WinRMWaitTimeout:    100 * time.Millisecond,
+		WinRMConnectBackoff: 10 * time.Millisecond,
+	}
+
+	if action := step.Run(state); action != multistep.ActionHalt {
+		t.Fatalf("bad action: %#v", action)
+	}
+	defer step.Cleanup(state)
+
+	err := state.Get("error").(error)
+	if !strings.HasPrefix(err.Error(), "Timeout waiting for WinRM after ") ||
+		!strings.HasSuffix(err.Error(), "last error: Error getting WinRM address: no IP address yet") {
+		t.Fatalf("bad error: %s", err)
+	}
+}
+
+func TestStepConnectWinRM_Ready(t *testing.T) {
+	r := winrmtest.NewRemote()
+	defer r.Close()
+
+	var lock sync.Mutex
+	rebootChecks := 0
+	r.CommandFunc(winrmtest.MatchScript(`RebootRequired`), func(cmd *winrmtest.Cmd) int {
+		lock.Lock()
+		defer lock.Unlock()
+		if rebootChecks++; rebootChecks <= 2 {
+			io.WriteString(cmd.Stdout, "Windows Update reboot required\r\n")
+		}
+		return 0
+	})
+	r.CommandFunc(winrmtest.MatchScript(`Get-Service`), func(cmd *winrmtest.Cmd) int {
+		if !strings.Contains(cmd.Script, "@('WinRM', 'W32Time')") {
+			io.WriteString(cmd.Stderr, "bad services")
+			return 1
+		}
+		return 0
+	})
+	r.Command(winrmtest.MatchText("check.cmd"), "", 0)
+
+	var output bytes.Buffer
+	state := new(multistep.BasicStateBag)
+	state.Put("ui", &packer.BasicUi{
+		Reader: new(bytes.Buffer),
+		Writer: &output,
+	})
+
+	step := &StepConnectWinRM{
+		WinRMAddress: func(multistep.StateBag) (string, error) {
+			return r.Address(), nil
+		},
+		WinRMUser:                 "vagrant",
+		WinRMPassword:             "vagrant",
+		WinRMWaitTimeout:          time.Minute,
+		WinRMReadyCommand:         "check.cmd",
+		WinRMReadyServices:        []string{"WinRM", "W32Time"},
+		WinRMReadyNoPendingReboot: true,
+		WinRMReadySuccesses:       2,
+		WinRMReadyInterval:        10 * time.Millisecond,
+	}
+
+	if action := step.Run(state); action != multistep.ActionContinue {
+		t.Fatalf("bad action: %#v\n%s", action, output.String())
+	}
+	defer step.Cleanup(state)
+
+	// Two failed checks and then two in a row that passed
+	lock.Lock()
+	defer lock.Unlock()
+	if rebootChecks != 4 {
+		t.Fatalf("bad number of checks: %d", rebootChecks)
+	}
+	if r.Requests("Command") != 8 {
+		t.Fatalf("bad number of commands: %d", r.Requests("Command"))
+	}
+
+	expected := "Guest not ready: reboot pending: Windows Update reboot required"
+	if !strings.Contains(output.String(), expected) {
+		t.Fatalf("output should contain %q: %s", expected, output.String())
+	}
+}
+
+func TestStepConnectWinRM_NotReady(t *testing.T) {
+	r := winrmtest.NewRemote()
+	defer r.Close()
+	r.Command(winrmtest.MatchScript(`Get-Service`), "W32Time\tStopped\r\nSpooler\tmissing\r\n", 0)
+
+	var output bytes.Buffer
+	state := new(multistep.BasicStateBag)
+	state.Put("ui", &packer.BasicUi{
+		Reader: new(bytes.Buffer),
+		Writer: &output,
+	})
+
+	step := &StepConnectWinRM{
+		WinRMAddress: func(multistep.StateBag) (string, error) {
+			return r.Address(), nil
+		},
+		WinRMUser:          "vagrant",
+		WinRMPassword:      "vagrant",
+		WinRMWaitTimeout:   500 * time.Millisecond,
+		WinRMReadyServices: []string{"W32Time", "Spooler"},
+		WinRMReadyInterval: 10 * time.Millisecond,
+	}
+
+	if action := step.Run(state); action != multistep.ActionHalt {
+		t.Fatalf("bad action: %#v", action)
+	}
+	defer step.Cleanup(state)
+
+	err := state.Get("error").(error)
+	expected := "Timeout waiting for the guest at " + r.Address() + " to be ready after "
+	if !strings.HasPrefix(err.Error(), expected) ||
+		!strings.HasSuffix(err.Error(), "last failure: services not running: W32Time (Stopped), Spooler (missing)") {
+		t.Fatalf("bad error: %s", err)
+	}
+
+	// The connection works, so it is not diagnosed
+	if strings.Contains(output.String(), "Diagnosing") {
+		t.Fatalf("should not diagnose: %s", output.String())
+	}
+
+	// The shells of the communicator that was not handed on are closed
+	deadline := time.Now().Add(5 * time.Second)
+	for r.Shells() != 0 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if n := r.Shells(); n != 0 {
+		t.Fatalf("%d shells left open", n)
+	}
+}
+
+func TestReadinessCheckCommand(t *testing.T) {
+	r := winrmtest.NewRemote()
+	defer r.Close()
+	r.CommandFunc(winrmtest.MatchText("check.cmd"), func(cmd *winrmtest.Cmd) int {
+		io.WriteString(cmd.Stdout, "checking\r\n")
+		io.WriteString(cmd.Stderr, "OOBE not finished\r\n")
+		return 2
+	})
+
+	comm := commtest.ConnectWinRM(t, r)
+	defer comm.Close()
+
+	err := checkCommand("check.cmd")(comm, make(chan struct{}))
+	if err == nil || err.Error() != "ready command exited with 2: OOBE not finished" {
+		t.Fatalf("bad error: %v", err)
+	}
+}
+
+func TestStepConnectWinRM_AttemptTimeout(t *testing.T) {
+	// A listener that accepts connections but never answers
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	defer l.Close()
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+		}
+	}()
+
+	var output bytes.Buffer
+	state := new(multistep.BasicStateBag)
+	state.Put("ui", &packer.BasicUi{
+		Reader: new(bytes.Buffer),
+		Writer: &output,
+	})
+
+	step := &StepConnectWinRM{
+		WinRMAddress: func(multistep.StateBag) (string, error) {
+			return l.Addr().String(), nil
+		},
+		WinRMUser:           "vagrant",
+		WinRMPassword:       "vagrant",
+		WinRMWaitTimeout:    time.Second,
+		WinRMConnectBackoff: 10 * time.Millisecond,
+		attemptTimeout:      100 * time.Millisecond,
+	}
+
+	// Stop listening just before the timeout, so that the diagnosis
+	// fails fast rather than waiting for an answer too
+	time.AfterFunc(900*time.Millisecond, func() { l.Close() })
+
+	if action := step.Run(state); action != multistep.ActionHalt {
+		t.Fatalf("bad action: %#v", action)
+	}
+	defer step.Cleanup(state)
+
+	// Every attempt gave up on its own, so there were several
+	step.lock.Lock()
+	attempts := step.attempts
+	step.lock.Unlock()
+	if attempts < 2 {
+		t.Fatalf("bad number of attempts: %d", attempts)
+	}
+
+	expected := "WinRM connection attempt 1 to " + l.Addr().String() + " failed: timed out"
+	if !strings.Contains(output.String(), expected) {
+		t.Fatalf("output should contain %q: %s", expected, output.String())
+	}
+}
+
+func TestStepConnectWinRM_TimeoutClosesLateConnection(t *testing.T) {
+	r := winrmtest.NewRemote()
+	defer r.Close()
+
+	state := new(multistep.BasicStateBag)
+	state.Put("ui", &packer.BasicUi{
+		Reader: new(bytes.Buffer),
+		Writer: new(bytes.Buffer),
+	})
+
+	// The address only comes after the step timed out, and connecting
+	// then succeeds
+	step := &StepConnectWinRM{
+		WinRMAddress: func(multistep.StateBag) (string, error) {
+			time.Sleep(300 * time.Millisecond)
+			return r.Address(), nil
+		},
+		WinRMUser:        "vagrant",
+		WinRMPassword:    "vagrant",
+		WinRMWaitTimeout: 100 * time.Millisecond,
+	}
+
+	if action := step.Run(state); action != multistep.ActionHalt {
+		t.Fatalf("bad action: %#v", action)
+	}
+	defer step.Cleanup(state)
+
+	// Wait for the late connection, which must be closed
+	deadline := time.Now().Add(5 * time.Second)
+	for r.Requests("Create") == 0 || r.Shells() != 0 {
+		if time.Now().After(deadline) {
+			t.Fatalf("connection not closed: %d creates, %d shells open", r.Requests("Create"), r.Shells())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
@@ -4,30 +4,122 @@ import (
 	"errors"
 	"fmt"
 	"net"
+	"os"
+	"strings"
 	"time"
 
 	"github.com/mitchellh/packer/template/interpolate"
+	plugin "github.com/packer-community/packer-windows-plugins/communicator/winrm"
 )
 
 type WinRMConfig struct {
-	WinRMUser           string `mapstructure:"winrm_username"`
-	WinRMPassword       string `mapstructure:"winrm_password"`
-	WinRMHost           string `mapstructure:"winrm_host"`
-	WinRMPort           uint   `mapstructure:"winrm_port"`
-	RawWinRMWaitTimeout string `mapstructure:"winrm_wait_timeout"`
+	WinRMUser                 string   `mapstructure:"winrm_username"`
+	WinRMPassword             string   `mapstructure:"winrm_password"`
+	WinRMHost                 string   `mapstructure:"winrm_host"`
+	WinRMPort                 uint     `mapstructure:"winrm_port"`
+	RawWinRMWaitTimeout       string   `mapstructure:"winrm_wait_timeout"`
+	RawWinRMConnectDelay      string   `mapstructure:"winrm_connect_delay"`
+	RawWinRMConnectBackoff    string   `mapstructure:"winrm_connect_backoff"`
+	RawWinRMConnectMaxBackoff string   `mapstructure:"winrm_connect_max_backoff"`
+	RawWinRMOperationTimeout  string   `mapstructure:"winrm_operation_timeout"`
+	WinRMUseSSL               bool     `mapstructure:"winrm_use_ssl"`
+	WinRMInsecure             bool     `mapstructure:"winrm_insecure"`
+	WinRMCACert               string   `mapstructure:"winrm_ca_cert"`
+	WinRMThumbprint           string   `mapstructure:"winrm_cert_thumbprint"`
+	WinRMAuth                 string   `mapstructure:"winrm_auth"`
+	WinRMMaxShells            int      `mapstructure:"winrm_max_shells"`
+	RawWinRMShellIdle         string   `mapstructure:"winrm_shell_idle_timeout"`
+	WinRMHTTPUpload           bool     `mapstructure:"winrm_http_upload"`
+	WinRMHTTPUploadHost       string   `mapstructure:"winrm_http_upload_host"`
+	WinRMHTTPUploadPort       int      `mapstructure:"winrm_http_upload_port"`
+	WinRMCodepage             int      `mapstructure:"winrm_codepage"`
+	WinRMMaxAttempts          int      `mapstructure:"winrm_max_attempts"`
+	RawWinRMBackoff           string   `mapstructure:"winrm_retry_backoff"`
+	RawWinRMMaxBackoff        string   `mapstructure:"winrm_retry_max_backoff"`
+	WinRMTraceFile            string   `mapstructure:"winrm_trace_file"`
+	WinRMReadyCommand         string   `mapstructure:"winrm_ready_command"`
+	WinRMReadyServices        []string `mapstructure:"winrm_ready_services"`
+	WinRMReadyNoPendingReboot bool     `mapstructure:"winrm_ready_no_pending_reboot"`
+	WinRMReadySuccesses       int      `mapstructure:"winrm_ready_successes"`
+	RawWinRMReadyInterval     string   `mapstructure:"winrm_ready_interval"`
 
-	WinRMWaitTimeout time.Duration
+	WinRMWaitTimeout       time.Duration
+	WinRMConnectDelay      time.Duration
+	WinRMConnectBackoff    time.Duration
+	WinRMConnectMaxBackoff time.Duration
+	WinRMOperationTimeout  time.Duration
+	WinRMShellIdleTimeout  time.Duration
+	WinRMRetryBackoff      time.Duration
+	WinRMRetryMaxBackoff   time.Duration
+	WinRMReadyInterval     time.Duration
 }
 
 func (c *WinRMConfig) Prepare(ctx *interpolate.Context) []error {
 	if c.WinRMPort == 0 {
-		c.WinRMPort = 5985
+		if c.WinRMUseSSL {
+			c.WinRMPort = 5986
+		} else {
+			c.WinRMPort = 5985
+		}
 	}
 
 	if c.RawWinRMWaitTimeout == "" {
 		c.RawWinRMWaitTimeout = "20m"
 	}
 
+	if c.RawWinRMConnectDelay == "" {
+		c.RawWinRMConnectDelay = defaultConnectDelay.String()
+	}
+
+	if c.RawWinRMConnectBackoff == "" {
+		c.RawWinRMConnectBackoff = defaultConnectBackoff.String()
+	}
+
+	if c.RawWinRMConnectMaxBackoff == "" {
+		c.RawWinRMConnectMaxBackoff = defaultConnectMaxBackoff.String()
+	}
+
+	if c.RawWinRMOperationTimeout == "" {
+		c.RawWinRMOperationTimeout = plugin.DefaultTimeout.String()
+	}
+
+	if c.WinRMAuth == "" {
+		c.WinRMAuth = plugin.AuthBasic
+	}
+	c.WinRMAuth = strings.ToLower(c.WinRMAuth)
+
+	if c.WinRMCodepage == 0 {
+		c.WinRMCodepage = plugin.CodepageUTF8
+	}
+
+	if c.WinRMMaxAttempts == 0 {
+		c.WinRMMaxAttempts = plugin.DefaultRetryPolicy.MaxAttempts
+	}
+
+	if c.RawWinRMBackoff == "" {
+		c.RawWinRMBackoff = plugin.DefaultRetryPolicy.InitialBackoff.String()
+	}
+
+	if c.RawWinRMMaxBackoff == "" {
+		c.RawWinRMMaxBackoff = plugin.DefaultRetryPolicy.MaxBackoff.String()
+	}
+
+	if c.WinRMMaxShells == 0 {
+		c.WinRMMaxShells = plugin.DefaultMaxShells
+	}
+
+	if c.RawWinRMShellIdle == "" {
+		c.RawWinRMShellIdle = plugin.DefaultShellIdleTimeout.String()
+	}
+
+	if c.WinRMReadySuccesses == 0 {
+		c.WinRMReadySuccesses = 1
+	}
+
+	if c.RawWinRMReadyInterval == "" {
+		c.RawWinRMReadyInterval = defaultReadyInterval.String()
+	}
+
 	var errs []error
 	if c.WinRMHost != "" {
 		if ip := net.ParseIP(c.WinRMHost); ip == nil {
@@ -51,5 +143,106 @@ func (c *WinRMConfig) Prepare(ctx *interpolate.Context) []error {
 		errs = append(errs, fmt.Errorf("Failed parsing winrm_wait_timeout: %s, raw timeout: %s", c.WinRMWaitTimeout, c.RawWinRMWaitTimeout))
 	}
 
+	c.WinRMConnectDelay, err = time.ParseDuration(c.RawWinRMConnectDelay)
+	if err != nil {
+		errs = append(errs, fmt.Errorf("Failed parsing winrm_connect_delay: %s", err))
+	} else if c.WinRMConnectDelay < 0 {
+		errs = append(errs, errors.New("winrm_connect_delay must not be negative"))
+	}
+
+	c.WinRMConnectBackoff, err = time.ParseDuration(c.RawWinRMConnectBackoff)
+	if err != nil {
+		errs = append(errs, fmt.Errorf("Failed parsing winrm_connect_backoff: %s", err))
+	} else if c.WinRMConnectBackoff <= 0 {
+		errs = append(errs, errors.New("winrm_connect_backoff must be greater than zero"))
+	}
+
+	c.WinRMConnectMaxBackoff, err = time.ParseDuration(c.RawWinRMConnectMaxBackoff)
+	if err != nil {
+		errs = append(errs, fmt.Errorf("Failed parsing winrm_connect_max_backoff: %s", err))
+	} else if c.WinRMConnectMaxBackoff < c.WinRMConnectBackoff {
+		errs = append(errs, errors.New("winrm_connect_max_backoff must be at least winrm_connect_backoff"))
+	}
+
+	if c.WinRMMaxShells < 0 {
+		errs = append(errs, errors.New("winrm_max_shells must be a positive number"))
+	}
+
+	c.WinRMOperationTimeout, err = time.ParseDuration(c.RawWinRMOperationTimeout)
+	if err != nil {
+		errs = append(errs, fmt.Errorf("Failed parsing winrm_operation_timeout: %s", err))
+	} else if c.WinRMOperationTimeout < time.Second {
+		errs = append(errs, errors.New("winrm_operation_timeout must be at least one second"))
+	}
+
+	c.WinRMShellIdleTimeout, err = time.ParseDuration(c.RawWinRMShellIdle)
+	if err != nil {
+		errs = append(errs, fmt.Errorf("Failed parsing winrm_shell_idle_timeout: %s", err))
+	} else if c.WinRMShellIdleTimeout <= 0 {
+		errs = append(errs, errors.New("winrm_shell_idle_timeout must be greater than zero"))
+	}
+
+	if c.WinRMMaxAttempts < 0 {
+		errs = append(errs, errors.New("winrm_max_attempts must be a positive number"))
+	}
+
+	c.WinRMRetryBackoff, err = time.ParseDuration(c.RawWinRMBackoff)
+	if err != nil {
+		errs = append(errs, fmt.Errorf("Failed parsing winrm_retry_backoff: %s", err))
+	} else if c.WinRMRetryBackoff <= 0 {
+		errs = append(errs, errors.New("winrm_retry_backoff must be greater than zero"))
+	}
+
+	c.WinRMRetryMaxBackoff, err = time.ParseDuration(c.RawWinRMMaxBackoff)
+	if err != nil {
+		errs = append(errs, fmt.Errorf("Failed parsing winrm_retry_max_backoff: %s", err))
+	} else if c.WinRMRetryMaxBackoff < c.WinRMRetryBackoff {
+		errs = append(errs, errors.New("winrm_retry_max_backoff must be at least winrm_retry_backoff"))
+	}
+
+	if c.WinRMReadySuccesses < 0 {
+		errs = append(errs, errors.New("winrm_ready_successes must be a positive number"))
+	}
+
+	c.WinRMReadyInterval, err = time.ParseDuration(c.RawWinRMReadyInterval)
+	if err != nil {
+		errs = append(errs, fmt.Errorf("Failed parsing winrm_ready_interval: %s", err))
+	} else if c.WinRMReadyInterval <= 0 {
+		errs = append(errs, errors.New("winrm_ready_interval must be greater than zero"))
+	}
+
+	if c.WinRMHTTPUploadPort < 0 || c.WinRMHTTPUploadPort > 65535 {
+		errs = append(errs, errors.New("winrm_http_upload_port must be between 0 and 65535"))
+	}
+
+	if !c.WinRMUseSSL && (c.WinRMInsecure || c.WinRMCACert != "" || c.WinRMThumbprint != "") {
+		errs = append(errs, errors.New("winrm_insecure, winrm_ca_cert and winrm_cert_thumbprint require winrm_use_ssl"))
+	}
+
+	if c.WinRMInsecure && (c.WinRMCACert != "" || c.WinRMThumbprint != "") {
+		errs = append(errs, errors.New("winrm_insecure cannot be combined with winrm_ca_cert or winrm_cert_thumbprint"))
+	}
+
+	if c.WinRMCACert != "" {
+		if _, err := os.Stat(c.WinRMCACert); err != nil {
+			errs = append(errs, fmt.Errorf("Bad winrm_ca_cert: %s", err))
+		}
+	}
+
+	if err := plugin.ValidateAuth(c.WinRMAuth); err != nil {
+		errs = append(errs, fmt.Errorf("Bad winrm_auth: %s", err))
+	}
+
+	if err := plugin.ValidateCodepage(c.WinRMCodepage); err != nil {
+		errs = append(errs, fmt.Errorf("Bad winrm_codepage: %s", err))
+	}
+
+	if c.WinRMThumbprint != "" {
+		c.WinRMThumbprint, err = plugin.NormalizeThumbprint(c.WinRMThumbprint)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("Bad winrm_cert_thumbprint: %s", err))
+		}
+	}
+
 	return errs
 }
@@ -1,8 +1,12 @@
 package common
 
 import (
-	"github.com/mitchellh/packer/packer"
+	"io/ioutil"
+	"os"
 	"testing"
+	"time"
+
+	"github.com/mitchellh/packer/template/interpolate"
 )
 
 func testWinRMConfig() *WinRMConfig {
@@ -11,13 +15,8 @@ func testWinRMConfig() *WinRMConfig {
 	}
 }
 
-func testConfigTemplate(t *testing.T) *packer.ConfigTemplate {
-	result, err := packer.NewConfigTemplate()
-	if err != nil {
-		t.Fatalf("err: %s", err)
-	}
-
-	return result
+func testConfigTemplate(t *testing.T) *interpolate.Context {
+	return &interpolate.Context{}
 }
 
 func TestWinRMConfigPrepare(t *testing.T) {
@@ -101,3 +100,432 @@ func TestWinRMConfigPrepare_WinRMWaitTimeout(t *testing.T) {
 		t.Fatalf("should not have error: %#v", errs)
 	}
 }
+
+func TestWinRMConfigPrepare_WinRMOperationTimeout(t *testing.T) {
+	var c *WinRMConfig
+	var errs []error
+
+	// Defaults
+	c = testWinRMConfig()
+	errs = c.Prepare(testConfigTemplate(t))
+	if len(errs) > 0 {
+		t.Fatalf("should not have error: %#v", errs)
+	}
+	if c.WinRMOperationTimeout != time.Minute {
+		t.Fatalf("bad winrm operation timeout: %s", c.WinRMOperationTimeout)
+	}
+
+	// Independent of the wait timeout
+	c = testWinRMConfig()
+	c.RawWinRMWaitTimeout = "1h"
+	c.RawWinRMOperationTimeout = "30s"
+	errs = c.Prepare(testConfigTemplate(t))
+	if len(errs) > 0 {
+		t.Fatalf("should not have error: %#v", errs)
+	}
+	if c.WinRMOperationTimeout != 30*time.Second {
+		t.Fatalf("bad winrm operation timeout: %s", c.WinRMOperationTimeout)
+	}
+
+	c = testWinRMConfig()
+	c.RawWinRMOperationTimeout = "bad"
+	errs = c.Prepare(testConfigTemplate(t))
+	if len(errs) == 0 {
+		t.Fatal("should have error")
+	}
+
+	c = testWinRMConfig()
+	c.RawWinRMOperationTimeout = "500ms"
+	errs = c.Prepare(testConfigTemplate(t))
+	if len(errs) == 0 {
+		t.Fatal("should have error")
+	}
+}
+
+func TestWinRMConfigPrepare_WinRMUseSSL(t *testing.T) {
+	var c *WinRMConfig
+	var errs []error
+
+	// Default port
+	c = testWinRMConfig()
+	c.WinRMUseSSL = true
+	errs = c.Prepare(testConfigTemplate(t))
+	if len(errs) > 0 {
+		t.Fatalf("should not have error: %#v", errs)
+	}
+	if c.WinRMPort != 5986 {
+		t.Fatalf("bad winrm port: %d", c.WinRMPort)
+	}
+
+	// Explicit port
+	c = testWinRMConfig()
+	c.WinRMUseSSL = true
+	c.WinRMPort = 443
+	errs = c.Prepare(testConfigTemplate(t))
+	if len(errs) > 0 {
+		t.Fatalf("should not have error: %#v", errs)
+	}
+	if c.WinRMPort != 443 {
+		t.Fatalf("bad winrm port: %d", c.WinRMPort)
+	}
+
+	// TLS options without SSL
+	c = testWinRMConfig()
+	c.WinRMInsecure = true
+	errs = c.Prepare(testConfigTemplate(t))
+	if len(errs) == 0 {
+		t.Fatal("should have error")
+	}
+}
+
+func TestWinRMConfigPrepare_WinRMCACert(t *testing.T) {
+	var c *WinRMConfig
+	var errs []error
+
+	tf, err := ioutil.TempFile("", "packer")
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	tf.Close()
+	defer os.Remove(tf.Name())
+
+	c = testWinRMConfig()
+	c.WinRMUseSSL = true
+	c.WinRMCACert = tf.Name()
+	errs = c.Prepare(testConfigTemplate(t))
+	if len(errs) > 0 {
+		t.Fatalf("should not have error: %#v", errs)
+	}
+
+	c = testWinRMConfig()
+	c.WinRMUseSSL = true
+	c.WinRMCACert = tf.Name() + ".missing"
+	errs = c.Prepare(testConfigTemplate(t))
+	if len(errs) == 0 {
+		t.Fatal("should have error")
+	}
+
+	c = testWinRMConfig()
+	c.WinRMUseSSL = true
+	c.WinRMInsecure = true
+	c.WinRMCACert = tf.Name()
+	errs = c.Prepare(testConfigTemplate(t))
+	if len(errs) == 0 {
+		t.Fatal("should have error")
+	}
+}
+
+func TestWinRMConfigPrepare_WinRMThumbprint(t *testing.T) {
+	var c *WinRMConfig
+	var errs []error
+
+	c = testWinRMConfig()
+	c.WinRMUseSSL = true
+	c.WinRMThumbprint = "d1 a5 0b 4f 4f 3e 7b 1e 93 16 5e 5a 57 70 a4 2e 3c 0d 9f 21"
+	errs = c.Prepare(testConfigTemplate(t))
+	if len(errs) > 0 {
+		t.Fatalf("should not have error: %#v", errs)
+	}
+	if c.WinRMThumbprint != "D1A50B4F4F3E7B1E93165E5A5770A42E3C0D9F21" {
+		t.Fatalf("bad thumbprint: %s", c.WinRMThumbprint)
+	}
+
+	c = testWinRMConfig()
+	c.WinRMUseSSL = true
+	c.WinRMThumbprint = "not a thumbprint"
+	errs = c.Prepare(testConfigTemplate(t))
+	if len(errs) == 0 {
+		t.Fatal("should have error")
+	}
+
+	// Thumbprint without SSL
+	c = testWinRMConfig()
+	c.WinRMThumbprint = "D1A50B4F4F3E7B1E93165E5A5770A42E3C0D9F21"
+	errs = c.Prepare(testConfigTemplate(t))
+	if len(errs) == 0 {
+		t.Fatal("should have error")
+	}
+}
+
+func TestWinRMConfigPrepare_WinRMAuth(t *testing.T) {
+	var c *WinRMConfig
+	var errs []error
+
+	// Default
+	c = testWinRMConfig()
+	errs = c.Prepare(testConfigTemplate(t))
+	if len(errs) > 0 {
+		t.Fatalf("should not have error: %#v", errs)
+	}
+	if c.WinRMAuth != "basic" {
+		t.Fatalf("bad winrm auth: %s", c.WinRMAuth)
+	}
+
+	// NTLM
+	c = testWinRMConfig()
+	c.WinRMAuth = "NTLM"
+	errs = c.Prepare(testConfigTemplate(t))
+	if len(errs) > 0 {
+		t.Fatalf("should not have error: %#v", errs)
+	}
+	if c.WinRMAuth != "ntlm" {
+		t.Fatalf("bad winrm auth: %s", c.WinRMAuth)
+	}
+
+	// Unsupported
+	c = testWinRMConfig()
+	c.WinRMAuth = "kerberos"
+	errs = c.Prepare(testConfigTemplate(t))
+	if len(errs) == 0 {
+		t.Fatal("should have error")
+	}
+}
+
+func TestWinRMConfigPrepare_WinRMShellPool(t *testing.T) {
+	var c *WinRMConfig
+	var errs []error
+
+	// Defaults
+	c = testWinRMConfig()
+	errs = c.Prepare(testConfigTemplate(t))
+	if len(errs) > 0 {
+		t.Fatalf("should not have error: %#v", errs)
+	}
+	if c.WinRMMaxShells != 4 {
+		t.Fatalf("bad winrm max shells: %d", c.WinRMMaxShells)
+	}
+	if c.WinRMShellIdleTimeout != 2*time.Minute {
+		t.Fatalf("bad winrm shell idle timeout: %s", c.WinRMShellIdleTimeout)
+	}
+
+	// Good
+	c = testWinRMConfig()
+	c.WinRMMaxShells = 1
+	c.RawWinRMShellIdle = "30s"
+	errs = c.Prepare(testConfigTemplate(t))
+	if len(errs) > 0 {
+		t.Fatalf("should not have error: %#v", errs)
+	}
+	if c.WinRMShellIdleTimeout != 30*time.Second {
+		t.Fatalf("bad winrm shell idle timeout: %s", c.WinRMShellIdleTimeout)
+	}
+
+	// Bad
+	c = testWinRMConfig()
+	c.WinRMMaxShells = -1
+	errs = c.Prepare(testConfigTemplate(t))
+	if len(errs) == 0 {
+		t.Fatal("should have error")
+	}
+
+	c = testWinRMConfig()
+	c.RawWinRMShellIdle = "bad"
+	errs = c.Prepare(testConfigTemplate(t))
+	if len(errs) == 0 {
+		t.Fatal("should have error")
+	}
+
+	c = testWinRMConfig()
+	c.RawWinRMShellIdle = "-1s"
+	errs = c.Prepare(testConfigTemplate(t))
+	if len(errs) == 0 {
+		t.Fatal("should have error")
+	}
+}
+
+func TestWinRMConfigPrepare_WinRMHTTPUpload(t *testing.T) {
+	var c *WinRMConfig
+	var errs []error
+
+	c = testWinRMConfig()
+	c.WinRMHTTPUpload = true
+	c.WinRMHTTPUploadHost = "10.0.2.2"
+	c.WinRMHTTPUploadPort = 8080
+	errs = c.Prepare(testConfigTemplate(t))
+	if len(errs) > 0 {
+		t.Fatalf("should not have error: %#v", errs)
+	}
+
+	c = testWinRMConfig()
+	c.WinRMHTTPUploadPort = -1
+	errs = c.Prepare(testConfigTemplate(t))
+	if len(errs) == 0 {
+		t.Fatal("should have error")
+	}
+
+	c = testWinRMConfig()
+	c.WinRMHTTPUploadPort = 65536
+	errs = c.Prepare(testConfigTemplate(t))
+	if len(errs) == 0 {
+		t.Fatal("should have error")
+	}
+}
+
+func TestWinRMConfigPrepare_WinRMCodepage(t *testing.T) {
+	var c *WinRMConfig
+	var errs []error
+
+	c = testWinRMConfig()
+	errs = c.Prepare(testConfigTemplate(t))
+	if len(errs) > 0 {
+		t.Fatalf("should not have error: %#v", errs)
+	}
+	if c.WinRMCodepage != 65001 {
+		t.Fatalf("bad winrm codepage: %d", c.WinRMCodepage)
+	}
+
+	c = testWinRMConfig()
+	c.WinRMCodepage = 850
+	errs = c.Prepare(testConfigTemplate(t))
+	if len(errs) > 0 {
+		t.Fatalf("should not have error: %#v", errs)
+	}
+
+	c = testWinRMConfig()
+	c.WinRMCodepage = 12345
+	errs = c.Prepare(testConfigTemplate(t))
+	if len(errs) == 0 {
+		t.Fatal("should have error")
+	}
+}
+
+func TestWinRMConfigPrepare_WinRMRetry(t *testing.T) {
+	var c *WinRMConfig
+	var errs []error
+
+	c = testWinRMConfig()
+	errs = c.Prepare(testConfigTemplate(t))
+	if len(errs) > 0 {
+		t.Fatalf("should not have error: %#v", errs)
+	}
+	if c.WinRMMaxAttempts != 5 {
+		t.Fatalf("bad winrm max attempts: %d", c.WinRMMaxAttempts)
+	}
+	if c.WinRMRetryBackoff != time.Second || c.WinRMRetryMaxBackoff != 30*time.Second {
+		t.Fatalf("bad winrm retry backoff: %s, %s", c.WinRMRetryBackoff, c.WinRMRetryMaxBackoff)
+	}
+
+	c = testWinRMConfig()
+	c.WinRMMaxAttempts = 1
+	c.RawWinRMBackoff = "5s"
+	c.RawWinRMMaxBackoff = "1m"
+	errs = c.Prepare(testConfigTemplate(t))
+	if len(errs) > 0 {
+		t.Fatalf("should not have error: %#v", errs)
+	}
+	if c.WinRMRetryBackoff != 5*time.Second || c.WinRMRetryMaxBackoff != time.Minute {
+		t.Fatalf("bad winrm retry backoff: %s, %s", c.WinRMRetryBackoff, c.WinRMRetryMaxBackoff)
+	}
+
+	c = testWinRMConfig()
+	c.WinRMMaxAttempts = -1
+	errs = c.Prepare(testConfigTemplate(t))
+	if len(errs) == 0 {
+		t.Fatal("should have error")
+	}
+
+	c = testWinRMConfig()
+	c.RawWinRMBackoff = "bad"
+	errs = c.Prepare(testConfigTemplate(t))
+	if len(errs) == 0 {
+		t.Fatal("should have error")
+	}
+
+	c = testWinRMConfig()
+	c.RawWinRMBackoff = "1m"
+	c.RawWinRMMaxBackoff = "10s"
+	errs = c.Prepare(testConfigTemplate(t))
+	if len(errs) == 0 {
+		t.Fatal("should have error")
+	}
+}
+
+func TestWinRMConfigPrepare_WinRMConnectBackoff(t *testing.T) {
+	var c *WinRMConfig
+	var errs []error
+
+	c = testWinRMConfig()
+	errs = c.Prepare(testConfigTemplate(t))
+	if len(errs) > 0 {
+		t.Fatalf("should not have error: %#v", errs)
+	}
+	if c.WinRMConnectDelay != 5*time.Second {
+		t.Fatalf("bad winrm connect delay: %s", c.WinRMConnectDelay)
+	}
+	if c.WinRMConnectBackoff != 5*time.Second || c.WinRMConnectMaxBackoff != 30*time.Second {
+		t.Fatalf("bad winrm connect backoff: %s, %s", c.WinRMConnectBackoff, c.WinRMConnectMaxBackoff)
+	}
+
+	c = testWinRMConfig()
+	c.RawWinRMConnectDelay = "0s"
+	c.RawWinRMConnectBackoff = "2s"
+	c.RawWinRMConnectMaxBackoff = "2m"
+	errs = c.Prepare(testConfigTemplate(t))
+	if len(errs) > 0 {
+		t.Fatalf("should not have error: %#v", errs)
+	}
+	if c.WinRMConnectDelay != 0 || c.WinRMConnectBackoff != 2*time.Second || c.WinRMConnectMaxBackoff != 2*time.Minute {
+		t.Fatalf("bad winrm connect backoff: %s, %s, %s", c.WinRMConnectDelay, c.WinRMConnectBackoff, c.WinRMConnectMaxBackoff)
+	}
+
+	c = testWinRMConfig()
+	c.RawWinRMConnectDelay = "-1s"
+	errs = c.Prepare(testConfigTemplate(t))
+	if len(errs) == 0 {
+		t.Fatal("should have error")
+	}
+
+	c = testWinRMConfig()
+	c.RawWinRMConnectBackoff = "0s"
+	errs = c.Prepare(testConfigTemplate(t))
+	if len(errs) == 0 {
+		t.Fatal("should have error")
+	}
+
+	c = testWinRMConfig()
+	c.RawWinRMConnectBackoff = "1m"
+	c.RawWinRMConnectMaxBackoff = "10s"
+	errs = c.Prepare(testConfigTemplate(t))
+	if len(errs) == 0 {
+		t.Fatal("should have error")
+	}
+}
+
+func TestWinRMConfigPrepare_WinRMReady(t *testing.T) {
+	var c *WinRMConfig
+	var errs []error
+
+	c = testWinRMConfig()
+	errs = c.Prepare(testConfigTemplate(t))
+	if len(errs) > 0 {
+		t.Fatalf("should not have error: %#v", errs)
+	}
+	if c.WinRMReadySuccesses != 1 || c.WinRMReadyInterval != 5*time.Second {
+		t.Fatalf("bad winrm readiness: %d, %s", c.WinRMReadySuccesses, c.WinRMReadyInterval)
+	}
+
+	c = testWinRMConfig()
+	c.WinRMReadySuccesses = 3
+	c.RawWinRMReadyInterval = "10s"
+	errs = c.Prepare(testConfigTemplate(t))
+	if len(errs) > 0 {
+		t.Fatalf("should not have error: %#v", errs)
+	}
+	if c.WinRMReadySuccesses != 3 || c.WinRMReadyInterval != 10*time.Second {
+		t.Fatalf("bad winrm readiness: %d, %s", c.WinRMReadySuccesses, c.WinRMReadyInterval)
+	}
+
+	c = testWinRMConfig()
+	c.WinRMReadySuccesses = -1
+	errs = c.Prepare(testConfigTemplate(t))
+	if len(errs) == 0 {
+		t.Fatal("should have error")
+	}
+
+	c = testWinRMConfig()
+	c.RawWinRMReadyInterval = "0s"
+	errs = c.Prepare(testConfigTemplate(t))
+	if len(errs) == 0 {
+		t.Fatal("should have error")
+	}
+}
@@ -0,0 +1,92 @@
+package common
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"strings"
+
+	"github.com/mitchellh/packer/helper/config"
+)
+
+// DefaultWinRMProfile is the profile LoadProfile reads when none is named.
+const DefaultWinRMProfile = "default"
+
+// LoadProfile sets the fields of c given by a named profile in a profiles
+// file. The file is a JSON object that maps profile names to objects with
+// the same keys as the WinRM settings of a template:
+//
+//	{
+//	  "lab": {
+//	    "winrm_host": "lab-01.example.com",
+//	    "winrm_username": "packer",
+//	    "winrm_use_ssl": true,
+//	    "winrm_cert_thumbprint": "D1A50B4F4F3E7B1E93165E5A5770A42E3C0D9F21"
+//	  }
+//	}
+//
+// An empty name reads DefaultWinRMProfile, which unlike a named profile
+// doesn't have to exist, nor does the file.
+func (c *WinRMConfig) LoadProfile(path string, name string) error {
+	required := name != ""
+	if !required {
+		name = DefaultWinRMProfile
+	}
+
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) && !required {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("Error reading WinRM profiles: %s", err)
+	}
+
+	var profiles map[string]map[string]interface{}
+	if err := json.Unmarshal(data, &profiles); err != nil {
+		return fmt.Errorf("Error parsing WinRM profiles in %s: %s", path, err)
+	}
+
+	profile, ok := profiles[name]
+	if !ok {
+		if !required {
+			return nil
+		}
+		return fmt.Errorf("WinRM profile %q not found in %s", name, path)
+	}
+
+	if err := config.Decode(c, &config.DecodeOpts{}, profile); err != nil {
+		return fmt.Errorf("Bad WinRM profile %q: %s", name, err)
+	}
+	return nil
+}
+
+// LoadEnv sets the fields of c given by environment variables. They are
+// named after the keys of the template, in upper case, such as WINRM_HOST,
+// WINRM_USERNAME or WINRM_USE_SSL. Lists, such as WINRM_READY_SERVICES,
+// are comma separated. Empty variables are ignored.
+func (c *WinRMConfig) LoadEnv() error {
+	raw := make(map[string]interface{})
+	t := reflect.TypeOf(*c)
+	for i := 0; i < t.NumField(); i++ {
+		key := t.Field(i).Tag.Get("mapstructure")
+		if key == "" {
+			continue
+		}
+
+		value := os.Getenv(strings.ToUpper(key))
+		switch {
+		case value == "":
+		case t.Field(i).Type.Kind() == reflect.Slice:
+			raw[key] = strings.Split(value, ",")
+		default:
+			raw[key] = value
+		}
+	}
+
+	if err := config.Decode(c, &config.DecodeOpts{}, raw); err != nil {
+		return fmt.Errorf("Bad WINRM_ environment variable: %s", err)
+	}
+	return nil
+}
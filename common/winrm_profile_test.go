@@ -0,0 +1,113 @@
+package common
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func testProfiles(t *testing.T, contents string) (string, func()) {
+	dir, err := ioutil.TempDir("", "packer-winrm")
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	path := filepath.Join(dir, "winrm.json")
+	if err := ioutil.WriteFile(path, []byte(contents), 0600); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	return path, func() { os.RemoveAll(dir) }
+}
+
+func TestWinRMConfigLoadProfile(t *testing.T) {
+	path, cleanup := testProfiles(t, `{
+		"default": {"winrm_host": "localhost"},
+		"lab": {"winrm_host": "lab-01", "winrm_port": 5999, "winrm_use_ssl": true, "winrm_wait_timeout": "30s"}
+	}`)
+	defer cleanup()
+
+	c := &WinRMConfig{WinRMUser: "packer"}
+	if err := c.LoadProfile(path, "lab"); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if c.WinRMHost != "lab-01" || c.WinRMPort != 5999 || !c.WinRMUseSSL || c.RawWinRMWaitTimeout != "30s" {
+		t.Fatalf("bad config: %#v", c)
+	}
+	if c.WinRMUser != "packer" {
+		t.Fatalf("settings not in the profile should be kept: %#v", c)
+	}
+
+	// Without a name, the default profile
+	c = &WinRMConfig{}
+	if err := c.LoadProfile(path, ""); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if c.WinRMHost != "localhost" {
+		t.Fatalf("bad config: %#v", c)
+	}
+
+	// A named profile must exist
+	if err := c.LoadProfile(path, "missing"); err == nil {
+		t.Fatal("should have error")
+	}
+}
+
+func TestWinRMConfigLoadProfile_NoFile(t *testing.T) {
+	path := filepath.Join(os.TempDir(), "packer-winrm-missing.json")
+
+	c := &WinRMConfig{}
+	if err := c.LoadProfile(path, ""); err != nil {
+		t.Fatalf("the default profile is optional: %s", err)
+	}
+	if err := c.LoadProfile(path, "lab"); err == nil {
+		t.Fatal("should have error")
+	}
+}
+
+func TestWinRMConfigLoadProfile_Bad(t *testing.T) {
+	for _, contents := range []string{
+		`not json`,
+		`{"lab": {"winrm_hots": "lab-01"}}`,
+		`{"lab": {"winrm_port": "not a number"}}`,
+	} {
+		path, cleanup := testProfiles(t, contents)
+		c := &WinRMConfig{}
+		err := c.LoadProfile(path, "lab")
+		cleanup()
+		if err == nil {
+			t.Fatalf("should have error: %s", contents)
+		}
+	}
+}
+
+func TestWinRMConfigLoadEnv(t *testing.T) {
+	os.Setenv("WINRM_HOST", "lab-02")
+	os.Setenv("WINRM_PORT", "5999")
+	os.Setenv("WINRM_USE_SSL", "true")
+	defer os.Setenv("WINRM_HOST", "")
+	defer os.Setenv("WINRM_PORT", "")
+	defer os.Setenv("WINRM_USE_SSL", "")
+
+	c := &WinRMConfig{WinRMHost: "lab-01", WinRMUser: "packer"}
+	if err := c.LoadEnv(); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if c.WinRMHost != "lab-02" || c.WinRMPort != 5999 || !c.WinRMUseSSL || c.WinRMUser != "packer" {
+		t.Fatalf("bad config: %#v", c)
+	}
+
+	os.Setenv("WINRM_READY_SERVICES", "WinRM,W32Time")
+	defer os.Setenv("WINRM_READY_SERVICES", "")
+	if err := c.LoadEnv(); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if len(c.WinRMReadyServices) != 2 || c.WinRMReadyServices[1] != "W32Time" {
+		t.Fatalf("bad services: %#v", c.WinRMReadyServices)
+	}
+
+	os.Setenv("WINRM_PORT", "not a number")
+	if err := c.LoadEnv(); err == nil {
+		t.Fatal("should have error")
+	}
+}
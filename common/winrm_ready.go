@@ -0,0 +1,250 @@
+package common
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/mitchellh/packer/packer"
+	"github.com/packer-community/packer-windows-plugins/common/powershell"
+	plugin "github.com/packer-community/packer-windows-plugins/communicator/winrm"
+)
+
+// defaultReadyInterval is the wait between rounds of readiness checks
+const defaultReadyInterval = 5 * time.Second
+
+var errWaitCancelled = errors.New("WinRM wait cancelled")
+
+// servicesScript writes the name and status of each of the services in the
+// array it is formatted with that is not running, tab separated.
+const servicesScript = `foreach ($name in @(%s)) {
+  $service = Get-Service -Name $name -ErrorAction SilentlyContinue
+  if (-not $service) {
+    "$name` + "`t" + `missing"
+  } elseif ($service.Status -ne 'Running') {
+    "$name` + "`t" + `$($service.Status)"
+  }
+}`
+
+// pendingRebootScript writes a line for every sign that Windows setup is
+// not finished or the guest is waiting to be rebooted.
+const pendingRebootScript = `$setup = Get-ItemProperty -Path 'HKLM:\SYSTEM\Setup' -ErrorAction SilentlyContinue
+if ($setup.SystemSetupInProgress -eq 1) { 'Windows setup in progress' }
+if ($setup.OOBEInProgress -eq 1) { 'OOBE in progress' }
+if (Test-Path 'HKLM:\SOFTWARE\Microsoft\Windows\CurrentVersion\Component Based Servicing\RebootPending') {
+  'Component Based Servicing reboot pending'
+}
+if (Test-Path 'HKLM:\SOFTWARE\Microsoft\Windows\CurrentVersion\WindowsUpdate\Auto Update\RebootRequired') {
+  'Windows Update reboot required'
+}`
+
+// readinessCheck checks that the guest is ready to be provisioned, and
+// returns an error saying why it isn't.
+type readinessCheck func(comm packer.Communicator, cancel <-chan struct{}) error
+
+// readinessChecks returns the checks that are configured, if any.
+func (s *StepConnectWinRM) readinessChecks() []readinessCheck {
+	var checks []readinessCheck
+	if s.WinRMReadyNoPendingReboot {
+		checks = append(checks, checkPendingReboot)
+	}
+	if len(s.WinRMReadyServices) > 0 {
+		checks = append(checks, checkServices(s.WinRMReadyServices))
+	}
+	if s.WinRMReadyCommand != "" {
+		checks = append(checks, checkCommand(s.WinRMReadyCommand))
+	}
+	return checks
+}
+
+// waitForReady runs the readiness checks until they all pass
+// WinRMReadySuccesses times in a row, or cancel is closed. Failures are
+// reported like failed attempts to connect.
+func (s *StepConnectWinRM) waitForReady(ui packer.Ui, comm packer.Communicator, checks []readinessCheck, cancel <-chan struct{}) error {
+	successes := s.WinRMReadySuccesses
+	if successes < 1 {
+		successes = 1
+	}
+	interval := s.WinRMReadyInterval
+	if interval <= 0 {
+		interval = defaultReadyInterval
+	}
+
+	ui.Say("Waiting for the guest to be ready...")
+
+	var reported time.Time
+	passed := 0
+	for round := 1; ; round++ {
+		err := runChecks(comm, checks, cancel)
+		if err == errWaitCancelled {
+			return err
+		}
+
+		if err == nil {
+			passed++
+			log.Printf("Readiness checks passed (%d of %d in a row)", passed, successes)
+			if passed >= successes {
+				return nil
+			}
+		} else {
+			passed = 0
+			log.Printf("Readiness check %d failed: %s", round, err)
+
+			s.lock.Lock()
+			s.checks = round
+			s.notReady = err
+			s.lock.Unlock()
+
+			if time.Since(reported) >= connectReportInterval {
+				reported = time.Now()
+				ui.Message(fmt.Sprintf("Guest not ready: %s", err))
+			}
+		}
+
+		select {
+		case <-cancel:
+			return errWaitCancelled
+		case <-time.After(interval):
+		}
+	}
+}
+
+// runChecks runs checks in order up to the first that fails.
+func runChecks(comm packer.Communicator, checks []readinessCheck, cancel <-chan struct{}) error {
+	for _, check := range checks {
+		if err := check(comm, cancel); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func checkPendingReboot(comm packer.Communicator, cancel <-chan struct{}) error {
+	stdout, err := runPowershellCheck(comm, pendingRebootScript, cancel)
+	if err != nil {
+		return err
+	}
+
+	if reasons := outputLines(stdout); len(reasons) > 0 {
+		return fmt.Errorf("reboot pending: %s", strings.Join(reasons, ", "))
+	}
+	return nil
+}
+
+func checkServices(services []string) readinessCheck {
+	names := make([]string, len(services))
+	for i, name := range services {
+		names[i] = "'" + strings.Replace(name, "'", "''", -1) + "'"
+	}
+	script := fmt.Sprintf(servicesScript, strings.Join(names, ", "))
+
+	return func(comm packer.Communicator, cancel <-chan struct{}) error {
+		stdout, err := runPowershellCheck(comm, script, cancel)
+		if err != nil {
+			return err
+		}
+
+		var stopped []string
+		for _, line := range outputLines(stdout) {
+			parts := strings.SplitN(line, "\t", 2)
+			if len(parts) != 2 {
+				return fmt.Errorf("unexpected output of the service check: %q", line)
+			}
+			stopped = append(stopped, fmt.Sprintf("%s (%s)", parts[0], parts[1]))
+		}
+
+		if len(stopped) > 0 {
+			return fmt.Errorf("services not running: %s", strings.Join(stopped, ", "))
+		}
+		return nil
+	}
+}
+
+func checkCommand(command string) readinessCheck {
+	return func(comm packer.Communicator, cancel <-chan struct{}) error {
+		stdout, stderr, exitStatus, err := runCheck(comm, command, cancel)
+		if err != nil {
+			return err
+		}
+
+		if exitStatus != 0 {
+			// The last line of the output is usually why
+			output := outputLines(stderr)
+			if len(output) == 0 {
+				output = outputLines(stdout)
+			}
+			if len(output) == 0 {
+				return fmt.Errorf("ready command exited with %d", exitStatus)
+			}
+			return fmt.Errorf("ready command exited with %d: %s", exitStatus, output[len(output)-1])
+		}
+		return nil
+	}
+}
+
+// runPowershellCheck runs a script for a check, which fails if the script
+// exits with non-zero.
+func runPowershellCheck(comm packer.Communicator, script string, cancel <-chan struct{}) (string, error) {
+	stdout, stderr, exitStatus, err := runCheck(comm, powershell.EncodedCommand(script), cancel)
+	if err != nil {
+		return "", err
+	}
+
+	if exitStatus != 0 {
+		return "", fmt.Errorf("readiness check exited with %d: %s", exitStatus, strings.TrimSpace(stderr))
+	}
+	return stdout, nil
+}
+
+// runCheck runs the command of a check and returns its output and exit
+// status. The command is terminated if cancel is closed first.
+func runCheck(comm packer.Communicator, command string, cancel <-chan struct{}) (string, string, int, error) {
+	var stdout, stderr bytes.Buffer
+	rc := &packer.RemoteCmd{Command: command, Stdout: &stdout, Stderr: &stderr}
+	if err := comm.Start(rc); err != nil {
+		return "", "", 0, fmt.Errorf("unable to run check: %s", plugin.ClassifyError(err))
+	}
+
+	done := make(chan struct{})
+	go func() {
+		rc.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return stdout.String(), stderr.String(), rc.ExitStatus, nil
+	case <-cancel:
+		if t, ok := comm.(Terminator); ok {
+			if err := t.Terminate(rc); err != nil {
+				log.Printf("Error terminating readiness check: %s", err)
+			}
+		}
+		return "", "", 0, errWaitCancelled
+	}
+}
+
+// outputLines returns the lines of output that are not blank, trimmed.
+func outputLines(output string) []string {
+	var result []string
+	for _, line := range strings.Split(output, "\n") {
+		if line = strings.TrimSpace(line); line != "" {
+			result = append(result, line)
+		}
+	}
+	return result
+}
+
+// closeCommunicator closes a communicator that won't be handed on, so its
+// shells are not left open on the guest.
+func closeCommunicator(comm packer.Communicator) {
+	if c, ok := comm.(io.Closer); ok {
+		if err := c.Close(); err != nil {
+			log.Printf("Error closing WinRM communicator: %s", err)
+		}
+	}
+}
@@ -0,0 +1,62 @@
+package winrm
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// Authentication methods supported by the communicator.
+const (
+	// AuthBasic sends the user name and password with every request. The
+	// WinRM service must have Basic authentication enabled.
+	AuthBasic = "basic"
+
+	// AuthNTLM authenticates with an NTLMv2 handshake, offered by the
+	// service through either the NTLM or the Negotiate scheme. Domain
+	// accounts are given as DOMAIN\user.
+	AuthNTLM = "ntlm"
+)
+
+// ValidateAuth checks that auth names an authentication method the
+// communicator supports. The empty string selects AuthBasic.
+func ValidateAuth(auth string) error {
+	switch strings.ToLower(auth) {
+	case "", AuthBasic, AuthNTLM:
+		return nil
+	}
+
+	return fmt.Errorf("unsupported WinRM authentication method %q, must be one of %s or %s",
+		auth, AuthBasic, AuthNTLM)
+}
+
+// newAuthTransport wraps a transport with the configured authentication
+// method. The winrm and winrmcp clients always attach Basic credentials to
+// their requests, so NTLM is layered on top by converting those.
+func newAuthTransport(auth string, t *http.Transport) http.RoundTripper {
+	if strings.ToLower(auth) != AuthNTLM {
+		return t
+	}
+
+	return newNTLMTransport(t)
+}
+
+// transportDecorator returns a function that applies the communicator's TLS
+// and authentication settings, and its trace, to the transports created by
+// the winrm and winrmcp clients.
+func (c *Communicator) transportDecorator() func(*http.Transport) http.RoundTripper {
+	if c.tlsConfig == nil && strings.ToLower(c.config.Auth) != AuthNTLM && c.tracer == nil {
+		return nil
+	}
+
+	return func(t *http.Transport) http.RoundTripper {
+		if c.tlsConfig != nil {
+			t.TLSClientConfig = c.tlsConfig
+		}
+		rt := newAuthTransport(c.config.Auth, t)
+		if c.tracer != nil {
+			rt = c.tracer.transport(rt)
+		}
+		return rt
+	}
+}
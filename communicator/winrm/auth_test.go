@@ -0,0 +1,268 @@
+package winrm
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/binary"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"unicode/utf16"
+)
+
+// ntlmTestServer is a fake WinRM HTTP endpoint that only accepts NTLM
+// authentication, challenging every connection the way IIS and WinRM do
+// and remembering the connections that are authenticated.
+type ntlmTestServer struct {
+	*httptest.Server
+
+	// schemes offered in the initial WWW-Authenticate challenges
+	schemes []string
+
+	mu            sync.Mutex
+	basicTries    int
+	users         []string
+	negotiated    int
+	requests      int
+	authenticated map[string]bool
+}
+
+func newNTLMTestServer(schemes ...string) *ntlmTestServer {
+	s := &ntlmTestServer{schemes: schemes, authenticated: make(map[string]bool)}
+	s.Server = httptest.NewServer(http.HandlerFunc(s.handle))
+	return s
+}
+
+func (s *ntlmTestServer) handle(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.requests++
+	auth := r.Header.Get("Authorization")
+	scheme, data := splitAuthHeader(auth)
+
+	switch {
+	case auth == "" && s.authenticated[r.RemoteAddr]:
+		w.Header().Set("Content-Type", "application/soap+xml;charset=UTF-8")
+		w.Write([]byte("<ok/>"))
+		return
+	case scheme == "Basic":
+		s.basicTries++
+	case (scheme == "NTLM" || scheme == "Negotiate") && ntlmMessageType(data) == 1:
+		s.negotiated++
+		w.Header().Set("WWW-Authenticate", scheme+" "+base64.StdEncoding.EncodeToString(testChallengeMessage()))
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	case (scheme == "NTLM" || scheme == "Negotiate") && ntlmMessageType(data) == 3:
+		user := ntlmUserName(data)
+		s.users = append(s.users, user)
+		if user == "vagrant" {
+			s.authenticated[r.RemoteAddr] = true
+			w.Header().Set("Content-Type", "application/soap+xml;charset=UTF-8")
+			w.Write([]byte("<ok/>"))
+			return
+		}
+	}
+
+	for _, scheme := range s.schemes {
+		w.Header().Add("WWW-Authenticate", scheme)
+	}
+	w.WriteHeader(http.StatusUnauthorized)
+}
+
+func splitAuthHeader(header string) (string, []byte) {
+	parts := strings.SplitN(header, " ", 2)
+	if len(parts) != 2 {
+		return header, nil
+	}
+
+	data, _ := base64.StdEncoding.DecodeString(parts[1])
+	return parts[0], data
+}
+
+func ntlmMessageType(msg []byte) uint32 {
+	if len(msg) < 12 || !bytes.Equal(msg[:8], []byte("NTLMSSP\x00")) {
+		return 0
+	}
+	return binary.LittleEndian.Uint32(msg[8:12])
+}
+
+// ntlmUserName extracts the user name field of an AUTHENTICATE message.
+func ntlmUserName(msg []byte) string {
+	if len(msg) < 44 {
+		return ""
+	}
+
+	length := int(binary.LittleEndian.Uint16(msg[36:38]))
+	offset := int(binary.LittleEndian.Uint32(msg[40:44]))
+	if offset+length > len(msg) || length%2 != 0 {
+		return ""
+	}
+
+	u := make([]uint16, length/2)
+	for i := range u {
+		u[i] = binary.LittleEndian.Uint16(msg[offset+2*i:])
+	}
+	return string(utf16.Decode(u))
+}
+
+// testChallengeMessage builds an NTLMv2 CHALLENGE message with an empty
+// target name and a target info block holding only the terminator.
+func testChallengeMessage() []byte {
+	var buf bytes.Buffer
+	buf.WriteString("NTLMSSP\x00")
+	binary.Write(&buf, binary.LittleEndian, uint32(2))
+
+	// TargetName: empty, pointing at the payload
+	binary.Write(&buf, binary.LittleEndian, uint16(0))
+	binary.Write(&buf, binary.LittleEndian, uint16(0))
+	binary.Write(&buf, binary.LittleEndian, uint32(48))
+
+	// NEGOTIATE_UNICODE | NEGOTIATE_NTLM | NEGOTIATE_TARGET_INFO
+	binary.Write(&buf, binary.LittleEndian, uint32(0x00000001|0x00000200|0x00800000))
+	buf.WriteString("01234567")
+	buf.Write(make([]byte, 8))
+
+	// TargetInfo: MsvAvEOL
+	binary.Write(&buf, binary.LittleEndian, uint16(4))
+	binary.Write(&buf, binary.LittleEndian, uint16(4))
+	binary.Write(&buf, binary.LittleEndian, uint32(48))
+	buf.Write(make([]byte, 4))
+
+	return buf.Bytes()
+}
+
+func testAuthRequest(t *testing.T, c *Communicator, url string, user string) *http.Response {
+	rt := http.RoundTripper(&http.Transport{})
+	if decorate := c.transportDecorator(); decorate != nil {
+		rt = decorate(&http.Transport{})
+	}
+	return testAuthRoundTrip(t, rt, url, user)
+}
+
+func testAuthRoundTrip(t *testing.T, rt http.RoundTripper, url string, user string) *http.Response {
+
+	req, err := http.NewRequest("POST", url, strings.NewReader("<s:Envelope/>"))
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	req.SetBasicAuth(user, "vagrant")
+
+	resp, err := rt.RoundTrip(req)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	resp.Body.Close()
+	return resp
+}
+
+func TestNTLMAuth(t *testing.T) {
+	for _, scheme := range []string{"NTLM", "Negotiate"} {
+		ts := newNTLMTestServer(scheme)
+
+		c := &Communicator{config: &Config{Auth: AuthNTLM}}
+		resp := testAuthRequest(t, c, ts.URL, "vagrant")
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("%s: bad status: %d", scheme, resp.StatusCode)
+		}
+
+		if ts.negotiated != 1 {
+			t.Fatalf("%s: expected one negotiation, got %d", scheme, ts.negotiated)
+		}
+
+		if ts.basicTries != 0 {
+			t.Fatalf("%s: basic credentials should not be sent", scheme)
+		}
+
+		ts.Close()
+	}
+}
+
+func TestNTLMAuth_ReusesConnection(t *testing.T) {
+	ts := newNTLMTestServer("Negotiate", "NTLM")
+	defer ts.Close()
+
+	c := &Communicator{config: &Config{Auth: AuthNTLM}}
+	rt := c.transportDecorator()(&http.Transport{})
+	for i := 0; i < 3; i++ {
+		resp := testAuthRoundTrip(t, rt, ts.URL, "vagrant")
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("bad status: %d", resp.StatusCode)
+		}
+	}
+
+	// The handshake is made once, after which requests go out alone on
+	// the authenticated connection
+	if ts.negotiated != 1 {
+		t.Fatalf("expected one negotiation, got %d", ts.negotiated)
+	}
+	if ts.requests != 5 {
+		t.Fatalf("expected 5 requests, got %d", ts.requests)
+	}
+
+	// A connection the service forgot about is authenticated again
+	ts.mu.Lock()
+	ts.authenticated = make(map[string]bool)
+	ts.mu.Unlock()
+	if resp := testAuthRoundTrip(t, rt, ts.URL, "vagrant"); resp.StatusCode != http.StatusOK {
+		t.Fatalf("bad status after the service forgot the connection: %d", resp.StatusCode)
+	}
+	if ts.negotiated != 2 {
+		t.Fatalf("expected a second negotiation, got %d", ts.negotiated)
+	}
+}
+
+func TestNTLMAuth_DomainUser(t *testing.T) {
+	ts := newNTLMTestServer("NTLM")
+	defer ts.Close()
+
+	c := &Communicator{config: &Config{Auth: AuthNTLM}}
+	resp := testAuthRequest(t, c, ts.URL, `BUILD\packer`)
+	if resp.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("bad status: %d", resp.StatusCode)
+	}
+
+	if len(ts.users) != 1 || ts.users[0] != "packer" {
+		t.Fatalf("bad users: %#v", ts.users)
+	}
+}
+
+func TestNTLMAuth_NoDowngrade(t *testing.T) {
+	ts := newNTLMTestServer(`Basic realm="WSMAN"`)
+	defer ts.Close()
+
+	c := &Communicator{config: &Config{Auth: AuthNTLM}}
+	rt := c.transportDecorator()(&http.Transport{})
+
+	req, _ := http.NewRequest("POST", ts.URL, strings.NewReader("<s:Envelope/>"))
+	req.SetBasicAuth("vagrant", "vagrant")
+	_, err := rt.RoundTrip(req)
+	if err == nil || !strings.Contains(err.Error(), errNoNTLM.Error()) {
+		t.Fatalf("expected downgrade error, got: %v", err)
+	}
+
+	if ts.basicTries != 0 {
+		t.Fatal("basic credentials should not be sent")
+	}
+}
+
+func TestBasicAuth(t *testing.T) {
+	c := &Communicator{config: &Config{Auth: AuthBasic}}
+	if c.transportDecorator() != nil {
+		t.Fatal("basic auth over HTTP should use the default transport")
+	}
+}
+
+func TestValidateAuth(t *testing.T) {
+	for _, auth := range []string{"", "basic", "ntlm", "NTLM"} {
+		if err := ValidateAuth(auth); err != nil {
+			t.Fatalf("err: %s", err)
+		}
+	}
+
+	if err := ValidateAuth("kerberos"); err == nil {
+		t.Fatal("should have error")
+	}
+}
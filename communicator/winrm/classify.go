@@ -0,0 +1,64 @@
+package winrm
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// ClassifyError returns a short description of the kind of failure an
+// error from New or a command is, such as "connection refused" or
+// "authentication failed (HTTP 401)", for reporting progress without the
+// details of the error. Errors it doesn't recognize are described by their
+// message.
+func ClassifyError(err error) string {
+	switch e := err.(type) {
+	case *httpStatusError:
+		switch e.StatusCode {
+		case http.StatusUnauthorized:
+			return "authentication failed (HTTP 401)"
+		case http.StatusNotFound:
+			return "no WinRM listener (HTTP 404)"
+		}
+		return fmt.Sprintf("HTTP %d", e.StatusCode)
+	case *wsmanFault:
+		if e.Code != "" {
+			return fmt.Sprintf("WinRM fault %s", e.Code)
+		}
+		return fmt.Sprintf("WinRM fault %s", e.Subcode)
+	case *transportError:
+		return classifyTransport(e.err)
+	}
+	return err.Error()
+}
+
+// classifyTransport describes a failure to exchange a request with the
+// service.
+func classifyTransport(err error) string {
+	if e, ok := err.(*url.Error); ok {
+		err = e.Err
+	}
+
+	msg := err.Error()
+	switch {
+	case strings.Contains(msg, "x509:") || strings.Contains(msg, "certificate thumbprint"):
+		return "TLS certificate rejected"
+	case strings.Contains(msg, "tls:") || strings.Contains(msg, "HTTP response to HTTPS client"):
+		return "TLS handshake failed"
+	case strings.Contains(msg, "connection refused"):
+		return "connection refused"
+	case strings.Contains(msg, "no such host"):
+		return "host not found"
+	case strings.Contains(msg, "no route to host") || strings.Contains(msg, "network is unreachable"):
+		return "host unreachable"
+	case strings.Contains(msg, "connection reset") || strings.Contains(msg, "EOF"):
+		return "connection reset"
+	}
+
+	if e, ok := err.(net.Error); ok && e.Timeout() {
+		return "timed out"
+	}
+	return msg
+}
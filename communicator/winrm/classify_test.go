@@ -0,0 +1,71 @@
+package winrm
+
+import (
+	"errors"
+	"net"
+	"strconv"
+	"testing"
+
+	"github.com/packer-community/packer-windows-plugins/communicator/winrm/winrmtest"
+)
+
+func TestClassifyError(t *testing.T) {
+	cases := []struct {
+		err      error
+		expected string
+	}{
+		{&httpStatusError{StatusCode: 401}, "authentication failed (HTTP 401)"},
+		{&httpStatusError{StatusCode: 503}, "HTTP 503"},
+		{&wsmanFault{Code: wsmanFaultMaxShells, Subcode: "w:QuotaLimit"}, "WinRM fault " + wsmanFaultMaxShells},
+		{&transportError{err: errors.New("x509: certificate signed by unknown authority")}, "TLS certificate rejected"},
+		{&transportError{err: errors.New("read tcp: connection reset by peer")}, "connection reset"},
+		{errors.New("WinRM service did not return a shell ID"), "WinRM service did not return a shell ID"},
+	}
+
+	for _, c := range cases {
+		if actual := ClassifyError(c.err); actual != c.expected {
+			t.Fatalf("bad class of %q: %q", c.err, actual)
+		}
+	}
+}
+
+func TestClassifyError_New(t *testing.T) {
+	r := winrmtest.NewRemote()
+	defer r.Close()
+	r.RequireBasicAuth("vagrant", "secret")
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	host, port, _ := net.SplitHostPort(l.Addr().String())
+	l.Close()
+
+	refused := testConfig()
+	refused.Host = host
+	refused.Port, _ = strconv.Atoi(port)
+
+	https := testRemoteConfig(r)
+	https.Https = true
+	https.Insecure = true
+
+	cases := []struct {
+		config   *Config
+		expected string
+	}{
+		{refused, "connection refused"},
+		{testRemoteConfig(r), "authentication failed (HTTP 401)"},
+		{https, "TLS handshake failed"},
+	}
+
+	for _, c := range cases {
+		c.config.Retry.MaxAttempts = 1
+		_, err := New(c.config)
+		if err == nil {
+			t.Fatalf("should not connect to %s:%d", c.config.Host, c.config.Port)
+		}
+		if actual := ClassifyError(err); actual != c.expected {
+			t.Fatalf("bad class of %q: %q, expected %q", err, actual, c.expected)
+		}
+	}
+}
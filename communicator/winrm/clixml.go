@@ -0,0 +1,257 @@
+package winrm
+
+import (
+	"bytes"
+	"encoding/xml"
+	"io"
+	"log"
+	"regexp"
+	"strconv"
+	"strings"
+	"unicode/utf16"
+)
+
+// clixmlHeader starts a CLIXML document on stderr. PowerShell writes its
+// error, warning, verbose and progress streams this way when its output is
+// redirected, as it is in a WinRM shell.
+const clixmlHeader = "#< CLIXML"
+
+// clixmlEscape matches the _xHHHH_ escapes CLIXML uses for characters
+// such as line breaks.
+var clixmlEscape = regexp.MustCompile(`_x([0-9A-Fa-f]{4})_`)
+
+// clixmlPrefixes are written before each line of a stream, like the
+// PowerShell console does.
+var clixmlPrefixes = map[string]string{
+	"warning": "WARNING: ",
+	"verbose": "VERBOSE: ",
+	"debug":   "DEBUG: ",
+}
+
+// clixmlWriter passes output through to w, decoding any CLIXML documents
+// in it into plain lines. Progress records are dropped. Close must be
+// called to write out anything still buffered.
+type clixmlWriter struct {
+	w     io.Writer
+	buf   []byte
+	inDoc bool
+}
+
+func newCLIXMLWriter(w io.Writer) *clixmlWriter {
+	return &clixmlWriter{w: w}
+}
+
+func (c *clixmlWriter) Write(p []byte) (int, error) {
+	c.buf = append(c.buf, p...)
+
+	for {
+		if !c.inDoc {
+			i := bytes.Index(c.buf, []byte(clixmlHeader))
+			if i < 0 {
+				// Hold back what could be the start of a header
+				n := len(c.buf) - partialSuffix(c.buf, clixmlHeader)
+				if err := c.flush(n); err != nil {
+					return 0, err
+				}
+				return len(p), nil
+			}
+
+			if err := c.flush(i); err != nil {
+				return 0, err
+			}
+			c.buf = c.buf[len(clixmlHeader):]
+			c.inDoc = true
+		}
+
+		end := bytes.Index(c.buf, []byte("</Objs>"))
+		if end < 0 {
+			return len(p), nil
+		}
+		end += len("</Objs>")
+
+		doc := c.buf[:end]
+		c.buf = trimNewline(c.buf[end:])
+		c.inDoc = false
+
+		if err := c.writeDoc(doc); err != nil {
+			return 0, err
+		}
+	}
+}
+
+// Close writes out anything left in the buffer, including an unfinished
+// document as it was received.
+func (c *clixmlWriter) Close() error {
+	if c.inDoc {
+		c.buf = append([]byte(clixmlHeader), c.buf...)
+		c.inDoc = false
+	}
+	return c.flush(len(c.buf))
+}
+
+func (c *clixmlWriter) flush(n int) error {
+	if n == 0 {
+		return nil
+	}
+
+	_, err := c.w.Write(c.buf[:n])
+	c.buf = c.buf[n:]
+	return err
+}
+
+func (c *clixmlWriter) writeDoc(doc []byte) error {
+	text, err := decodeCLIXML(doc)
+	if err != nil {
+		log.Printf("Error decoding CLIXML, passing it through: %s", err)
+		_, err = io.WriteString(c.w, clixmlHeader+string(doc)+"\n")
+		return err
+	}
+
+	_, err = io.WriteString(c.w, text)
+	return err
+}
+
+// decodeCLIXML turns a CLIXML document into the lines PowerShell would
+// have shown on the console.
+func decodeCLIXML(doc []byte) (string, error) {
+	var out bytes.Buffer
+	stream := ""
+	lineStart := true
+	progress := 0
+
+	write := func(s, text string) {
+		if s != stream && !lineStart {
+			out.WriteString("\n")
+			lineStart = true
+		}
+		stream = s
+
+		for _, line := range strings.SplitAfter(text, "\n") {
+			if line == "" {
+				continue
+			}
+			if lineStart {
+				out.WriteString(clixmlPrefixes[s])
+			}
+			out.WriteString(line)
+			lineStart = strings.HasSuffix(line, "\n")
+		}
+	}
+
+	d := xml.NewDecoder(bytes.NewReader(doc))
+	depth := 0
+	for {
+		t, err := d.Token()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return "", err
+		}
+
+		switch t := t.(type) {
+		case xml.StartElement:
+			depth++
+			if depth != 2 {
+				continue
+			}
+
+			s := strings.ToLower(clixmlAttr(t, "S"))
+			switch {
+			case t.Name.Local == "S":
+				var text string
+				if err := d.DecodeElement(&text, &t); err != nil {
+					return "", err
+				}
+				write(s, unescapeCLIXML(text))
+			case t.Name.Local == "Obj" && s == "progress":
+				progress++
+				if err := d.Skip(); err != nil {
+					return "", err
+				}
+			case t.Name.Local == "Obj":
+				var obj struct {
+					ToString string `xml:"ToString"`
+				}
+				if err := d.DecodeElement(&obj, &t); err != nil {
+					return "", err
+				}
+				if obj.ToString != "" {
+					write(s, unescapeCLIXML(obj.ToString)+"\n")
+				}
+			default:
+				if err := d.Skip(); err != nil {
+					return "", err
+				}
+			}
+			depth--
+		case xml.EndElement:
+			depth--
+		}
+	}
+
+	if progress > 0 {
+		log.Printf("Dropped %d PowerShell progress record(s)", progress)
+	}
+	if !lineStart {
+		out.WriteString("\n")
+	}
+	return out.String(), nil
+}
+
+// unescapeCLIXML replaces _xHHHH_ escapes with the UTF-16 characters they
+// stand for, and CRLF line breaks with LF.
+func unescapeCLIXML(s string) string {
+	var units []uint16
+	var out bytes.Buffer
+
+	flush := func() {
+		out.WriteString(string(utf16.Decode(units)))
+		units = units[:0]
+	}
+
+	last := 0
+	for _, m := range clixmlEscape.FindAllStringSubmatchIndex(s, -1) {
+		if m[0] != last {
+			flush()
+			out.WriteString(s[last:m[0]])
+		}
+		u, _ := strconv.ParseUint(s[m[2]:m[3]], 16, 16)
+		units = append(units, uint16(u))
+		last = m[1]
+	}
+	flush()
+	out.WriteString(s[last:])
+
+	return strings.Replace(out.String(), "\r\n", "\n", -1)
+}
+
+func clixmlAttr(e xml.StartElement, name string) string {
+	for _, a := range e.Attr {
+		if a.Name.Local == name {
+			return a.Value
+		}
+	}
+	return ""
+}
+
+// partialSuffix returns the length of the longest suffix of b that is a
+// proper prefix of s.
+func partialSuffix(b []byte, s string) int {
+	for n := len(s) - 1; n > 0; n-- {
+		if len(b) >= n && string(b[len(b)-n:]) == s[:n] {
+			return n
+		}
+	}
+	return 0
+}
+
+func trimNewline(b []byte) []byte {
+	if bytes.HasPrefix(b, []byte("\r\n")) {
+		return b[2:]
+	}
+	if bytes.HasPrefix(b, []byte("\n")) {
+		return b[1:]
+	}
+	return b
+}
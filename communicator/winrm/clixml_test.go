@@ -0,0 +1,107 @@
+package winrm
+
+import (
+	"bytes"
+	"testing"
+)
+
+const testCLIXML = "#< CLIXML\r\n" +
+	`<Objs Version="1.1.0.1" xmlns="http://schemas.microsoft.com/powershell/2004/04">` +
+	`<Obj S="progress" RefId="0"><TN RefId="0"><T>System.Management.Automation.PSCustomObject</T><T>System.Object</T></TN>` +
+	`<MS><I64 N="SourceId">1</I64><PR N="Record"><AV>Preparing modules for first use.</AV><AI>0</AI><Nil /><PI>-1</PI><PC>-1</PC><T>Completed</T><SR>-1</SR><SD> </SD></PR></MS></Obj>` +
+	`<S S="Error">Get-Item : Cannot find path 'C:\missing' because it does not exist._x000D__x000A_</S>` +
+	`<S S="Error">At line:1 char:1_x000D__x000A_</S>` +
+	`<S S="Error">+ Get-Item C:\missing_x000D__x000A_</S>` +
+	`<S S="warning">Disk is almost full</S>` +
+	`<S S="verbose">Performing the operation "Remove File" on target "C:\a_x005F_x000D_b".</S>` +
+	`</Objs>`
+
+func TestDecodeCLIXML(t *testing.T) {
+	text, err := decodeCLIXML([]byte(testCLIXML[len(clixmlHeader)+2:]))
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	expected := "Get-Item : Cannot find path 'C:\\missing' because it does not exist.\n" +
+		"At line:1 char:1\n" +
+		"+ Get-Item C:\\missing\n" +
+		"WARNING: Disk is almost full\n" +
+		"VERBOSE: Performing the operation \"Remove File\" on target \"C:\\a_x000D_b\".\n"
+	if text != expected {
+		t.Fatalf("bad text:\n%s", text)
+	}
+}
+
+func TestCLIXMLWriter(t *testing.T) {
+	var out bytes.Buffer
+	w := newCLIXMLWriter(&out)
+
+	input := "plain error\r\n" + testCLIXML + "\r\nafter\r\n"
+
+	// Split across writes anywhere, including inside the header
+	for i := 0; i < len(input); i += 7 {
+		end := i + 7
+		if end > len(input) {
+			end = len(input)
+		}
+		if _, err := w.Write([]byte(input[i:end])); err != nil {
+			t.Fatalf("err: %s", err)
+		}
+	}
+	if err := w.Close(); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	expected := "plain error\r\n" +
+		"Get-Item : Cannot find path 'C:\\missing' because it does not exist.\n" +
+		"At line:1 char:1\n" +
+		"+ Get-Item C:\\missing\n" +
+		"WARNING: Disk is almost full\n" +
+		"VERBOSE: Performing the operation \"Remove File\" on target \"C:\\a_x000D_b\".\n" +
+		"after\r\n"
+	if out.String() != expected {
+		t.Fatalf("bad output:\n%q", out.String())
+	}
+}
+
+func TestCLIXMLWriter_Unfinished(t *testing.T) {
+	var out bytes.Buffer
+	w := newCLIXMLWriter(&out)
+
+	input := "#< CLIXML\r\n<Objs><S S=\"Error\">cut off"
+	w.Write([]byte(input))
+	w.Close()
+
+	if out.String() != input {
+		t.Fatalf("bad output: %q", out.String())
+	}
+}
+
+func TestCLIXMLWriter_Invalid(t *testing.T) {
+	var out bytes.Buffer
+	w := newCLIXMLWriter(&out)
+
+	w.Write([]byte("#< CLIXML\r\n<Objs><S></Objs>"))
+	w.Close()
+
+	if out.String() != "#< CLIXML\r\n<Objs><S></Objs>\n" {
+		t.Fatalf("bad output: %q", out.String())
+	}
+}
+
+func TestUnescapeCLIXML(t *testing.T) {
+	cases := map[string]string{
+		"line_x000D__x000A_": "line\n",
+		"tab_x0009_":         "tab\t",
+		"_x005F_x000A_":      "_x000A_",
+		"_xD83D__xDE00_":     "\U0001F600",
+		"no escapes":         "no escapes",
+		"_x00E9_t_x00E9_":    "été",
+	}
+
+	for input, expected := range cases {
+		if actual := unescapeCLIXML(input); actual != expected {
+			t.Fatalf("bad unescape of %s: %q", input, actual)
+		}
+	}
+}
@@ -0,0 +1,81 @@
+package winrm
+
+import (
+	"fmt"
+	"io"
+
+	"golang.org/x/text/encoding"
+	"golang.org/x/text/encoding/charmap"
+	"golang.org/x/text/encoding/japanese"
+	"golang.org/x/text/encoding/korean"
+	"golang.org/x/text/encoding/simplifiedchinese"
+	"golang.org/x/text/encoding/traditionalchinese"
+	"golang.org/x/text/transform"
+)
+
+// CodepageUTF8 is the default shell code page. Output in it is passed
+// through unchanged.
+const CodepageUTF8 = 65001
+
+// codepages are the Windows code pages whose output can be transcoded to
+// UTF-8.
+var codepages = map[int]encoding.Encoding{
+	437:   charmap.CodePage437,
+	850:   charmap.CodePage850,
+	852:   charmap.CodePage852,
+	855:   charmap.CodePage855,
+	858:   charmap.CodePage858,
+	860:   charmap.CodePage860,
+	862:   charmap.CodePage862,
+	863:   charmap.CodePage863,
+	865:   charmap.CodePage865,
+	866:   charmap.CodePage866,
+	874:   charmap.Windows874,
+	932:   japanese.ShiftJIS,
+	936:   simplifiedchinese.GBK,
+	949:   korean.EUCKR,
+	950:   traditionalchinese.Big5,
+	1250:  charmap.Windows1250,
+	1251:  charmap.Windows1251,
+	1252:  charmap.Windows1252,
+	1253:  charmap.Windows1253,
+	1254:  charmap.Windows1254,
+	1255:  charmap.Windows1255,
+	1256:  charmap.Windows1256,
+	1257:  charmap.Windows1257,
+	1258:  charmap.Windows1258,
+	20866: charmap.KOI8R,
+	28591: charmap.ISO8859_1,
+	28592: charmap.ISO8859_2,
+	28595: charmap.ISO8859_5,
+}
+
+// ValidateCodepage returns an error if output in the given code page
+// can't be transcoded. Zero selects the default, CodepageUTF8.
+func ValidateCodepage(codepage int) error {
+	if codepage == 0 || codepage == CodepageUTF8 {
+		return nil
+	}
+	if _, ok := codepages[codepage]; !ok {
+		return fmt.Errorf("unsupported code page %d", codepage)
+	}
+	return nil
+}
+
+// nopWriteCloser adds a Close method that does nothing to a writer.
+type nopWriteCloser struct {
+	io.Writer
+}
+
+func (nopWriteCloser) Close() error { return nil }
+
+// newCodepageWriter returns a writer that transcodes output in the given
+// code page to UTF-8 before writing it to w. It must be closed to write
+// out a trailing partial character.
+func newCodepageWriter(w io.Writer, codepage int) io.WriteCloser {
+	enc, ok := codepages[codepage]
+	if !ok {
+		return nopWriteCloser{w}
+	}
+	return transform.NewWriter(w, enc.NewDecoder())
+}
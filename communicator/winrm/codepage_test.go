@@ -0,0 +1,82 @@
+package winrm
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestValidateCodepage(t *testing.T) {
+	for _, cp := range []int{0, CodepageUTF8, 437, 850, 866, 932, 1252} {
+		if err := ValidateCodepage(cp); err != nil {
+			t.Fatalf("code page %d should be valid: %s", cp, err)
+		}
+	}
+
+	for _, cp := range []int{-1, 1, 12345} {
+		if err := ValidateCodepage(cp); err == nil {
+			t.Fatalf("code page %d should be invalid", cp)
+		}
+	}
+}
+
+func TestNew_InvalidCodepage(t *testing.T) {
+	config := testConfig()
+	config.Codepage = 12345
+	if _, err := New(config); err == nil {
+		t.Fatal("should have error")
+	}
+}
+
+func TestCodepageWriter(t *testing.T) {
+	cases := []struct {
+		codepage int
+		input    []byte
+		expected string
+	}{
+		// "Größe" as printed by a German cmd.exe
+		{850, []byte{'G', 'r', 0x94, 0xe1, 'e'}, "Größe"},
+		// "Привет" on a Russian image
+		{866, []byte{0x8f, 0xe0, 0xa8, 0xa2, 0xa5, 0xe2}, "Привет"},
+		// "日本" in Shift JIS, split across writes below
+		{932, []byte{0x93, 0xfa, 0x96, 0x7b}, "日本"},
+		{CodepageUTF8, []byte("Größe"), "Größe"},
+	}
+
+	for _, tc := range cases {
+		var out bytes.Buffer
+		w := newCodepageWriter(&out, tc.codepage)
+
+		// One byte at a time, so multi-byte characters are split
+		for _, b := range tc.input {
+			if _, err := w.Write([]byte{b}); err != nil {
+				t.Fatalf("err: %s", err)
+			}
+		}
+		if err := w.Close(); err != nil {
+			t.Fatalf("err: %s", err)
+		}
+
+		if out.String() != tc.expected {
+			t.Fatalf("bad output for code page %d: %q", tc.codepage, out.String())
+		}
+	}
+}
+
+func TestOutputWriter_Stderr(t *testing.T) {
+	comm := &Communicator{codepage: 850}
+
+	var out bytes.Buffer
+	w := comm.outputWriter(&out, true)
+
+	input := []byte("#< CLIXML\r\n<Objs><S S=\"Error\">Gr\x94\xe1e_x000D__x000A_</S></Objs>")
+	if _, err := w.Write(input); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	if out.String() != "Größe\n" {
+		t.Fatalf("bad output: %q", out.String())
+	}
+}
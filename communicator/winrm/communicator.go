@@ -1,117 +1,487 @@
 package winrm
 
 import (
+	"crypto/tls"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"log"
+	"net"
+	"net/http"
 	"os"
+	"strconv"
+	"sync"
 	"time"
 
 	"github.com/dylanmei/iso8601"
-	"github.com/masterzen/winrm/winrm"
 	"github.com/mitchellh/packer/packer"
+	"github.com/packer-community/packer-windows-plugins/common/redact"
 	"github.com/packer-community/winrmcp/winrmcp"
 )
 
+// Config is used to configure the WinRM connection
+type Config struct {
+	Host     string
+	Port     int
+	User     string
+	Password string
+
+	// Timeout is the WS-Management operation timeout for requests. A
+	// request for command output that sees no output within the timeout
+	// is simply repeated.
+	Timeout time.Duration
+
+	// ConnectTimeout bounds the attempt to connect made by New. If it is
+	// set, New gives up on a service that doesn't answer within it and
+	// makes a single attempt, leaving retries to the caller.
+	ConnectTimeout time.Duration
+
+	// MaxShells is the maximum number of shells kept open on the guest
+	MaxShells int
+
+	// ShellIdleTimeout is how long an unused shell is kept open
+	ShellIdleTimeout time.Duration
+
+	// Auth is the authentication method, AuthBasic or AuthNTLM
+	Auth string
+
+	// Https connects to the HTTPS listener instead of the HTTP one
+	Https bool
+
+	// Insecure skips validation of the server certificate
+	Insecure bool
+
+	// CACert is a PEM encoded CA certificate used to validate the server
+	// certificate, in addition to the system roots
+	CACert []byte
+
+	// Thumbprint pins the server certificate to the given SHA-1 or SHA-256
+	// thumbprint instead of validating its chain
+	Thumbprint string
+
+	// Ui receives the progress of uploads. It may be nil.
+	Ui packer.Ui
+
+	// ProgressInterval is how often the progress of an upload is reported
+	ProgressInterval time.Duration
+
+	// Codepage is the code page requested for shells, CodepageUTF8 if
+	// zero. Output in other code pages is transcoded to UTF-8.
+	Codepage int
+
+	// Retry is the policy for retrying requests and uploads that fail
+	// with a transient error. Fields that are not set are taken from
+	// DefaultRetryPolicy.
+	Retry RetryPolicy
+
+	// Trace receives every request sent to the WinRM service and its
+	// response as a TraceEntry, with the password and long payloads
+	// removed. It may be nil.
+	Trace io.Writer
+
+	// Transport replaces the HTTP transport used for commands, such as
+	// with a ReplayTransport. Authentication is left to it.
+	Transport http.RoundTripper
+
+	// HTTPUpload has the guest download large files from an HTTP server
+	// on the host instead of receiving them through WinRM
+	HTTPUpload bool
+
+	// HTTPUploadHost is the address the guest reaches the host on. It
+	// defaults to the host's address on the network used to reach WinRM.
+	HTTPUploadHost string
+
+	// HTTPUploadPort is the port the HTTP server listens on, or zero for a
+	// random port
+	HTTPUploadPort int
+}
+
+// DefaultTimeout is the operation timeout used when Config.Timeout is not
+// set.
+const DefaultTimeout = time.Minute
+
+// defaultEnvelopeSize is the largest response envelope, in bytes, the
+// communicator asks the service for. It is the default MaxEnvelopeSizekb
+// of Windows Server 2008 R2.
+const defaultEnvelopeSize = 150 * 1024
+
 type Communicator struct {
-	client   *winrm.Client
-	endpoint *winrm.Endpoint
-	user     string
-	password string
+	config    *Config
+	client    *wsmanClient
+	tlsConfig *tls.Config
+	pool      *shellPool
+	codepage  int
+	tracer    *tracer
+
+	lock       sync.Mutex
+	running    map[*packer.RemoteCmd]*remoteCommand
+	uploads    *uploadServer
+	uploadsErr error
 }
 
 // Creates a new packer.Communicator implementation over WinRM.
-// Called when Packer tries to connect to WinRM
-func New(endpoint *winrm.Endpoint, user string, password string, timeout time.Duration) (*Communicator, error) {
-	// Create the WinRM client we use internally
-	params := winrm.DefaultParameters()
-	params.Timeout = iso8601.FormatDuration(timeout)
-	client, err := winrm.NewClientWithParameters(endpoint, user, password, params)
-	if err != nil {
+// Called when Packer tries to connect to WinRM. The password is added to
+// the secrets masked by the redact package.
+func New(config *Config) (*Communicator, error) {
+	redact.Add(config.Password)
+
+	c := &Communicator{
+		config:  config,
+		running: make(map[*packer.RemoteCmd]*remoteCommand),
+	}
+
+	if err := ValidateAuth(config.Auth); err != nil {
 		return nil, err
 	}
 
-	// Attempt to connect to the WinRM service
-	shell, err := client.CreateShell()
+	if err := ValidateCodepage(config.Codepage); err != nil {
+		return nil, err
+	}
+	c.codepage = config.Codepage
+	if c.codepage == 0 {
+		c.codepage = CodepageUTF8
+	}
+
+	if config.Https {
+		tlsConfig, err := newTLSConfig(config)
+		if err != nil {
+			return nil, err
+		}
+		c.tlsConfig = tlsConfig
+	}
+
+	timeout := config.Timeout
+	if timeout <= 0 {
+		timeout = DefaultTimeout
+	}
+
+	// Create the WinRM client we use internally
+	transport := &http.Transport{
+		Proxy:                 http.ProxyFromEnvironment,
+		TLSClientConfig:       c.tlsConfig,
+		ResponseHeaderTimeout: timeout + 30*time.Second,
+	}
+	rt := newAuthTransport(config.Auth, transport)
+	if config.Transport != nil {
+		rt = config.Transport
+	}
+	if config.Trace != nil {
+		c.tracer = newTracer(config.Trace, config.Password)
+		rt = c.tracer.transport(rt)
+	}
+	c.client = newWSManClient(config, &http.Client{Transport: rt}, timeout)
+	c.client.retry = config.Retry.withDefaults()
+
+	c.pool = newShellPool(config.MaxShells, config.ShellIdleTimeout, func() (io.Closer, error) {
+		return c.client.createShell(c.codepage)
+	})
+
+	// Attempt to connect to the WinRM service. The shell is kept open for
+	// the first command.
+	ps, err := c.connect(rt)
 	if err != nil {
 		return nil, err
 	}
+	c.pool.Put(ps)
+
+	return c, nil
+}
 
-	err = shell.Close()
+// connect opens the first shell, with requests bounded by ConnectTimeout
+// if it is set. The shell goes on to use the client of the communicator.
+func (c *Communicator) connect(rt http.RoundTripper) (*pooledShell, error) {
+	if c.config.ConnectTimeout <= 0 {
+		return c.pool.Get()
+	}
+
+	client := c.client
+	bounded := *client
+	bounded.http = &http.Client{Transport: rt, Timeout: c.config.ConnectTimeout}
+	bounded.retry = RetryPolicy{MaxAttempts: 1}
+
+	c.client = &bounded
+	ps, err := c.pool.Get()
+	c.client = client
 	if err != nil {
 		return nil, err
 	}
 
-	return &Communicator{
-		endpoint: endpoint,
-		user:     user,
-		password: password,
-	}, nil
+	ps.shell.(*shell).client = client
+	return ps, nil
 }
 
 func (c *Communicator) Start(rc *packer.RemoteCmd) error {
-	log.Printf("starting remote command: %s", rc.Command)
+	log.Printf("starting remote command: %s", redact.String(rc.Command))
 
-	// Create a new shell process on the guest
-	params := winrm.DefaultParameters()
-	params.Timeout = iso8601.FormatDuration(time.Hour * 24)
-	client, err := winrm.NewClientWithParameters(c.endpoint, c.user, c.password, params)
+	ps, cmd, err := c.execute(rc.Command)
 	if err != nil {
 		return err
 	}
 
-	shell, err := client.CreateShell()
-	if err != nil {
-		return err
+	c.startCommand(ps, cmd, rc)
+	return nil
+}
+
+// startCommand tracks a command that was started for rc until it exits.
+func (c *Communicator) startCommand(ps *pooledShell, cmd *remoteCommand, rc *packer.RemoteCmd) {
+	c.lock.Lock()
+	c.running[rc] = cmd
+	c.lock.Unlock()
+
+	go c.runCommand(ps, cmd, rc)
+}
+
+// Terminate stops a command started with Start. The command is sent the
+// terminate signal and its shell is closed once it has exited, which ends
+// any processes the command left behind. A command that has already
+// exited is ignored.
+func (c *Communicator) Terminate(rc *packer.RemoteCmd) error {
+	c.lock.Lock()
+	cmd, ok := c.running[rc]
+	c.lock.Unlock()
+
+	if !ok {
+		return nil
 	}
 
-	cmd, err := shell.Execute(rc.Command)
-	if err != nil {
-		return err
+	log.Printf("Terminating remote command: %s", redact.String(rc.Command))
+	return cmd.terminate()
+}
+
+// Close terminates all running commands and closes the shells that are
+// kept open on the guest. The communicator cannot be used afterwards.
+func (c *Communicator) Close() error {
+	c.lock.Lock()
+	running := make([]*remoteCommand, 0, len(c.running))
+	for _, cmd := range c.running {
+		running = append(running, cmd)
 	}
+	uploads := c.uploads
+	c.lock.Unlock()
 
-	go runCommand(shell, cmd, rc)
-	return nil
+	for _, cmd := range running {
+		if err := cmd.terminate(); err != nil {
+			log.Printf("Error terminating remote command: %s", err)
+		}
+	}
+
+	if uploads != nil {
+		uploads.Close()
+	}
+
+	return c.pool.Close()
+}
+
+// execute starts a command on a shell from the pool. The shell must be
+// returned to the pool once the command has finished.
+func (c *Communicator) execute(command string) (*pooledShell, *remoteCommand, error) {
+	for {
+		ps, err := c.pool.Get()
+		if err != nil {
+			return nil, nil, err
+		}
+
+		cmd, err := ps.shell.(*shell).execute(command)
+		if err != nil {
+			c.pool.Discard(ps)
+
+			// A shell that sat in the pool may have been closed by the
+			// guest, most likely because it restarted. Try the next one,
+			// or a new one once the pool is empty.
+			if ps.reused {
+				log.Printf("Discarding stale WinRM shell: %s", err)
+				continue
+			}
+			return nil, nil, err
+		}
+
+		return ps, cmd, nil
+	}
 }
 
-func runCommand(shell *winrm.Shell, cmd *winrm.Command, rc *packer.RemoteCmd) {
-	defer shell.Close()
+func (c *Communicator) runCommand(ps *pooledShell, cmd *remoteCommand, rc *packer.RemoteCmd) {
+	// Without any input the command sees the end of its stdin right away,
+	// as if it were redirected from NUL.
+	go func() {
+		if rc.Stdin != nil {
+			if _, err := io.Copy(cmd.Stdin, rc.Stdin); err != nil {
+				log.Printf("Error sending stdin to remote command: %s", err)
+			}
+		}
+		if err := cmd.Stdin.Close(); err != nil {
+			log.Printf("Error closing stdin of remote command: %s", err)
+		}
+	}()
 
-	go io.Copy(rc.Stdout, cmd.Stdout)
-	go io.Copy(rc.Stderr, cmd.Stderr)
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go copyOutput(&wg, c.outputWriter(rc.Stdout, false), cmd.Stdout)
+	go copyOutput(&wg, c.outputWriter(rc.Stderr, true), cmd.Stderr)
 
 	cmd.Wait()
+	wg.Wait()
+
+	c.lock.Lock()
+	delete(c.running, rc)
+	c.lock.Unlock()
+
+	// Closing the shell of a terminated command kills what is left of its
+	// process tree. The shell is released before the RemoteCmd exits so
+	// that the next command can reuse it.
+	if cmd.terminated() {
+		c.pool.Discard(ps)
+	} else {
+		c.pool.Put(ps)
+	}
+
 	rc.SetExited(cmd.ExitCode())
 }
 
-func (c *Communicator) Upload(dst string, input io.Reader, ignored *os.FileInfo) error {
-	wcp, err := c.newCopyClient()
-	if err != nil {
-		return err
+// outputWriter returns the writer a command's stdout or stderr is copied
+// to, which transcodes it to UTF-8 and, for stderr, decodes CLIXML. A nil
+// w discards the stream.
+func (c *Communicator) outputWriter(w io.Writer, stderr bool) io.WriteCloser {
+	if w == nil {
+		return nopWriteCloser{ioutil.Discard}
+	}
+
+	if stderr {
+		// PowerShell writes its error streams as CLIXML when redirected
+		clixml := newCLIXMLWriter(w)
+		return &closeChain{newCodepageWriter(clixml, c.codepage), clixml}
 	}
-	return wcp.Write(dst, input)
+
+	return newCodepageWriter(w, c.codepage)
 }
 
-func (c *Communicator) UploadDir(dst string, src string, TODO []string) error {
-	wcp, err := c.newCopyClient()
-	if err != nil {
-		return err
+// closeChain closes a writer and then the writer it writes to.
+type closeChain struct {
+	io.WriteCloser
+	next io.Closer
+}
+
+func (c *closeChain) Close() error {
+	err := c.WriteCloser.Close()
+	if nextErr := c.next.Close(); err == nil {
+		err = nextErr
 	}
-	return wcp.Copy(src, dst)
+	return err
 }
 
-func (c *Communicator) Download(string, io.Writer) error {
-	panic("Download not implemented yet")
+// copyOutput copies a command's output stream and closes the writer once
+// the stream ends.
+func copyOutput(wg *sync.WaitGroup, w io.WriteCloser, r io.Reader) {
+	defer wg.Done()
+
+	if _, err := io.Copy(w, r); err != nil {
+		log.Printf("Error copying remote command output: %s", err)
+	}
+	w.Close()
+}
+
+func (c *Communicator) Upload(dst string, input io.Reader, fi *os.FileInfo) error {
+	size := int64(-1)
+	if _, n, ok := seekableSize(input); ok {
+		size = n
+	} else if fi != nil {
+		size = (*fi).Size()
+	}
+
+	progress := c.newProgress(dst, size)
+	err := c.upload(nil, dst, input, size, progress)
+	progress.finish(err)
+	return err
+}
+
+// upload sends a single file of the given size, which is negative if
+// unknown. Large files are served over HTTP when enabled, everything else
+// is copied with wcp, or a new copy client if wcp is nil.
+func (c *Communicator) upload(wcp *winrmcp.Winrmcp, dst string, input io.Reader, size int64, progress *transferProgress) error {
+	progress.startFile()
+
+	if c.config.HTTPUpload && size >= httpUploadMinSize {
+		if rs, ok := input.(io.ReadSeeker); ok {
+			err := c.uploadHTTP(dst, rs, progress)
+			if err != errHTTPUploadUnavailable {
+				return err
+			}
+
+			log.Printf("Uploading %s through WinRM instead", dst)
+		}
+	}
+
+	if wcp == nil {
+		var err error
+		wcp, err = c.newCopyClient()
+		if err != nil {
+			return err
+		}
+	}
+
+	// Only input that can be read again can be sent again
+	r := progress.reader(input)
+	rs, canRetry := r.(io.ReadSeeker)
+	var start int64
+	if canRetry {
+		var err error
+		if start, err = rs.Seek(0, os.SEEK_CUR); err != nil {
+			canRetry = false
+		}
+	}
+	for attempt := 1; ; attempt++ {
+		err := wcp.Write(dst, r)
+		if err == nil || !canRetry || attempt >= c.client.retry.MaxAttempts || !isTransient(err) {
+			return err
+		}
+
+		backoff := c.client.retry.backoff(attempt)
+		log.Printf("Upload of %s failed (attempt %d of %d), retrying in %s: %s",
+			dst, attempt, c.client.retry.MaxAttempts, backoff, err)
+		time.Sleep(backoff)
+
+		if _, err := rs.Seek(start, os.SEEK_SET); err != nil {
+			return err
+		}
+	}
 }
 
 func (c *Communicator) newCopyClient() (*winrmcp.Winrmcp, error) {
-	addr := fmt.Sprintf("%s:%d", c.endpoint.Host, c.endpoint.Port)
-	return winrmcp.New(addr, &winrmcp.Config{
+	return winrmcp.New(c.address(), &winrmcp.Config{
 		Auth: winrmcp.Auth{
-			User:     c.user,
-			Password: c.password,
+			User:     c.config.User,
+			Password: c.config.Password,
 		},
+		Https:                 c.config.Https,
+		Insecure:              c.config.Insecure,
+		CACertBytes:           c.config.CACert,
+		TransportDecorator:    c.transportDecorator(),
 		OperationTimeout:      time.Minute * 5,
 		MaxOperationsPerShell: 15, // lowest common denominator
 	})
 }
+
+// newWSManClient returns a client for the WinRM service of config that
+// sends its requests with client. Requests are not retried.
+func newWSManClient(config *Config, client *http.Client, timeout time.Duration) *wsmanClient {
+	scheme := "http"
+	if config.Https {
+		scheme = "https"
+	}
+	address := net.JoinHostPort(config.Host, strconv.Itoa(config.Port))
+
+	return &wsmanClient{
+		url:          fmt.Sprintf("%s://%s/wsman", scheme, address),
+		user:         config.User,
+		password:     config.Password,
+		http:         client,
+		timeout:      iso8601.FormatDuration(timeout),
+		locale:       "en-US",
+		envelopeSize: defaultEnvelopeSize,
+		retry:        RetryPolicy{MaxAttempts: 1},
+	}
+}
+
+// address returns the host and port of the WinRM service.
+func (c *Communicator) address() string {
+	return net.JoinHostPort(c.config.Host, strconv.Itoa(c.config.Port))
+}
@@ -3,14 +3,29 @@ package winrm
 import (
 	"bytes"
 	"fmt"
+	"log"
+	"net"
 	"os"
+	"strconv"
+	"strings"
 	"testing"
 	"time"
 
-	"github.com/masterzen/winrm/winrm"
 	"github.com/mitchellh/packer/packer"
+	"github.com/packer-community/packer-windows-plugins/common/redact"
+	"github.com/packer-community/packer-windows-plugins/communicator/winrm/winrmtest"
 )
 
+func testConfig() *Config {
+	return &Config{
+		Host:     "localhost",
+		Port:     5985,
+		User:     "vagrant",
+		Password: "vagrant",
+		Timeout:  time.Duration(1) * time.Minute,
+	}
+}
+
 func TestCommIsCommunicator(t *testing.T) {
 	var raw interface{}
 	raw = &Communicator{}
@@ -24,7 +39,7 @@ func TestStart(t *testing.T) {
 	// You can comment this line out temporarily during development
 	t.Skip()
 
-	comm, err := New(&winrm.Endpoint{"localhost", 5985}, "vagrant", "vagrant", time.Duration(1)*time.Minute)
+	comm, err := New(testConfig())
 	if err != nil {
 		t.Fatalf("error connecting to WinRM: %s", err)
 	}
@@ -59,7 +74,7 @@ func TestUpload(t *testing.T) {
 	// You can comment this line out temporarily during development
 	t.Skip()
 
-	comm, err := New(&winrm.Endpoint{"localhost", 5985}, "vagrant", "vagrant", time.Duration(1)*time.Minute)
+	comm, err := New(testConfig())
 	if err != nil {
 		t.Fatalf("error connecting to WinRM: %s", err)
 	}
@@ -81,7 +96,7 @@ func TestUploadDir(t *testing.T) {
 	// You can comment this line out temporarily during development
 	t.Skip()
 
-	comm, err := New(&winrm.Endpoint{"localhost", 5985}, "vagrant", "vagrant", time.Duration(1)*time.Minute)
+	comm, err := New(testConfig())
 	if err != nil {
 		t.Fatalf("error connecting to WinRM: %s", err)
 	}
@@ -92,3 +107,243 @@ func TestUploadDir(t *testing.T) {
 	}
 }
 
+func TestDownload(t *testing.T) {
+	// This test hits an already running Windows VM
+	// You can comment this line out temporarily during development
+	t.Skip()
+
+	comm, err := New(testConfig())
+	if err != nil {
+		t.Fatalf("error connecting to WinRM: %s", err)
+	}
+
+	var buf bytes.Buffer
+	err = comm.Download("c:\\Windows\\win.ini", &buf)
+	if err != nil {
+		t.Fatalf("error downloading file: %s", err)
+	}
+
+	if buf.Len() == 0 {
+		t.Fatal("downloaded file should not be empty")
+	}
+}
+
+func TestDownload_Directory(t *testing.T) {
+	s := winrmtest.NewRemote()
+	defer s.Close()
+	s.WriteFile(`C:\logs\setup.log`, []byte("done"))
+
+	comm := testConnect(t, s)
+	defer comm.Close()
+
+	var buf bytes.Buffer
+	err := comm.Download(`C:\logs`, &buf)
+	if _, ok := err.(*DirectoryError); !ok {
+		t.Fatalf("should be a directory error: %#v", err)
+	}
+}
+
+func TestStart_Redact(t *testing.T) {
+	s := winrmtest.NewRemote()
+	defer s.Close()
+	s.CommandFunc(winrmtest.MatchPattern(`^net use `), func(*winrmtest.Cmd) int {
+		return 0
+	})
+
+	var logs bytes.Buffer
+	redact.SetLogOutput(&logs)
+	defer log.SetOutput(os.Stderr)
+
+	config := testRemoteConfig(s)
+	config.Password = "winrm-s3cret"
+	comm, err := New(config)
+	if err != nil {
+		t.Fatalf("error connecting to WinRM: %s", err)
+	}
+	defer comm.Close()
+
+	cmd := &packer.RemoteCmd{Command: "net use Z: \\\\host\\share winrm-s3cret"}
+	if err := comm.Start(cmd); err != nil {
+		t.Fatalf("error starting cmd: %s", err)
+	}
+	cmd.Wait()
+
+	if strings.Contains(logs.String(), "winrm-s3cret") {
+		t.Fatalf("password should be masked: %s", logs.String())
+	}
+	if !strings.Contains(logs.String(), "starting remote command: net use Z: \\\\host\\share [REDACTED]") {
+		t.Fatalf("command should be logged: %s", logs.String())
+	}
+}
+
+func TestStart_Stdin(t *testing.T) {
+	s := newTestShellServer()
+	defer s.Close()
+
+	comm := testConnect(t, s)
+
+	var stdout bytes.Buffer
+	cmd := &packer.RemoteCmd{
+		Command: "cat",
+		Stdin:   strings.NewReader("hello from stdin"),
+		Stdout:  &stdout,
+	}
+
+	if err := comm.Start(cmd); err != nil {
+		t.Fatalf("error starting cmd: %s", err)
+	}
+	cmd.Wait()
+
+	if stdout.String() != "hello from stdin" {
+		t.Fatalf("bad output: %q", stdout.String())
+	}
+
+	// Without stdin the command still sees the end of its input
+	sends := s.Requests("Send")
+	cmd = &packer.RemoteCmd{Command: "cat"}
+	if err := comm.Start(cmd); err != nil {
+		t.Fatalf("error starting cmd: %s", err)
+	}
+	cmd.Wait()
+
+	if n := s.Requests("Send") - sends; n != 1 {
+		t.Fatalf("bad number of Send requests: %d", n)
+	}
+}
+
+func TestTerminate(t *testing.T) {
+	s := newTestShellServer()
+	defer s.Close()
+
+	comm := testConnect(t, s)
+
+	cmd := &packer.RemoteCmd{Command: "hang"}
+	if err := comm.Start(cmd); err != nil {
+		t.Fatalf("error starting cmd: %s", err)
+	}
+
+	if err := comm.Terminate(cmd); err != nil {
+		t.Fatalf("error terminating cmd: %s", err)
+	}
+
+	exited := make(chan struct{})
+	go func() {
+		cmd.Wait()
+		close(exited)
+	}()
+
+	select {
+	case <-exited:
+	case <-time.After(5 * time.Second):
+		t.Fatal("command should exit once terminated")
+	}
+
+	if cmd.ExitStatus != winrmtest.ExitCodeTerminated {
+		t.Fatalf("bad exit status: %d", cmd.ExitStatus)
+	}
+
+	// The shell of a terminated command is not reused
+	if deleted := s.Requests("Delete"); deleted != 1 {
+		t.Fatalf("shell should be closed, %d deleted", deleted)
+	}
+
+	// Terminating a command that has exited does nothing
+	if err := comm.Terminate(cmd); err != nil {
+		t.Fatalf("error terminating exited cmd: %s", err)
+	}
+}
+
+func TestClose(t *testing.T) {
+	s := newTestShellServer()
+	defer s.Close()
+
+	comm := testConnect(t, s)
+
+	cmd := &packer.RemoteCmd{Command: "hang"}
+	if err := comm.Start(cmd); err != nil {
+		t.Fatalf("error starting cmd: %s", err)
+	}
+
+	if err := comm.Close(); err != nil {
+		t.Fatalf("error closing communicator: %s", err)
+	}
+	cmd.Wait()
+
+	if cmd.ExitStatus != winrmtest.ExitCodeTerminated {
+		t.Fatalf("bad exit status: %d", cmd.ExitStatus)
+	}
+
+	if err := comm.Start(&packer.RemoteCmd{Command: "cat"}); err == nil {
+		t.Fatal("should not start commands once closed")
+	}
+}
+
+func TestNew_ConnectTimeout(t *testing.T) {
+	// A listener that accepts connections but never answers
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	defer l.Close()
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+		}
+	}()
+
+	config := testConfig()
+	host, port, _ := net.SplitHostPort(l.Addr().String())
+	config.Host = host
+	config.Port, _ = strconv.Atoi(port)
+	config.ConnectTimeout = 200 * time.Millisecond
+
+	start := time.Now()
+	_, err = New(config)
+	if err == nil {
+		t.Fatal("should not connect")
+	}
+	if d := time.Since(start); d > 5*time.Second {
+		t.Fatalf("took %s to give up, should be a single attempt", d)
+	}
+	if class := ClassifyError(err); class != "timed out" {
+		t.Fatalf("bad class of %q: %s", err, class)
+	}
+}
+
+func TestNew_ConnectTimeoutShell(t *testing.T) {
+	r := winrmtest.NewRemote()
+	defer r.Close()
+	r.Command(winrmtest.MatchText("hostname"), "WIN-PACKER\r\n", 0)
+
+	config := testRemoteConfig(r)
+	config.ConnectTimeout = 5 * time.Second
+	comm, err := New(config)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	defer comm.Close()
+
+	// The first shell outlives the bound on connecting
+	ps, err := comm.pool.Get()
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if ps.shell.(*shell).client != comm.client {
+		t.Fatal("the first shell should use the client of the communicator")
+	}
+	comm.pool.Put(ps)
+
+	var stdout bytes.Buffer
+	cmd := &packer.RemoteCmd{Command: "hostname", Stdout: &stdout}
+	if err := comm.Start(cmd); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	cmd.Wait()
+	if stdout.String() != "WIN-PACKER\r\n" {
+		t.Fatalf("bad output: %q", stdout.String())
+	}
+}
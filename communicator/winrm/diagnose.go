@@ -0,0 +1,462 @@
+package winrm
+
+import (
+	"bytes"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// diagnoseTimeout bounds each of the probes made by Diagnose.
+const diagnoseTimeout = 15 * time.Second
+
+// Layers of a WinRM connection checked by Diagnose, from the bottom up.
+const (
+	LayerTCP    = "TCP"
+	LayerTLS    = "TLS"
+	LayerHTTP   = "HTTP"
+	LayerAuth   = "Authentication"
+	LayerConfig = "Configuration"
+	LayerShell  = "Shell"
+)
+
+// Commands that fix the WinRM service settings Diagnose checks, to run in
+// an elevated command prompt on the guest.
+const (
+	fixAllowUnencrypted = `winrm set winrm/config/service @{AllowUnencrypted="true"}`
+	fixBasic            = `winrm set winrm/config/service/auth @{Basic="true"}`
+	fixNegotiate        = `winrm set winrm/config/service/auth @{Negotiate="true"}`
+	fixMaxEnvelopeSize  = `winrm set winrm/config @{MaxEnvelopeSizekb="500"}`
+	fixMaxShells        = `winrm set winrm/config/winrs @{MaxShellsPerUser="%d"}`
+)
+
+// errNoBasic is returned when Basic authentication was requested but the
+// service doesn't offer it.
+var errNoBasic = errors.New("WinRM service does not offer Basic authentication")
+
+// DiagnosticCheck is the result of probing one layer of a WinRM
+// connection.
+type DiagnosticCheck struct {
+	Layer string
+
+	// Detail describes what was found
+	Detail string
+
+	// Err is the error the layer failed with
+	Err error
+
+	// Warning is set if the problem found doesn't prevent connecting,
+	// but is likely to make a build fail later
+	Warning bool
+}
+
+// Diagnosis is the result of Diagnose.
+type Diagnosis struct {
+	// Address is the host and port of the WinRM service
+	Address string
+
+	// Checks holds the layers probed, up to the first that failed
+	Checks []DiagnosticCheck
+
+	// Remediation holds the commands that fix the problems found, to run
+	// in an elevated command prompt on the guest
+	Remediation []string
+}
+
+// Failed returns the check of the layer that failed, or nil if a shell
+// could be opened.
+func (d *Diagnosis) Failed() *DiagnosticCheck {
+	for i := range d.Checks {
+		if c := &d.Checks[i]; c.Err != nil && !c.Warning {
+			return c
+		}
+	}
+	return nil
+}
+
+// String formats the diagnosis as a report for the user.
+func (d *Diagnosis) String() string {
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "WinRM diagnosis of %s:\n", d.Address)
+	for _, c := range d.Checks {
+		status := "ok"
+		if c.Err != nil {
+			status = "FAIL"
+			if c.Warning {
+				status = "warn"
+			}
+		}
+
+		message := c.Detail
+		if c.Err != nil {
+			if message != "" {
+				message += ": "
+			}
+			message += c.Err.Error()
+		}
+		fmt.Fprintf(&b, "  %-4s  %s: %s\n", status, c.Layer, message)
+	}
+
+	if len(d.Remediation) > 0 {
+		b.WriteString("Run these commands in an elevated command prompt on the guest to fix it:\n")
+		for _, command := range d.Remediation {
+			fmt.Fprintf(&b, "  %s\n", command)
+		}
+	}
+
+	return b.String()
+}
+
+// Diagnose probes the WinRM service of config one layer at a time: the TCP
+// connection, the TLS handshake for HTTPS, the HTTP listener,
+// authentication, the service configuration and opening a shell. It stops
+// at the first layer that fails, and suggests the commands that fix the
+// usual causes, such as a missing listener or Basic authentication being
+// disabled.
+func Diagnose(config *Config) *Diagnosis {
+	dg := &diagnoser{
+		config:  config,
+		address: net.JoinHostPort(config.Host, strconv.Itoa(config.Port)),
+	}
+	dg.diagnosis.Address = dg.address
+	if config.Trace != nil {
+		dg.tracer = newTracer(config.Trace, config.Password)
+	}
+
+	steps := []func() bool{dg.tcp}
+	if config.Https {
+		steps = append(steps, dg.tls)
+	}
+	steps = append(steps, dg.http, dg.auth, dg.shell)
+	for _, step := range steps {
+		if !step() {
+			break
+		}
+	}
+
+	return &dg.diagnosis
+}
+
+// diagnoser holds what Diagnose has found out so far.
+type diagnoser struct {
+	config    *Config
+	address   string
+	tlsConfig *tls.Config
+	tracer    *tracer
+	diagnosis Diagnosis
+
+	// schemes are the authentication schemes the service offered, or nil
+	// if it didn't ask for authentication
+	schemes []string
+}
+
+func (dg *diagnoser) tcp() bool {
+	conn, err := net.DialTimeout("tcp", dg.address, diagnoseTimeout)
+	if err != nil {
+		detail := fmt.Sprintf("unable to connect to port %d", dg.config.Port)
+		if ne, ok := err.(net.Error); ok && ne.Timeout() {
+			detail = fmt.Sprintf("no answer on port %d, a firewall is probably dropping the connection", dg.config.Port)
+		} else if strings.Contains(err.Error(), "refused") {
+			detail = fmt.Sprintf("nothing is listening on port %d, the WinRM service may be stopped or have no %s listener",
+				dg.config.Port, dg.transport())
+		}
+		return dg.fail(LayerTCP, detail, err, dg.listenerFixes()...)
+	}
+	conn.Close()
+
+	return dg.pass(LayerTCP, "connected to port %d", dg.config.Port)
+}
+
+func (dg *diagnoser) tls() bool {
+	tlsConfig, err := newTLSConfig(dg.config)
+	if err != nil {
+		return dg.fail(LayerTLS, "the TLS settings are not valid", err)
+	}
+
+	dialer := &net.Dialer{Timeout: diagnoseTimeout}
+	conn, err := tls.DialWithDialer(dialer, "tcp", dg.address, tlsConfig)
+	if err != nil {
+		if msg := err.Error(); strings.Contains(msg, "x509:") || strings.Contains(msg, "certificate thumbprint") {
+			return dg.fail(LayerTLS, "the server certificate was rejected, trust its CA certificate, pin its thumbprint or skip validation", err)
+		}
+		return dg.fail(LayerTLS, "the TLS handshake failed, the port may not have an HTTPS listener", err, dg.listenerFixes()...)
+	}
+	conn.Close()
+	dg.tlsConfig = tlsConfig
+
+	return dg.pass(LayerTLS, "handshake succeeded")
+}
+
+// http sends a request without credentials, which a WinRM listener answers
+// with the authentication schemes it offers.
+func (dg *diagnoser) http() bool {
+	client := newWSManClient(dg.config, dg.httpClient(false), diagnoseTimeout)
+	req, err := http.NewRequest("POST", client.url, strings.NewReader(client.envelope(configRequest())))
+	if err != nil {
+		return dg.fail(LayerHTTP, "", err)
+	}
+	req.Header.Set("Content-Type", "application/soap+xml;charset=UTF-8")
+
+	resp, err := client.http.Do(req)
+	if err != nil {
+		return dg.fail(LayerHTTP, "the request failed", err, dg.listenerFixes()...)
+	}
+	io.Copy(ioutil.Discard, resp.Body)
+	resp.Body.Close()
+
+	switch {
+	case resp.StatusCode == http.StatusUnauthorized:
+		dg.schemes = authSchemes(resp.Header["Www-Authenticate"])
+		return dg.pass(LayerHTTP, "WinRM listener found, offering %s authentication", strings.Join(dg.schemes, ", "))
+	case strings.Contains(resp.Header.Get("Content-Type"), "application/soap+xml"):
+		return dg.pass(LayerHTTP, "WinRM listener found")
+	case resp.StatusCode == http.StatusNotFound:
+		return dg.fail(LayerHTTP, "no WinRM listener at /wsman", &httpStatusError{StatusCode: resp.StatusCode}, dg.listenerFixes()...)
+	}
+
+	return dg.fail(LayerHTTP, "unexpected response, this may not be a WinRM service",
+		&httpStatusError{StatusCode: resp.StatusCode}, dg.listenerFixes()...)
+}
+
+// auth reads the service configuration with the credentials, and checks
+// it allows the communicator to work.
+func (dg *diagnoser) auth() bool {
+	if err := ValidateAuth(dg.config.Auth); err != nil {
+		return dg.fail(LayerAuth, "", err)
+	}
+
+	ntlm := strings.ToLower(dg.config.Auth) == AuthNTLM
+	if dg.schemes != nil {
+		if ntlm && !dg.offered("Negotiate") && !dg.offered("NTLM") {
+			return dg.fail(LayerAuth, "", errNoNTLM, fixNegotiate)
+		}
+		if !ntlm && !dg.offered("Basic") {
+			// Basic authentication is only offered on HTTP if unencrypted
+			// traffic is allowed
+			fixes := []string{fixBasic}
+			if !dg.config.Https {
+				fixes = append(fixes, fixAllowUnencrypted)
+			}
+			return dg.fail(LayerAuth, "", errNoBasic, fixes...)
+		}
+	}
+
+	client := newWSManClient(dg.config, dg.httpClient(true), diagnoseTimeout)
+	resp, err := client.post(configRequest())
+	if err != nil {
+		if e, ok := err.(*httpStatusError); ok && e.StatusCode == http.StatusUnauthorized {
+			if dg.config.Https {
+				return dg.fail(LayerAuth, "the user name or password was rejected", err)
+			}
+			// The communicator doesn't encrypt messages itself, so even
+			// NTLM needs unencrypted traffic to be allowed on HTTP
+			return dg.fail(LayerAuth, "the user name or password was rejected, or the service doesn't allow unencrypted traffic",
+				err, fixAllowUnencrypted)
+		}
+
+		f, ok := err.(*wsmanFault)
+		if !ok {
+			return dg.fail(LayerAuth, "the request failed", err)
+		}
+
+		dg.pass(LayerAuth, "logged in as %s", dg.config.User)
+		if isEncodingLimit(f) {
+			return dg.fail(LayerConfig, "the service's maximum envelope size is too small", err, fixMaxEnvelopeSize)
+		}
+		dg.warn(LayerConfig, "unable to read the service configuration, the user may not be an administrator", err)
+		return true
+	}
+	dg.pass(LayerAuth, "logged in as %s", dg.config.User)
+
+	config := resp.Body.Config
+	if config == nil {
+		dg.warn(LayerConfig, "", errors.New("the service did not return its configuration"))
+		return true
+	}
+
+	if config.MaxEnvelopeSizekb*1024 < defaultEnvelopeSize {
+		return dg.fail(LayerConfig, "", fmt.Errorf("MaxEnvelopeSizekb is %d, the communicator needs at least %d",
+			config.MaxEnvelopeSizekb, defaultEnvelopeSize/1024), fixMaxEnvelopeSize)
+	}
+
+	shells := dg.shells()
+	if config.MaxShellsPerUser > 0 && config.MaxShellsPerUser < shells {
+		dg.warn(LayerConfig, "", fmt.Errorf("MaxShellsPerUser is %d, the communicator can use %d",
+			config.MaxShellsPerUser, shells), dg.maxShellsFix(shells))
+		return true
+	}
+
+	return dg.pass(LayerConfig, "MaxEnvelopeSizekb is %d, MaxShellsPerUser is %d",
+		config.MaxEnvelopeSizekb, config.MaxShellsPerUser)
+}
+
+func (dg *diagnoser) shell() bool {
+	codepage := dg.config.Codepage
+	if codepage == 0 {
+		codepage = CodepageUTF8
+	}
+
+	client := newWSManClient(dg.config, dg.httpClient(true), diagnoseTimeout)
+	s, err := client.createShell(codepage)
+	if err != nil {
+		f, _ := err.(*wsmanFault)
+		switch {
+		case f != nil && f.Code == wsmanFaultMaxShells:
+			return dg.fail(LayerShell, "the user has as many shells open as the service allows", err,
+				dg.maxShellsFix(dg.shells()))
+		case f != nil && isEncodingLimit(f):
+			return dg.fail(LayerShell, "the service's maximum envelope size is too small", err, fixMaxEnvelopeSize)
+		case f != nil && strings.HasSuffix(f.Subcode, ":AccessDenied"):
+			return dg.fail(LayerShell, "the user is not allowed to open shells", err,
+				fmt.Sprintf(`net localgroup Administrators "%s" /add`, dg.config.User))
+		}
+		return dg.fail(LayerShell, "unable to open a shell", err)
+	}
+
+	if err := s.Close(); err != nil {
+		log.Printf("Error closing WinRM shell: %s", err)
+	}
+	return dg.pass(LayerShell, "opened a shell")
+}
+
+func (dg *diagnoser) pass(layer string, format string, args ...interface{}) bool {
+	dg.diagnosis.Checks = append(dg.diagnosis.Checks, DiagnosticCheck{
+		Layer:  layer,
+		Detail: fmt.Sprintf(format, args...),
+	})
+	return true
+}
+
+func (dg *diagnoser) fail(layer string, detail string, err error, fixes ...string) bool {
+	dg.diagnosis.Checks = append(dg.diagnosis.Checks, DiagnosticCheck{
+		Layer:  layer,
+		Detail: detail,
+		Err:    err,
+	})
+	dg.remediate(fixes)
+	return false
+}
+
+func (dg *diagnoser) warn(layer string, detail string, err error, fixes ...string) {
+	dg.diagnosis.Checks = append(dg.diagnosis.Checks, DiagnosticCheck{
+		Layer:   layer,
+		Detail:  detail,
+		Err:     err,
+		Warning: true,
+	})
+	dg.remediate(fixes)
+}
+
+func (dg *diagnoser) remediate(fixes []string) {
+Fixes:
+	for _, fix := range fixes {
+		for _, existing := range dg.diagnosis.Remediation {
+			if existing == fix {
+				continue Fixes
+			}
+		}
+		dg.diagnosis.Remediation = append(dg.diagnosis.Remediation, fix)
+	}
+}
+
+// httpClient returns a client for the probes, which sends credentials if
+// authenticate is set.
+func (dg *diagnoser) httpClient(authenticate bool) *http.Client {
+	transport := &http.Transport{
+		Proxy:           http.ProxyFromEnvironment,
+		TLSClientConfig: dg.tlsConfig,
+	}
+	var rt http.RoundTripper = transport
+	if authenticate {
+		rt = newAuthTransport(dg.config.Auth, transport)
+	}
+	if dg.tracer != nil {
+		rt = dg.tracer.transport(rt)
+	}
+
+	return &http.Client{Transport: rt, Timeout: diagnoseTimeout}
+}
+
+func (dg *diagnoser) offered(scheme string) bool {
+	for _, s := range dg.schemes {
+		if strings.EqualFold(s, scheme) {
+			return true
+		}
+	}
+	return false
+}
+
+func (dg *diagnoser) transport() string {
+	if dg.config.Https {
+		return "HTTPS"
+	}
+	return "HTTP"
+}
+
+// listenerFixes returns the commands that create a listener for the
+// configured transport and open the firewall for it.
+func (dg *diagnoser) listenerFixes() []string {
+	quickconfig := "winrm quickconfig -q"
+	if dg.config.Https {
+		// Needs a certificate for the host name in the machine store
+		quickconfig = "winrm quickconfig -transport:https -q"
+	}
+
+	return []string{
+		quickconfig,
+		fmt.Sprintf(`netsh advfirewall firewall add rule name="WinRM %s" dir=in action=allow protocol=TCP localport=%d`,
+			dg.transport(), dg.config.Port),
+	}
+}
+
+// shells returns the number of shells the communicator can open, those of
+// its pool and one for file transfers.
+func (dg *diagnoser) shells() int {
+	shells := dg.config.MaxShells
+	if shells <= 0 {
+		shells = DefaultMaxShells
+	}
+	return shells + 1
+}
+
+func (dg *diagnoser) maxShellsFix(shells int) string {
+	if shells < 30 {
+		shells = 30
+	}
+	return fmt.Sprintf(fixMaxShells, shells)
+}
+
+// configRequest returns a request that reads the service configuration.
+func configRequest() *wsmanRequest {
+	return &wsmanRequest{action: actionGet, resource: resourceConfig}
+}
+
+// isEncodingLimit reports whether a fault says a request or its response
+// is larger than the service's MaxEnvelopeSizekb.
+func isEncodingLimit(f *wsmanFault) bool {
+	return strings.HasSuffix(f.Subcode, ":EncodingLimit")
+}
+
+// authSchemes returns the schemes of WWW-Authenticate headers.
+func authSchemes(headers []string) []string {
+	var schemes []string
+	for _, h := range headers {
+		for _, challenge := range strings.Split(h, ",") {
+			fields := strings.Fields(challenge)
+			if len(fields) == 0 || strings.Contains(fields[0], "=") {
+				// A parameter of the previous challenge
+				continue
+			}
+			schemes = append(schemes, fields[0])
+		}
+	}
+	return schemes
+}
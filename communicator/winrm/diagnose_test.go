@@ -0,0 +1,135 @@
+package winrm
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+
+	"github.com/packer-community/packer-windows-plugins/communicator/winrm/winrmtest"
+)
+
+func TestDiagnose(t *testing.T) {
+	s := winrmtest.NewRemote()
+	defer s.Close()
+	s.RequireBasicAuth("vagrant", "vagrant")
+
+	d := Diagnose(testRemoteConfig(s))
+	if f := d.Failed(); f != nil {
+		t.Fatalf("should not fail: %s", d)
+	}
+
+	var layers []string
+	for _, c := range d.Checks {
+		if c.Err != nil {
+			t.Fatalf("bad check: %#v", c)
+		}
+		layers = append(layers, c.Layer)
+	}
+	expected := []string{LayerTCP, LayerHTTP, LayerAuth, LayerConfig, LayerShell}
+	if fmt.Sprint(layers) != fmt.Sprint(expected) {
+		t.Fatalf("bad layers: %v", layers)
+	}
+
+	if len(d.Remediation) != 0 {
+		t.Fatalf("bad remediation: %v", d.Remediation)
+	}
+	if s.Shells() != 0 {
+		t.Fatalf("shell should be closed, %d open", s.Shells())
+	}
+}
+
+func TestDiagnose_TCP(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	host, port, _ := net.SplitHostPort(l.Addr().String())
+	l.Close()
+
+	config := testConfig()
+	config.Host = host
+	config.Port, _ = strconv.Atoi(port)
+
+	d := Diagnose(config)
+	if f := d.Failed(); f == nil || f.Layer != LayerTCP {
+		t.Fatalf("should fail to connect: %s", d)
+	}
+	if len(d.Remediation) != 2 || d.Remediation[0] != "winrm quickconfig -q" {
+		t.Fatalf("bad remediation: %v", d.Remediation)
+	}
+}
+
+func TestDiagnose_HTTP(t *testing.T) {
+	s := httptest.NewServer(http.NotFoundHandler())
+	defer s.Close()
+
+	config := testConfig()
+	host, port, _ := net.SplitHostPort(s.Listener.Addr().String())
+	config.Host = host
+	config.Port, _ = strconv.Atoi(port)
+
+	d := Diagnose(config)
+	if f := d.Failed(); f == nil || f.Layer != LayerHTTP {
+		t.Fatalf("should find no listener: %s", d)
+	}
+}
+
+func TestDiagnose_Auth(t *testing.T) {
+	s := winrmtest.NewRemote()
+	defer s.Close()
+	s.RequireBasicAuth("vagrant", "secret")
+
+	d := Diagnose(testRemoteConfig(s))
+	if f := d.Failed(); f == nil || f.Layer != LayerAuth {
+		t.Fatalf("should fail to authenticate: %s", d)
+	}
+	if fmt.Sprint(d.Remediation) != fmt.Sprint([]string{fixAllowUnencrypted}) {
+		t.Fatalf("bad remediation: %v", d.Remediation)
+	}
+}
+
+func TestDiagnose_MaxEnvelopeSize(t *testing.T) {
+	s := winrmtest.NewRemote()
+	defer s.Close()
+	s.SetConfig(100, 30)
+
+	d := Diagnose(testRemoteConfig(s))
+	if f := d.Failed(); f == nil || f.Layer != LayerConfig {
+		t.Fatalf("should fail on the envelope size: %s", d)
+	}
+	if fmt.Sprint(d.Remediation) != fmt.Sprint([]string{fixMaxEnvelopeSize}) {
+		t.Fatalf("bad remediation: %v", d.Remediation)
+	}
+}
+
+func TestDiagnose_MaxShells(t *testing.T) {
+	s := winrmtest.NewRemote()
+	defer s.Close()
+	s.SetConfig(500, 2)
+
+	d := Diagnose(testRemoteConfig(s))
+	if f := d.Failed(); f != nil {
+		t.Fatalf("should only warn: %s", d)
+	}
+
+	expected := `winrm set winrm/config/winrs @{MaxShellsPerUser="30"}`
+	if fmt.Sprint(d.Remediation) != fmt.Sprint([]string{expected}) {
+		t.Fatalf("bad remediation: %v", d.Remediation)
+	}
+}
+
+func TestAuthSchemes(t *testing.T) {
+	schemes := authSchemes([]string{
+		"Negotiate",
+		`Basic realm="WSMAN", charset="UTF-8"`,
+		"Kerberos, NTLM",
+	})
+
+	expected := []string{"Negotiate", "Basic", "Kerberos", "NTLM"}
+	if fmt.Sprint(schemes) != fmt.Sprint(expected) {
+		t.Fatalf("bad schemes: %v", schemes)
+	}
+}
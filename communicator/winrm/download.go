@@ -0,0 +1,345 @@
+package winrm
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/packer-community/packer-windows-plugins/common/powershell"
+)
+
+// downloadChunkSize is the number of bytes the guest reads and encodes per
+// line of output. It is a multiple of three so that every line is a
+// self-contained base64 block without padding.
+const downloadChunkSize = 3 * 16 * 1024
+
+// Exit codes used by the download scripts to report why a remote path
+// could not be read.
+const (
+	downloadExitNotFound    = 2
+	downloadExitAccess      = 3
+	downloadExitLocked      = 4
+	downloadExitIsDirectory = 5
+)
+
+// downloadFileScript streams a remote file to stdout as base64 lines and
+// finishes with the file length and SHA-256, computed in the same pass so
+// the checksum covers exactly the bytes that were sent.
+const downloadFileScript = `$ProgressPreference='SilentlyContinue'
+$p='%s'
+if (Test-Path -LiteralPath $p -PathType Container) { [Console]::Error.WriteLine("$p is a directory"); exit %d }
+try { $fs=[IO.File]::Open($p,'Open','Read','ReadWrite') }
+catch [IO.FileNotFoundException],[IO.DirectoryNotFoundException] { [Console]::Error.WriteLine($_.Exception.GetBaseException().Message); exit %d }
+catch [UnauthorizedAccessException] { [Console]::Error.WriteLine($_.Exception.GetBaseException().Message); exit %d }
+catch { [Console]::Error.WriteLine($_.Exception.GetBaseException().Message); exit %d }
+$h=[Security.Cryptography.SHA256]::Create()
+$b=New-Object byte[] %d
+$t=0
+try {
+while (($n=$fs.Read($b,0,$b.Length)) -gt 0) {
+$h.TransformBlock($b,0,$n,$null,0) | Out-Null
+[Console]::Out.WriteLine([Convert]::ToBase64String($b,0,$n))
+$t+=$n
+}
+$h.TransformFinalBlock($b,0,0) | Out-Null
+} finally { $fs.Close() }
+[Console]::Out.WriteLine("#length $t")
+[Console]::Out.WriteLine("#sha256 "+[BitConverter]::ToString($h.Hash).Replace('-',''))
+`
+
+// listDirScript prints one line per entry below a remote directory, with a
+// "d" or "f" marker followed by the path relative to the directory.
+const listDirScript = `$ProgressPreference='SilentlyContinue'
+$p='%s'
+if (!(Test-Path -LiteralPath $p)) { [Console]::Error.WriteLine("$p does not exist"); exit %d }
+if (!(Test-Path -LiteralPath $p -PathType Container)) { [Console]::Error.WriteLine("$p is not a directory"); exit %d }
+$r=(Resolve-Path -LiteralPath $p).ProviderPath.TrimEnd('\')
+Get-ChildItem -LiteralPath $r -Recurse -Force | ForEach-Object {
+$k='f'; if ($_.PSIsContainer) { $k='d' }
+[Console]::Out.WriteLine($k+' '+$_.FullName.Substring($r.Length+1))
+}
+`
+
+// DirectoryError is returned by Download when the remote path is a
+// directory, which DownloadDir copies instead.
+type DirectoryError struct {
+	Path string
+}
+
+func (e *DirectoryError) Error() string {
+	return fmt.Sprintf("Remote path %s is a directory, not a file", e.Path)
+}
+
+// Download copies a single file from the guest into output. The transfer
+// is verified against a SHA-256 computed on the guest.
+func (c *Communicator) Download(path string, output io.Writer) error {
+	log.Printf("Downloading file from remote: %s", path)
+
+	return c.downloadFile(path, output)
+}
+
+// DownloadDir recursively copies the remote directory src into the local
+// directory dst. Entries whose relative path matches one of the exclude
+// glob patterns are skipped.
+func (c *Communicator) DownloadDir(src string, dst string, exclude []string) error {
+	log.Printf("Downloading dir from remote: %s -> %s", src, dst)
+
+	stdout, stderr, code, err := c.runPowershell(fmt.Sprintf(listDirScript,
+		psQuote(src), downloadExitNotFound, downloadExitIsDirectory))
+	if err != nil {
+		return err
+	}
+	if code != 0 {
+		return downloadError(src, code, stderr)
+	}
+
+	entries, err := parseDirListing(stdout)
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(dst, 0755); err != nil {
+		return err
+	}
+
+	for _, entry := range entries {
+		if excluded(entry.path, exclude) {
+			log.Printf("Skipping excluded path: %s", entry.path)
+			continue
+		}
+
+		localPath := filepath.Join(dst, filepath.FromSlash(entry.path))
+		if entry.dir {
+			if err := os.MkdirAll(localPath, 0755); err != nil {
+				return err
+			}
+			continue
+		}
+
+		if err := os.MkdirAll(filepath.Dir(localPath), 0755); err != nil {
+			return err
+		}
+
+		f, err := os.Create(localPath)
+		if err != nil {
+			return err
+		}
+
+		err = c.downloadFile(winJoin(src, entry.path), f)
+		f.Close()
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (c *Communicator) downloadFile(path string, output io.Writer) error {
+	script := fmt.Sprintf(downloadFileScript, psQuote(path),
+		downloadExitIsDirectory, downloadExitNotFound, downloadExitAccess,
+		downloadExitLocked, downloadChunkSize)
+
+	ps, cmd, err := c.execute(powershell.EncodedCommand(script))
+	if err != nil {
+		return err
+	}
+	defer c.pool.Put(ps)
+	cmd.Stdin.Close()
+
+	var stderr bytes.Buffer
+	stderrDone := make(chan struct{})
+	go func() {
+		io.Copy(&stderr, cmd.Stderr)
+		close(stderrDone)
+	}()
+
+	hash := sha256.New()
+	result, decodeErr := decodeDownload(cmd.Stdout, io.MultiWriter(output, hash))
+	if decodeErr != nil {
+		// Drain what is left so the command can finish.
+		io.Copy(ioutil.Discard, cmd.Stdout)
+	}
+
+	cmd.Wait()
+	<-stderrDone
+	if code := cmd.ExitCode(); code == downloadExitIsDirectory {
+		return &DirectoryError{Path: path}
+	} else if code != 0 {
+		return downloadError(path, code, stderr.String())
+	}
+	if decodeErr != nil {
+		return fmt.Errorf("Error downloading %s: %s", path, decodeErr)
+	}
+
+	if result.length != result.written {
+		return fmt.Errorf("Error downloading %s: received %d bytes, expected %d",
+			path, result.written, result.length)
+	}
+
+	sum := hex.EncodeToString(hash.Sum(nil))
+	if !strings.EqualFold(sum, result.checksum) {
+		return fmt.Errorf("Error downloading %s: checksum mismatch (remote %s, local %s)",
+			path, strings.ToLower(result.checksum), sum)
+	}
+
+	log.Printf("Downloaded %d bytes from %s (sha256 %s)", result.written, path, sum)
+	return nil
+}
+
+type downloadResult struct {
+	written  int64
+	length   int64
+	checksum string
+}
+
+// decodeDownload reassembles the output of downloadFileScript, writing the
+// decoded content to w.
+func decodeDownload(r io.Reader, w io.Writer) (*downloadResult, error) {
+	result := &downloadResult{length: -1}
+
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 0, 64*1024), 4*downloadChunkSize)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+
+		if strings.HasPrefix(line, "#") {
+			fields := strings.Fields(line[1:])
+			if len(fields) != 2 {
+				return nil, fmt.Errorf("unexpected trailer: %q", line)
+			}
+
+			switch fields[0] {
+			case "length":
+				n, err := strconv.ParseInt(fields[1], 10, 64)
+				if err != nil {
+					return nil, fmt.Errorf("bad length trailer: %s", err)
+				}
+				result.length = n
+			case "sha256":
+				result.checksum = fields[1]
+			default:
+				return nil, fmt.Errorf("unexpected trailer: %q", line)
+			}
+			continue
+		}
+
+		data, err := base64.StdEncoding.DecodeString(line)
+		if err != nil {
+			return nil, fmt.Errorf("bad chunk after %d bytes: %s", result.written, err)
+		}
+
+		n, err := w.Write(data)
+		result.written += int64(n)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	if result.length < 0 || result.checksum == "" {
+		return nil, fmt.Errorf("transfer ended after %d bytes without a checksum", result.written)
+	}
+
+	return result, nil
+}
+
+type dirEntry struct {
+	path string
+	dir  bool
+}
+
+// parseDirListing parses the output of listDirScript into entries with
+// slash separated relative paths.
+func parseDirListing(output string) ([]dirEntry, error) {
+	var entries []dirEntry
+	for _, line := range strings.Split(output, "\n") {
+		line = strings.TrimRight(line, "\r")
+		if line == "" {
+			continue
+		}
+
+		if len(line) < 3 || line[1] != ' ' || (line[0] != 'd' && line[0] != 'f') {
+			return nil, fmt.Errorf("unexpected directory listing line: %q", line)
+		}
+
+		entries = append(entries, dirEntry{
+			path: strings.Replace(line[2:], `\`, "/", -1),
+			dir:  line[0] == 'd',
+		})
+	}
+
+	return entries, nil
+}
+
+// excluded reports whether the slash separated path, or any of its parent
+// directories, matches one of the glob patterns.
+func excluded(path string, patterns []string) bool {
+	for _, pattern := range patterns {
+		pattern = filepath.ToSlash(pattern)
+		for p := path; p != "." && p != "/" && p != ""; p = filepath.ToSlash(filepath.Dir(p)) {
+			if ok, _ := filepath.Match(pattern, p); ok {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+func downloadError(path string, code int, stderr string) error {
+	detail := strings.TrimSpace(stderr)
+	switch code {
+	case downloadExitNotFound:
+		return fmt.Errorf("Remote path %s does not exist: %s", path, detail)
+	case downloadExitAccess:
+		return fmt.Errorf("Access to remote path %s was denied: %s", path, detail)
+	case downloadExitLocked:
+		return fmt.Errorf("Remote file %s could not be opened, it may be locked: %s", path, detail)
+	case downloadExitIsDirectory:
+		return fmt.Errorf("Remote path %s is not a directory", path)
+	}
+
+	return fmt.Errorf("Error downloading %s, exit code %d: %s", path, code, detail)
+}
+
+// runPowershell runs a script on the guest and collects its output.
+func (c *Communicator) runPowershell(script string) (string, string, int, error) {
+	ps, cmd, err := c.execute(powershell.EncodedCommand(script))
+	if err != nil {
+		return "", "", 0, err
+	}
+	defer c.pool.Put(ps)
+	cmd.Stdin.Close()
+
+	var stdout, stderr bytes.Buffer
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go copyOutput(&wg, c.outputWriter(&stdout, false), cmd.Stdout)
+	go copyOutput(&wg, c.outputWriter(&stderr, true), cmd.Stderr)
+	wg.Wait()
+
+	cmd.Wait()
+	return stdout.String(), stderr.String(), cmd.ExitCode(), nil
+}
+
+// psQuote escapes s for use inside a single quoted PowerShell string.
+func psQuote(s string) string {
+	return strings.Replace(s, "'", "''", -1)
+}
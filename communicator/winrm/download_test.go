@@ -0,0 +1,96 @@
+package winrm
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestDecodeDownload(t *testing.T) {
+	output := strings.Join([]string{
+		"aGVsbG8g",
+		"d29ybGQ=",
+		"#length 11",
+		"#sha256 B94D27B9934D3E08A52E52D7DA7DABFAC484EFE37A5380EE9088F7ACE2EFCDE9",
+		"",
+	}, "\r\n")
+
+	var buf bytes.Buffer
+	result, err := decodeDownload(strings.NewReader(output), &buf)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	if buf.String() != "hello world" {
+		t.Fatalf("bad content: %q", buf.String())
+	}
+
+	if result.written != 11 || result.length != 11 {
+		t.Fatalf("bad lengths: %#v", result)
+	}
+
+	if result.checksum != "B94D27B9934D3E08A52E52D7DA7DABFAC484EFE37A5380EE9088F7ACE2EFCDE9" {
+		t.Fatalf("bad checksum: %s", result.checksum)
+	}
+}
+
+func TestDecodeDownload_Truncated(t *testing.T) {
+	var buf bytes.Buffer
+	_, err := decodeDownload(strings.NewReader("aGVsbG8g\r\n"), &buf)
+	if err == nil {
+		t.Fatal("should have error")
+	}
+}
+
+func TestDecodeDownload_BadChunk(t *testing.T) {
+	var buf bytes.Buffer
+	_, err := decodeDownload(strings.NewReader("not base64!\r\n#length 0\r\n"), &buf)
+	if err == nil {
+		t.Fatal("should have error")
+	}
+}
+
+func TestParseDirListing(t *testing.T) {
+	entries, err := parseDirListing("d logs\r\nf logs\\setup.log\r\nf report.xml\r\n")
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	expected := []dirEntry{
+		{path: "logs", dir: true},
+		{path: "logs/setup.log"},
+		{path: "report.xml"},
+	}
+	if len(entries) != len(expected) {
+		t.Fatalf("bad entries: %#v", entries)
+	}
+	for i := range expected {
+		if entries[i] != expected[i] {
+			t.Fatalf("bad entry %d: %#v", i, entries[i])
+		}
+	}
+
+	if _, err := parseDirListing("garbage\r\n"); err == nil {
+		t.Fatal("should have error")
+	}
+}
+
+func TestExcluded(t *testing.T) {
+	cases := []struct {
+		path     string
+		patterns []string
+		result   bool
+	}{
+		{"report.xml", nil, false},
+		{"report.xml", []string{"*.xml"}, true},
+		{"logs/setup.log", []string{"logs"}, true},
+		{"logs/setup.log", []string{"*.txt"}, false},
+		{"logs/setup.log", []string{"logs/*.log"}, true},
+	}
+
+	for _, tc := range cases {
+		if excluded(tc.path, tc.patterns) != tc.result {
+			t.Errorf("excluded(%q, %v) should be %v", tc.path, tc.patterns, tc.result)
+		}
+	}
+}
@@ -0,0 +1,313 @@
+package winrm
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// httpUploadMinSize is the size from which files are served to the guest
+// over HTTP. Smaller files aren't worth the extra round trips.
+const httpUploadMinSize = 1024 * 1024
+
+// Exit codes used by httpUploadScript.
+const (
+	httpUploadExitUnreachable = 2
+	httpUploadExitChecksum    = 3
+)
+
+// httpUploadScript has the guest download a file from the host and check
+// its SHA-256 before moving it into place. The destination is expanded
+// like winrmcp does, so paths such as ${env:TEMP}\file work the same way.
+const httpUploadScript = `$ProgressPreference='SilentlyContinue'
+$dst=[IO.Path]::GetFullPath("%s")
+$tmp=$dst+'.packer-upload'
+$d=[IO.Path]::GetDirectoryName($dst)
+if (!(Test-Path -LiteralPath $d)) { New-Item -ItemType Directory -Force -Path $d | Out-Null }
+$r=[Net.WebRequest]::Create('%s')
+$r.Proxy=$null
+$r.Timeout=15000
+$r.ReadWriteTimeout=300000
+try { $resp=$r.GetResponse() } catch { [Console]::Error.WriteLine($_.Exception.GetBaseException().Message); exit %d }
+$h=[Security.Cryptography.SHA256]::Create()
+$in=$resp.GetResponseStream()
+$out=[IO.File]::Create($tmp)
+try {
+$b=New-Object byte[] 65536
+while (($n=$in.Read($b,0,$b.Length)) -gt 0) { $out.Write($b,0,$n); $h.TransformBlock($b,0,$n,$null,0) | Out-Null }
+$h.TransformFinalBlock($b,0,0) | Out-Null
+} finally { $out.Close(); $in.Close(); $resp.Close() }
+$sum=[BitConverter]::ToString($h.Hash).Replace('-','')
+if ($sum -ne '%s') { Remove-Item -LiteralPath $tmp -Force; [Console]::Error.WriteLine("checksum mismatch: $sum"); exit %d }
+if (Test-Path -LiteralPath $dst) { Remove-Item -LiteralPath $dst -Force }
+Move-Item -LiteralPath $tmp -Destination $dst
+`
+
+// errHTTPUploadUnavailable is returned when a file can't be served to the
+// guest over HTTP and must be sent through WinRM instead.
+var errHTTPUploadUnavailable = errors.New("HTTP uploads are unavailable")
+
+// uploadServer serves files to the guest from the host. Every file is
+// published under a random token that is only good for one request.
+type uploadServer struct {
+	listener net.Listener
+	baseURL  string
+
+	lock  sync.Mutex
+	files map[string]io.ReadSeeker
+}
+
+// newUploadServer listens on the given port, or a random one if it is
+// zero, on the address the guest reaches the host on.
+func newUploadServer(host string, port int) (*uploadServer, error) {
+	l, err := net.Listen("tcp", net.JoinHostPort(listenHost(host), strconv.Itoa(port)))
+	if err != nil {
+		return nil, err
+	}
+
+	_, actualPort, _ := net.SplitHostPort(l.Addr().String())
+	s := &uploadServer{
+		listener: l,
+		baseURL:  "http://" + net.JoinHostPort(host, actualPort),
+		files:    make(map[string]io.ReadSeeker),
+	}
+
+	go http.Serve(l, s)
+	return s, nil
+}
+
+// listenHost returns the address to listen on for a guest that reaches the
+// host on host. An IP address that isn't the host's own is one the guest's
+// NAT forwards to the host, such as 10.0.2.2 behind VirtualBox NAT, where
+// connections arrive on the loopback interface.
+func listenHost(host string) string {
+	ip := net.ParseIP(host)
+	if ip == nil || ip.IsLoopback() {
+		return host
+	}
+
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		return host
+	}
+	for _, addr := range addrs {
+		if n, ok := addr.(*net.IPNet); ok && n.IP.Equal(ip) {
+			return host
+		}
+	}
+
+	if ip.To4() == nil {
+		return "::1"
+	}
+	return "127.0.0.1"
+}
+
+// publish makes content available to the guest and returns its URL. The
+// returned function withdraws it again.
+func (s *uploadServer) publish(content io.ReadSeeker) (string, func()) {
+	var b [32]byte
+	if _, err := io.ReadFull(rand.Reader, b[:]); err != nil {
+		panic(err)
+	}
+	token := hex.EncodeToString(b[:])
+
+	s.lock.Lock()
+	s.files[token] = content
+	s.lock.Unlock()
+
+	return s.baseURL + "/" + token, func() {
+		s.lock.Lock()
+		delete(s.files, token)
+		s.lock.Unlock()
+	}
+}
+
+func (s *uploadServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	token := strings.TrimPrefix(r.URL.Path, "/")
+
+	s.lock.Lock()
+	content, ok := s.files[token]
+	delete(s.files, token)
+	s.lock.Unlock()
+
+	if !ok || r.Method != "GET" {
+		log.Printf("Refused HTTP upload request from %s", r.RemoteAddr)
+		http.NotFound(w, r)
+		return
+	}
+
+	log.Printf("Serving HTTP upload to %s", r.RemoteAddr)
+	http.ServeContent(w, r, "", time.Time{}, content)
+}
+
+func (s *uploadServer) Close() error {
+	return s.listener.Close()
+}
+
+// uploadHTTP has the guest download a file from the host. It returns
+// errHTTPUploadUnavailable if the guest could not reach the host, in which
+// case nothing was written on the guest, input is back where it was and
+// HTTP uploads are disabled for the life of the communicator.
+func (c *Communicator) uploadHTTP(dst string, input io.ReadSeeker, progress *transferProgress) error {
+	srv, err := c.uploadServer()
+	if err != nil {
+		return err
+	}
+
+	start, err := input.Seek(0, os.SEEK_CUR)
+	if err != nil {
+		return err
+	}
+	hash := sha256.New()
+	if _, err := io.Copy(hash, input); err != nil {
+		return err
+	}
+	if _, err := input.Seek(start, os.SEEK_SET); err != nil {
+		return err
+	}
+	sum := strings.ToUpper(hex.EncodeToString(hash.Sum(nil)))
+
+	content := progress.reader(input).(io.ReadSeeker)
+	url, withdraw := srv.publish(&offsetReadSeeker{rs: content, start: start})
+	defer withdraw()
+
+	script := fmt.Sprintf(httpUploadScript, psDoubleQuote(dst), url,
+		httpUploadExitUnreachable, sum, httpUploadExitChecksum)
+	_, stderr, code, err := c.runPowershell(script)
+	if err != nil {
+		return err
+	}
+
+	switch code {
+	case 0:
+	case httpUploadExitUnreachable:
+		log.Printf("Disabling HTTP uploads, guest could not download from %s: %s",
+			srv.baseURL, strings.TrimSpace(stderr))
+		c.lock.Lock()
+		c.uploadsErr = errHTTPUploadUnavailable
+		c.lock.Unlock()
+
+		if _, err := content.Seek(start, os.SEEK_SET); err != nil {
+			return err
+		}
+		return errHTTPUploadUnavailable
+	case httpUploadExitChecksum:
+		return fmt.Errorf("Error uploading %s over HTTP: %s", dst, strings.TrimSpace(stderr))
+	default:
+		return fmt.Errorf("Error uploading %s over HTTP, exit code %d: %s",
+			dst, code, strings.TrimSpace(stderr))
+	}
+
+	log.Printf("Uploaded %s over HTTP", dst)
+	return nil
+}
+
+// uploadServer starts the upload server the first time it is needed. If
+// the guest has no way to reach the host, HTTP uploads are disabled for
+// the life of the communicator.
+func (c *Communicator) uploadServer() (*uploadServer, error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if c.uploads != nil || c.uploadsErr != nil {
+		return c.uploads, c.uploadsErr
+	}
+
+	host := c.config.HTTPUploadHost
+	if host == "" {
+		var err error
+		host, err = c.localAddress()
+		if err != nil {
+			log.Printf("Disabling HTTP uploads: %s", err)
+			c.uploadsErr = errHTTPUploadUnavailable
+			return nil, c.uploadsErr
+		}
+	}
+
+	srv, err := newUploadServer(host, c.config.HTTPUploadPort)
+	if err != nil {
+		log.Printf("Disabling HTTP uploads, could not listen: %s", err)
+		c.uploadsErr = errHTTPUploadUnavailable
+		return nil, c.uploadsErr
+	}
+
+	log.Printf("Serving HTTP uploads at %s", srv.baseURL)
+	c.uploads = srv
+	return srv, nil
+}
+
+// localAddress returns the address of the host on the network it uses to
+// reach the guest's WinRM service.
+func (c *Communicator) localAddress() (string, error) {
+	conn, err := net.DialTimeout("tcp", c.address(), 10*time.Second)
+	if err != nil {
+		return "", err
+	}
+	defer conn.Close()
+
+	ip := conn.LocalAddr().(*net.TCPAddr).IP
+	if ip.IsLoopback() {
+		return "", fmt.Errorf("WinRM is reached through %s, set the host address the guest can reach", ip)
+	}
+
+	return ip.String(), nil
+}
+
+// seekableSize returns the size of what is left of input if it can be read
+// more than once. input is left at the offset it was at.
+func seekableSize(input io.Reader) (io.ReadSeeker, int64, bool) {
+	rs, ok := input.(io.ReadSeeker)
+	if !ok {
+		return nil, 0, false
+	}
+
+	start, err := rs.Seek(0, os.SEEK_CUR)
+	if err != nil {
+		return nil, 0, false
+	}
+	end, err := rs.Seek(0, os.SEEK_END)
+	if err != nil {
+		return nil, 0, false
+	}
+	if _, err := rs.Seek(start, os.SEEK_SET); err != nil {
+		return nil, 0, false
+	}
+
+	return rs, end - start, true
+}
+
+// offsetReadSeeker makes what follows start in rs look like all of it, so
+// the upload server serves a reader from the offset it was handed at.
+type offsetReadSeeker struct {
+	rs    io.ReadSeeker
+	start int64
+}
+
+func (r *offsetReadSeeker) Read(p []byte) (int, error) {
+	return r.rs.Read(p)
+}
+
+func (r *offsetReadSeeker) Seek(offset int64, whence int) (int64, error) {
+	if whence == os.SEEK_SET {
+		offset += r.start
+	}
+	pos, err := r.rs.Seek(offset, whence)
+	return pos - r.start, err
+}
+
+// psDoubleQuote escapes s for use inside a double quoted PowerShell
+// string, leaving variables such as $env:TEMP to be expanded.
+func psDoubleQuote(s string) string {
+	return strings.NewReplacer("`", "``", `"`, "`\"").Replace(s)
+}
@@ -0,0 +1,211 @@
+package winrm
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/packer-community/packer-windows-plugins/communicator/winrm/winrmtest"
+)
+
+func TestUploadServer(t *testing.T) {
+	srv, err := newUploadServer("127.0.0.1", 0)
+	if err != nil {
+		t.Fatalf("error starting upload server: %s", err)
+	}
+	defer srv.Close()
+
+	content := bytes.Repeat([]byte("packer"), 1000)
+	url, withdraw := srv.publish(bytes.NewReader(content))
+	defer withdraw()
+
+	if !strings.HasPrefix(url, srv.baseURL+"/") {
+		t.Fatalf("bad url: %s", url)
+	}
+
+	resp, err := http.Get(url)
+	if err != nil {
+		t.Fatalf("error downloading: %s", err)
+	}
+	body, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		t.Fatalf("error reading body: %s", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("bad status: %d", resp.StatusCode)
+	}
+	if !bytes.Equal(body, content) {
+		t.Fatalf("bad body: %d bytes, expected %d", len(body), len(content))
+	}
+
+	// Files can only be downloaded once
+	resp, err = http.Get(url)
+	if err != nil {
+		t.Fatalf("error downloading: %s", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNotFound {
+		t.Fatalf("bad status on second download: %d", resp.StatusCode)
+	}
+
+	resp, err = http.Get(srv.baseURL + "/unknown")
+	if err != nil {
+		t.Fatalf("error downloading: %s", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNotFound {
+		t.Fatalf("bad status for unknown token: %d", resp.StatusCode)
+	}
+}
+
+func TestUploadServer_Withdraw(t *testing.T) {
+	srv, err := newUploadServer("127.0.0.1", 0)
+	if err != nil {
+		t.Fatalf("error starting upload server: %s", err)
+	}
+	defer srv.Close()
+
+	url, withdraw := srv.publish(strings.NewReader("packer"))
+	withdraw()
+
+	resp, err := http.Get(url)
+	if err != nil {
+		t.Fatalf("error downloading: %s", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNotFound {
+		t.Fatalf("bad status: %d", resp.StatusCode)
+	}
+}
+
+func TestUploadServer_ListenHost(t *testing.T) {
+	srv, err := newUploadServer("127.0.0.1", 0)
+	if err != nil {
+		t.Fatalf("error starting upload server: %s", err)
+	}
+	defer srv.Close()
+
+	host, _, _ := net.SplitHostPort(srv.listener.Addr().String())
+	if host != "127.0.0.1" {
+		t.Fatalf("should only listen on the guest's address: %s", host)
+	}
+
+	// Addresses that aren't the host's own are forwarded by NAT
+	if actual := listenHost("192.0.2.1"); actual != "127.0.0.1" {
+		t.Fatalf("bad listen host: %s", actual)
+	}
+	if actual := listenHost("packer-host"); actual != "packer-host" {
+		t.Fatalf("bad listen host: %s", actual)
+	}
+}
+
+func TestCommunicatorUploadServer_Loopback(t *testing.T) {
+	s := newTestShellServer()
+	defer s.Close()
+
+	config := testRemoteConfig(s)
+	config.HTTPUpload = true
+	comm, err := New(config)
+	if err != nil {
+		t.Fatalf("error connecting to WinRM: %s", err)
+	}
+	defer comm.Close()
+
+	// A guest reached through loopback can't reach the host the same way
+	if _, err := comm.uploadServer(); err != errHTTPUploadUnavailable {
+		t.Fatalf("HTTP uploads should be unavailable: %v", err)
+	}
+
+	config.HTTPUploadHost = "10.0.2.2"
+	comm, err = New(config)
+	if err != nil {
+		t.Fatalf("error connecting to WinRM: %s", err)
+	}
+	defer comm.Close()
+
+	srv, err := comm.uploadServer()
+	if err != nil {
+		t.Fatalf("error starting upload server: %s", err)
+	}
+	if !strings.HasPrefix(srv.baseURL, "http://10.0.2.2:") {
+		t.Fatalf("bad base url: %s", srv.baseURL)
+	}
+}
+
+func TestSeekableSize(t *testing.T) {
+	r := strings.NewReader("packer")
+	r.ReadByte()
+
+	rs, size, ok := seekableSize(r)
+	if !ok {
+		t.Fatal("should be seekable")
+	}
+	if size != 5 {
+		t.Fatalf("bad size: %d", size)
+	}
+	if b, _ := ioutil.ReadAll(rs); string(b) != "acker" {
+		t.Fatalf("should read from where it was: %q", b)
+	}
+
+	if _, _, ok := seekableSize(bytes.NewBufferString("packer")); ok {
+		t.Fatal("should not be seekable")
+	}
+}
+
+func TestPsDoubleQuote(t *testing.T) {
+	cases := map[string]string{
+		`C:\Windows\Temp\file`: `C:\Windows\Temp\file`,
+		`${env:TEMP}\file`:     `${env:TEMP}\file`,
+		`C:\"quoted"\file`:     "C:\\`\"quoted`\"\\file",
+		"C:\\back`tick\\file":  "C:\\back``tick\\file",
+	}
+
+	for input, expected := range cases {
+		if actual := psDoubleQuote(input); actual != expected {
+			t.Fatalf("bad quoting of %s: %s", input, actual)
+		}
+	}
+}
+
+func TestCommunicatorUploadHTTP_Unreachable(t *testing.T) {
+	r := winrmtest.NewRemote()
+	defer r.Close()
+
+	config := testRemoteConfig(r)
+	config.HTTPUpload = true
+	config.HTTPUploadHost = "127.0.0.1"
+	comm, err := New(config)
+	if err != nil {
+		t.Fatalf("error connecting to WinRM: %s", err)
+	}
+	defer comm.Close()
+
+	// Nothing listens at the address the guest is given
+	srv, err := comm.uploadServer()
+	if err != nil {
+		t.Fatalf("error starting upload server: %s", err)
+	}
+	srv.Close()
+
+	input := strings.NewReader("skipped packer")
+	input.Seek(int64(len("skipped ")), os.SEEK_SET)
+	progress := comm.newProgress(`C:\packer.txt`, 6)
+	if err := comm.uploadHTTP(`C:\packer.txt`, input, progress); err != errHTTPUploadUnavailable {
+		t.Fatalf("upload should be unavailable: %v", err)
+	}
+
+	if b, _ := ioutil.ReadAll(input); string(b) != "packer" {
+		t.Fatalf("input should be back where it was: %q", b)
+	}
+	if _, ok := r.File(`C:\packer.txt`); ok {
+		t.Fatal("nothing should be written")
+	}
+	if _, err := comm.uploadServer(); err != errHTTPUploadUnavailable {
+		t.Fatalf("HTTP uploads should be disabled: %v", err)
+	}
+}
@@ -0,0 +1,150 @@
+package winrm
+
+import (
+	"bytes"
+	"os"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/mitchellh/packer/packer"
+	"github.com/packer-community/packer-windows-plugins/common/powershell"
+)
+
+// The interop tests run the communicator against a real WinRM service,
+// which the fake one in winrmtest can only imitate. They are skipped
+// unless WINRM_INTEROP_HOST names a Windows machine to use, with
+// WINRM_INTEROP_USER and WINRM_INTEROP_PASSWORD, and optionally
+// WINRM_INTEROP_PORT, WINRM_INTEROP_AUTH, WINRM_INTEROP_HTTPS and
+// WINRM_INTEROP_INSECURE.
+func interopCommunicator(t *testing.T) *Communicator {
+	host := os.Getenv("WINRM_INTEROP_HOST")
+	if host == "" {
+		t.Skip("WINRM_INTEROP_HOST not set")
+	}
+
+	config := &Config{
+		Host:     host,
+		Port:     5985,
+		User:     os.Getenv("WINRM_INTEROP_USER"),
+		Password: os.Getenv("WINRM_INTEROP_PASSWORD"),
+		Auth:     os.Getenv("WINRM_INTEROP_AUTH"),
+		Https:    os.Getenv("WINRM_INTEROP_HTTPS") != "",
+		Insecure: os.Getenv("WINRM_INTEROP_INSECURE") != "",
+		Timeout:  time.Minute,
+	}
+	if config.Https {
+		config.Port = 5986
+	}
+	if port := os.Getenv("WINRM_INTEROP_PORT"); port != "" {
+		var err error
+		if config.Port, err = strconv.Atoi(port); err != nil {
+			t.Fatalf("bad WINRM_INTEROP_PORT: %s", err)
+		}
+	}
+
+	comm, err := New(config)
+	if err != nil {
+		t.Fatalf("error connecting to WinRM: %s", err)
+	}
+	return comm
+}
+
+// interopRun runs a command and returns its output and exit status.
+func interopRun(t *testing.T, comm *Communicator, rc *packer.RemoteCmd) (string, string) {
+	var stdout, stderr bytes.Buffer
+	rc.Stdout, rc.Stderr = &stdout, &stderr
+	if err := comm.Start(rc); err != nil {
+		t.Fatalf("error starting %q: %s", rc.Command, err)
+	}
+	rc.Wait()
+	return stdout.String(), stderr.String()
+}
+
+func TestInterop_Start(t *testing.T) {
+	comm := interopCommunicator(t)
+	defer comm.Close()
+
+	rc := &packer.RemoteCmd{Command: "echo hello"}
+	stdout, _ := interopRun(t, comm, rc)
+	if rc.ExitStatus != 0 || strings.TrimSpace(stdout) != "hello" {
+		t.Fatalf("bad result: %d, %q", rc.ExitStatus, stdout)
+	}
+
+	rc = &packer.RemoteCmd{Command: "exit /b 3"}
+	interopRun(t, comm, rc)
+	if rc.ExitStatus != 3 {
+		t.Fatalf("bad exit status: %d", rc.ExitStatus)
+	}
+}
+
+func TestInterop_Stdin(t *testing.T) {
+	comm := interopCommunicator(t)
+	defer comm.Close()
+
+	rc := &packer.RemoteCmd{Command: `findstr "^"`, Stdin: strings.NewReader("one\r\ntwo\r\n")}
+	stdout, _ := interopRun(t, comm, rc)
+	if rc.ExitStatus != 0 || stdout != "one\r\ntwo\r\n" {
+		t.Fatalf("bad result: %d, %q", rc.ExitStatus, stdout)
+	}
+}
+
+func TestInterop_Powershell(t *testing.T) {
+	comm := interopCommunicator(t)
+	defer comm.Close()
+
+	script := "Write-Output 'café'\nWrite-Error 'failed'\nexit 4"
+	rc := &packer.RemoteCmd{Command: powershell.EncodedCommand(script)}
+	stdout, stderr := interopRun(t, comm, rc)
+	if rc.ExitStatus != 4 || strings.TrimSpace(stdout) != "café" {
+		t.Fatalf("bad result: %d, %q", rc.ExitStatus, stdout)
+	}
+	if strings.Contains(stderr, "CLIXML") || !strings.Contains(stderr, "failed") {
+		t.Fatalf("bad stderr: %q", stderr)
+	}
+}
+
+func TestInterop_Terminate(t *testing.T) {
+	comm := interopCommunicator(t)
+	defer comm.Close()
+
+	rc := &packer.RemoteCmd{Command: "ping -n 600 127.0.0.1"}
+	if err := comm.Start(rc); err != nil {
+		t.Fatalf("error starting cmd: %s", err)
+	}
+	if err := comm.Terminate(rc); err != nil {
+		t.Fatalf("error terminating cmd: %s", err)
+	}
+
+	exited := make(chan struct{})
+	go func() {
+		rc.Wait()
+		close(exited)
+	}()
+	select {
+	case <-exited:
+	case <-time.After(time.Minute):
+		t.Fatal("command should exit once terminated")
+	}
+}
+
+func TestInterop_UploadDownload(t *testing.T) {
+	comm := interopCommunicator(t)
+	defer comm.Close()
+
+	path := `C:\Windows\Temp\packer-interop.txt`
+	content := strings.Repeat("packer interop\r\n", 4096)
+	if err := comm.Upload(path, strings.NewReader(content), nil); err != nil {
+		t.Fatalf("error uploading: %s", err)
+	}
+	defer interopRun(t, comm, &packer.RemoteCmd{Command: `del /f /q "` + path + `"`})
+
+	var downloaded bytes.Buffer
+	if err := comm.Download(path, &downloaded); err != nil {
+		t.Fatalf("error downloading: %s", err)
+	}
+	if downloaded.String() != content {
+		t.Fatalf("bad content: %d bytes", downloaded.Len())
+	}
+}
@@ -0,0 +1,348 @@
+package winrm
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/tls"
+	"encoding/base64"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Azure/go-ntlmssp"
+)
+
+// ntlmTransport authenticates connections with an NTLM handshake and keeps
+// them open for the requests that follow. The service remembers who is on
+// an authenticated connection, so requests on it are sent without
+// credentials and the three legs of the handshake are paid for once per
+// connection, not for every request and every Receive poll.
+//
+// It dials the connections itself, because http.Transport doesn't say
+// which connection a request will be sent on. They are made directly, not
+// through a proxy.
+type ntlmTransport struct {
+	base *http.Transport
+
+	lock sync.Mutex
+	idle map[string][]*ntlmConn
+
+	// scheme is the authentication scheme the service asked for, once
+	// known, so further connections don't have to ask again
+	scheme string
+}
+
+func newNTLMTransport(base *http.Transport) *ntlmTransport {
+	return &ntlmTransport{base: base, idle: make(map[string][]*ntlmConn)}
+}
+
+// ntlmConn is a connection the handshake went through on.
+type ntlmConn struct {
+	net.Conn
+	br  *bufio.Reader
+	key string
+}
+
+func (t *ntlmTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	user, password, ok := req.BasicAuth()
+	if !ok {
+		return t.base.RoundTrip(req)
+	}
+
+	var body []byte
+	if req.Body != nil {
+		var err error
+		body, err = ioutil.ReadAll(req.Body)
+		req.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// An authenticated connection is tried first. A request it turns
+	// away, because it was closed or the service no longer knows it, was
+	// not acted on and goes out on a new connection.
+	key := connKey(req)
+	for conn := t.get(key); conn != nil; conn = t.get(key) {
+		resp, err := t.send(conn, req, body, "")
+		if err != nil {
+			conn.Close()
+			if _, ok := err.(*unsentError); ok {
+				continue
+			}
+			return nil, err
+		}
+		if resp.StatusCode == http.StatusUnauthorized {
+			discard(resp)
+			conn.Close()
+			continue
+		}
+		return t.handOver(conn, resp), nil
+	}
+
+	return t.authenticate(req, body, user, password)
+}
+
+// authenticate sends req on a new connection with an NTLM handshake.
+func (t *ntlmTransport) authenticate(req *http.Request, body []byte, user, password string) (*http.Response, error) {
+	conn, err := t.dial(req)
+	if err != nil {
+		return nil, err
+	}
+
+	t.lock.Lock()
+	scheme := t.scheme
+	t.lock.Unlock()
+
+	if scheme == "" {
+		// Ask without credentials to learn which schemes are offered
+		resp, err := t.send(conn, req, body, "")
+		if err != nil {
+			conn.Close()
+			return nil, err
+		}
+		if resp.StatusCode != http.StatusUnauthorized {
+			return t.handOver(conn, resp), nil
+		}
+
+		scheme = offeredNTLMScheme(resp)
+		discard(resp)
+		if scheme == "" {
+			// Falling back to Basic would silently downgrade the
+			// authentication that was asked for
+			conn.Close()
+			return nil, errNoNTLM
+		}
+
+		t.lock.Lock()
+		t.scheme = scheme
+		t.lock.Unlock()
+
+		if resp.Close {
+			conn.Close()
+			if conn, err = t.dial(req); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	user, domain := ntlmssp.GetDomain(user)
+	negotiate, err := ntlmssp.NewNegotiateMessage(domain, "")
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	resp, err := t.send(conn, req, body, scheme+" "+base64.StdEncoding.EncodeToString(negotiate))
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	challenge := ntlmChallenge(resp, scheme)
+	if resp.StatusCode != http.StatusUnauthorized || challenge == nil {
+		// The handshake failed, the caller deals with the response
+		return t.handOver(conn, resp), nil
+	}
+	discard(resp)
+
+	authenticate, err := ntlmssp.ProcessChallenge(challenge, user, password)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	resp, err = t.send(conn, req, body, scheme+" "+base64.StdEncoding.EncodeToString(authenticate))
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return t.handOver(conn, resp), nil
+}
+
+// send writes a copy of req with the given Authorization header, or none,
+// to conn and reads the response header.
+func (t *ntlmTransport) send(conn *ntlmConn, req *http.Request, body []byte, authorization string) (*http.Response, error) {
+	r, err := http.NewRequest(req.Method, req.URL.String(), bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	for k, v := range req.Header {
+		r.Header[k] = v
+	}
+	r.Header.Del("Authorization")
+	if authorization != "" {
+		r.Header.Set("Authorization", authorization)
+	}
+
+	// Closing the connection is the only way to stop a request that is
+	// under way on it
+	if req.Cancel != nil {
+		done := make(chan struct{})
+		defer close(done)
+		go func() {
+			select {
+			case <-req.Cancel:
+				conn.Close()
+			case <-done:
+			}
+		}()
+	}
+
+	if err := r.Write(conn); err != nil {
+		return nil, &unsentError{err}
+	}
+
+	if t.base.ResponseHeaderTimeout > 0 {
+		conn.SetReadDeadline(time.Now().Add(t.base.ResponseHeaderTimeout))
+		defer conn.SetReadDeadline(time.Time{})
+	}
+
+	// Nothing at all coming back on a kept connection means it was closed
+	// before the request reached the service
+	if _, err := conn.br.Peek(1); err == io.EOF {
+		return nil, &unsentError{err}
+	}
+	return http.ReadResponse(conn.br, r)
+}
+
+// handOver returns resp to the caller. The connection goes back to the
+// idle ones once its body has been read, unless the service closes it.
+func (t *ntlmTransport) handOver(conn *ntlmConn, resp *http.Response) *http.Response {
+	resp.Body = &ntlmBody{ReadCloser: resp.Body, conn: conn, keep: !resp.Close, transport: t}
+	return resp
+}
+
+func (t *ntlmTransport) get(key string) *ntlmConn {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	conns := t.idle[key]
+	if len(conns) == 0 {
+		return nil
+	}
+	conn := conns[len(conns)-1]
+	t.idle[key] = conns[:len(conns)-1]
+	return conn
+}
+
+func (t *ntlmTransport) put(conn *ntlmConn) {
+	t.lock.Lock()
+	t.idle[conn.key] = append(t.idle[conn.key], conn)
+	t.lock.Unlock()
+}
+
+// dial opens a connection to the host of req, with TLS for https.
+func (t *ntlmTransport) dial(req *http.Request) (*ntlmConn, error) {
+	host, port, err := net.SplitHostPort(req.URL.Host)
+	if err != nil {
+		host, port = req.URL.Host, "80"
+		if req.URL.Scheme == "https" {
+			port = "443"
+		}
+	}
+
+	dial := t.base.Dial
+	if dial == nil {
+		dial = (&net.Dialer{Timeout: 30 * time.Second, KeepAlive: 30 * time.Second}).Dial
+	}
+	conn, err := dial("tcp", net.JoinHostPort(host, port))
+	if err != nil {
+		return nil, err
+	}
+
+	if req.URL.Scheme == "https" {
+		config := &tls.Config{}
+		if t.base.TLSClientConfig != nil {
+			config = t.base.TLSClientConfig.Clone()
+		}
+		if config.ServerName == "" {
+			config.ServerName = host
+		}
+
+		tlsConn := tls.Client(conn, config)
+		if err := tlsConn.Handshake(); err != nil {
+			conn.Close()
+			return nil, err
+		}
+		conn = tlsConn
+	}
+
+	return &ntlmConn{Conn: conn, br: bufio.NewReader(conn), key: connKey(req)}, nil
+}
+
+// unsentError is a failure to send a request on a connection that the
+// service had already closed, so it never saw the request.
+type unsentError struct {
+	err error
+}
+
+func (e *unsentError) Error() string {
+	return e.err.Error()
+}
+
+// ntlmBody puts the connection of a response back with the idle ones once
+// the body is done with.
+type ntlmBody struct {
+	io.ReadCloser
+	conn      *ntlmConn
+	keep      bool
+	transport *ntlmTransport
+}
+
+func (b *ntlmBody) Close() error {
+	_, err := io.Copy(ioutil.Discard, b.ReadCloser)
+	b.ReadCloser.Close()
+	if err == nil && b.keep {
+		b.transport.put(b.conn)
+	} else {
+		b.conn.Close()
+	}
+	return nil
+}
+
+func connKey(req *http.Request) string {
+	return req.URL.Scheme + "://" + req.URL.Host
+}
+
+func discard(resp *http.Response) {
+	io.Copy(ioutil.Discard, resp.Body)
+	resp.Body.Close()
+}
+
+// offeredNTLMScheme returns the scheme of the WWW-Authenticate challenges
+// in resp to authenticate with, preferring Negotiate, or the empty string
+// if neither Negotiate nor NTLM is offered.
+func offeredNTLMScheme(resp *http.Response) string {
+	scheme := ""
+	for _, challenge := range resp.Header["Www-Authenticate"] {
+		switch name := strings.SplitN(challenge, " ", 2)[0]; {
+		case strings.EqualFold(name, "Negotiate"):
+			return "Negotiate"
+		case strings.EqualFold(name, "NTLM"):
+			scheme = "NTLM"
+		}
+	}
+	return scheme
+}
+
+// ntlmChallenge returns the CHALLENGE message in resp for scheme, or nil.
+func ntlmChallenge(resp *http.Response, scheme string) []byte {
+	for _, challenge := range resp.Header["Www-Authenticate"] {
+		parts := strings.SplitN(challenge, " ", 2)
+		if len(parts) != 2 || !strings.EqualFold(parts[0], scheme) {
+			continue
+		}
+		if data, err := base64.StdEncoding.DecodeString(strings.TrimSpace(parts[1])); err == nil && len(data) > 0 {
+			return data
+		}
+	}
+	return nil
+}
+
+// errNoNTLM is returned when NTLM authentication was requested but the
+// service only offers Basic authentication.
+var errNoNTLM = errors.New("WinRM service does not offer NTLM or Negotiate authentication")
@@ -0,0 +1,175 @@
+package winrm
+
+import (
+	"errors"
+	"io"
+	"log"
+	"sync"
+	"time"
+)
+
+const (
+	// DefaultMaxShells is the default number of shells the communicator
+	// keeps open on the guest. Windows Server 2008 R2 allows five shells
+	// per user, one of which is left for file transfers.
+	DefaultMaxShells = 4
+
+	// DefaultShellIdleTimeout is how long an unused shell is kept open.
+	DefaultShellIdleTimeout = 2 * time.Minute
+)
+
+var errPoolClosed = errors.New("WinRM shell pool is closed")
+
+// shellPool hands out shells on the guest, reusing them between commands
+// so that every command doesn't pay for opening and closing a shell.
+//
+// The pool doesn't know how to check a shell is still alive. Callers that
+// get an error using a reused shell should Discard it and try again; a
+// shell that was just created is reported as fresh.
+type shellPool struct {
+	create      func() (io.Closer, error)
+	size        int
+	idleTimeout time.Duration
+
+	lock   sync.Mutex
+	cond   *sync.Cond
+	idle   []*pooledShell
+	open   int // shells idle, in use or being created
+	closed bool
+}
+
+type pooledShell struct {
+	shell    io.Closer
+	lastUsed time.Time
+
+	// reused is true if the shell ran a command before it was handed out
+	reused bool
+}
+
+func newShellPool(size int, idleTimeout time.Duration, create func() (io.Closer, error)) *shellPool {
+	if size <= 0 {
+		size = DefaultMaxShells
+	}
+	if idleTimeout <= 0 {
+		idleTimeout = DefaultShellIdleTimeout
+	}
+
+	p := &shellPool{
+		create:      create,
+		size:        size,
+		idleTimeout: idleTimeout,
+	}
+	p.cond = sync.NewCond(&p.lock)
+	return p
+}
+
+// Get returns an idle shell, or opens a new one. If the pool is at its
+// maximum size it blocks until another shell is returned.
+func (p *shellPool) Get() (*pooledShell, error) {
+	p.reap()
+
+	p.lock.Lock()
+	for {
+		if p.closed {
+			p.lock.Unlock()
+			return nil, errPoolClosed
+		}
+
+		if n := len(p.idle); n > 0 {
+			ps := p.idle[n-1]
+			p.idle = p.idle[:n-1]
+			p.lock.Unlock()
+
+			ps.reused = true
+			return ps, nil
+		}
+
+		if p.open < p.size {
+			break
+		}
+
+		p.cond.Wait()
+	}
+	p.open++
+	p.lock.Unlock()
+
+	shell, err := p.create()
+	if err != nil {
+		p.release()
+		return nil, err
+	}
+
+	return &pooledShell{shell: shell}, nil
+}
+
+// Put returns a shell to the pool once the command using it has finished.
+func (p *shellPool) Put(ps *pooledShell) {
+	ps.lastUsed = time.Now()
+
+	p.lock.Lock()
+	if p.closed {
+		p.lock.Unlock()
+		p.Discard(ps)
+		return
+	}
+	p.idle = append(p.idle, ps)
+	p.cond.Signal()
+	p.lock.Unlock()
+
+	time.AfterFunc(p.idleTimeout, p.reap)
+}
+
+// Discard closes a shell that is broken, or no longer needed, and frees
+// its place in the pool.
+func (p *shellPool) Discard(ps *pooledShell) {
+	if err := ps.shell.Close(); err != nil {
+		log.Printf("Error closing WinRM shell: %s", err)
+	}
+	p.release()
+}
+
+// Close closes all idle shells. Shells that are in use are closed when
+// they are returned.
+func (p *shellPool) Close() error {
+	p.lock.Lock()
+	idle := p.idle
+	p.idle = nil
+	p.closed = true
+	p.cond.Broadcast()
+	p.lock.Unlock()
+
+	for _, ps := range idle {
+		p.Discard(ps)
+	}
+	return nil
+}
+
+func (p *shellPool) release() {
+	p.lock.Lock()
+	p.open--
+	p.cond.Signal()
+	p.lock.Unlock()
+}
+
+// reap closes shells that have been idle for longer than the idle timeout.
+func (p *shellPool) reap() {
+	deadline := time.Now().Add(-p.idleTimeout)
+
+	p.lock.Lock()
+	var expired []*pooledShell
+	idle := p.idle[:0]
+	for _, ps := range p.idle {
+		if ps.lastUsed.After(deadline) {
+			idle = append(idle, ps)
+		} else {
+			expired = append(expired, ps)
+		}
+	}
+	p.idle = idle
+	p.lock.Unlock()
+
+	for _, ps := range expired {
+		log.Printf("Closing WinRM shell idle since %s", ps.lastUsed.Format(time.RFC3339))
+		p.Discard(ps)
+	}
+}
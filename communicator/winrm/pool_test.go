@@ -0,0 +1,182 @@
+package winrm
+
+import (
+	"errors"
+	"io"
+	"sync"
+	"testing"
+	"time"
+)
+
+type testShell struct {
+	factory *testShellFactory
+	closed  bool
+}
+
+func (s *testShell) Close() error {
+	s.factory.lock.Lock()
+	defer s.factory.lock.Unlock()
+
+	s.closed = true
+	return nil
+}
+
+type testShellFactory struct {
+	lock   sync.Mutex
+	shells []*testShell
+	err    error
+}
+
+func (f *testShellFactory) create() (io.Closer, error) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	if f.err != nil {
+		return nil, f.err
+	}
+
+	s := &testShell{factory: f}
+	f.shells = append(f.shells, s)
+	return s, nil
+}
+
+func (f *testShellFactory) closed(i int) bool {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	return f.shells[i].closed
+}
+
+func (f *testShellFactory) created() int {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	return len(f.shells)
+}
+
+func TestShellPool_Reuse(t *testing.T) {
+	f := new(testShellFactory)
+	p := newShellPool(2, time.Minute, f.create)
+
+	ps, err := p.Get()
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if ps.reused {
+		t.Fatal("new shell should not be reused")
+	}
+	p.Put(ps)
+
+	ps, err = p.Get()
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if !ps.reused {
+		t.Fatal("shell should be reused")
+	}
+	p.Put(ps)
+
+	if f.created() != 1 {
+		t.Fatalf("expected one shell, created %d", f.created())
+	}
+}
+
+func TestShellPool_MaxShells(t *testing.T) {
+	f := new(testShellFactory)
+	p := newShellPool(2, time.Minute, f.create)
+
+	first, _ := p.Get()
+	second, _ := p.Get()
+
+	got := make(chan *pooledShell)
+	go func() {
+		ps, _ := p.Get()
+		got <- ps
+	}()
+
+	select {
+	case <-got:
+		t.Fatal("Get should block while the pool is full")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	p.Put(first)
+	select {
+	case ps := <-got:
+		if ps.shell != first.shell {
+			t.Fatal("should get the returned shell")
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Get should return once a shell is returned")
+	}
+
+	p.Discard(second)
+	if !f.closed(1) {
+		t.Fatal("discarded shell should be closed")
+	}
+
+	if _, err := p.Get(); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if f.created() != 3 {
+		t.Fatalf("expected a new shell after discard, created %d", f.created())
+	}
+}
+
+func TestShellPool_IdleTimeout(t *testing.T) {
+	f := new(testShellFactory)
+	p := newShellPool(2, 20*time.Millisecond, f.create)
+
+	ps, _ := p.Get()
+	p.Put(ps)
+
+	time.Sleep(100 * time.Millisecond)
+	if !f.closed(0) {
+		t.Fatal("idle shell should be closed")
+	}
+
+	ps, _ = p.Get()
+	if ps.reused {
+		t.Fatal("expired shell should not be reused")
+	}
+}
+
+func TestShellPool_CreateError(t *testing.T) {
+	f := &testShellFactory{err: errors.New("connection refused")}
+	p := newShellPool(1, time.Minute, f.create)
+
+	if _, err := p.Get(); err == nil {
+		t.Fatal("should have error")
+	}
+
+	// The failed create must not hold on to the only slot
+	f.lock.Lock()
+	f.err = nil
+	f.lock.Unlock()
+	if _, err := p.Get(); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+}
+
+func TestShellPool_Close(t *testing.T) {
+	f := new(testShellFactory)
+	p := newShellPool(2, time.Minute, f.create)
+
+	idle, _ := p.Get()
+	busy, _ := p.Get()
+	p.Put(idle)
+
+	p.Close()
+	if !f.closed(0) {
+		t.Fatal("idle shell should be closed")
+	}
+
+	p.Put(busy)
+	if !f.closed(1) {
+		t.Fatal("shell returned after close should be closed")
+	}
+
+	if _, err := p.Get(); err != errPoolClosed {
+		t.Fatalf("bad: %v", err)
+	}
+}
@@ -0,0 +1,170 @@
+package winrm
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/mitchellh/packer/packer"
+)
+
+// DefaultProgressInterval is how often the progress of an upload is
+// reported when Config.ProgressInterval is not set.
+const DefaultProgressInterval = 10 * time.Second
+
+// transferProgress tracks the bytes sent for one upload, which may be made
+// of several files, and reports them to the UI every so often.
+type transferProgress struct {
+	ui       packer.Ui
+	name     string
+	total    int64
+	interval time.Duration
+	start    time.Time
+
+	lock     sync.Mutex
+	sent     int64
+	files    int
+	reported time.Time
+}
+
+// newProgress starts tracking an upload of total bytes, or an unknown
+// amount if total is negative.
+func (c *Communicator) newProgress(name string, total int64) *transferProgress {
+	interval := c.config.ProgressInterval
+	if interval <= 0 {
+		interval = DefaultProgressInterval
+	}
+
+	now := time.Now()
+	return &transferProgress{
+		ui:       c.config.Ui,
+		name:     name,
+		total:    total,
+		interval: interval,
+		start:    now,
+		reported: now,
+	}
+}
+
+// reader counts the bytes read from r towards the progress. If r can seek,
+// so can the returned reader, and seeking back takes bytes off the count
+// again, as happens when an upload is retried another way.
+func (p *transferProgress) reader(r io.Reader) io.Reader {
+	pr := &progressReader{progress: p, r: r}
+	if rs, ok := r.(io.ReadSeeker); ok {
+		// Counting starts from wherever the reader is
+		pos, _ := rs.Seek(0, os.SEEK_CUR)
+		return &progressReadSeeker{progressReader: pr, s: rs, pos: pos}
+	}
+	return pr
+}
+
+// startFile counts another file towards the upload.
+func (p *transferProgress) startFile() {
+	p.lock.Lock()
+	p.files++
+	p.lock.Unlock()
+}
+
+func (p *transferProgress) add(n int64, report bool) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	p.sent += n
+
+	now := time.Now()
+	if report && p.ui != nil && now.Sub(p.reported) >= p.interval {
+		p.reported = now
+		p.ui.Message(p.status(now))
+	}
+}
+
+// status describes the progress so far, such as "C:\file: 45% (900.0 MB
+// of 2.0 GB), 12.5 MB/s, 1m28s left".
+func (p *transferProgress) status(now time.Time) string {
+	elapsed := now.Sub(p.start)
+	rate := float64(p.sent) / elapsed.Seconds()
+
+	if p.total <= 0 {
+		return fmt.Sprintf("%s: %s, %s/s", p.name, formatBytes(p.sent), formatBytes(int64(rate)))
+	}
+
+	status := fmt.Sprintf("%s: %d%% (%s of %s), %s/s", p.name, p.sent*100/p.total,
+		formatBytes(p.sent), formatBytes(p.total), formatBytes(int64(rate)))
+	if rate > 0 && p.sent < p.total {
+		left := time.Duration(float64(p.total-p.sent)/rate) * time.Second
+		status += fmt.Sprintf(", %s left", left)
+	}
+	return status
+}
+
+// finish logs a summary of the upload.
+func (p *transferProgress) finish(err error) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	elapsed := time.Since(p.start)
+	rate := float64(p.sent) / elapsed.Seconds()
+	if err != nil {
+		log.Printf("Upload of %s failed after %s in %d file(s) and %s: %s",
+			p.name, formatBytes(p.sent), p.files, elapsed, err)
+		return
+	}
+
+	log.Printf("Uploaded %s: %s in %d file(s) in %s (%s/s)",
+		p.name, formatBytes(p.sent), p.files, elapsed, formatBytes(int64(rate)))
+}
+
+type progressReader struct {
+	progress *transferProgress
+	r        io.Reader
+}
+
+func (r *progressReader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	r.progress.add(int64(n), true)
+	return n, err
+}
+
+type progressReadSeeker struct {
+	*progressReader
+	s   io.Seeker
+	pos int64
+}
+
+func (r *progressReadSeeker) Read(p []byte) (int, error) {
+	n, err := r.progressReader.Read(p)
+	r.pos += int64(n)
+	return n, err
+}
+
+func (r *progressReadSeeker) Seek(offset int64, whence int) (int64, error) {
+	pos, err := r.s.Seek(offset, whence)
+	if err != nil {
+		return pos, err
+	}
+
+	// Seeking to the end to find the size doesn't send anything, so the
+	// count is only updated and not reported
+	r.progress.add(pos-r.pos, false)
+	r.pos = pos
+	return pos, nil
+}
+
+// formatBytes formats a byte count for humans, such as "1.5 GB".
+func formatBytes(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit && exp < 4; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %cB", float64(n)/float64(div), "KMGTP"[exp])
+}
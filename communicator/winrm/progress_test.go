@@ -0,0 +1,125 @@
+package winrm
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// testUi records the messages it is given.
+type testUi struct {
+	lock     sync.Mutex
+	messages []string
+}
+
+func (u *testUi) Ask(string) (string, error) { return "", nil }
+func (u *testUi) Say(m string)               { u.Message(m) }
+func (u *testUi) Error(m string)             { u.Message(m) }
+func (u *testUi) Machine(string, ...string)  {}
+
+func (u *testUi) Message(m string) {
+	u.lock.Lock()
+	u.messages = append(u.messages, m)
+	u.lock.Unlock()
+}
+
+func TestTransferProgress(t *testing.T) {
+	ui := &testUi{}
+	comm := &Communicator{config: &Config{Ui: ui, ProgressInterval: time.Nanosecond}}
+
+	content := bytes.Repeat([]byte("x"), 4096)
+	p := comm.newProgress(`C:\file`, int64(len(content)))
+	p.startFile()
+
+	r := p.reader(bytes.NewReader(content))
+	buf := make([]byte, 1024)
+	for {
+		if _, err := r.Read(buf); err == io.EOF {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+	p.finish(nil)
+
+	if p.sent != int64(len(content)) {
+		t.Fatalf("bad bytes sent: %d", p.sent)
+	}
+	if len(ui.messages) == 0 {
+		t.Fatal("should report progress")
+	}
+	last := ui.messages[len(ui.messages)-1]
+	if !strings.HasPrefix(last, `C:\file: 100% (4.0 KB of 4.0 KB), `) {
+		t.Fatalf("bad progress: %s", last)
+	}
+}
+
+func TestTransferProgress_Seek(t *testing.T) {
+	comm := &Communicator{config: &Config{}}
+	p := comm.newProgress(`C:\file`, 6)
+
+	r := p.reader(strings.NewReader("packer"))
+	rs, ok := r.(io.ReadSeeker)
+	if !ok {
+		t.Fatal("should be able to seek")
+	}
+
+	if _, err := ioutil.ReadAll(rs); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if p.sent != 6 {
+		t.Fatalf("bad bytes sent: %d", p.sent)
+	}
+
+	// Starting over takes the bytes off again
+	if _, err := rs.Seek(0, os.SEEK_SET); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if p.sent != 0 {
+		t.Fatalf("bad bytes sent after seek: %d", p.sent)
+	}
+
+	if _, ok := p.reader(bytes.NewBufferString("packer")).(io.Seeker); ok {
+		t.Fatal("should not be able to seek")
+	}
+}
+
+func TestTransferProgress_Status(t *testing.T) {
+	start := time.Now()
+	p := &transferProgress{name: `C:\file`, total: 4 * 1024 * 1024, start: start}
+	p.sent = 1024 * 1024
+
+	status := p.status(start.Add(time.Second))
+	expected := `C:\file: 25% (1.0 MB of 4.0 MB), 1.0 MB/s, 3s left`
+	if status != expected {
+		t.Fatalf("bad status: %s", status)
+	}
+
+	p.total = -1
+	status = p.status(start.Add(time.Second))
+	if status != `C:\file: 1.0 MB, 1.0 MB/s` {
+		t.Fatalf("bad status: %s", status)
+	}
+}
+
+func TestFormatBytes(t *testing.T) {
+	cases := map[int64]string{
+		0:               "0 B",
+		1023:            "1023 B",
+		1024:            "1.0 KB",
+		1536:            "1.5 KB",
+		5 * 1024 * 1024: "5.0 MB",
+		2 << 30:         "2.0 GB",
+		3 << 40:         "3.0 TB",
+	}
+
+	for n, expected := range cases {
+		if actual := formatBytes(n); actual != expected {
+			t.Fatalf("bad format of %d: %s", n, actual)
+		}
+	}
+}
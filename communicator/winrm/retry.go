@@ -0,0 +1,181 @@
+package winrm
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"path"
+	"regexp"
+	"time"
+)
+
+// RetryPolicy controls how requests that fail with a transient error, such
+// as a reset connection or an overloaded WinRM service, are retried.
+type RetryPolicy struct {
+	// MaxAttempts is the number of times a request is sent before giving
+	// up. One disables retries.
+	MaxAttempts int
+
+	// InitialBackoff is the wait before the first retry. It doubles with
+	// every attempt, up to MaxBackoff.
+	InitialBackoff time.Duration
+	MaxBackoff     time.Duration
+}
+
+// DefaultRetryPolicy is used for the fields of Config.Retry that are not
+// set.
+var DefaultRetryPolicy = RetryPolicy{
+	MaxAttempts:    5,
+	InitialBackoff: time.Second,
+	MaxBackoff:     30 * time.Second,
+}
+
+// withDefaults fills in the fields that are not set from
+// DefaultRetryPolicy.
+func (p RetryPolicy) withDefaults() RetryPolicy {
+	if p.MaxAttempts <= 0 {
+		p.MaxAttempts = DefaultRetryPolicy.MaxAttempts
+	}
+	if p.InitialBackoff <= 0 {
+		p.InitialBackoff = DefaultRetryPolicy.InitialBackoff
+	}
+	if p.MaxBackoff <= 0 {
+		p.MaxBackoff = DefaultRetryPolicy.MaxBackoff
+	}
+	if p.MaxBackoff < p.InitialBackoff {
+		p.MaxBackoff = p.InitialBackoff
+	}
+	return p
+}
+
+// backoff returns the wait after the given failed attempt, counting from
+// one.
+func (p RetryPolicy) backoff(attempt int) time.Duration {
+	d := p.InitialBackoff
+	for i := 1; i < attempt && d < p.MaxBackoff; i++ {
+		d *= 2
+	}
+	if d > p.MaxBackoff {
+		d = p.MaxBackoff
+	}
+	return d
+}
+
+// wsmanFaultMaxShells is the WSManFault code returned when the user
+// already has as many shells open as the service allows. Shells closed by
+// other clients free up slots, so it is worth waiting for.
+const wsmanFaultMaxShells = "2150859173"
+
+// transportError is a failure to exchange a request with the WinRM
+// service, such as a refused or reset connection.
+type transportError struct {
+	err error
+
+	// delivered is set if the request may have reached the service
+	delivered bool
+}
+
+func (e *transportError) Error() string {
+	return e.err.Error()
+}
+
+// httpStatusError is returned for an HTTP error response without a SOAP
+// fault.
+type httpStatusError struct {
+	StatusCode int
+}
+
+func (e *httpStatusError) Error() string {
+	return fmt.Sprintf("WinRM request failed: http response code %d", e.StatusCode)
+}
+
+// newTransportError classifies an error returned by http.Client.Do. Only a
+// failure to connect guarantees the service never saw the request.
+func newTransportError(err error) *transportError {
+	inner := err
+	if e, ok := inner.(*url.Error); ok {
+		inner = e.Err
+	}
+	e, ok := inner.(*net.OpError)
+	return &transportError{err: err, delivered: !ok || e.Op != "dial"}
+}
+
+// retryable reports whether a request that failed with err can be sent
+// again. Requests that change the state of a shell or read its output are
+// only resent if the service certainly did not act on them, so a command
+// never runs twice, input is never sent twice, output is never lost and no
+// shell is left open behind the one that is used.
+func retryable(action string, err error) bool {
+	switch e := err.(type) {
+	case *wsmanFault:
+		if isTimedOut(e) {
+			switch action {
+			case actionReceive:
+				// A long poll coming back empty, which the caller
+				// repeats itself
+				return false
+			case actionCommand, actionSend:
+				// The operation may have gone ahead on the guest
+				return false
+			}
+			return true
+		}
+		return e.Code == wsmanFaultMaxShells
+	case *transportError:
+		switch action {
+		case actionCreate, actionCommand, actionSend, actionReceive:
+			return !e.delivered
+		}
+		return true
+	case *httpStatusError:
+		if e.StatusCode == http.StatusServiceUnavailable {
+			return true
+		}
+		if action == actionCommand || action == actionSend {
+			return false
+		}
+		return e.StatusCode == http.StatusInternalServerError ||
+			e.StatusCode == http.StatusBadGateway ||
+			e.StatusCode == http.StatusGatewayTimeout
+	}
+	return false
+}
+
+// transientMessage matches the messages of errors returned by winrmcp for
+// dropped connections, server errors and the retryable faults.
+var transientMessage = regexp.MustCompile(`connection reset|connection refused|broken pipe|unexpected EOF|` +
+	`http error:? 50[0234]|` + wsmanFaultTimedOut + `|` + wsmanFaultMaxShells)
+
+// isTransient reports whether an error from a copy made with winrmcp looks
+// like a dropped connection or an overloaded service. winrmcp only returns
+// formatted errors, so this goes by their messages.
+func isTransient(err error) bool {
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		return true
+	}
+	if _, ok := err.(net.Error); ok {
+		return true
+	}
+
+	return transientMessage.MatchString(err.Error())
+}
+
+// post sends a request and decodes the response envelope, retrying
+// transient failures according to the retry policy. SOAP faults are
+// returned as a *wsmanFault.
+func (c *wsmanClient) post(r *wsmanRequest) (*wsmanResponse, error) {
+	for attempt := 1; ; attempt++ {
+		resp, err := c.postOnce(r)
+		if err == nil || attempt >= c.retry.MaxAttempts || !retryable(r.action, err) {
+			return resp, err
+		}
+
+		backoff := c.retry.backoff(attempt)
+		log.Printf("WinRM %s request failed (attempt %d of %d), retrying in %s: %s",
+			path.Base(r.action), attempt, c.retry.MaxAttempts, backoff, err)
+		time.Sleep(backoff)
+	}
+}
@@ -0,0 +1,217 @@
+package winrm
+
+import (
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/packer-community/packer-windows-plugins/communicator/winrm/winrmtest"
+)
+
+func TestRetryPolicy_Backoff(t *testing.T) {
+	p := RetryPolicy{MaxAttempts: 10, InitialBackoff: time.Second, MaxBackoff: 5 * time.Second}
+
+	expected := []time.Duration{time.Second, 2 * time.Second, 4 * time.Second, 5 * time.Second, 5 * time.Second}
+	for i, d := range expected {
+		if actual := p.backoff(i + 1); actual != d {
+			t.Fatalf("bad backoff after attempt %d: %s", i+1, actual)
+		}
+	}
+}
+
+func TestRetryPolicy_WithDefaults(t *testing.T) {
+	p := RetryPolicy{}.withDefaults()
+	if p != DefaultRetryPolicy {
+		t.Fatalf("bad policy: %#v", p)
+	}
+
+	p = RetryPolicy{MaxAttempts: 1, MaxBackoff: time.Millisecond}.withDefaults()
+	if p.MaxAttempts != 1 || p.InitialBackoff != time.Second || p.MaxBackoff != time.Second {
+		t.Fatalf("bad policy: %#v", p)
+	}
+}
+
+func TestRetryable(t *testing.T) {
+	dial := newTransportError(&url.Error{Op: "Post", URL: "http://guest", Err: &net.OpError{Op: "dial", Err: errors.New("connection refused")}})
+	reset := newTransportError(&url.Error{Op: "Post", URL: "http://guest", Err: &net.OpError{Op: "read", Err: errors.New("connection reset by peer")}})
+
+	cases := []struct {
+		action   string
+		err      error
+		expected bool
+	}{
+		{actionCreate, dial, true},
+		{actionCreate, reset, false},
+		{actionCommand, dial, true},
+		{actionCommand, reset, false},
+		{actionSend, reset, false},
+		{actionReceive, dial, true},
+		{actionReceive, reset, false},
+		{actionDelete, reset, true},
+		{actionCreate, &wsmanFault{Code: wsmanFaultMaxShells}, true},
+		{actionCreate, &wsmanFault{Code: wsmanFaultTimedOut}, true},
+		{actionReceive, &wsmanFault{Code: wsmanFaultTimedOut}, false},
+		{actionCommand, &wsmanFault{Code: wsmanFaultTimedOut}, false},
+		{actionSend, &wsmanFault{Code: wsmanFaultTimedOut}, false},
+		{actionCommand, &wsmanFault{Code: "2147942402"}, false},
+		{actionCreate, &httpStatusError{StatusCode: 500}, true},
+		{actionCommand, &httpStatusError{StatusCode: 500}, false},
+		{actionCommand, &httpStatusError{StatusCode: 503}, true},
+		{actionCreate, &httpStatusError{StatusCode: 401}, false},
+		{actionCreate, errors.New("Error parsing WinRM response"), false},
+	}
+
+	for _, tc := range cases {
+		if actual := retryable(tc.action, tc.err); actual != tc.expected {
+			t.Errorf("retryable(%s, %s) = %t", tc.action, tc.err, actual)
+		}
+	}
+}
+
+func TestIsTransient(t *testing.T) {
+	transient := []error{
+		io.EOF,
+		io.ErrUnexpectedEOF,
+		errors.New("Post http://guest:5985/wsman: read tcp: connection reset by peer"),
+		errors.New("http error 503: Service Unavailable"),
+		errors.New("http error: 500 - <f:WSManFault Code=\"2150858793\">"),
+	}
+	for _, err := range transient {
+		if !isTransient(err) {
+			t.Errorf("should be transient: %s", err)
+		}
+	}
+
+	permanent := []error{
+		errors.New("http error 401: Unauthorized"),
+		errors.New("Access to the path is denied"),
+	}
+	for _, err := range permanent {
+		if isTransient(err) {
+			t.Errorf("should not be transient: %s", err)
+		}
+	}
+}
+
+// flakyHandler fails the first requests with the given status before
+// passing them on.
+type flakyHandler struct {
+	lock     sync.Mutex
+	failures int
+	status   int
+	requests int
+	next     http.Handler
+}
+
+// newFlakyServer puts a flakyHandler in front of a test shell server.
+func newFlakyServer() (*winrmtest.Remote, *flakyHandler) {
+	s := newTestShellServer()
+	h := &flakyHandler{next: s}
+	s.Server.Close()
+	s.Server = httptest.NewServer(h)
+	return s, h
+}
+
+// fail has the next n requests fail with the given status.
+func (h *flakyHandler) fail(n, status int) {
+	h.lock.Lock()
+	h.requests = 0
+	h.failures = n
+	h.status = status
+	h.lock.Unlock()
+}
+
+func (h *flakyHandler) count() int {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	return h.requests
+}
+
+func (h *flakyHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	h.lock.Lock()
+	h.requests++
+	fail := h.requests <= h.failures
+	h.lock.Unlock()
+
+	if fail {
+		http.Error(w, "busy", h.status)
+		return
+	}
+	h.next.ServeHTTP(w, r)
+}
+
+func TestPost_Retry(t *testing.T) {
+	s, h := newFlakyServer()
+	defer s.Close()
+
+	h.fail(2, http.StatusServiceUnavailable)
+	config := testRemoteConfig(s)
+	config.Retry = RetryPolicy{MaxAttempts: 3, InitialBackoff: time.Millisecond}
+	if _, err := New(config); err != nil {
+		t.Fatalf("should connect after retrying: %s", err)
+	}
+	if n := h.count(); n != 3 {
+		t.Fatalf("bad number of requests: %d", n)
+	}
+
+	// Giving up after the last attempt
+	h.fail(3, http.StatusServiceUnavailable)
+	if _, err := New(config); err == nil {
+		t.Fatal("should have error")
+	}
+	if n := h.count(); n != 3 {
+		t.Fatalf("bad number of requests: %d", n)
+	}
+}
+
+func TestPost_NoRetryCommand(t *testing.T) {
+	s, h := newFlakyServer()
+	defer s.Close()
+
+	config := testRemoteConfig(s)
+	config.Retry = RetryPolicy{MaxAttempts: 3, InitialBackoff: time.Millisecond}
+	comm, err := New(config)
+	if err != nil {
+		t.Fatalf("error connecting to WinRM: %s", err)
+	}
+
+	ps, err := comm.pool.Get()
+	if err != nil {
+		t.Fatalf("error getting shell: %s", err)
+	}
+	defer comm.pool.Put(ps)
+
+	// The command may have started, so it must not be sent again
+	h.fail(1, http.StatusInternalServerError)
+
+	if _, err := ps.shell.(*shell).execute("cat"); err == nil {
+		t.Fatal("should have error")
+	}
+	if n := h.count(); n != 1 {
+		t.Fatalf("bad number of requests: %d", n)
+	}
+}
+
+func TestNewTransportError(t *testing.T) {
+	httpServer := httptest.NewServer(http.NotFoundHandler())
+	addr := httpServer.Listener.Addr().String()
+	httpServer.Close()
+
+	_, err := http.Post("http://"+addr+"/wsman", "text/plain", nil)
+	if err == nil {
+		t.Fatal("should not connect to a closed server")
+	}
+	if e := newTransportError(err); e.delivered {
+		t.Fatalf("refused connection should not be delivered: %s", err)
+	}
+
+	if e := newTransportError(io.ErrUnexpectedEOF); !e.delivered {
+		t.Fatal("other errors may have been delivered")
+	}
+}
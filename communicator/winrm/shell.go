@@ -0,0 +1,306 @@
+package winrm
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"strconv"
+	"sync"
+)
+
+// maxSendSize is the most stdin sent in one Send request. Base64 encoded
+// it stays well below the 150KB default MaxEnvelopeSizekb of Windows
+// Server 2008 R2.
+const maxSendSize = 64 * 1024
+
+const signalTerminate = nsShell + "/signal/terminate"
+
+// shell is a cmd shell on the guest. Commands run in a shell one at a
+// time.
+type shell struct {
+	client *wsmanClient
+	id     string
+}
+
+// createShell opens a shell whose console uses the given code page.
+func (c *wsmanClient) createShell(codepage int) (*shell, error) {
+	resp, err := c.post(&wsmanRequest{
+		action: actionCreate,
+		options: []wsmanOption{
+			{"WINRS_NOPROFILE", "FALSE"},
+			{"WINRS_CODEPAGE", strconv.Itoa(codepage)},
+		},
+		body: `<rsp:Shell><rsp:InputStreams>stdin</rsp:InputStreams><rsp:OutputStreams>stdout stderr</rsp:OutputStreams></rsp:Shell>`,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	id := resp.shellID()
+	if id == "" {
+		return nil, errors.New("WinRM service did not return a shell ID")
+	}
+
+	return &shell{client: c, id: id}, nil
+}
+
+// Close deletes the shell on the guest.
+func (s *shell) Close() error {
+	_, err := s.client.post(&wsmanRequest{
+		action:  actionDelete,
+		shellID: s.id,
+	})
+	return err
+}
+
+// execute starts a command in the shell. Its output must be read from
+// both Stdout and Stderr, or the command stalls once either pipe is full.
+func (s *shell) execute(command string, args ...string) (*remoteCommand, error) {
+	body := `<rsp:CommandLine><rsp:Command>` + xmlEscape(command) + `</rsp:Command>`
+	for _, arg := range args {
+		body += `<rsp:Arguments>` + xmlEscape(arg) + `</rsp:Arguments>`
+	}
+	body += `</rsp:CommandLine>`
+
+	resp, err := s.client.post(&wsmanRequest{
+		action:  actionCommand,
+		shellID: s.id,
+		options: []wsmanOption{
+			{"WINRS_CONSOLEMODE_STDIN", "TRUE"},
+			{"WINRS_SKIP_CMD_SHELL", "FALSE"},
+		},
+		body: body,
+	})
+	if err != nil {
+		return nil, err
+	}
+	if resp.Body.CommandResponse == nil || resp.Body.CommandResponse.CommandID == "" {
+		return nil, errors.New("WinRM service did not return a command ID")
+	}
+
+	stdout, stdoutW := io.Pipe()
+	stderr, stderrW := io.Pipe()
+	cmd := &remoteCommand{
+		shell:    s,
+		id:       resp.Body.CommandResponse.CommandID,
+		Stdout:   stdout,
+		Stderr:   stderr,
+		stdout:   stdoutW,
+		stderr:   stderrW,
+		done:     make(chan struct{}),
+		exitCode: -1,
+	}
+	cmd.Stdin = &commandStdin{cmd: cmd}
+
+	go cmd.receive()
+	return cmd, nil
+}
+
+// remoteCommand is a command running in a shell on the guest.
+type remoteCommand struct {
+	shell *shell
+	id    string
+
+	// Stdin streams input to the command. Closing it signals the end of
+	// the input.
+	Stdin io.WriteCloser
+
+	Stdout io.Reader
+	Stderr io.Reader
+
+	stdout *io.PipeWriter
+	stderr *io.PipeWriter
+
+	done     chan struct{}
+	exitCode int
+	err      error
+
+	lock         sync.Mutex
+	isTerminated bool
+}
+
+// Wait blocks until the command has finished and its output has been
+// read.
+func (c *remoteCommand) Wait() {
+	<-c.done
+}
+
+// ExitCode returns the exit code of the finished command, or -1 if the
+// command's state could not be determined.
+func (c *remoteCommand) ExitCode() int {
+	return c.exitCode
+}
+
+// Err returns the error that stopped the command's output from being
+// received, if any.
+func (c *remoteCommand) Err() error {
+	return c.err
+}
+
+// receive reads the command's output until it has finished.
+func (c *remoteCommand) receive() {
+	defer close(c.done)
+
+	err := c.receiveOutput()
+	if err != nil {
+		c.err = err
+		log.Printf("Error receiving WinRM command output: %s", err)
+	}
+	c.stdout.CloseWithError(err)
+	c.stderr.CloseWithError(err)
+
+	// Releases the command's resources in the shell
+	if err := c.signal(signalTerminate); err != nil {
+		log.Printf("Error terminating WinRM command: %s", err)
+	}
+}
+
+func (c *remoteCommand) receiveOutput() error {
+	for {
+		resp, err := c.shell.client.post(&wsmanRequest{
+			action:  actionReceive,
+			shellID: c.shell.id,
+			options: []wsmanOption{
+				{"WSMAN_CMDSHELL_OPTION_KEEPALIVE", "TRUE"},
+			},
+			body: `<rsp:Receive><rsp:DesiredStream CommandId="` + xmlEscape(c.id) + `">stdout stderr</rsp:DesiredStream></rsp:Receive>`,
+		})
+		if isTimedOut(err) {
+			// No output within the operation timeout
+			continue
+		}
+		if err != nil {
+			return err
+		}
+
+		r := resp.Body.ReceiveResponse
+		if r == nil {
+			return errors.New("WinRM service returned no command output")
+		}
+
+		for _, s := range r.Streams {
+			if s.Content == "" {
+				continue
+			}
+
+			data, err := base64.StdEncoding.DecodeString(s.Content)
+			if err != nil {
+				return fmt.Errorf("Error decoding %s: %s", s.Name, err)
+			}
+
+			switch s.Name {
+			case "stdout":
+				c.stdout.Write(data)
+			case "stderr":
+				c.stderr.Write(data)
+			}
+		}
+
+		if state := r.CommandState; state != nil && state.State == commandStateDone {
+			if state.ExitCode != nil {
+				c.exitCode = *state.ExitCode
+			}
+			return nil
+		}
+	}
+}
+
+// terminate stops the command before it exits by itself.
+func (c *remoteCommand) terminate() error {
+	c.lock.Lock()
+	c.isTerminated = true
+	c.lock.Unlock()
+
+	return c.signal(signalTerminate)
+}
+
+// terminated reports whether terminate was called.
+func (c *remoteCommand) terminated() bool {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	return c.isTerminated
+}
+
+// send streams a block of input to the command. end marks the end of the
+// input.
+func (c *remoteCommand) send(data []byte, end bool) error {
+	endAttr := ""
+	if end {
+		endAttr = ` End="true"`
+	}
+
+	_, err := c.shell.client.post(&wsmanRequest{
+		action:  actionSend,
+		shellID: c.shell.id,
+		body: `<rsp:Send><rsp:Stream Name="stdin" CommandId="` + xmlEscape(c.id) + `"` + endAttr + `>` +
+			base64.StdEncoding.EncodeToString(data) + `</rsp:Stream></rsp:Send>`,
+	})
+	return err
+}
+
+// signal sends a signal, such as signalTerminate, to the command.
+func (c *remoteCommand) signal(code string) error {
+	_, err := c.shell.client.post(&wsmanRequest{
+		action:  actionSignal,
+		shellID: c.shell.id,
+		body: `<rsp:Signal CommandId="` + xmlEscape(c.id) + `"><rsp:Code>` + code +
+			`</rsp:Code></rsp:Signal>`,
+	})
+	return err
+}
+
+// commandStdin writes to a command's stdin with Send requests.
+type commandStdin struct {
+	cmd *remoteCommand
+
+	lock   sync.Mutex
+	closed bool
+}
+
+func (w *commandStdin) Write(p []byte) (int, error) {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+
+	if w.closed {
+		return 0, errors.New("write to closed stdin")
+	}
+
+	n := 0
+	for len(p) > 0 {
+		chunk := p
+		if len(chunk) > maxSendSize {
+			chunk = chunk[:maxSendSize]
+		}
+
+		if err := w.cmd.send(chunk, false); err != nil {
+			return n, err
+		}
+		n += len(chunk)
+		p = p[len(chunk):]
+	}
+
+	return n, nil
+}
+
+// Close tells the command there is no more input.
+func (w *commandStdin) Close() error {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+
+	if w.closed {
+		return nil
+	}
+	w.closed = true
+
+	select {
+	case <-w.cmd.done:
+		// The command finished without reading all of its input
+		return nil
+	default:
+	}
+
+	return w.cmd.send(nil, true)
+}
@@ -0,0 +1,116 @@
+package winrm
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"testing"
+
+	"github.com/packer-community/packer-windows-plugins/communicator/winrm/winrmtest"
+)
+
+// newTestShellServer returns a fake WinRM service with two commands:
+// "cat" echoes its stdin to stdout, and "hang" runs until it is
+// terminated.
+func newTestShellServer() *winrmtest.Remote {
+	r := winrmtest.NewRemote()
+	r.CommandFunc(winrmtest.MatchText("cat"), func(cmd *winrmtest.Cmd) int {
+		io.Copy(cmd.Stdout, cmd.Stdin)
+		return 0
+	})
+	r.CommandFunc(winrmtest.MatchText("hang"), func(cmd *winrmtest.Cmd) int {
+		<-cmd.Terminated
+		return 0
+	})
+	return r
+}
+
+// testRemoteConfig returns the configuration for connecting to a fake
+// WinRM service.
+func testRemoteConfig(r *winrmtest.Remote) *Config {
+	config := testConfig()
+	config.Host, config.Port = r.HostPort()
+	return config
+}
+
+// testConnect returns a communicator connected to a fake WinRM service,
+// like commtest.ConnectWinRM, which the tests of this package can't import.
+func testConnect(t *testing.T, r *winrmtest.Remote) *Communicator {
+	comm, err := New(testRemoteConfig(r))
+	if err != nil {
+		t.Fatalf("error connecting to WinRM: %s", err)
+	}
+	return comm
+}
+
+func TestShellStdin(t *testing.T) {
+	s := newTestShellServer()
+	defer s.Close()
+
+	comm := testConnect(t, s)
+
+	ps, cmd, err := comm.execute("cat")
+	if err != nil {
+		t.Fatalf("error starting command: %s", err)
+	}
+	defer comm.pool.Put(ps)
+
+	// More than fits in a single Send request
+	input := bytes.Repeat([]byte("0123456789abcdef"), maxSendSize/8)
+
+	go func() {
+		cmd.Stdin.Write(input)
+		cmd.Stdin.Close()
+	}()
+	go io.Copy(ioutil.Discard, cmd.Stderr)
+
+	output, err := ioutil.ReadAll(cmd.Stdout)
+	if err != nil {
+		t.Fatalf("error reading output: %s", err)
+	}
+	cmd.Wait()
+
+	if !bytes.Equal(output, input) {
+		t.Fatalf("bad output: %d bytes, expected %d", len(output), len(input))
+	}
+
+	// Two chunks of input and the end of stream
+	if n := s.Requests("Send"); n != 3 {
+		t.Fatalf("bad number of Send requests: %d", n)
+	}
+}
+
+func TestShellFault(t *testing.T) {
+	s := newTestShellServer()
+	defer s.Close()
+
+	comm := testConnect(t, s)
+
+	_, _, err := comm.execute("unknown")
+	if err == nil {
+		t.Fatal("should have error")
+	}
+
+	f, ok := err.(*wsmanFault)
+	if !ok {
+		t.Fatalf("should be a fault: %#v", err)
+	}
+	if f.Code != winrmtest.FaultUnknownCommand || f.Reason != "unknown command: unknown" {
+		t.Fatalf("bad fault: %#v", f)
+	}
+}
+
+func TestIsTimedOut(t *testing.T) {
+	if !isTimedOut(&wsmanFault{Code: wsmanFaultTimedOut}) {
+		t.Fatal("should be timed out")
+	}
+	if !isTimedOut(&wsmanFault{Subcode: "w:TimedOut"}) {
+		t.Fatal("should be timed out")
+	}
+	if isTimedOut(&wsmanFault{Subcode: "w:InternalError"}) {
+		t.Fatal("should not be timed out")
+	}
+	if isTimedOut(nil) {
+		t.Fatal("should not be timed out")
+	}
+}
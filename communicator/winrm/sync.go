@@ -0,0 +1,143 @@
+package winrm
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strings"
+)
+
+// hashDirScript prints one line per file below a remote directory, with
+// its SHA-256, or "-" if it can't be read, followed by the path relative
+// to the directory. A directory that doesn't exist has no files.
+const hashDirScript = `$ProgressPreference='SilentlyContinue'
+$p='%s'
+if (!(Test-Path -LiteralPath $p)) { exit 0 }
+if (!(Test-Path -LiteralPath $p -PathType Container)) { [Console]::Error.WriteLine("$p is not a directory"); exit %d }
+$r=(Resolve-Path -LiteralPath $p).ProviderPath.TrimEnd('\')
+$h=[Security.Cryptography.SHA256]::Create()
+Get-ChildItem -LiteralPath $r -Recurse -Force | Where-Object { !$_.PSIsContainer } | ForEach-Object {
+$f=$_.FullName
+$s='-'
+try { $fs=[IO.File]::Open($f,'Open','Read','ReadWrite'); try { $s=[BitConverter]::ToString($h.ComputeHash($fs)).Replace('-','') } finally { $fs.Close() } } catch {}
+[Console]::Out.WriteLine($s+' '+$f.Substring($r.Length+1))
+}
+`
+
+// SyncDir copies the local directory src to the remote directory dst like
+// UploadDir, but only the files that are missing on the guest or whose
+// SHA-256 differs from the local one. Files on the guest that are not in
+// src are left alone. It returns the remote paths of the files copied.
+func (c *Communicator) SyncDir(dst string, src string, exclude []string) ([]string, error) {
+	log.Printf("Syncing dir to remote: %s -> %s", src, dst)
+
+	fi, err := os.Stat(src)
+	if err != nil {
+		return nil, err
+	}
+	if !fi.IsDir() {
+		return nil, fmt.Errorf("%s is not a directory", src)
+	}
+
+	files, dirs, err := planUploadDir(dst, src, exclude)
+	if err != nil {
+		return nil, err
+	}
+
+	remote, err := c.remoteHashes(uploadRoot(dst, src))
+	if err != nil {
+		return nil, err
+	}
+
+	var changed []uploadFile
+	var total int64
+	for _, file := range files {
+		sum, err := fileHash(file.local)
+		if err != nil {
+			return nil, err
+		}
+
+		if remote[strings.ToLower(file.remote)] == sum {
+			continue
+		}
+		changed = append(changed, file)
+		total += file.size
+	}
+	log.Printf("%d of %d files changed", len(changed), len(files))
+
+	if len(dirs) > 0 {
+		if err := c.mkdirs(dirs); err != nil {
+			return nil, err
+		}
+	}
+
+	var copied []string
+	if len(changed) == 0 {
+		return copied, nil
+	}
+
+	wcp, err := c.newCopyClient()
+	if err != nil {
+		return nil, err
+	}
+
+	progress := c.newProgress(dst, total)
+	err = c.uploadFiles(wcp, changed, progress)
+	progress.finish(err)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, file := range changed {
+		copied = append(copied, file.remote)
+	}
+	return copied, nil
+}
+
+// remoteHashes returns the SHA-256 of the files below a remote directory,
+// keyed by their lower case full path.
+func (c *Communicator) remoteHashes(dir string) (map[string]string, error) {
+	stdout, stderr, code, err := c.runPowershell(fmt.Sprintf(hashDirScript,
+		psQuote(dir), downloadExitIsDirectory))
+	if err != nil {
+		return nil, err
+	}
+	if code != 0 {
+		return nil, downloadError(dir, code, stderr)
+	}
+
+	hashes := make(map[string]string)
+	for _, line := range strings.Split(stdout, "\n") {
+		line = strings.TrimRight(line, "\r")
+		if line == "" {
+			continue
+		}
+
+		i := strings.Index(line, " ")
+		if i < 1 {
+			return nil, fmt.Errorf("unexpected hash listing line: %q", line)
+		}
+		path := winJoin(dir, strings.Replace(line[i+1:], `\`, "/", -1))
+		hashes[strings.ToLower(path)] = strings.ToLower(line[:i])
+	}
+
+	return hashes, nil
+}
+
+// fileHash returns the hex encoded SHA-256 of a local file.
+func fileHash(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
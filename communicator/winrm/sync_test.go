@@ -0,0 +1,67 @@
+package winrm
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/packer-community/packer-windows-plugins/communicator/winrm/winrmtest"
+)
+
+func TestSyncDir(t *testing.T) {
+	s := winrmtest.NewRemote()
+	defer s.Close()
+
+	src, err := ioutil.TempDir("", "packer-sync")
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	defer os.RemoveAll(src)
+
+	os.MkdirAll(filepath.Join(src, "scripts"), 0755)
+	os.MkdirAll(filepath.Join(src, "empty"), 0755)
+	ioutil.WriteFile(filepath.Join(src, "unchanged.txt"), []byte("same"), 0644)
+	ioutil.WriteFile(filepath.Join(src, "scripts", "setup.ps1"), []byte("Write-Host new"), 0644)
+	ioutil.WriteFile(filepath.Join(src, "added.txt"), []byte("added"), 0644)
+
+	// File names are not case sensitive on the guest
+	s.WriteFile(`C:\app\UNCHANGED.txt`, []byte("same"))
+	s.WriteFile(`C:\app\scripts\setup.ps1`, []byte("Write-Host old"))
+	s.WriteFile(`C:\app\extra.txt`, []byte("left alone"))
+
+	comm := testConnect(t, s)
+	defer comm.Close()
+
+	copied, err := comm.SyncDir(`C:\app`, src+"/", nil)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	expected := []string{`C:\app\added.txt`, `C:\app\scripts\setup.ps1`}
+	if fmt.Sprint(copied) != fmt.Sprint(expected) {
+		t.Fatalf("bad files copied: %v", copied)
+	}
+	if _, ok := s.File(`C:\app\extra.txt`); !ok {
+		t.Fatal("remote only file should be left alone")
+	}
+	if !s.IsDir(`C:\app\empty`) {
+		t.Fatal("empty directory should be created")
+	}
+
+	// Nothing to copy once the guest has the same files
+	s.WriteFile(`C:\app\scripts\setup.ps1`, []byte("Write-Host new"))
+	s.WriteFile(`C:\app\added.txt`, []byte("added"))
+	copied, err = comm.SyncDir(`C:\app`, src+"/", nil)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if len(copied) != 0 {
+		t.Fatalf("should copy nothing: %v", copied)
+	}
+
+	if _, err := comm.SyncDir(`C:\app`, filepath.Join(src, "added.txt"), nil); err == nil {
+		t.Fatal("should not sync a file")
+	}
+}
@@ -0,0 +1,92 @@
+package winrm
+
+import (
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// newTLSConfig builds the TLS client configuration for an HTTPS endpoint.
+//
+// When a thumbprint is configured the certificate chain is not verified,
+// since WinRM listeners almost always use self-signed certificates, and the
+// server certificate must match the pinned thumbprint instead.
+func newTLSConfig(config *Config) (*tls.Config, error) {
+	tlsConfig := &tls.Config{
+		ServerName:         config.Host,
+		InsecureSkipVerify: config.Insecure,
+	}
+
+	if len(config.CACert) > 0 {
+		// The CA certificate is trusted in addition to the system roots,
+		// which are missing on some platforms.
+		pool, err := x509.SystemCertPool()
+		if err != nil {
+			pool = x509.NewCertPool()
+		}
+		if !pool.AppendCertsFromPEM(config.CACert) {
+			return nil, errors.New("no PEM certificates found in WinRM CA certificate")
+		}
+		tlsConfig.RootCAs = pool
+	}
+
+	if config.Thumbprint != "" {
+		thumbprint, err := NormalizeThumbprint(config.Thumbprint)
+		if err != nil {
+			return nil, err
+		}
+
+		tlsConfig.InsecureSkipVerify = true
+		tlsConfig.VerifyPeerCertificate = func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+			if len(rawCerts) == 0 {
+				return errors.New("WinRM server presented no certificate")
+			}
+
+			actual := certThumbprint(rawCerts[0], len(thumbprint))
+			if actual != thumbprint {
+				return fmt.Errorf("WinRM server certificate thumbprint %s does not match %s",
+					actual, thumbprint)
+			}
+			return nil
+		}
+	}
+
+	return tlsConfig, nil
+}
+
+// NormalizeThumbprint strips the separators that certificate tools put in
+// thumbprints and checks that what is left is a hex encoded SHA-1 or
+// SHA-256 hash. The result is upper case, the way Windows displays it.
+func NormalizeThumbprint(thumbprint string) (string, error) {
+	// The certificate manager MMC snap-in prefixes copied thumbprints with
+	// an invisible left-to-right mark.
+	t := strings.NewReplacer(" ", "", ":", "", "\u200e", "").Replace(thumbprint)
+	t = strings.ToUpper(t)
+
+	if len(t) != 2*sha1.Size && len(t) != 2*sha256.Size {
+		return "", fmt.Errorf("certificate thumbprint must be a SHA-1 or SHA-256 hash: %s", thumbprint)
+	}
+
+	if _, err := hex.DecodeString(t); err != nil {
+		return "", fmt.Errorf("certificate thumbprint is not hex encoded: %s", thumbprint)
+	}
+
+	return t, nil
+}
+
+// certThumbprint hashes a DER encoded certificate with the algorithm
+// implied by the length of the expected thumbprint.
+func certThumbprint(der []byte, length int) string {
+	if length == 2*sha256.Size {
+		sum := sha256.Sum256(der)
+		return strings.ToUpper(hex.EncodeToString(sum[:]))
+	}
+
+	sum := sha1.Sum(der)
+	return strings.ToUpper(hex.EncodeToString(sum[:]))
+}
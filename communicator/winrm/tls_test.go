@@ -0,0 +1,129 @@
+package winrm
+
+import (
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/pem"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func testTLSServer(t *testing.T) (*httptest.Server, *Config) {
+	ts := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+
+	u, err := url.Parse(ts.URL)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	port, _ := strconv.Atoi(u.Port())
+	return ts, &Config{Host: u.Hostname(), Port: port, Https: true}
+}
+
+func testTLSGet(config *Config, ts *httptest.Server) error {
+	tlsConfig, err := newTLSConfig(config)
+	if err != nil {
+		return err
+	}
+
+	client := &http.Client{Transport: &http.Transport{TLSClientConfig: tlsConfig}}
+	resp, err := client.Get(ts.URL)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+func TestNewTLSConfig_Default(t *testing.T) {
+	ts, config := testTLSServer(t)
+	defer ts.Close()
+
+	// The test server uses a self-signed certificate
+	if err := testTLSGet(config, ts); err == nil {
+		t.Fatal("should have error")
+	}
+}
+
+func TestNewTLSConfig_Insecure(t *testing.T) {
+	ts, config := testTLSServer(t)
+	defer ts.Close()
+
+	config.Insecure = true
+	if err := testTLSGet(config, ts); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+}
+
+func TestNewTLSConfig_CACert(t *testing.T) {
+	ts, config := testTLSServer(t)
+	defer ts.Close()
+
+	config.CACert = pem.EncodeToMemory(&pem.Block{
+		Type:  "CERTIFICATE",
+		Bytes: ts.Certificate().Raw,
+	})
+	config.Host = "example.com"
+	if err := testTLSGet(config, ts); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	config.CACert = []byte("garbage")
+	if _, err := newTLSConfig(config); err == nil {
+		t.Fatal("should have error")
+	}
+}
+
+func TestNewTLSConfig_Thumbprint(t *testing.T) {
+	ts, config := testTLSServer(t)
+	defer ts.Close()
+
+	sha1Sum := sha1.Sum(ts.Certificate().Raw)
+	sha256Sum := sha256.Sum256(ts.Certificate().Raw)
+
+	config.Thumbprint = hex.EncodeToString(sha1Sum[:])
+	if err := testTLSGet(config, ts); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	config.Thumbprint = hex.EncodeToString(sha256Sum[:])
+	if err := testTLSGet(config, ts); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	config.Thumbprint = strings.Repeat("AB", sha1.Size)
+	if err := testTLSGet(config, ts); err == nil {
+		t.Fatal("should have error")
+	}
+}
+
+func TestNormalizeThumbprint(t *testing.T) {
+	cases := map[string]string{
+		"d1 a5 0b 4f 4f 3e 7b 1e 93 16 5e 5a 57 70 a4 2e 3c 0d 9f 21": "D1A50B4F4F3E7B1E93165E5A5770A42E3C0D9F21",
+		"\u200ed1a50b4f4f3e7b1e93165e5a5770a42e3c0d9f21":              "D1A50B4F4F3E7B1E93165E5A5770A42E3C0D9F21",
+		"D1:A5:0B:4F:4F:3E:7B:1E:93:16:5E:5A:57:70:A4:2E:3C:0D:9F:21": "D1A50B4F4F3E7B1E93165E5A5770A42E3C0D9F21",
+	}
+
+	for input, expected := range cases {
+		actual, err := NormalizeThumbprint(input)
+		if err != nil {
+			t.Fatalf("err: %s", err)
+		}
+		if actual != expected {
+			t.Fatalf("bad thumbprint for %q: %s", input, actual)
+		}
+	}
+
+	for _, input := range []string{"", "D1A50B", strings.Repeat("ZZ", sha1.Size)} {
+		if _, err := NormalizeThumbprint(input); err == nil {
+			t.Fatalf("should have error for %q", input)
+		}
+	}
+}
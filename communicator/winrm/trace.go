@@ -0,0 +1,247 @@
+package winrm
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/packer-community/packer-windows-plugins/common/redact"
+)
+
+// traceMaxPayload is the longest base64 payload, such as command output or
+// an encoded PowerShell script, kept in a trace. Longer ones are replaced
+// by a comment giving their length.
+const traceMaxPayload = 256
+
+var (
+	traceAction    = regexp.MustCompile(`<(?:\w+:)?Action\b[^>]*>([^<]+)</`)
+	traceShellID   = regexp.MustCompile(`Name="ShellId"[^>]*>([^<]+)</`)
+	traceCommandID = regexp.MustCompile(`CommandId="([^"]+)"`)
+	traceBase64    = regexp.MustCompile(`[A-Za-z0-9+/]{64,}={0,2}`)
+)
+
+// TraceEntry is one request to the WinRM service and its response, as
+// written to a trace by Config.Trace, one JSON object per line.
+type TraceEntry struct {
+	Time        time.Time `json:"time"`
+	Duration    string    `json:"duration"`
+	Action      string    `json:"action"`
+	Request     string    `json:"request"`
+	Status      int       `json:"status,omitempty"`
+	ContentType string    `json:"content_type,omitempty"`
+	Response    string    `json:"response,omitempty"`
+	Error       string    `json:"error,omitempty"`
+}
+
+// tracer writes the requests and responses that pass through its
+// transports to a trace, with secrets and long payloads removed. Besides
+// its own secrets, which are also masked as they appear in XML, the ones
+// added to redact.Default are masked.
+type tracer struct {
+	lock    sync.Mutex
+	enc     *json.Encoder
+	secrets redact.Filter
+}
+
+func newTracer(w io.Writer, secrets ...string) *tracer {
+	t := &tracer{enc: json.NewEncoder(w)}
+	for _, s := range secrets {
+		t.secrets.Add(s, xmlEscape(s))
+	}
+	return t
+}
+
+// transport returns a RoundTripper that traces the requests it sends
+// through next.
+func (t *tracer) transport(next http.RoundTripper) http.RoundTripper {
+	return &traceTransport{tracer: t, next: next}
+}
+
+// redact removes the secrets and long payloads from s.
+func (t *tracer) redact(s string) string {
+	s = redact.String(t.secrets.String(s))
+
+	return traceBase64.ReplaceAllStringFunc(s, func(payload string) string {
+		if len(payload) <= traceMaxPayload {
+			return payload
+		}
+		return fmt.Sprintf("<!-- %d characters of base64 omitted -->", len(payload))
+	})
+}
+
+func (t *tracer) write(e *TraceEntry) {
+	e.Request = t.redact(e.Request)
+	e.Response = t.redact(e.Response)
+	e.Error = t.redact(e.Error)
+
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	t.enc.Encode(e)
+}
+
+type traceTransport struct {
+	tracer *tracer
+	next   http.RoundTripper
+}
+
+func (t *traceTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	body, err := readBody(&req.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	e := &TraceEntry{
+		Time:    time.Now().UTC(),
+		Action:  envelopeAction(body),
+		Request: string(body),
+	}
+
+	resp, err := t.next.RoundTrip(req)
+	e.Duration = time.Since(e.Time).String()
+	if err != nil {
+		e.Error = err.Error()
+		t.tracer.write(e)
+		return nil, err
+	}
+
+	respBody, err := readBody(&resp.Body)
+	if err != nil {
+		e.Error = err.Error()
+	}
+	e.Status = resp.StatusCode
+	e.ContentType = resp.Header.Get("Content-Type")
+	e.Response = string(respBody)
+	t.tracer.write(e)
+
+	return resp, err
+}
+
+// readBody reads a request or response body, replacing it with a copy
+// that can be read again.
+func readBody(body *io.ReadCloser) ([]byte, error) {
+	if *body == nil {
+		return nil, nil
+	}
+
+	b, err := ioutil.ReadAll(*body)
+	(*body).Close()
+	*body = ioutil.NopCloser(bytes.NewReader(b))
+	return b, err
+}
+
+// envelopeAction returns the WS-Addressing action of a SOAP envelope.
+func envelopeAction(envelope []byte) string {
+	m := traceAction.FindSubmatch(envelope)
+	if m == nil {
+		return "unknown"
+	}
+	return string(m[1])
+}
+
+// replayKey identifies the requests a recorded response can answer: those
+// with the same action, for the same shell and command.
+func replayKey(envelope []byte) string {
+	key := envelopeAction(envelope)
+	for _, re := range []*regexp.Regexp{traceShellID, traceCommandID} {
+		if m := re.FindSubmatch(envelope); m != nil {
+			key += " " + string(m[1])
+		}
+	}
+	return key
+}
+
+// ReplayTransport is an http.RoundTripper that answers requests with the
+// responses recorded in a trace, so that a Communicator can be driven
+// without a Windows machine by setting it as Config.Transport. Each
+// request gets the first response not yet replayed that was recorded for
+// the same action, shell and command.
+type ReplayTransport struct {
+	lock    sync.Mutex
+	entries []*TraceEntry
+	keys    []string
+}
+
+// NewReplayTransport reads a trace written through Config.Trace.
+func NewReplayTransport(r io.Reader) (*ReplayTransport, error) {
+	t := &ReplayTransport{}
+
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	for line := 1; scanner.Scan(); line++ {
+		if len(bytes.TrimSpace(scanner.Bytes())) == 0 {
+			continue
+		}
+
+		var e TraceEntry
+		if err := json.Unmarshal(scanner.Bytes(), &e); err != nil {
+			return nil, fmt.Errorf("Error reading trace line %d: %s", line, err)
+		}
+		t.entries = append(t.entries, &e)
+		t.keys = append(t.keys, replayKey([]byte(e.Request)))
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	return t, nil
+}
+
+func (t *ReplayTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	body, err := readBody(&req.Body)
+	if err != nil {
+		return nil, err
+	}
+	key := replayKey(body)
+
+	t.lock.Lock()
+	var e *TraceEntry
+	for i := range t.entries {
+		if t.keys[i] == key {
+			e = t.entries[i]
+			t.entries = append(t.entries[:i], t.entries[i+1:]...)
+			t.keys = append(t.keys[:i], t.keys[i+1:]...)
+			break
+		}
+	}
+	t.lock.Unlock()
+
+	if e == nil {
+		return nil, fmt.Errorf("No recorded response left for %s", key)
+	}
+	if e.Status == 0 {
+		return nil, errors.New(e.Error)
+	}
+
+	header := make(http.Header)
+	if e.ContentType != "" {
+		header.Set("Content-Type", e.ContentType)
+	}
+
+	return &http.Response{
+		Status:        fmt.Sprintf("%d %s", e.Status, http.StatusText(e.Status)),
+		StatusCode:    e.Status,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        header,
+		Body:          ioutil.NopCloser(strings.NewReader(e.Response)),
+		ContentLength: int64(len(e.Response)),
+		Request:       req,
+	}, nil
+}
+
+// Remaining returns the number of recorded responses not yet replayed.
+func (t *ReplayTransport) Remaining() int {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	return len(t.entries)
+}
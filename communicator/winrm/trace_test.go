@@ -0,0 +1,137 @@
+package winrm
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"github.com/mitchellh/packer/packer"
+	"github.com/packer-community/packer-windows-plugins/common/redact"
+)
+
+func TestTrace_Replay(t *testing.T) {
+	s := newTestShellServer()
+
+	var trace bytes.Buffer
+	config := testRemoteConfig(s)
+	config.Password = "s3cr&t"
+	config.Trace = &trace
+
+	run := func(config *Config) (string, int) {
+		comm, err := New(config)
+		if err != nil {
+			t.Fatalf("error connecting to WinRM: %s", err)
+		}
+
+		var stdout bytes.Buffer
+		cmd := &packer.RemoteCmd{
+			Command: "cat",
+			Stdin:   strings.NewReader("hello from the trace"),
+			Stdout:  &stdout,
+		}
+		if err := comm.Start(cmd); err != nil {
+			t.Fatalf("error starting cmd: %s", err)
+		}
+		cmd.Wait()
+
+		if err := comm.Close(); err != nil {
+			t.Fatalf("error closing communicator: %s", err)
+		}
+		return stdout.String(), cmd.ExitStatus
+	}
+
+	output, status := run(config)
+	s.Close()
+
+	if strings.Contains(trace.String(), "s3cr") {
+		t.Fatalf("trace should not contain the password:\n%s", trace.String())
+	}
+
+	actions := make(map[string]int)
+	scanner := bufio.NewScanner(bytes.NewReader(trace.Bytes()))
+	for scanner.Scan() {
+		var e TraceEntry
+		if err := json.Unmarshal(scanner.Bytes(), &e); err != nil {
+			t.Fatalf("bad trace line: %s", err)
+		}
+		if e.Status == 0 || e.Request == "" || e.Response == "" {
+			t.Fatalf("incomplete trace entry: %#v", e)
+		}
+		actions[e.Action]++
+	}
+	for _, action := range []string{actionCreate, actionCommand, actionSend, actionReceive, actionDelete} {
+		if actions[action] == 0 {
+			t.Fatalf("trace should contain %s: %#v", action, actions)
+		}
+	}
+
+	// The same session against the trace, with the server gone
+	replay, err := NewReplayTransport(bytes.NewReader(trace.Bytes()))
+	if err != nil {
+		t.Fatalf("error reading trace: %s", err)
+	}
+
+	config = testRemoteConfig(s)
+	config.Transport = replay
+	replayed, replayedStatus := run(config)
+
+	if replayed != output || replayedStatus != status {
+		t.Fatalf("bad replay: %q, %d, recorded %q, %d", replayed, replayedStatus, output, status)
+	}
+	// The recorded responses come back at once, so the replayed command
+	// may finish before the end of its stdin is sent, which is then
+	// skipped
+	for _, e := range replay.entries {
+		if e.Action != actionSend {
+			t.Fatalf("%d recorded responses were not replayed, including %s", replay.Remaining(), e.Action)
+		}
+	}
+}
+
+func TestReplayTransport_Exhausted(t *testing.T) {
+	replay, err := NewReplayTransport(strings.NewReader(""))
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	config := testConfig()
+	config.Transport = replay
+	config.Retry = RetryPolicy{MaxAttempts: 1}
+	if _, err := New(config); err == nil || !strings.Contains(err.Error(), "No recorded response") {
+		t.Fatalf("should have error: %v", err)
+	}
+}
+
+func TestTracer_Redact(t *testing.T) {
+	tr := newTracer(&bytes.Buffer{}, "p<ss", "")
+
+	payload := strings.Repeat("QUJD", 100)
+	input := `<rsp:Stream Name="stdout">` + payload + `</rsp:Stream><x>p&lt;ss p<ss</x><y>c2hvcnQ=</y>`
+	expected := `<rsp:Stream Name="stdout"><!-- 400 characters of base64 omitted --></rsp:Stream>` +
+		`<x>[REDACTED] [REDACTED]</x><y>c2hvcnQ=</y>`
+
+	if actual := tr.redact(input); actual != expected {
+		t.Fatalf("bad redaction: %s", actual)
+	}
+
+	// As well as the secrets known to the process
+	redact.Add("tracer-s3cret")
+	if actual := tr.redact("<x>tracer-s3cret</x>"); actual != "<x>[REDACTED]</x>" {
+		t.Fatalf("bad redaction: %s", actual)
+	}
+}
+
+func TestReplayKey(t *testing.T) {
+	envelope := []byte(`<env:Header><a:Action mustUnderstand="true">` + actionReceive + `</a:Action>` +
+		`<w:SelectorSet><w:Selector Name="ShellId">SHELL-1</w:Selector></w:SelectorSet></env:Header>` +
+		`<env:Body><rsp:Receive><rsp:DesiredStream CommandId="CMD-1">stdout stderr</rsp:DesiredStream></rsp:Receive></env:Body>`)
+
+	if key := replayKey(envelope); key != actionReceive+" SHELL-1 CMD-1" {
+		t.Fatalf("bad key: %s", key)
+	}
+	if key := replayKey([]byte("<bad/>")); key != "unknown" {
+		t.Fatalf("bad key: %s", key)
+	}
+}
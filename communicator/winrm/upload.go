@@ -0,0 +1,193 @@
+package winrm
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/packer-community/winrmcp/winrmcp"
+)
+
+// maxMkdirScript is roughly the longest directory creation script sent in
+// one command. Encoded for -EncodedCommand it stays below the 8191
+// character limit of a cmd.exe command line.
+const maxMkdirScript = 2048
+
+// uploadFile is a local file and the remote path it is copied to.
+type uploadFile struct {
+	local  string
+	remote string
+	size   int64
+}
+
+// UploadDir copies the local directory src to the remote directory dst,
+// following the rules of the SSH communicator: with a trailing slash the
+// contents of src are copied into dst, otherwise src itself is copied into
+// dst. Entries whose path relative to src matches one of the exclude glob
+// patterns are skipped, and empty directories are created on the guest.
+func (c *Communicator) UploadDir(dst string, src string, exclude []string) error {
+	log.Printf("Uploading dir to remote: %s -> %s", src, dst)
+
+	files, dirs, err := planUploadDir(dst, src, exclude)
+	if err != nil {
+		return err
+	}
+
+	if len(dirs) > 0 {
+		if err := c.mkdirs(dirs); err != nil {
+			return err
+		}
+	}
+
+	if len(files) == 0 {
+		return nil
+	}
+
+	wcp, err := c.newCopyClient()
+	if err != nil {
+		return err
+	}
+
+	var total int64
+	for _, file := range files {
+		total += file.size
+	}
+
+	progress := c.newProgress(dst, total)
+	err = c.uploadFiles(wcp, files, progress)
+	progress.finish(err)
+	return err
+}
+
+func (c *Communicator) uploadFiles(wcp *winrmcp.Winrmcp, files []uploadFile, progress *transferProgress) error {
+	for _, file := range files {
+		f, err := os.Open(file.local)
+		if err != nil {
+			return fmt.Errorf("Error opening %s: %s", file.local, err)
+		}
+
+		log.Printf("Uploading %s -> %s", file.local, file.remote)
+		err = c.upload(wcp, file.remote, f, file.size, progress)
+		f.Close()
+		if err != nil {
+			return fmt.Errorf("Error uploading %s: %s", file.local, err)
+		}
+	}
+
+	return nil
+}
+
+// planUploadDir walks src and works out which files are copied where, and
+// which directories would be left out because they contain no files.
+func planUploadDir(dst string, src string, exclude []string) ([]uploadFile, []string, error) {
+	fi, err := os.Stat(src)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	root := uploadRoot(dst, src)
+	if !fi.IsDir() {
+		return []uploadFile{{local: src, remote: root, size: fi.Size()}}, nil, nil
+	}
+
+	var files []uploadFile
+	var dirs []string
+	hasFiles := make(map[string]bool)
+
+	err = filepath.Walk(src, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		rel, err := filepath.Rel(src, path)
+		if err != nil {
+			return err
+		}
+		rel = filepath.ToSlash(rel)
+
+		if rel != "." && excluded(rel, exclude) {
+			log.Printf("Skipping excluded path: %s", rel)
+			if info.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+
+		if info.IsDir() {
+			dirs = append(dirs, rel)
+			return nil
+		}
+
+		files = append(files, uploadFile{local: path, remote: winJoin(root, rel), size: info.Size()})
+		for d := filepath.ToSlash(filepath.Dir(rel)); ; d = filepath.ToSlash(filepath.Dir(d)) {
+			hasFiles[d] = true
+			if d == "." {
+				break
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// Directories with files in them are created along with the files
+	var empty []string
+	for _, d := range dirs {
+		if !hasFiles[d] {
+			empty = append(empty, winJoin(root, d))
+		}
+	}
+
+	return files, empty, nil
+}
+
+// uploadRoot returns the remote path src is copied to: dst itself if src
+// ends with a slash, otherwise the path below dst named after src.
+func uploadRoot(dst string, src string) string {
+	if strings.HasSuffix(src, "/") || strings.HasSuffix(src, string(os.PathSeparator)) {
+		return dst
+	}
+	return winJoin(dst, filepath.Base(src))
+}
+
+// mkdirs creates directories on the guest, including any missing parents.
+func (c *Communicator) mkdirs(dirs []string) error {
+	for len(dirs) > 0 {
+		var script bytes.Buffer
+		script.WriteString("$ProgressPreference='SilentlyContinue'\n")
+
+		n := 0
+		for ; n < len(dirs); n++ {
+			line := fmt.Sprintf("New-Item -ItemType Directory -Force -Path '%s' | Out-Null\n", psQuote(dirs[n]))
+			if n > 0 && script.Len()+len(line) > maxMkdirScript {
+				break
+			}
+			script.WriteString(line)
+		}
+		dirs = dirs[n:]
+
+		_, stderr, code, err := c.runPowershell(script.String())
+		if err != nil {
+			return err
+		}
+		if code != 0 {
+			return fmt.Errorf("Error creating remote directories, exit code %d: %s",
+				code, strings.TrimSpace(stderr))
+		}
+	}
+
+	return nil
+}
+
+// winJoin appends a slash separated relative path to a remote Windows
+// path.
+func winJoin(dir string, rel string) string {
+	if rel == "." || rel == "" {
+		return dir
+	}
+	return strings.TrimRight(dir, `\/`) + `\` + strings.Replace(rel, "/", `\`, -1)
+}
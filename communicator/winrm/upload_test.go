@@ -0,0 +1,126 @@
+package winrm
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"testing"
+)
+
+func testUploadDir(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "packer-winrm-upload")
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	src := filepath.Join(dir, "src")
+	for _, d := range []string{"a/b", "empty/nested", "logs"} {
+		if err := os.MkdirAll(filepath.Join(src, filepath.FromSlash(d)), 0755); err != nil {
+			t.Fatalf("err: %s", err)
+		}
+	}
+	for _, f := range []string{"top.txt", "a/b/c.txt", "logs/build.log", ".DS_Store"} {
+		if err := ioutil.WriteFile(filepath.Join(src, filepath.FromSlash(f)), []byte(f), 0644); err != nil {
+			t.Fatalf("err: %s", err)
+		}
+	}
+
+	return dir
+}
+
+func remotePaths(files []uploadFile) []string {
+	var paths []string
+	for _, f := range files {
+		paths = append(paths, f.remote)
+	}
+	sort.Strings(paths)
+	return paths
+}
+
+func TestPlanUploadDir(t *testing.T) {
+	dir := testUploadDir(t)
+	defer os.RemoveAll(dir)
+	src := filepath.Join(dir, "src")
+
+	// Without a trailing slash the directory itself is copied
+	files, dirs, err := planUploadDir(`C:\dst`, src, nil)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	expected := []string{`C:\dst\src\.DS_Store`, `C:\dst\src\a\b\c.txt`, `C:\dst\src\logs\build.log`, `C:\dst\src\top.txt`}
+	if paths := remotePaths(files); !reflect.DeepEqual(paths, expected) {
+		t.Fatalf("bad files: %#v", paths)
+	}
+	if !reflect.DeepEqual(dirs, []string{`C:\dst\src\empty`, `C:\dst\src\empty\nested`}) {
+		t.Fatalf("bad dirs: %#v", dirs)
+	}
+
+	// With a trailing slash its contents are
+	files, _, err = planUploadDir(`C:\dst\`, src+"/", nil)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	expected = []string{`C:\dst\.DS_Store`, `C:\dst\a\b\c.txt`, `C:\dst\logs\build.log`, `C:\dst\top.txt`}
+	if paths := remotePaths(files); !reflect.DeepEqual(paths, expected) {
+		t.Fatalf("bad files: %#v", paths)
+	}
+}
+
+func TestPlanUploadDir_Exclude(t *testing.T) {
+	dir := testUploadDir(t)
+	defer os.RemoveAll(dir)
+	src := filepath.Join(dir, "src") + "/"
+
+	files, dirs, err := planUploadDir(`C:\dst`, src, []string{"logs", "*.txt", ".DS_Store", "empty/nested"})
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	// a/b/c.txt is not matched by *.txt, which only covers the top level
+	expected := []string{`C:\dst\a\b\c.txt`}
+	if paths := remotePaths(files); !reflect.DeepEqual(paths, expected) {
+		t.Fatalf("bad files: %#v", paths)
+	}
+	if !reflect.DeepEqual(dirs, []string{`C:\dst\empty`}) {
+		t.Fatalf("bad dirs: %#v", dirs)
+	}
+}
+
+func TestPlanUploadDir_Empty(t *testing.T) {
+	dir, err := ioutil.TempDir("", "packer-winrm-upload")
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	files, dirs, err := planUploadDir(`C:\dst`, dir, nil)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	if len(files) != 0 {
+		t.Fatalf("bad files: %#v", files)
+	}
+	if !reflect.DeepEqual(dirs, []string{`C:\dst\` + filepath.Base(dir)}) {
+		t.Fatalf("bad dirs: %#v", dirs)
+	}
+}
+
+func TestWinJoin(t *testing.T) {
+	cases := map[[2]string]string{
+		{`C:\dst`, "."}:       `C:\dst`,
+		{`C:\dst\`, "a/b"}:    `C:\dst\a\b`,
+		{`C:/dst/`, "a"}:      `C:/dst\a`,
+		{`C:\dst`, "a b/c.d"}: `C:\dst\a b\c.d`,
+	}
+
+	for in, expected := range cases {
+		if actual := winJoin(in[0], in[1]); actual != expected {
+			t.Errorf("winJoin(%q, %q) = %q, expected %q", in[0], in[1], actual, expected)
+		}
+	}
+}
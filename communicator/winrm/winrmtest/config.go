@@ -0,0 +1,76 @@
+package winrmtest
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// resourceConfig is the resource URI of the WinRM service configuration.
+const resourceConfig = "http://schemas.microsoft.com/wbem/wsman/1/config"
+
+// remoteConfig is the part of the WinRM service configuration the Remote
+// emulates.
+type remoteConfig struct {
+	user     string
+	password string
+
+	maxEnvelopeSizekb int
+	maxShellsPerUser  int
+}
+
+// defaultConfig is the configuration of a Remote that doesn't require
+// authentication, with the defaults of Windows Server 2012.
+var defaultConfig = remoteConfig{
+	maxEnvelopeSizekb: 500,
+	maxShellsPerUser:  30,
+}
+
+// RequireBasicAuth has the Remote answer requests that don't carry the
+// user and password with Basic authentication with a 401, offering the
+// Basic and Negotiate schemes.
+func (r *Remote) RequireBasicAuth(user, password string) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.config.user = user
+	r.config.password = password
+}
+
+// SetConfig sets the MaxEnvelopeSizekb and MaxShellsPerUser the Remote
+// reports for a Get of the service configuration. The Remote doesn't
+// enforce them.
+func (r *Remote) SetConfig(maxEnvelopeSizekb, maxShellsPerUser int) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.config.maxEnvelopeSizekb = maxEnvelopeSizekb
+	r.config.maxShellsPerUser = maxShellsPerUser
+}
+
+func (r *Remote) authorized(req *http.Request) bool {
+	r.lock.Lock()
+	config := r.config
+	r.lock.Unlock()
+
+	if config.user == "" {
+		return true
+	}
+	user, password, ok := req.BasicAuth()
+	return ok && user == config.user && password == config.password
+}
+
+func (r *Remote) get(env *request) (string, *fault) {
+	if strings.TrimSpace(env.Header.ResourceURI) != resourceConfig {
+		return "", &fault{subcode: "w:DestinationUnreachable",
+			reason: "unexpected resource " + env.Header.ResourceURI}
+	}
+
+	r.lock.Lock()
+	config := r.config
+	r.lock.Unlock()
+
+	return fmt.Sprintf(`<cfg:Config xmlns:cfg="%s">`+
+		`<cfg:MaxEnvelopeSizekb>%d</cfg:MaxEnvelopeSizekb>`+
+		`<cfg:Winrs><cfg:MaxShellsPerUser>%d</cfg:MaxShellsPerUser></cfg:Winrs>`+
+		`</cfg:Config>`,
+		resourceConfig, config.maxEnvelopeSizekb, config.maxShellsPerUser), nil
+}
@@ -0,0 +1,440 @@
+package winrmtest
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Directories of the guest user, to which relative paths and environment
+// variables in paths are resolved.
+const (
+	HomeDir = `C:\Users\packer`
+	TempDir = HomeDir + `\AppData\Local\Temp`
+)
+
+var environment = map[string]string{
+	"TEMP":        TempDir,
+	"TMP":         TempDir,
+	"USERPROFILE": HomeDir,
+	"SYSTEMROOT":  `C:\Windows`,
+	"WINDIR":      `C:\Windows`,
+}
+
+// Exit codes of the communicator's download and HTTP upload scripts.
+const (
+	exitNotFound    = 2
+	exitIsDirectory = 5
+	exitUnreachable = 2
+	exitChecksum    = 3
+)
+
+var (
+	envReference = regexp.MustCompile(`%(\w+)%|\$\{env:(\w+)\}|\$env:(\w+)`)
+
+	// winrmcp appends base64 chunks to a temporary file with cmd's echo,
+	// then decodes it into place and removes it with PowerShell
+	appendChunk  = regexp.MustCompile(`^echo (\S+) >> "([^"]+)"$`)
+	tmpFilePath  = regexp.MustCompile(`\$tmp_file_path\s*=\s*\[System\.IO\.Path\]::GetFullPath\("([^"]*)"\)`)
+	destFilePath = regexp.MustCompile(`\$dest_file_path\s*=\s*\[System\.IO\.Path\]::GetFullPath\("([^"]*)"`)
+
+	// The communicator's own scripts
+	mkdirLine     = regexp.MustCompile(`New-Item -ItemType Directory -Force -Path '((?:[^']|'')*)' \| Out-Null`)
+	scriptPath    = regexp.MustCompile(`(?m)^\$p='((?:[^']|'')*)'\r?$`)
+	chunkSize     = regexp.MustCompile(`New-Object byte\[\] (\d+)`)
+	uploadDst     = regexp.MustCompile(`\$dst=\[IO\.Path\]::GetFullPath\("((?:` + "`.|[^\"`]" + `)*)"\)`)
+	uploadURL     = regexp.MustCompile(`\[Net\.WebRequest\]::Create\('([^']*)'\)`)
+	uploadSHA256  = regexp.MustCompile(`if \(\$sum -ne '([0-9A-F]*)'\)`)
+	psBacktickEsc = regexp.MustCompile("`(.)")
+)
+
+// fileSystem is the in-memory disk of a Remote. Paths are not case
+// sensitive, like on NTFS.
+type fileSystem struct {
+	lock  sync.Mutex
+	files map[string]*file
+	dirs  map[string]string
+
+	builtin []handler
+}
+
+type file struct {
+	path string
+	data []byte
+}
+
+func newFileSystem() *fileSystem {
+	fs := &fileSystem{
+		files: make(map[string]*file),
+		dirs:  make(map[string]string),
+	}
+	fs.mkdirAll(TempDir)
+
+	fs.builtin = []handler{
+		{MatchPattern(appendChunk.String()), fs.appendChunk},
+		{MatchScript(destFilePath.String()), fs.restore},
+		{MatchScript(`Remove-Item \$tmp_file_path`), fs.cleanup},
+		{MatchScript(mkdirLine.String()), fs.mkdir},
+		{MatchScript(`\[Convert\]::ToBase64String\(\$b,0,\$n\)`), fs.download},
+		{MatchScript(`\$h\.ComputeHash\(\$fs\)`), fs.hashDir},
+		{MatchScript(`Get-ChildItem -LiteralPath \$r -Recurse`), fs.listDir},
+		{MatchScript(uploadURL.String()), fs.httpUpload},
+	}
+	return fs
+}
+
+// fullPath resolves a path on the guest the way GetFullPath does, after
+// expanding environment variables.
+func fullPath(p string) string {
+	p = strings.Trim(strings.TrimSpace(p), `"'`)
+	p = envReference.ReplaceAllStringFunc(p, func(ref string) string {
+		m := envReference.FindStringSubmatch(ref)
+		name := strings.ToUpper(m[1] + m[2] + m[3])
+		if value, ok := environment[name]; ok {
+			return value
+		}
+		return ref
+	})
+	p = strings.Replace(p, "/", `\`, -1)
+
+	switch {
+	case len(p) >= 2 && p[1] == ':':
+	case strings.HasPrefix(p, `\`):
+		p = "C:" + p
+	default:
+		p = HomeDir + `\` + p
+	}
+
+	var parts []string
+	for _, part := range strings.Split(p[2:], `\`) {
+		switch part {
+		case "", ".":
+		case "..":
+			if len(parts) > 0 {
+				parts = parts[:len(parts)-1]
+			}
+		default:
+			parts = append(parts, part)
+		}
+	}
+
+	return strings.ToUpper(p[:1]) + `:\` + strings.Join(parts, `\`)
+}
+
+func key(p string) string {
+	return strings.ToLower(p)
+}
+
+// parent returns the directory of a full path, or "" for a drive root.
+func parent(p string) string {
+	i := strings.LastIndex(p, `\`)
+	if i < 0 || i == len(p)-1 {
+		return ""
+	}
+	if i == 2 {
+		return p[:3]
+	}
+	return p[:i]
+}
+
+// mkdirAll is called with the lock held.
+func (fs *fileSystem) mkdirAll(p string) {
+	for ; p != ""; p = parent(p) {
+		if _, ok := fs.dirs[key(p)]; ok {
+			return
+		}
+		fs.dirs[key(p)] = p
+	}
+}
+
+func (fs *fileSystem) write(p string, data []byte, appending bool) {
+	p = fullPath(p)
+
+	fs.lock.Lock()
+	defer fs.lock.Unlock()
+
+	fs.mkdirAll(parent(p))
+	f, ok := fs.files[key(p)]
+	if !ok {
+		f = &file{path: p}
+		fs.files[key(p)] = f
+	}
+	if appending {
+		f.data = append(f.data, data...)
+	} else {
+		f.data = append([]byte(nil), data...)
+	}
+}
+
+func (fs *fileSystem) read(p string) ([]byte, bool) {
+	fs.lock.Lock()
+	defer fs.lock.Unlock()
+
+	f, ok := fs.files[key(fullPath(p))]
+	if !ok {
+		return nil, false
+	}
+	return append([]byte(nil), f.data...), true
+}
+
+func (fs *fileSystem) remove(p string) {
+	fs.lock.Lock()
+	defer fs.lock.Unlock()
+	delete(fs.files, key(fullPath(p)))
+}
+
+func (fs *fileSystem) isDir(p string) bool {
+	fs.lock.Lock()
+	defer fs.lock.Unlock()
+	_, ok := fs.dirs[key(fullPath(p))]
+	return ok
+}
+
+// list returns the directories and files below a directory, as paths
+// relative to it.
+func (fs *fileSystem) list(dir string) (dirs, files []string) {
+	prefix := key(fullPath(dir))
+	if !strings.HasSuffix(prefix, `\`) {
+		prefix += `\`
+	}
+
+	fs.lock.Lock()
+	defer fs.lock.Unlock()
+
+	for k, p := range fs.dirs {
+		if strings.HasPrefix(k, prefix) && k != prefix {
+			dirs = append(dirs, p[len(prefix):])
+		}
+	}
+	for k, f := range fs.files {
+		if strings.HasPrefix(k, prefix) {
+			files = append(files, f.path[len(prefix):])
+		}
+	}
+	sort.Strings(dirs)
+	sort.Strings(files)
+	return dirs, files
+}
+
+// File returns the content of a file on the Remote.
+func (r *Remote) File(path string) ([]byte, bool) {
+	return r.fs.read(path)
+}
+
+// WriteFile creates or replaces a file on the Remote, along with its
+// parent directories.
+func (r *Remote) WriteFile(path string, data []byte) {
+	r.fs.write(path, data, false)
+}
+
+// IsDir reports whether a directory exists on the Remote.
+func (r *Remote) IsDir(path string) bool {
+	return r.fs.isDir(path)
+}
+
+// Files returns the full paths of the files on the Remote, sorted.
+func (r *Remote) Files() []string {
+	_, files := r.fs.list("C:\\")
+	for i, f := range files {
+		files[i] = `C:\` + f
+	}
+	return files
+}
+
+func (fs *fileSystem) appendChunk(cmd *Cmd) int {
+	m := appendChunk.FindStringSubmatch(cmd.Line)
+
+	// echo keeps the space before the redirection
+	fs.write(m[2], []byte(m[1]+" \r\n"), true)
+	return 0
+}
+
+func (fs *fileSystem) restore(cmd *Cmd) int {
+	tmp := tmpFilePath.FindStringSubmatch(cmd.Script)
+	dst := destFilePath.FindStringSubmatch(cmd.Script)
+	if tmp == nil {
+		fmt.Fprintln(cmd.Stderr, "no temporary file in restore script")
+		return 1
+	}
+
+	var content bytes.Buffer
+	if encoded, ok := fs.read(tmp[1]); ok {
+		scanner := bufio.NewScanner(bytes.NewReader(encoded))
+		for scanner.Scan() {
+			line := strings.TrimSpace(scanner.Text())
+			if line == "" {
+				continue
+			}
+			data, err := base64.StdEncoding.DecodeString(line)
+			if err != nil {
+				fmt.Fprintf(cmd.Stderr, "Invalid base64 line: %s\r\n", err)
+				return 1
+			}
+			content.Write(data)
+		}
+	}
+
+	fs.write(strings.Trim(dst[1], "'"), content.Bytes(), false)
+	return 0
+}
+
+func (fs *fileSystem) cleanup(cmd *Cmd) int {
+	if tmp := tmpFilePath.FindStringSubmatch(cmd.Script); tmp != nil {
+		fs.remove(tmp[1])
+	}
+	return 0
+}
+
+func (fs *fileSystem) mkdir(cmd *Cmd) int {
+	for _, m := range mkdirLine.FindAllStringSubmatch(cmd.Script, -1) {
+		p := fullPath(psUnquote(m[1]))
+
+		fs.lock.Lock()
+		fs.mkdirAll(p)
+		fs.lock.Unlock()
+	}
+	return 0
+}
+
+func (fs *fileSystem) download(cmd *Cmd) int {
+	p := scriptPath.FindStringSubmatch(cmd.Script)
+	if p == nil {
+		fmt.Fprintln(cmd.Stderr, "no path in download script")
+		return 1
+	}
+	path := psUnquote(p[1])
+
+	if fs.isDir(path) {
+		fmt.Fprintf(cmd.Stderr, "%s is a directory\r\n", path)
+		return exitIsDirectory
+	}
+	data, ok := fs.read(path)
+	if !ok {
+		fmt.Fprintf(cmd.Stderr, "Could not find file '%s'.\r\n", fullPath(path))
+		return exitNotFound
+	}
+
+	size := 3 * 16 * 1024
+	if m := chunkSize.FindStringSubmatch(cmd.Script); m != nil {
+		size, _ = strconv.Atoi(m[1])
+	}
+	for rest := data; len(rest) > 0; {
+		n := size
+		if n > len(rest) {
+			n = len(rest)
+		}
+		fmt.Fprintf(cmd.Stdout, "%s\r\n", base64.StdEncoding.EncodeToString(rest[:n]))
+		rest = rest[n:]
+	}
+
+	sum := sha256.Sum256(data)
+	fmt.Fprintf(cmd.Stdout, "#length %d\r\n", len(data))
+	fmt.Fprintf(cmd.Stdout, "#sha256 %s\r\n", strings.ToUpper(hex.EncodeToString(sum[:])))
+	return 0
+}
+
+func (fs *fileSystem) listDir(cmd *Cmd) int {
+	p := scriptPath.FindStringSubmatch(cmd.Script)
+	if p == nil {
+		fmt.Fprintln(cmd.Stderr, "no path in listing script")
+		return 1
+	}
+	path := psUnquote(p[1])
+
+	if !fs.isDir(path) {
+		if _, ok := fs.read(path); ok {
+			fmt.Fprintf(cmd.Stderr, "%s is not a directory\r\n", path)
+			return exitIsDirectory
+		}
+		fmt.Fprintf(cmd.Stderr, "%s does not exist\r\n", path)
+		return exitNotFound
+	}
+
+	dirs, files := fs.list(path)
+	for _, d := range dirs {
+		fmt.Fprintf(cmd.Stdout, "d %s\r\n", d)
+	}
+	for _, f := range files {
+		fmt.Fprintf(cmd.Stdout, "f %s\r\n", f)
+	}
+	return 0
+}
+
+// hashDir lists the files below a directory with their SHA-256.
+func (fs *fileSystem) hashDir(cmd *Cmd) int {
+	p := scriptPath.FindStringSubmatch(cmd.Script)
+	if p == nil {
+		fmt.Fprintln(cmd.Stderr, "no path in hash script")
+		return 1
+	}
+	path := psUnquote(p[1])
+
+	if !fs.isDir(path) {
+		if _, ok := fs.read(path); ok {
+			fmt.Fprintf(cmd.Stderr, "%s is not a directory\r\n", path)
+			return exitIsDirectory
+		}
+		return 0
+	}
+
+	_, files := fs.list(path)
+	for _, f := range files {
+		data, _ := fs.read(path + `\` + f)
+		sum := sha256.Sum256(data)
+		fmt.Fprintf(cmd.Stdout, "%s %s\r\n", strings.ToUpper(hex.EncodeToString(sum[:])), f)
+	}
+	return 0
+}
+
+// httpUpload downloads the file that the communicator serves over HTTP.
+func (fs *fileSystem) httpUpload(cmd *Cmd) int {
+	dst := uploadDst.FindStringSubmatch(cmd.Script)
+	url := uploadURL.FindStringSubmatch(cmd.Script)
+	sum := uploadSHA256.FindStringSubmatch(cmd.Script)
+	if dst == nil || sum == nil {
+		fmt.Fprintln(cmd.Stderr, "unexpected upload script")
+		return 1
+	}
+
+	resp, err := http.Get(url[1])
+	if err != nil {
+		fmt.Fprintln(cmd.Stderr, err)
+		return exitUnreachable
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		fmt.Fprintf(cmd.Stderr, "The remote server returned an error: (%d).\r\n", resp.StatusCode)
+		return exitUnreachable
+	}
+
+	data, err := ioutil.ReadAll(io.LimitReader(resp.Body, 1<<30))
+	if err != nil {
+		fmt.Fprintln(cmd.Stderr, err)
+		return 1
+	}
+
+	actual := sha256.Sum256(data)
+	if s := strings.ToUpper(hex.EncodeToString(actual[:])); s != sum[1] {
+		fmt.Fprintf(cmd.Stderr, "checksum mismatch: %s\r\n", s)
+		return exitChecksum
+	}
+
+	fs.write(psBacktickEsc.ReplaceAllString(dst[1], "$1"), data, false)
+	return 0
+}
+
+// psUnquote reverses the escaping of a single quoted PowerShell string.
+func psUnquote(s string) string {
+	return strings.Replace(s, "''", "'", -1)
+}
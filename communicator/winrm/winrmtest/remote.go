@@ -0,0 +1,614 @@
+// Package winrmtest is an in-process WinRM service for tests. It speaks
+// enough of the WS-Management shell protocol to drive the communicator,
+// and the tools built on it, without a Windows machine: shells are
+// created and deleted, commands run scripted handlers that read stdin and
+// write output, and the commands used to copy files are carried out
+// against an in-memory file system.
+package winrmtest
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"path"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf16"
+)
+
+// XML namespaces of the WS-Management shell protocol.
+const (
+	nsSoap       = "http://www.w3.org/2003/05/soap-envelope"
+	nsAddressing = "http://schemas.xmlsoap.org/ws/2004/08/addressing"
+	nsWsman      = "http://schemas.dmtf.org/wbem/wsman/1/wsman.xsd"
+	nsTransfer   = "http://schemas.xmlsoap.org/ws/2004/09/transfer"
+	nsShell      = "http://schemas.microsoft.com/wbem/wsman/1/windows/shell"
+	nsFault      = "http://schemas.microsoft.com/wbem/wsman/1/wsmanfault"
+
+	signalTerminate = nsShell + "/signal/terminate"
+)
+
+// WSManFault codes returned by the Remote.
+const (
+	// FaultTimedOut is returned by a Receive that saw no output within
+	// the poll timeout
+	FaultTimedOut = "2150858793"
+
+	// FaultShellNotFound is returned for requests to a shell that was
+	// deleted, as after the guest restarted
+	FaultShellNotFound = "2150858843"
+
+	// FaultUnknownCommand is returned for a command no handler matches
+	FaultUnknownCommand = "2147942402"
+)
+
+// ExitCodeTerminated is the exit code of a command terminated by the
+// client, STATUS_CONTROL_C_EXIT.
+const ExitCodeTerminated = -1073741510
+
+// pollTimeout is how long a Receive waits for output. WinRM waits for the
+// operation timeout of the request, usually a minute, which would make
+// tests slow to notice a command that hangs.
+const pollTimeout = 50 * time.Millisecond
+
+// Cmd is a command started on the Remote, as seen by its handler.
+type Cmd struct {
+	// Line is the command line sent by the client
+	Line string
+
+	// Script is the decoded script of a "powershell -EncodedCommand"
+	// command line, and empty for other commands
+	Script string
+
+	// Stdin reads the input the client sends, until it closes it or
+	// terminates the command
+	Stdin io.Reader
+
+	Stdout io.Writer
+	Stderr io.Writer
+
+	// Terminated is closed when the client terminates the command or
+	// deletes its shell. The command has exited with ExitCodeTerminated
+	// at that point, and whatever its handler writes afterwards is lost.
+	Terminated <-chan struct{}
+}
+
+// CommandFunc handles a command and returns its exit code.
+type CommandFunc func(cmd *Cmd) int
+
+// Matcher selects the commands a handler runs.
+type Matcher func(cmd *Cmd) bool
+
+// MatchText matches a command line exactly.
+func MatchText(text string) Matcher {
+	return func(cmd *Cmd) bool {
+		return cmd.Line == text
+	}
+}
+
+// MatchPattern matches command lines against a regular expression.
+func MatchPattern(pattern string) Matcher {
+	re := regexp.MustCompile(pattern)
+	return func(cmd *Cmd) bool {
+		return re.MatchString(cmd.Line)
+	}
+}
+
+// MatchScript matches the decoded script of encoded PowerShell commands
+// against a regular expression.
+func MatchScript(pattern string) Matcher {
+	re := regexp.MustCompile(pattern)
+	return func(cmd *Cmd) bool {
+		return cmd.Script != "" && re.MatchString(cmd.Script)
+	}
+}
+
+type handler struct {
+	match Matcher
+	run   CommandFunc
+}
+
+// Remote is a WinRM service listening on a local port. Commands are
+// answered by the first handler registered with CommandFunc or Command
+// that matches them, or else by the built-in handlers that emulate file
+// transfers. Anything else fails with FaultUnknownCommand.
+type Remote struct {
+	*httptest.Server
+
+	lock     sync.Mutex
+	changed  *sync.Cond
+	handlers []handler
+	shells   map[string]bool
+	commands map[string]*command
+	requests map[string]int
+	nextID   int
+
+	fs     *fileSystem
+	config remoteConfig
+}
+
+// command is the state of a command started on the Remote.
+type command struct {
+	id      string
+	shellID string
+
+	stdin    []byte
+	stdinEnd bool
+	stdout   []byte
+	stderr   []byte
+
+	done       bool
+	exitCode   int
+	terminated chan struct{}
+}
+
+// NewRemote starts a Remote. It must be closed with Close.
+func NewRemote() *Remote {
+	r := &Remote{
+		shells:   make(map[string]bool),
+		commands: make(map[string]*command),
+		requests: make(map[string]int),
+		fs:       newFileSystem(),
+		config:   defaultConfig,
+	}
+	r.changed = sync.NewCond(&r.lock)
+	r.Server = httptest.NewServer(r)
+	return r
+}
+
+// Address returns the host and port the Remote listens on.
+func (r *Remote) Address() string {
+	return r.Listener.Addr().String()
+}
+
+// HostPort returns the host and port the Remote listens on, separately.
+func (r *Remote) HostPort() (string, int) {
+	host, port, _ := net.SplitHostPort(r.Address())
+	n, _ := strconv.Atoi(port)
+	return host, n
+}
+
+// CommandFunc registers a handler for the commands that m matches.
+func (r *Remote) CommandFunc(m Matcher, f CommandFunc) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.handlers = append(r.handlers, handler{match: m, run: f})
+}
+
+// Command registers a handler that writes stdout and exits with the given
+// code for the commands that m matches.
+func (r *Remote) Command(m Matcher, stdout string, exitCode int) {
+	r.CommandFunc(m, func(cmd *Cmd) int {
+		io.WriteString(cmd.Stdout, stdout)
+		return exitCode
+	})
+}
+
+// Requests returns the number of requests received for an action, such
+// as "Create" or "Send".
+func (r *Remote) Requests(action string) int {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	return r.requests[action]
+}
+
+// Shells returns the number of shells open on the Remote.
+func (r *Remote) Shells() int {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	return len(r.shells)
+}
+
+// request is the part of a WS-Management request the Remote looks at.
+type request struct {
+	Header struct {
+		Action      string `xml:"http://schemas.xmlsoap.org/ws/2004/08/addressing Action"`
+		ResourceURI string `xml:"http://schemas.dmtf.org/wbem/wsman/1/wsman.xsd ResourceURI"`
+		Selectors   []struct {
+			Name  string `xml:"Name,attr"`
+			Value string `xml:",chardata"`
+		} `xml:"http://schemas.dmtf.org/wbem/wsman/1/wsman.xsd SelectorSet>Selector"`
+	} `xml:"http://www.w3.org/2003/05/soap-envelope Header"`
+	Body struct {
+		Command struct {
+			Command   string   `xml:"http://schemas.microsoft.com/wbem/wsman/1/windows/shell Command"`
+			Arguments []string `xml:"http://schemas.microsoft.com/wbem/wsman/1/windows/shell Arguments"`
+		} `xml:"http://schemas.microsoft.com/wbem/wsman/1/windows/shell CommandLine"`
+		Send struct {
+			CommandID string `xml:"CommandId,attr"`
+			End       bool   `xml:"End,attr"`
+			Content   string `xml:",chardata"`
+		} `xml:"http://schemas.microsoft.com/wbem/wsman/1/windows/shell Send>Stream"`
+		Receive struct {
+			CommandID string `xml:"CommandId,attr"`
+		} `xml:"http://schemas.microsoft.com/wbem/wsman/1/windows/shell Receive>DesiredStream"`
+		Signal struct {
+			CommandID string `xml:"CommandId,attr"`
+			Code      string `xml:"http://schemas.microsoft.com/wbem/wsman/1/windows/shell Code"`
+		} `xml:"http://schemas.microsoft.com/wbem/wsman/1/windows/shell Signal"`
+	} `xml:"http://www.w3.org/2003/05/soap-envelope Body"`
+}
+
+func (req *request) shellID() string {
+	for _, s := range req.Header.Selectors {
+		if s.Name == "ShellId" {
+			return strings.TrimSpace(s.Value)
+		}
+	}
+	return ""
+}
+
+// fault is a SOAP fault returned by a handler.
+type fault struct {
+	code    string
+	subcode string
+	reason  string
+}
+
+func (r *Remote) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if !r.authorized(req) {
+		w.Header().Add("WWW-Authenticate", `Basic realm="WSMAN"`)
+		w.Header().Add("WWW-Authenticate", "Negotiate")
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	var env request
+	if err := xml.NewDecoder(req.Body).Decode(&env); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	action := env.Header.Action
+	r.lock.Lock()
+	r.requests[path.Base(action)]++
+	r.lock.Unlock()
+
+	var body string
+	var f *fault
+	switch action {
+	case nsTransfer + "/Create":
+		body = r.create()
+	case nsTransfer + "/Get":
+		body, f = r.get(&env)
+	case nsTransfer + "/Delete":
+		f = r.delete(env.shellID())
+	case nsShell + "/Command":
+		body, f = r.command(env.shellID(), &env)
+	case nsShell + "/Send":
+		body, f = r.send(&env)
+	case nsShell + "/Receive":
+		body, f = r.receive(env.Body.Receive.CommandID)
+	case nsShell + "/Signal":
+		body, f = r.signal(env.Body.Signal.CommandID, env.Body.Signal.Code)
+	default:
+		f = &fault{subcode: "w:ActionNotSupported", reason: "unexpected action " + action}
+	}
+
+	w.Header().Set("Content-Type", "application/soap+xml;charset=UTF-8")
+	if f != nil {
+		if f.subcode == "" {
+			f.subcode = "w:InternalError"
+		}
+		w.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprintf(w, `<s:Envelope xmlns:s="%s" xmlns:w="%s" xmlns:f="%s"><s:Body><s:Fault>`+
+			`<s:Code><s:Value>s:Receiver</s:Value><s:Subcode><s:Value>%s</s:Value></s:Subcode></s:Code>`+
+			`<s:Reason><s:Text xml:lang="en-US">%s</s:Text></s:Reason>`+
+			`<s:Detail><f:WSManFault Code="%s" Machine="winrmtest"><f:Message>%s</f:Message></f:WSManFault></s:Detail>`+
+			`</s:Fault></s:Body></s:Envelope>`,
+			nsSoap, nsWsman, nsFault, f.subcode, xmlEscape(f.reason), f.code, xmlEscape(f.reason))
+		return
+	}
+
+	fmt.Fprintf(w, `<s:Envelope xmlns:s="%s" xmlns:a="%s" xmlns:x="%s" xmlns:w="%s" xmlns:rsp="%s">`+
+		`<s:Header/><s:Body>%s</s:Body></s:Envelope>`,
+		nsSoap, nsAddressing, nsTransfer, nsWsman, nsShell, body)
+}
+
+func (r *Remote) create() string {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	r.nextID++
+	return r.createShell(fmt.Sprintf("SHELL-%d", r.nextID))
+}
+
+// createShell adds a shell and returns the response to its creation. It
+// is called with the lock held.
+func (r *Remote) createShell(id string) string {
+	r.shells[id] = true
+
+	// Older clients only look for the shell ID in the selector set
+	return `<x:ResourceCreated><a:ReferenceParameters><w:SelectorSet>` +
+		`<w:Selector Name="ShellId">` + id + `</w:Selector>` +
+		`</w:SelectorSet></a:ReferenceParameters></x:ResourceCreated>` +
+		`<rsp:Shell><rsp:ShellId>` + id + `</rsp:ShellId></rsp:Shell>`
+}
+
+func (r *Remote) delete(shellID string) *fault {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	if !r.shells[shellID] {
+		return shellNotFound(shellID)
+	}
+	delete(r.shells, shellID)
+
+	// Deleting a shell ends the processes running in it. Their output
+	// can still be received, as requests already on the way may ask for it.
+	for _, cmd := range r.commands {
+		if cmd.shellID == shellID {
+			r.terminate(cmd)
+		}
+	}
+	return nil
+}
+
+func (r *Remote) command(shellID string, env *request) (string, *fault) {
+	line := strings.TrimSpace(env.Body.Command.Command)
+	for _, arg := range env.Body.Command.Arguments {
+		line += " " + arg
+	}
+
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	if !r.shells[shellID] {
+		return "", shellNotFound(shellID)
+	}
+
+	c := &command{shellID: shellID, terminated: make(chan struct{})}
+	cmd := &Cmd{
+		Line:       line,
+		Script:     decodeScript(line),
+		Stdin:      &stdinReader{r: r, c: c},
+		Stdout:     &outputWriter{r: r, c: c},
+		Stderr:     &outputWriter{r: r, c: c, stderr: true},
+		Terminated: c.terminated,
+	}
+
+	run := r.handler(cmd)
+	if run == nil {
+		return "", &fault{code: FaultUnknownCommand, reason: "unknown command: " + line}
+	}
+
+	r.nextID++
+	c.id = fmt.Sprintf("CMD-%d", r.nextID)
+	r.commands[c.id] = c
+
+	go func() {
+		code := run(cmd)
+
+		r.lock.Lock()
+		defer r.lock.Unlock()
+		if !c.done {
+			c.done = true
+			c.exitCode = code
+			r.changed.Broadcast()
+		}
+	}()
+
+	return `<rsp:CommandResponse><rsp:CommandId>` + c.id + `</rsp:CommandId></rsp:CommandResponse>`, nil
+}
+
+// handler returns the function that runs cmd. It is called with the lock
+// held.
+func (r *Remote) handler(cmd *Cmd) CommandFunc {
+	for _, h := range r.handlers {
+		if h.match(cmd) {
+			return h.run
+		}
+	}
+	for _, h := range r.fs.builtin {
+		if h.match(cmd) {
+			return h.run
+		}
+	}
+	return nil
+}
+
+func (r *Remote) send(env *request) (string, *fault) {
+	data, err := base64.StdEncoding.DecodeString(strings.TrimSpace(env.Body.Send.Content))
+	if err != nil {
+		return "", &fault{subcode: "w:InvalidParameter", reason: "bad stdin: " + err.Error()}
+	}
+
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	c, ok := r.commands[env.Body.Send.CommandID]
+	if !ok {
+		return "", commandNotFound(env.Body.Send.CommandID)
+	}
+	c.stdin = append(c.stdin, data...)
+	if env.Body.Send.End {
+		c.stdinEnd = true
+	}
+	r.changed.Broadcast()
+
+	return `<rsp:SendResponse/>`, nil
+}
+
+func (r *Remote) receive(id string) (string, *fault) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	c, ok := r.commands[id]
+	if !ok {
+		return "", commandNotFound(id)
+	}
+
+	if !r.poll(func() bool { return len(c.stdout) > 0 || len(c.stderr) > 0 || c.done }) {
+		return "", timedOut()
+	}
+
+	body := `<rsp:ReceiveResponse>`
+	for _, s := range []struct {
+		name string
+		data *[]byte
+	}{{"stdout", &c.stdout}, {"stderr", &c.stderr}} {
+		if len(*s.data) > 0 {
+			body += `<rsp:Stream Name="` + s.name + `" CommandId="` + id + `">` +
+				base64.StdEncoding.EncodeToString(*s.data) + `</rsp:Stream>`
+			*s.data = nil
+		}
+	}
+	if c.done {
+		body += `<rsp:Stream Name="stdout" CommandId="` + id + `" End="true"></rsp:Stream>` +
+			`<rsp:Stream Name="stderr" CommandId="` + id + `" End="true"></rsp:Stream>` +
+			`<rsp:CommandState CommandId="` + id + `" State="` + nsShell + `/CommandState/Done">` +
+			fmt.Sprintf(`<rsp:ExitCode>%d</rsp:ExitCode>`, c.exitCode) +
+			`</rsp:CommandState>`
+	} else {
+		body += `<rsp:CommandState CommandId="` + id + `" State="` + nsShell + `/CommandState/Running"/>`
+	}
+	body += `</rsp:ReceiveResponse>`
+
+	return body, nil
+}
+
+// poll waits for ready to return true, for up to the poll timeout, like
+// WinRM waits for output. It is called with the lock held.
+func (r *Remote) poll(ready func() bool) bool {
+	timer := time.AfterFunc(pollTimeout, func() {
+		r.lock.Lock()
+		r.changed.Broadcast()
+		r.lock.Unlock()
+	})
+	defer timer.Stop()
+
+	deadline := time.Now().Add(pollTimeout)
+	for !ready() && time.Now().Before(deadline) {
+		r.changed.Wait()
+	}
+	return ready()
+}
+
+func (r *Remote) signal(id, code string) (string, *fault) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	c, ok := r.commands[id]
+	if !ok {
+		return "", commandNotFound(id)
+	}
+	if strings.TrimSpace(code) == signalTerminate {
+		r.terminate(c)
+	}
+
+	return `<rsp:SignalResponse/>`, nil
+}
+
+// terminate ends a command that is still running. It is called with the
+// lock held.
+func (r *Remote) terminate(c *command) {
+	if c.done {
+		return
+	}
+
+	c.done = true
+	c.exitCode = ExitCodeTerminated
+	c.stdinEnd = true
+	close(c.terminated)
+	r.changed.Broadcast()
+}
+
+func timedOut() *fault {
+	return &fault{
+		code:    FaultTimedOut,
+		subcode: "w:TimedOut",
+		reason:  "The WS-Management service cannot complete the operation within the time specified in OperationTimeout.",
+	}
+}
+
+func shellNotFound(id string) *fault {
+	return &fault{
+		code:    FaultShellNotFound,
+		subcode: "w:InvalidSelectors",
+		reason:  "The request for the Windows Remote Shell with ShellId " + id + " failed because the shell was not found on the server.",
+	}
+}
+
+func commandNotFound(id string) *fault {
+	return &fault{subcode: "w:InvalidSelectors", reason: "unknown command ID " + id}
+}
+
+// stdinReader reads the input sent to a command.
+type stdinReader struct {
+	r *Remote
+	c *command
+}
+
+func (s *stdinReader) Read(p []byte) (int, error) {
+	s.r.lock.Lock()
+	defer s.r.lock.Unlock()
+
+	for len(s.c.stdin) == 0 && !s.c.stdinEnd {
+		s.r.changed.Wait()
+	}
+	if len(s.c.stdin) == 0 {
+		return 0, io.EOF
+	}
+
+	n := copy(p, s.c.stdin)
+	s.c.stdin = s.c.stdin[n:]
+	return n, nil
+}
+
+// outputWriter buffers a command's output until the client receives it.
+type outputWriter struct {
+	r      *Remote
+	c      *command
+	stderr bool
+}
+
+func (w *outputWriter) Write(p []byte) (int, error) {
+	w.r.lock.Lock()
+	defer w.r.lock.Unlock()
+
+	if !w.c.done {
+		if w.stderr {
+			w.c.stderr = append(w.c.stderr, p...)
+		} else {
+			w.c.stdout = append(w.c.stdout, p...)
+		}
+		w.r.changed.Broadcast()
+	}
+	return len(p), nil
+}
+
+var encodedCommand = regexp.MustCompile(`(?i)^powershell(?:\.exe)?\s.*-EncodedCommand\s+(\S+)`)
+
+// decodeScript returns the script of a command line that runs PowerShell
+// with an encoded command, which is base64 encoded UTF-16.
+func decodeScript(line string) string {
+	m := encodedCommand.FindStringSubmatch(line)
+	if m == nil {
+		return ""
+	}
+
+	b, err := base64.StdEncoding.DecodeString(m[1])
+	if err != nil || len(b)%2 != 0 {
+		return ""
+	}
+
+	u := make([]uint16, len(b)/2)
+	for i := range u {
+		u[i] = uint16(b[2*i]) | uint16(b[2*i+1])<<8
+	}
+	return string(utf16.Decode(u))
+}
+
+func xmlEscape(s string) string {
+	var b bytes.Buffer
+	xml.EscapeText(&b, []byte(s))
+	return b.String()
+}
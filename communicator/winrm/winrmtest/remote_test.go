@@ -0,0 +1,310 @@
+package winrmtest
+
+import (
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/mitchellh/packer/packer"
+	"github.com/packer-community/packer-windows-plugins/communicator/winrm"
+)
+
+func testCommunicator(t *testing.T, r *Remote) *winrm.Communicator {
+	config := &winrm.Config{
+		User:     "vagrant",
+		Password: "vagrant",
+		Timeout:  time.Minute,
+	}
+	config.Host, config.Port = r.HostPort()
+
+	comm, err := winrm.New(config)
+	if err != nil {
+		t.Fatalf("error connecting to WinRM: %s", err)
+	}
+	return comm
+}
+
+// run runs a command to completion and returns its output.
+func run(t *testing.T, comm packer.Communicator, command string) (string, string, int) {
+	var stdout, stderr bytes.Buffer
+	cmd := &packer.RemoteCmd{Command: command, Stdout: &stdout, Stderr: &stderr}
+	if err := comm.Start(cmd); err != nil {
+		t.Fatalf("error starting %q: %s", command, err)
+	}
+	cmd.Wait()
+	return stdout.String(), stderr.String(), cmd.ExitStatus
+}
+
+// powershell encodes a script the way clients run PowerShell over WinRM.
+func powershell(script string) string {
+	var wide []byte
+	for _, c := range script {
+		wide = append(wide, byte(c), byte(c>>8))
+	}
+	return "powershell.exe -EncodedCommand " + base64.StdEncoding.EncodeToString(wide)
+}
+
+func TestRemote_Command(t *testing.T) {
+	r := NewRemote()
+	defer r.Close()
+
+	r.Command(MatchText("hostname"), "WIN-PACKER\r\n", 0)
+	r.CommandFunc(MatchPattern(`^exit \d+$`), func(cmd *Cmd) int {
+		fmt.Fprintln(cmd.Stderr, "exiting")
+		code, _ := strconv.Atoi(strings.TrimPrefix(cmd.Line, "exit "))
+		return code
+	})
+	r.Command(MatchScript(`^Write-Host`), "from powershell", 0)
+
+	comm := testCommunicator(t, r)
+
+	if stdout, _, code := run(t, comm, "hostname"); stdout != "WIN-PACKER\r\n" || code != 0 {
+		t.Fatalf("bad result: %q, %d", stdout, code)
+	}
+	if _, stderr, code := run(t, comm, "exit 42"); stderr != "exiting\n" || code != 42 {
+		t.Fatalf("bad result: %q, %d", stderr, code)
+	}
+	if stdout, _, _ := run(t, comm, powershell("Write-Host hello")); stdout != "from powershell" {
+		t.Fatalf("bad output: %q", stdout)
+	}
+
+	// Commands without a handler fail to start
+	if err := comm.Start(&packer.RemoteCmd{Command: "unknown"}); err == nil {
+		t.Fatal("should have error")
+	}
+
+	if err := comm.Close(); err != nil {
+		t.Fatalf("error closing communicator: %s", err)
+	}
+	if n := r.Shells(); n != 0 {
+		t.Fatalf("%d shells left open", n)
+	}
+	// Including the one that failed
+	if n := r.Requests("Command"); n != 5 {
+		t.Fatalf("bad number of commands: %d", n)
+	}
+}
+
+func TestRemote_Stdin(t *testing.T) {
+	r := NewRemote()
+	defer r.Close()
+
+	r.CommandFunc(MatchText("more"), func(cmd *Cmd) int {
+		io.Copy(cmd.Stdout, cmd.Stdin)
+		return 0
+	})
+
+	comm := testCommunicator(t, r)
+	defer comm.Close()
+
+	var stdout bytes.Buffer
+	cmd := &packer.RemoteCmd{
+		Command: "more",
+		Stdin:   strings.NewReader("line one\r\nline two\r\n"),
+		Stdout:  &stdout,
+	}
+	if err := comm.Start(cmd); err != nil {
+		t.Fatalf("error starting cmd: %s", err)
+	}
+	cmd.Wait()
+
+	if stdout.String() != "line one\r\nline two\r\n" {
+		t.Fatalf("bad output: %q", stdout.String())
+	}
+}
+
+func TestRemote_Terminate(t *testing.T) {
+	r := NewRemote()
+	defer r.Close()
+
+	// A handler that ignores the signal is terminated all the same
+	r.CommandFunc(MatchText("ping -t localhost"), func(cmd *Cmd) int {
+		time.Sleep(time.Second)
+		return 0
+	})
+
+	comm := testCommunicator(t, r)
+	defer comm.Close()
+
+	cmd := &packer.RemoteCmd{Command: "ping -t localhost"}
+	if err := comm.Start(cmd); err != nil {
+		t.Fatalf("error starting cmd: %s", err)
+	}
+	if err := comm.Terminate(cmd); err != nil {
+		t.Fatalf("error terminating cmd: %s", err)
+	}
+	cmd.Wait()
+
+	if cmd.ExitStatus != ExitCodeTerminated {
+		t.Fatalf("bad exit status: %d", cmd.ExitStatus)
+	}
+}
+
+func TestRemote_CopyFile(t *testing.T) {
+	r := NewRemote()
+	defer r.Close()
+
+	comm := testCommunicator(t, r)
+	defer comm.Close()
+
+	// The commands winrmcp runs to copy a file
+	tmp := `winrmcp-3f1e2a.tmp`
+	for _, chunk := range []string{"hello ", "world"} {
+		line := fmt.Sprintf(`echo %s >> "%%TEMP%%\%s"`, base64.StdEncoding.EncodeToString([]byte(chunk)), tmp)
+		if _, stderr, code := run(t, comm, line); code != 0 {
+			t.Fatalf("error appending chunk: %s", stderr)
+		}
+	}
+
+	restore := fmt.Sprintf(`
+		$tmp_file_path = [System.IO.Path]::GetFullPath("$env:TEMP\%s")
+		$dest_file_path = [System.IO.Path]::GetFullPath("%s".Trim("'"))
+		if (Test-Path $dest_file_path) {
+			rm $dest_file_path
+		}
+	`, tmp, `C:\Windows\Temp\script.ps1`)
+	if _, stderr, code := run(t, comm, powershell(restore)); code != 0 {
+		t.Fatalf("error restoring file: %s", stderr)
+	}
+
+	cleanup := fmt.Sprintf(`
+		$tmp_file_path = [System.IO.Path]::GetFullPath("$env:TEMP\%s")
+		if (Test-Path $tmp_file_path) {
+			Remove-Item $tmp_file_path -ErrorAction SilentlyContinue
+		}
+	`, tmp)
+	if _, stderr, code := run(t, comm, powershell(cleanup)); code != 0 {
+		t.Fatalf("error removing temporary file: %s", stderr)
+	}
+
+	if data, ok := r.File(`c:\windows\temp\SCRIPT.ps1`); !ok || string(data) != "hello world" {
+		t.Fatalf("bad file: %q, %t", data, ok)
+	}
+	if files := r.Files(); len(files) != 1 {
+		t.Fatalf("temporary file should be removed: %v", files)
+	}
+}
+
+func TestRemote_Download(t *testing.T) {
+	r := NewRemote()
+	defer r.Close()
+
+	comm := testCommunicator(t, r)
+	defer comm.Close()
+
+	content := bytes.Repeat([]byte("0123456789"), 10000)
+	r.WriteFile(`C:\packer\logs\setup.log`, content)
+	r.WriteFile(`C:\packer\logs\old\first.log`, []byte("first"))
+
+	var buf bytes.Buffer
+	if err := comm.Download(`C:\packer\logs\setup.log`, &buf); err != nil {
+		t.Fatalf("error downloading file: %s", err)
+	}
+	if !bytes.Equal(buf.Bytes(), content) {
+		t.Fatalf("bad content: %d bytes", buf.Len())
+	}
+
+	if err := comm.Download(`C:\packer\missing.log`, &buf); err == nil || !strings.Contains(err.Error(), "does not exist") {
+		t.Fatalf("should have error: %v", err)
+	}
+
+	dir, err := ioutil.TempDir("", "winrmtest")
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	if err := comm.DownloadDir(`C:\packer\logs`, dir, nil); err != nil {
+		t.Fatalf("error downloading dir: %s", err)
+	}
+	if data, err := ioutil.ReadFile(filepath.Join(dir, "old", "first.log")); err != nil || string(data) != "first" {
+		t.Fatalf("bad file: %q, %v", data, err)
+	}
+}
+
+func TestRemote_HTTPUpload(t *testing.T) {
+	r := NewRemote()
+	defer r.Close()
+
+	config := &winrm.Config{
+		User:           "vagrant",
+		Password:       "vagrant",
+		Timeout:        time.Minute,
+		HTTPUpload:     true,
+		HTTPUploadHost: "127.0.0.1",
+	}
+	config.Host, config.Port = r.HostPort()
+
+	comm, err := winrm.New(config)
+	if err != nil {
+		t.Fatalf("error connecting to WinRM: %s", err)
+	}
+	defer comm.Close()
+
+	content := bytes.Repeat([]byte("packer"), 200*1024)
+	if err := comm.Upload(`${env:TEMP}\big.bin`, bytes.NewReader(content), nil); err != nil {
+		t.Fatalf("error uploading: %s", err)
+	}
+
+	if data, ok := r.File(TempDir + `\big.bin`); !ok || !bytes.Equal(data, content) {
+		t.Fatalf("bad file: %d bytes, %t", len(data), ok)
+	}
+}
+
+func TestRemote_Mkdir(t *testing.T) {
+	r := NewRemote()
+	defer r.Close()
+
+	comm := testCommunicator(t, r)
+	defer comm.Close()
+
+	src, err := ioutil.TempDir("", "winrmtest")
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	defer os.RemoveAll(src)
+	os.MkdirAll(filepath.Join(src, "modules", "o'brien"), 0755)
+
+	if err := comm.UploadDir(`C:\packer`, src+string(filepath.Separator), nil); err != nil {
+		t.Fatalf("error uploading dir: %s", err)
+	}
+	if !r.IsDir(`C:\packer\modules\o'brien`) {
+		t.Fatal("directory should be created")
+	}
+}
+
+func TestFullPath(t *testing.T) {
+	cases := map[string]string{
+		`C:\Windows\Temp\file`:        `C:\Windows\Temp\file`,
+		`c:/windows/temp/../file`:     `C:\windows\file`,
+		`"%TEMP%\winrmcp-1.tmp"`:      TempDir + `\winrmcp-1.tmp`,
+		`$env:TEMP\winrmcp-1.tmp`:     TempDir + `\winrmcp-1.tmp`,
+		`${env:SystemRoot}\Temp\file`: `C:\Windows\Temp\file`,
+		`\packer\file`:                `C:\packer\file`,
+		`script.ps1`:                  HomeDir + `\script.ps1`,
+		`'C:\quoted'`:                 `C:\quoted`,
+	}
+
+	for input, expected := range cases {
+		if actual := fullPath(input); actual != expected {
+			t.Errorf("fullPath(%s) = %s, expected %s", input, actual, expected)
+		}
+	}
+}
+
+func TestDecodeScript(t *testing.T) {
+	if script := decodeScript(powershell("Get-Date | Out-Host")); script != "Get-Date | Out-Host" {
+		t.Fatalf("bad script: %q", script)
+	}
+	if script := decodeScript("powershell -Command Get-Date"); script != "" {
+		t.Fatalf("bad script: %q", script)
+	}
+}
@@ -0,0 +1,287 @@
+package winrm
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+)
+
+// XML namespaces used by the WS-Management shell protocol.
+const (
+	nsSoap       = "http://www.w3.org/2003/05/soap-envelope"
+	nsAddressing = "http://schemas.xmlsoap.org/ws/2004/08/addressing"
+	nsWsman      = "http://schemas.dmtf.org/wbem/wsman/1/wsman.xsd"
+	nsWsmanMsft  = "http://schemas.microsoft.com/wbem/wsman/1/wsman.xsd"
+	nsTransfer   = "http://schemas.xmlsoap.org/ws/2004/09/transfer"
+	nsShell      = "http://schemas.microsoft.com/wbem/wsman/1/windows/shell"
+	nsFault      = "http://schemas.microsoft.com/wbem/wsman/1/wsmanfault"
+)
+
+// WS-Management actions and resources for the Windows cmd shell and the
+// service configuration.
+const (
+	actionGet     = nsTransfer + "/Get"
+	actionCreate  = nsTransfer + "/Create"
+	actionDelete  = nsTransfer + "/Delete"
+	actionCommand = nsShell + "/Command"
+	actionSend    = nsShell + "/Send"
+	actionReceive = nsShell + "/Receive"
+	actionSignal  = nsShell + "/Signal"
+
+	resourceCmdShell = nsShell + "/cmd"
+	resourceConfig   = "http://schemas.microsoft.com/wbem/wsman/1/config"
+
+	commandStateDone = nsShell + "/CommandState/Done"
+)
+
+// wsmanFaultTimedOut is the WSManFault code returned when a Receive sees
+// no output within the operation timeout.
+const wsmanFaultTimedOut = "2150858793"
+
+// wsmanClient posts WS-Management envelopes to a WinRM endpoint.
+type wsmanClient struct {
+	url      string
+	user     string
+	password string
+	http     *http.Client
+
+	// timeout is the ISO 8601 operation timeout sent with every request
+	timeout      string
+	locale       string
+	envelopeSize int
+
+	retry RetryPolicy
+}
+
+// wsmanOption is a WS-Management OptionSet entry.
+type wsmanOption struct {
+	name  string
+	value string
+}
+
+// wsmanRequest is a single WS-Management operation against a shell or
+// the service configuration.
+type wsmanRequest struct {
+	action  string
+	shellID string
+	options []wsmanOption
+
+	// resource is the resource URI of the request, the cmd shell if empty
+	resource string
+
+	// body is the XML content of the SOAP body
+	body string
+}
+
+// wsmanFault is the error returned for a SOAP fault.
+type wsmanFault struct {
+	// Code is the WSManFault code, such as 2150858793 for a timeout
+	Code    string
+	Subcode string
+	Reason  string
+}
+
+func (f *wsmanFault) Error() string {
+	if f.Code != "" {
+		return fmt.Sprintf("WinRM fault %s (%s): %s", f.Subcode, f.Code, f.Reason)
+	}
+	return fmt.Sprintf("WinRM fault %s: %s", f.Subcode, f.Reason)
+}
+
+// isTimedOut reports whether err is the fault returned when an operation
+// did not complete within the operation timeout.
+func isTimedOut(err error) bool {
+	f, ok := err.(*wsmanFault)
+	return ok && (f.Code == wsmanFaultTimedOut || strings.HasSuffix(f.Subcode, ":TimedOut"))
+}
+
+// postOnce sends a request and decodes the response envelope.
+func (c *wsmanClient) postOnce(r *wsmanRequest) (*wsmanResponse, error) {
+	req, err := http.NewRequest("POST", c.url, strings.NewReader(c.envelope(r)))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/soap+xml;charset=UTF-8")
+	req.SetBasicAuth(c.user, c.password)
+
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return nil, newTransportError(err)
+	}
+	defer resp.Body.Close()
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, &transportError{
+			err:       fmt.Errorf("Error reading WinRM response: %s", err),
+			delivered: true,
+		}
+	}
+
+	if !strings.Contains(resp.Header.Get("Content-Type"), "application/soap+xml") {
+		if resp.StatusCode != http.StatusOK {
+			return nil, &httpStatusError{StatusCode: resp.StatusCode}
+		}
+		return nil, fmt.Errorf("WinRM response has unexpected content type %q",
+			resp.Header.Get("Content-Type"))
+	}
+
+	var env wsmanResponse
+	if err := xml.Unmarshal(body, &env); err != nil {
+		return nil, fmt.Errorf("Error parsing WinRM response: %s", err)
+	}
+
+	if f := env.Body.Fault; f != nil {
+		return nil, &wsmanFault{
+			Code:    f.Detail.WSManFault.Code,
+			Subcode: strings.TrimSpace(f.Code.Subcode.Value),
+			Reason:  strings.TrimSpace(f.Reason.Text),
+		}
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, &httpStatusError{StatusCode: resp.StatusCode}
+	}
+
+	return &env, nil
+}
+
+// envelope renders a request as a SOAP envelope.
+func (c *wsmanClient) envelope(r *wsmanRequest) string {
+	var b bytes.Buffer
+
+	fmt.Fprintf(&b, `<env:Envelope xmlns:env="%s" xmlns:a="%s" xmlns:w="%s" xmlns:p="%s" xmlns:rsp="%s">`,
+		nsSoap, nsAddressing, nsWsman, nsWsmanMsft, nsShell)
+	b.WriteString(`<env:Header>`)
+	fmt.Fprintf(&b, `<a:To>%s</a:To>`, xmlEscape(c.url))
+	b.WriteString(`<a:ReplyTo><a:Address mustUnderstand="true">http://schemas.xmlsoap.org/ws/2004/08/addressing/role/anonymous</a:Address></a:ReplyTo>`)
+	fmt.Fprintf(&b, `<w:MaxEnvelopeSize mustUnderstand="true">%d</w:MaxEnvelopeSize>`, c.envelopeSize)
+	fmt.Fprintf(&b, `<w:OperationTimeout>%s</w:OperationTimeout>`, c.timeout)
+	fmt.Fprintf(&b, `<a:MessageID>uuid:%s</a:MessageID>`, newUUID())
+	fmt.Fprintf(&b, `<w:Locale mustUnderstand="false" xml:lang="%s"/>`, c.locale)
+	fmt.Fprintf(&b, `<p:DataLocale mustUnderstand="false" xml:lang="%s"/>`, c.locale)
+	fmt.Fprintf(&b, `<a:Action mustUnderstand="true">%s</a:Action>`, r.action)
+	if r.shellID != "" {
+		fmt.Fprintf(&b, `<w:SelectorSet><w:Selector Name="ShellId">%s</w:Selector></w:SelectorSet>`,
+			xmlEscape(r.shellID))
+	}
+	resource := r.resource
+	if resource == "" {
+		resource = resourceCmdShell
+	}
+	fmt.Fprintf(&b, `<w:ResourceURI mustUnderstand="true">%s</w:ResourceURI>`, resource)
+	if len(r.options) > 0 {
+		b.WriteString(`<w:OptionSet>`)
+		for _, o := range r.options {
+			fmt.Fprintf(&b, `<w:Option Name="%s">%s</w:Option>`, o.name, xmlEscape(o.value))
+		}
+		b.WriteString(`</w:OptionSet>`)
+	}
+	b.WriteString(`</env:Header>`)
+
+	b.WriteString(`<env:Body>`)
+	b.WriteString(r.body)
+	b.WriteString(`</env:Body></env:Envelope>`)
+
+	return b.String()
+}
+
+// wsmanResponse is the subset of the response envelopes that the shell
+// protocol needs.
+type wsmanResponse struct {
+	XMLName xml.Name `xml:"http://www.w3.org/2003/05/soap-envelope Envelope"`
+	Body    struct {
+		Fault *struct {
+			Code struct {
+				Subcode struct {
+					Value string `xml:"http://www.w3.org/2003/05/soap-envelope Value"`
+				} `xml:"http://www.w3.org/2003/05/soap-envelope Subcode"`
+			} `xml:"http://www.w3.org/2003/05/soap-envelope Code"`
+			Reason struct {
+				Text string `xml:"http://www.w3.org/2003/05/soap-envelope Text"`
+			} `xml:"http://www.w3.org/2003/05/soap-envelope Reason"`
+			Detail struct {
+				WSManFault struct {
+					Code string `xml:"Code,attr"`
+				} `xml:"http://schemas.microsoft.com/wbem/wsman/1/wsmanfault WSManFault"`
+			} `xml:"http://www.w3.org/2003/05/soap-envelope Detail"`
+		} `xml:"http://www.w3.org/2003/05/soap-envelope Fault"`
+
+		ResourceCreated *struct {
+			ReferenceParameters struct {
+				SelectorSet struct {
+					Selectors []struct {
+						Name  string `xml:"Name,attr"`
+						Value string `xml:",chardata"`
+					} `xml:"http://schemas.dmtf.org/wbem/wsman/1/wsman.xsd Selector"`
+				} `xml:"http://schemas.dmtf.org/wbem/wsman/1/wsman.xsd SelectorSet"`
+			} `xml:"http://schemas.xmlsoap.org/ws/2004/08/addressing ReferenceParameters"`
+		} `xml:"http://schemas.xmlsoap.org/ws/2004/09/transfer ResourceCreated"`
+
+		Shell *struct {
+			ShellID string `xml:"http://schemas.microsoft.com/wbem/wsman/1/windows/shell ShellId"`
+		} `xml:"http://schemas.microsoft.com/wbem/wsman/1/windows/shell Shell"`
+
+		Config *struct {
+			MaxEnvelopeSizekb int `xml:"http://schemas.microsoft.com/wbem/wsman/1/config MaxEnvelopeSizekb"`
+			MaxShellsPerUser  int `xml:"http://schemas.microsoft.com/wbem/wsman/1/config Winrs>MaxShellsPerUser"`
+		} `xml:"http://schemas.microsoft.com/wbem/wsman/1/config Config"`
+
+		CommandResponse *struct {
+			CommandID string `xml:"http://schemas.microsoft.com/wbem/wsman/1/windows/shell CommandId"`
+		} `xml:"http://schemas.microsoft.com/wbem/wsman/1/windows/shell CommandResponse"`
+
+		ReceiveResponse *struct {
+			Streams []struct {
+				Name      string `xml:"Name,attr"`
+				CommandID string `xml:"CommandId,attr"`
+				End       bool   `xml:"End,attr"`
+				Content   string `xml:",chardata"`
+			} `xml:"http://schemas.microsoft.com/wbem/wsman/1/windows/shell Stream"`
+			CommandState *struct {
+				CommandID string `xml:"CommandId,attr"`
+				State     string `xml:"State,attr"`
+				ExitCode  *int   `xml:"http://schemas.microsoft.com/wbem/wsman/1/windows/shell ExitCode"`
+			} `xml:"http://schemas.microsoft.com/wbem/wsman/1/windows/shell CommandState"`
+		} `xml:"http://schemas.microsoft.com/wbem/wsman/1/windows/shell ReceiveResponse"`
+	} `xml:"http://www.w3.org/2003/05/soap-envelope Body"`
+}
+
+// shellID returns the ID of the shell created by a Create request. Older
+// versions of WinRM only return it in the selector set.
+func (r *wsmanResponse) shellID() string {
+	if r.Body.Shell != nil && r.Body.Shell.ShellID != "" {
+		return strings.TrimSpace(r.Body.Shell.ShellID)
+	}
+	if rc := r.Body.ResourceCreated; rc != nil {
+		for _, s := range rc.ReferenceParameters.SelectorSet.Selectors {
+			if s.Name == "ShellId" {
+				return strings.TrimSpace(s.Value)
+			}
+		}
+	}
+	return ""
+}
+
+func xmlEscape(s string) string {
+	var b bytes.Buffer
+	xml.EscapeText(&b, []byte(s))
+	return b.String()
+}
+
+// newUUID returns a random (version 4) UUID for message IDs.
+func newUUID() string {
+	var u [16]byte
+	if _, err := io.ReadFull(rand.Reader, u[:]); err != nil {
+		panic(err)
+	}
+	u[6] = (u[6] & 0x0f) | 0x40
+	u[8] = (u[8] & 0x3f) | 0x80
+
+	return fmt.Sprintf("%X-%X-%X-%X-%X", u[0:4], u[4:6], u[6:8], u[8:10], u[10:])
+}
@@ -1,8 +1,11 @@
 package main
 
 import (
+	"os"
+
 	"github.com/mitchellh/packer/packer/plugin"
 	"github.com/packer-community/packer-windows-plugins/builder/amazon-windows/ebs"
+	"github.com/packer-community/packer-windows-plugins/common/redact"
 )
 
 func main() {
@@ -10,6 +13,7 @@ func main() {
 	if err != nil {
 		panic(err)
 	}
+	redact.SetLogOutput(os.Stderr)
 	server.RegisterBuilder(new(ebs.Builder))
 	server.Serve()
 }
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"flag"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/mitchellh/packer/packer"
+	"github.com/packer-community/packer-windows-plugins/common"
+	plugin "github.com/packer-community/packer-windows-plugins/communicator/winrm"
+)
+
+// newConfig returns the configuration of the connection.
+func newConfig() (*plugin.Config, error) {
+	c, err := winrmConfig()
+	if err != nil {
+		return nil, err
+	}
+
+	config := &plugin.Config{
+		Host:             c.WinRMHost,
+		Port:             int(c.WinRMPort),
+		User:             c.WinRMUser,
+		Password:         c.WinRMPassword,
+		Timeout:          c.WinRMOperationTimeout,
+		ConnectTimeout:   c.WinRMWaitTimeout,
+		MaxShells:        c.WinRMMaxShells,
+		ShellIdleTimeout: c.WinRMShellIdleTimeout,
+		Auth:             c.WinRMAuth,
+		Https:            c.WinRMUseSSL,
+		Insecure:         c.WinRMInsecure,
+		Thumbprint:       c.WinRMThumbprint,
+		HTTPUpload:       c.WinRMHTTPUpload,
+		HTTPUploadHost:   c.WinRMHTTPUploadHost,
+		HTTPUploadPort:   c.WinRMHTTPUploadPort,
+		Ui:               &packer.BasicUi{Reader: os.Stdin, Writer: os.Stderr},
+		Codepage:         c.WinRMCodepage,
+		Retry: plugin.RetryPolicy{
+			MaxAttempts:    c.WinRMMaxAttempts,
+			InitialBackoff: c.WinRMRetryBackoff,
+			MaxBackoff:     c.WinRMRetryMaxBackoff,
+		},
+	}
+
+	if c.WinRMTraceFile != "" {
+		f, err := os.OpenFile(c.WinRMTraceFile, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+		if err != nil {
+			return nil, err
+		}
+		config.Trace = f
+	}
+
+	if c.WinRMCACert != "" {
+		bytes, err := ioutil.ReadFile(c.WinRMCACert)
+		if err != nil {
+			return nil, err
+		}
+		config.CACert = bytes
+	}
+
+	return config, nil
+}
+
+// winrmConfig returns the settings of the connection. Each of the profile,
+// the WINRM_ environment variables and the flags given overrides the one
+// before, and the result is validated like the settings of a template.
+func winrmConfig() (*common.WinRMConfig, error) {
+	c := &common.WinRMConfig{
+		WinRMHost:                "localhost",
+		RawWinRMWaitTimeout:      timeout.String(),
+		RawWinRMOperationTimeout: operationTimeout.String(),
+	}
+
+	name := *profile
+	if name == "" {
+		name = os.Getenv("WINRM_PROFILE")
+	}
+	if err := c.LoadProfile(*profiles, name); err != nil {
+		return nil, err
+	}
+
+	if err := c.LoadEnv(); err != nil {
+		return nil, err
+	}
+
+	flag.Visit(func(f *flag.Flag) {
+		switch f.Name {
+		case "host":
+			c.WinRMHost = *host
+		case "port":
+			c.WinRMPort = uint(*port)
+		case "user":
+			c.WinRMUser = *user
+		case "pass":
+			c.WinRMPassword = *pass
+		case "timeout":
+			c.RawWinRMWaitTimeout = timeout.String()
+		case "operation-timeout":
+			c.RawWinRMOperationTimeout = operationTimeout.String()
+		case "auth":
+			c.WinRMAuth = *auth
+		case "https":
+			c.WinRMUseSSL = *https
+		case "insecure":
+			c.WinRMInsecure = *insecure
+		case "cacert":
+			c.WinRMCACert = *cacert
+		case "thumbprint":
+			c.WinRMThumbprint = *thumbprint
+		case "trace":
+			c.WinRMTraceFile = *trace
+		case "codepage":
+			c.WinRMCodepage = *codepage
+		}
+	})
+
+	if *passStdin {
+		password, err := bufio.NewReader(os.Stdin).ReadString('\n')
+		if err != nil && password == "" {
+			return nil, err
+		}
+		c.WinRMPassword = strings.TrimRight(password, "\r\n")
+	}
+
+	if c.WinRMUser == "" || c.WinRMPassword == "" {
+		return nil, errors.New("A user and password are required: set them with -user and -pass or -pass-stdin, in a profile, or with WINRM_USERNAME and WINRM_PASSWORD")
+	}
+
+	if errs := c.Prepare(nil); len(errs) > 0 {
+		return nil, &packer.MultiError{Errors: errs}
+	}
+	return c, nil
+}
+
+// packerDir returns the directory Packer keeps its settings in.
+func packerDir() string {
+	home := os.Getenv("HOME")
+	if home == "" {
+		home = os.Getenv("USERPROFILE")
+	}
+	return filepath.Join(home, ".packer.d")
+}
+
+// profilesPath returns the file profiles are read from by default.
+func profilesPath() string {
+	return filepath.Join(packerDir(), "winrm.json")
+}
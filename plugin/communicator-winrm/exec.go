@@ -0,0 +1,270 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+
+	"github.com/mitchellh/packer/packer"
+	plugin "github.com/packer-community/packer-windows-plugins/communicator/winrm"
+)
+
+// utf8BOM marks an uploaded script as UTF-8.
+var utf8BOM = []byte{0xEF, 0xBB, 0xBF}
+
+type ExecCommand struct {
+	hosts     *string
+	inventory *string
+	parallel  *int
+	script    *string
+}
+
+func (e *ExecCommand) Flags(fs *flag.FlagSet) *flag.FlagSet {
+	e.hosts = fs.String("hosts", "", "comma separated hosts to run on, as host or host:port")
+	e.inventory = fs.String("inventory", "", "file listing the hosts to run on, one per line")
+	e.parallel = fs.Int("parallel", 10, "number of hosts to run on at once")
+	e.script = fs.String("script", "", "PowerShell script to run instead of a command")
+	return fs
+}
+
+func (e *ExecCommand) Run(args []string) {
+	targets, err := e.targets()
+	if err != nil {
+		fail("unable to read hosts: %s", err)
+	}
+	if len(targets) == 0 {
+		fail("no hosts given, use -hosts or -inventory")
+	}
+
+	var command string
+	var script []byte
+	switch {
+	case *e.script != "" && len(args) > 0:
+		fail("give either a command or -script, not both")
+	case *e.script != "":
+		script, err = ioutil.ReadFile(*e.script)
+		if err != nil {
+			fail("unable to read script: %s", err)
+		}
+
+		// Windows PowerShell reads scripts without a byte order mark in
+		// the ANSI code page
+		if !bytes.HasPrefix(script, utf8BOM) {
+			script = append(utf8BOM, script...)
+		}
+	case len(args) > 0:
+		command = args[0]
+	default:
+		fail("no command given")
+	}
+
+	parallel := *e.parallel
+	if parallel < 1 {
+		parallel = 1
+	}
+
+	config, err := newConfig()
+	if err != nil {
+		fail("unable to configure WinRM: %s", err)
+	}
+
+	// The debug logs of the hosts would get in the way of their output
+	if os.Getenv("PACKER_LOG") == "" {
+		log.SetOutput(ioutil.Discard)
+	}
+
+	results := make([]execResult, len(targets))
+	slots := make(chan struct{}, parallel)
+	var output sync.Mutex
+	var wg sync.WaitGroup
+	for i, target := range targets {
+		wg.Add(1)
+		go func(i int, target execTarget) {
+			defer wg.Done()
+			slots <- struct{}{}
+			defer func() { <-slots }()
+
+			results[i] = execOn(config, target, command, script, &output)
+		}(i, target)
+	}
+	wg.Wait()
+
+	if !printSummary(results) {
+		os.Exit(1)
+	}
+}
+
+// targets returns the hosts given with -hosts and in the -inventory file,
+// in order. Hosts without a port use the configured one.
+func (e *ExecCommand) targets() ([]execTarget, error) {
+	var names []string
+	for _, name := range strings.Split(*e.hosts, ",") {
+		if name = strings.TrimSpace(name); name != "" {
+			names = append(names, name)
+		}
+	}
+
+	if *e.inventory != "" {
+		inventory, err := readInventory(*e.inventory)
+		if err != nil {
+			return nil, err
+		}
+		names = append(names, inventory...)
+	}
+
+	targets := make([]execTarget, 0, len(names))
+	for _, name := range names {
+		target, err := parseTarget(name)
+		if err != nil {
+			return nil, err
+		}
+		targets = append(targets, target)
+	}
+	return targets, nil
+}
+
+// readInventory reads an inventory file, which lists one host per line.
+// Blank lines and lines starting with # are skipped.
+func readInventory(path string) ([]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var names []string
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		names = append(names, line)
+	}
+	return names, scanner.Err()
+}
+
+// execTarget is a host exec runs on.
+type execTarget struct {
+	// name is the host as given, which prefixes its output
+	name string
+	host string
+
+	// port is zero if the host was given without one
+	port int
+}
+
+func parseTarget(name string) (execTarget, error) {
+	target := execTarget{name: name, host: name}
+
+	h, p, err := net.SplitHostPort(name)
+	if err != nil {
+		// No port
+		return target, nil
+	}
+
+	n, err := strconv.Atoi(p)
+	if err != nil {
+		return target, fmt.Errorf("bad port in host %s", name)
+	}
+	target.host, target.port = h, n
+	return target, nil
+}
+
+// execResult is the outcome of running on a host.
+type execResult struct {
+	target     execTarget
+	exitStatus int
+
+	// err is set if the command could not be run
+	err error
+}
+
+// execOn runs a command, or a PowerShell script if one is given, on a
+// host, connecting with the settings of config other than the host and
+// port. Every line of the output is prefixed with the host, and output is
+// held while a line is written.
+func execOn(config *plugin.Config, target execTarget, command string, script []byte, output *sync.Mutex) execResult {
+	result := execResult{target: target}
+
+	hostConfig := *config
+	hostConfig.Host = target.host
+	if target.port != 0 {
+		hostConfig.Port = target.port
+	}
+
+	communicator, err := plugin.New(&hostConfig)
+	if err != nil {
+		result.err = fmt.Errorf("unable to connect: %s", err)
+		return result
+	}
+	defer communicator.Close()
+
+	stdout := &lineWriter{emit: prefixLines(os.Stdout, target.name+": ", output)}
+	stderr := &lineWriter{emit: prefixLines(os.Stderr, target.name+": ", output)}
+	rc := &packer.RemoteCmd{Command: command, Stdout: stdout, Stderr: stderr}
+	if script != nil {
+		// The script is uploaded and run as a file, so its length is not
+		// limited by the cmd.exe command line
+		path := fmt.Sprintf(`C:\Windows\Temp\pcw-exec-%d.ps1`, time.Now().UnixNano())
+		if err := communicator.Upload(path, bytes.NewReader(script), nil); err != nil {
+			result.err = fmt.Errorf("unable to upload script: %s", err)
+			return result
+		}
+		defer removeScript(communicator, path)
+
+		rc.Command = fmt.Sprintf(`powershell -NoProfile -NonInteractive -ExecutionPolicy Bypass -File "%s"`, path)
+	}
+	if err := communicator.Start(rc); err != nil {
+		result.err = fmt.Errorf("unable to run command: %s", err)
+		return result
+	}
+	rc.Wait()
+	stdout.Flush()
+	stderr.Flush()
+
+	result.exitStatus = rc.ExitStatus
+	return result
+}
+
+// removeScript deletes a script uploaded to a host once it has run.
+func removeScript(communicator *plugin.Communicator, path string) {
+	rc := &packer.RemoteCmd{Command: fmt.Sprintf(`del /f /q "%s"`, path)}
+	if err := communicator.Start(rc); err != nil {
+		log.Printf("Error removing %s: %s", path, err)
+		return
+	}
+	rc.Wait()
+}
+
+// printSummary prints the exit status of every host, and reports whether
+// the command succeeded on all of them.
+func printSummary(results []execResult) bool {
+	ok := true
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w)
+	fmt.Fprintln(w, "HOST\tEXIT")
+	for _, r := range results {
+		switch {
+		case r.err != nil:
+			ok = false
+			fmt.Fprintf(w, "%s\terror: %s\n", r.target.name, r.err)
+		default:
+			ok = ok && r.exitStatus == 0
+			fmt.Fprintf(w, "%s\t%d\n", r.target.name, r.exitStatus)
+		}
+	}
+	w.Flush()
+
+	return ok
+}
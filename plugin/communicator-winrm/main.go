@@ -2,23 +2,37 @@ package main
 
 import (
 	"flag"
-	plugin "github.com/packer-community/packer-windows-plugins/communicator/winrm"
-	"github.com/masterzen/winrm/winrm"
+	"fmt"
+	"os"
+	"time"
+
 	"github.com/mitchellh/packer/packer"
 	rpc "github.com/mitchellh/packer/packer/plugin"
+	"github.com/packer-community/packer-windows-plugins/common/redact"
+	plugin "github.com/packer-community/packer-windows-plugins/communicator/winrm"
 	"github.com/rakyll/command"
-	"log"
-	"os"
-	"time"
 )
 
 var host = flag.String("host", "localhost", "host machine")
-var port = flag.Int("port", 5985, "host port")
-var user = flag.String("user", "vagrant", "user to run as")
-var pass = flag.String("pass", "vagrant", "user's password")
+var port = flag.Int("port", 0, "host port, 5985 or 5986 with -https")
+var user = flag.String("user", "", "user to run as")
+var pass = flag.String("pass", "", "user's password")
+var passStdin = flag.Bool("pass-stdin", false, "read the password from the first line of stdin")
 var timeout = flag.Duration("timeout", 60*time.Second, "connection timeout")
+var operationTimeout = flag.Duration("operation-timeout", plugin.DefaultTimeout, "timeout of each WinRM request")
+var auth = flag.String("auth", "basic", "authentication method, basic or ntlm")
+var https = flag.Bool("https", false, "use the HTTPS listener")
+var insecure = flag.Bool("insecure", false, "skip validation of the server certificate")
+var cacert = flag.String("cacert", "", "path to a PEM encoded CA certificate to trust")
+var thumbprint = flag.String("thumbprint", "", "expected server certificate thumbprint")
+var trace = flag.String("trace", "", "file to append WinRM requests and responses to")
+var codepage = flag.Int("codepage", plugin.CodepageUTF8, "code page of the guest's console output")
+var profile = flag.String("profile", "", "named profile to read settings from, or $WINRM_PROFILE")
+var profiles = flag.String("profiles", profilesPath(), "file to read profiles from")
 
 func main() {
+	redact.SetLogOutput(os.Stderr)
+
 	args := os.Args[1:]
 	if len(args) != 0 {
 		standalone()
@@ -32,42 +46,66 @@ func main() {
 	}
 }
 
+func connect() (*plugin.Communicator, error) {
+	config, err := newConfig()
+	if err != nil {
+		return nil, err
+	}
+
+	return plugin.New(config)
+}
+
 func standalone() {
 	command.On("cmd", "run a command", &RunCommand{}, []string{})
 	command.On("file", "copy a file", &FileCommand{}, []string{})
 	command.On("dir", "copy a dir", &DirCommand{}, []string{})
+	command.On("download", "copy a file or dir from the guest", &DownloadCommand{}, []string{})
+	command.On("sync", "copy the changed files of a dir", &SyncCommand{}, []string{})
+	command.On("shell", "start an interactive shell", &ShellCommand{}, []string{})
+	command.On("exec", "run a command on many hosts", &ExecCommand{}, []string{})
+	command.On("diagnose", "find out why WinRM can't be reached", &DiagnoseCommand{}, []string{})
 	command.Parse()
 	command.Run()
 }
 
-type RunCommand struct{}
+type RunCommand struct {
+	json *bool
+}
 
 func (r *RunCommand) Flags(fs *flag.FlagSet) *flag.FlagSet {
+	r.json = fs.Bool("json", false, "print the output and exit code as JSON records")
 	return fs
 }
 
 func (r *RunCommand) Run(args []string) {
+	if *r.json {
+		runJSON(args)
+		return
+	}
+
+	if len(args) == 0 {
+		fail("no command given")
+	}
 	command := args[0]
 
-	endpoint := &winrm.Endpoint{Host: *host, Port: *port}
-	communicator, err := plugin.New(endpoint, *user, *pass, *timeout)
+	communicator, err := connect()
+	if err != nil {
+		fail("unable to connect: %s", err)
+	}
+
 	rc := &packer.RemoteCmd{
 		Command: command,
 		Stdout:  os.Stdout,
 		Stderr:  os.Stderr,
 	}
-	if err != nil {
-		log.Printf("unable to run command: %s", err)
-		return
-	}
-
 	err = communicator.Start(rc)
 	if err != nil {
-		log.Printf("unable to run command: %s", err)
-		return
+		fail("unable to run command: %s", err)
 	}
 
 	rc.Wait()
+	communicator.Close()
+	os.Exit(exitStatus(rc.ExitStatus))
 }
 
 type FileCommand struct {
@@ -82,22 +120,26 @@ func (f *FileCommand) Flags(fs *flag.FlagSet) *flag.FlagSet {
 }
 
 func (f *FileCommand) Run(args []string) {
-	endpoint := &winrm.Endpoint{Host: *host, Port: *port}
-	communicator, err := plugin.New(endpoint, *user, *pass, *timeout)
+	communicator, err := connect()
+	if err != nil {
+		fail("unable to connect: %s", err)
+	}
+	defer communicator.Close()
 
 	info, err := os.Stat(*f.from)
 	if err != nil {
-		log.Panicln("unable to stat file", err.Error())
+		fail("unable to stat file: %s", err)
 	}
 
 	file, err := os.Open(*f.from)
 	if err != nil {
-		log.Panicln("unable to open file", err.Error())
+		fail("unable to open file: %s", err)
 	}
+	defer file.Close()
 
 	err = communicator.Upload(*f.to, file, &info)
 	if err != nil {
-		log.Printf("unable to copy file: %s", err)
+		fail("unable to copy file: %s", err)
 	}
 }
 
@@ -113,16 +155,44 @@ func (f *DirCommand) Flags(fs *flag.FlagSet) *flag.FlagSet {
 }
 
 func (f *DirCommand) Run(args []string) {
-	endpoint := &winrm.Endpoint{Host: *host, Port: *port}
-	communicator, _ := plugin.New(endpoint, *user, *pass, *timeout)
+	communicator, err := connect()
+	if err != nil {
+		fail("unable to connect: %s", err)
+	}
+	defer communicator.Close()
 
-	_, err := os.Stat(*f.from)
+	_, err = os.Stat(*f.from)
 	if err != nil {
-		log.Panicln("unable to stat dir", err.Error())
+		fail("unable to stat dir: %s", err)
 	}
 
 	err = communicator.UploadDir(*f.to, *f.from, nil)
 	if err != nil {
-		log.Printf("unable to copy dir: %s", err)
+		fail("unable to copy dir: %s", err)
 	}
 }
+
+type DiagnoseCommand struct{}
+
+func (d *DiagnoseCommand) Flags(fs *flag.FlagSet) *flag.FlagSet {
+	return fs
+}
+
+func (d *DiagnoseCommand) Run(args []string) {
+	config, err := newConfig()
+	if err != nil {
+		fail("unable to diagnose: %s", err)
+	}
+
+	diagnosis := plugin.Diagnose(config)
+	fmt.Print(diagnosis)
+	if diagnosis.Failed() != nil {
+		os.Exit(1)
+	}
+}
+
+// fail reports an error to the user and exits with a non-zero status.
+func fail(format string, args ...interface{}) {
+	printError(format, args...)
+	os.Exit(1)
+}
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mitchellh/packer/packer"
+)
+
+// lineWriter calls emit with every complete line written to it, newline
+// included. Flush emits what is left after the last newline.
+type lineWriter struct {
+	emit func(line []byte) error
+	buf  bytes.Buffer
+}
+
+func (l *lineWriter) Write(b []byte) (int, error) {
+	l.buf.Write(b)
+	for {
+		i := bytes.IndexByte(l.buf.Bytes(), '\n')
+		if i < 0 {
+			return len(b), nil
+		}
+
+		if err := l.emit(l.buf.Next(i + 1)); err != nil {
+			return len(b), err
+		}
+	}
+}
+
+func (l *lineWriter) Flush() error {
+	if l.buf.Len() == 0 {
+		return nil
+	}
+
+	l.buf.WriteByte('\n')
+	return l.emit(l.buf.Next(l.buf.Len()))
+}
+
+// prefixLines returns an emit function for a lineWriter that writes lines
+// to w with a prefix, holding lock while it does so that the lines of
+// different hosts don't mix.
+func prefixLines(w io.Writer, prefix string, lock *sync.Mutex) func([]byte) error {
+	return func(line []byte) error {
+		lock.Lock()
+		defer lock.Unlock()
+
+		_, err := w.Write(append([]byte(prefix), line...))
+		return err
+	}
+}
+
+// lineRecord is a line of output of the remote command in JSON mode.
+type lineRecord struct {
+	Time   time.Time `json:"time"`
+	Stream string    `json:"stream"`
+	Line   string    `json:"line"`
+}
+
+// exitRecord is the last record in JSON mode. ExitCode is missing if the
+// command could not be run, and Error says why.
+type exitRecord struct {
+	Time     time.Time `json:"time"`
+	ExitCode *int      `json:"exit_code,omitempty"`
+	Duration string    `json:"duration"`
+	Error    string    `json:"error,omitempty"`
+}
+
+// jsonOutput writes records to stdout, one JSON object per line.
+type jsonOutput struct {
+	lock  sync.Mutex
+	enc   *json.Encoder
+	start time.Time
+}
+
+func (o *jsonOutput) write(record interface{}) error {
+	o.lock.Lock()
+	defer o.lock.Unlock()
+	return o.enc.Encode(record)
+}
+
+// lines returns an emit function for a lineWriter that writes the lines
+// of a stream as records.
+func (o *jsonOutput) lines(stream string) func([]byte) error {
+	return func(line []byte) error {
+		return o.write(&lineRecord{
+			Time:   time.Now(),
+			Stream: stream,
+			Line:   strings.TrimRight(string(line), "\r\n"),
+		})
+	}
+}
+
+// exit writes the exit code of the command, or the error that kept it
+// from running.
+func (o *jsonOutput) exit(exitCode *int, err error) {
+	record := &exitRecord{
+		Time:     time.Now(),
+		ExitCode: exitCode,
+		Duration: time.Since(o.start).String(),
+	}
+	if err != nil {
+		record.Error = err.Error()
+	}
+	o.write(record)
+}
+
+// runJSON runs a command like RunCommand, but prints its output and exit
+// code as JSON records on stdout. It exits with the remote exit code, or 1
+// if the command could not be run.
+func runJSON(args []string) {
+	out := &jsonOutput{enc: json.NewEncoder(os.Stdout), start: time.Now()}
+	abort := func(err error) {
+		out.exit(nil, err)
+		os.Exit(1)
+	}
+
+	if len(args) == 0 {
+		abort(errors.New("no command given"))
+	}
+
+	// Errors are reported in the last record, so the debug log is only
+	// noise for scripts reading the output
+	if os.Getenv("PACKER_LOG") == "" {
+		log.SetOutput(ioutil.Discard)
+	}
+
+	communicator, err := connect()
+	if err != nil {
+		abort(fmt.Errorf("unable to connect: %s", err))
+	}
+
+	stdout := &lineWriter{emit: out.lines("stdout")}
+	stderr := &lineWriter{emit: out.lines("stderr")}
+	rc := &packer.RemoteCmd{Command: args[0], Stdout: stdout, Stderr: stderr}
+	if err := communicator.Start(rc); err != nil {
+		communicator.Close()
+		abort(fmt.Errorf("unable to run command: %s", err))
+	}
+	rc.Wait()
+	stdout.Flush()
+	stderr.Flush()
+
+	out.exit(&rc.ExitStatus, nil)
+	communicator.Close()
+	os.Exit(exitStatus(rc.ExitStatus))
+}
+
+// exitStatus returns the status to exit with for a remote exit code.
+// Windows exit codes are 32 bits, so those that would be truncated, maybe
+// to zero, are reported as 1.
+func exitStatus(code int) int {
+	if code < 0 || code > 255 {
+		return 1
+	}
+	return code
+}
@@ -0,0 +1,299 @@
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"github.com/mitchellh/packer/packer"
+	"github.com/packer-community/packer-windows-plugins/common/powershell"
+	plugin "github.com/packer-community/packer-windows-plugins/communicator/winrm"
+	"github.com/peterh/liner"
+)
+
+const shellHelp = `Commands run on the guest as they are typed, with their output streamed
+back. Ctrl+C stops the running command, Ctrl+D ends the session.
+
+  :powershell  switch between cmd and PowerShell
+  :help        show this help
+  :exit        end the session
+
+Commands run in the directory, or PowerShell location, the last cd
+changed to. Each PowerShell command starts a new powershell.exe, so
+variables and functions don't carry over to the next one.
+`
+
+// cdCommand matches the cmd commands that change the directory.
+var cdCommand = regexp.MustCompile(`(?i)^(cd|chdir)([\s\\/.]|$)`)
+
+// locationCommand matches the PowerShell commands that change the
+// location.
+var locationCommand = regexp.MustCompile(`(?i)^(cd|chdir|sl|set-location|pushd|push-location|popd|pop-location)(\s|$)`)
+
+// driveLetterPath matches file system paths, which cmd can change to.
+var driveLetterPath = regexp.MustCompile(`^[A-Za-z]:\\`)
+
+type ShellCommand struct {
+	powershell *bool
+}
+
+func (s *ShellCommand) Flags(fs *flag.FlagSet) *flag.FlagSet {
+	s.powershell = fs.Bool("powershell", false, "start in PowerShell rather than cmd")
+	return fs
+}
+
+func (s *ShellCommand) Run(args []string) {
+	communicator, err := connect()
+	if err != nil {
+		fail("unable to connect: %s", err)
+	}
+	defer communicator.Close()
+
+	// The debug log would get in the way of the session
+	if os.Getenv("PACKER_LOG") == "" {
+		log.SetOutput(ioutil.Discard)
+	}
+
+	sh := &remoteShell{comm: communicator, powershell: *s.powershell}
+	sh.run()
+}
+
+// remoteShell is an interactive session on the guest, reading commands
+// with line editing and history.
+type remoteShell struct {
+	comm       *plugin.Communicator
+	powershell bool
+
+	// cwd is the directory cmd commands run in, or the location of
+	// PowerShell commands
+	cwd string
+}
+
+func (s *remoteShell) run() {
+	line := liner.NewLiner()
+	defer line.Close()
+	line.SetCtrlCAborts(true)
+
+	history := historyPath()
+	if f, err := os.Open(history); err == nil {
+		line.ReadHistory(f)
+		f.Close()
+	}
+	defer saveHistory(line, history)
+
+	if err := s.updateLocation(); err != nil {
+		printError("unable to start the shell: %s", err)
+		return
+	}
+	fmt.Fprintf(os.Stderr, "Connected to %s. Type :help for help.\n", *host)
+
+	for {
+		input, err := line.Prompt(s.prompt())
+		if err == liner.ErrPromptAborted {
+			continue
+		}
+		if err == io.EOF {
+			fmt.Println()
+			return
+		}
+		if err != nil {
+			printError("unable to read command: %s", err)
+			return
+		}
+
+		input = strings.TrimSpace(input)
+		if input == "" {
+			continue
+		}
+		line.AppendHistory(input)
+
+		switch input {
+		case ":exit", "exit":
+			return
+		case ":help":
+			fmt.Fprint(os.Stderr, shellHelp)
+		case ":powershell":
+			s.toggle()
+		default:
+			s.execute(input)
+		}
+	}
+}
+
+func (s *remoteShell) prompt() string {
+	if s.powershell {
+		return fmt.Sprintf("PS %s> ", s.cwd)
+	}
+	return s.cwd + ">"
+}
+
+// toggle switches between cmd and PowerShell, keeping the directory.
+func (s *remoteShell) toggle() {
+	s.powershell = !s.powershell
+	if err := s.updateLocation(); err != nil {
+		printError("unable to switch shells: %s", err)
+		s.powershell = !s.powershell
+	}
+}
+
+func (s *remoteShell) execute(input string) {
+	if s.powershell {
+		s.executePowershell(input)
+		return
+	}
+
+	rc := &packer.RemoteCmd{Stdout: os.Stdout, Stderr: os.Stderr}
+	rc.Command = fmt.Sprintf(`cd /d "%s" && %s`, s.cwd, input)
+	if !cdCommand.MatchString(input) {
+		if err := s.comm.Start(rc); err != nil {
+			printError("unable to run command: %s", err)
+			return
+		}
+		s.wait(rc)
+		return
+	}
+
+	// Each command starts a new process, so the shell remembers the
+	// directory a cd changed to, which cd then prints
+	var stdout bytes.Buffer
+	rc.Command += " && cd"
+	rc.Stdout = &stdout
+	if err := s.comm.Start(rc); err != nil {
+		printError("unable to run command: %s", err)
+		return
+	}
+	s.wait(rc)
+
+	if rc.ExitStatus == 0 {
+		if cwd := lastLine(stdout.String()); cwd != "" {
+			s.cwd = cwd
+		}
+	}
+}
+
+// executePowershell runs a PowerShell command in the current location.
+func (s *remoteShell) executePowershell(input string) {
+	script := fmt.Sprintf("Set-Location -LiteralPath '%s' -ErrorAction Stop\n%s", psQuote(s.cwd), input)
+	if !locationCommand.MatchString(input) {
+		rc := &packer.RemoteCmd{Command: powershell.EncodedCommand(script), Stdout: os.Stdout, Stderr: os.Stderr}
+		if err := s.comm.Start(rc); err != nil {
+			printError("unable to run command: %s", err)
+			return
+		}
+		s.wait(rc)
+		return
+	}
+
+	// The location is printed last, after the output of the command
+	var stdout bytes.Buffer
+	rc := &packer.RemoteCmd{
+		Command: powershell.EncodedCommand(script + "\n$PWD.Path"),
+		Stdout:  &stdout,
+		Stderr:  os.Stderr,
+	}
+	if err := s.comm.Start(rc); err != nil {
+		printError("unable to run command: %s", err)
+		return
+	}
+	s.wait(rc)
+
+	output := strings.TrimRight(stdout.String(), "\r\n")
+	i := strings.LastIndex(output, "\n")
+	fmt.Print(output[:i+1])
+	if rc.ExitStatus == 0 {
+		if cwd := strings.TrimSpace(output[i+1:]); cwd != "" {
+			s.cwd = cwd
+		}
+	}
+}
+
+// wait waits for a command to exit, terminating it on Ctrl+C.
+func (s *remoteShell) wait(rc *packer.RemoteCmd) {
+	interrupt := make(chan os.Signal, 1)
+	signal.Notify(interrupt, os.Interrupt)
+	defer signal.Stop(interrupt)
+
+	exited := make(chan struct{})
+	go func() {
+		rc.Wait()
+		close(exited)
+	}()
+
+	for {
+		select {
+		case <-exited:
+			return
+		case <-interrupt:
+			fmt.Fprintln(os.Stderr, "^C")
+			if err := s.comm.Terminate(rc); err != nil {
+				printError("unable to stop command: %s", err)
+			}
+		}
+	}
+}
+
+// updateLocation reads the directory commands run in for the prompt, if
+// it isn't known yet or cmd can't change to the PowerShell location.
+func (s *remoteShell) updateLocation() error {
+	if driveLetterPath.MatchString(s.cwd) || (s.powershell && s.cwd != "") {
+		return nil
+	}
+
+	var stdout bytes.Buffer
+	rc := &packer.RemoteCmd{Command: "cd", Stdout: &stdout, Stderr: os.Stderr}
+	if err := s.comm.Start(rc); err != nil {
+		return err
+	}
+	rc.Wait()
+	if rc.ExitStatus != 0 {
+		return fmt.Errorf("exit code %d", rc.ExitStatus)
+	}
+	s.cwd = lastLine(stdout.String())
+	return nil
+}
+
+// psQuote escapes s for use inside a single quoted PowerShell string.
+func psQuote(s string) string {
+	return strings.Replace(s, "'", "''", -1)
+}
+
+// printError reports an error to the user, who doesn't see the log.
+func printError(format string, args ...interface{}) {
+	fmt.Fprintf(os.Stderr, format+"\n", args...)
+}
+
+func lastLine(s string) string {
+	lines := strings.Split(strings.TrimSpace(s), "\n")
+	return strings.TrimSpace(lines[len(lines)-1])
+}
+
+// historyPath returns the file the commands typed in shells are kept in.
+func historyPath() string {
+	return filepath.Join(packerDir(), "winrm_history")
+}
+
+func saveHistory(line *liner.State, path string) {
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		printError("unable to save history: %s", err)
+		return
+	}
+
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0600)
+	if err != nil {
+		printError("unable to save history: %s", err)
+		return
+	}
+	defer f.Close()
+
+	if _, err := line.WriteHistory(f); err != nil {
+		printError("unable to save history: %s", err)
+	}
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	plugin "github.com/packer-community/packer-windows-plugins/communicator/winrm"
+)
+
+type DownloadCommand struct {
+	to      *string
+	from    *string
+	exclude *string
+}
+
+func (d *DownloadCommand) Flags(fs *flag.FlagSet) *flag.FlagSet {
+	d.to = fs.String("to", ".", "destination file or dir path")
+	d.from = fs.String("from", "", "remote file or dir path")
+	d.exclude = fs.String("exclude", "", "comma separated glob patterns of paths to skip in a dir")
+	return fs
+}
+
+func (d *DownloadCommand) Run(args []string) {
+	if *d.from == "" {
+		fail("no remote path given")
+	}
+
+	communicator, err := connect()
+	if err != nil {
+		fail("unable to connect: %s", err)
+	}
+	defer communicator.Close()
+
+	err = downloadFile(communicator, *d.from, *d.to)
+	if _, ok := err.(*plugin.DirectoryError); ok {
+		err = communicator.DownloadDir(*d.from, *d.to, splitList(*d.exclude))
+	}
+	if err != nil {
+		fail("unable to download: %s", err)
+	}
+}
+
+// downloadFile copies a remote file to the local path dst, or into dst
+// under its remote name if dst is a directory. Nothing is written to dst
+// unless the whole file was copied.
+func downloadFile(communicator *plugin.Communicator, src string, dst string) error {
+	if fi, err := os.Stat(dst); err == nil && fi.IsDir() {
+		dst = filepath.Join(dst, remoteBase(src))
+	}
+
+	f, err := ioutil.TempFile(filepath.Dir(dst), ".download")
+	if err != nil {
+		return err
+	}
+
+	err = communicator.Download(src, f)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(f.Name())
+		return err
+	}
+
+	return os.Rename(f.Name(), dst)
+}
+
+type SyncCommand struct {
+	to      *string
+	from    *string
+	exclude *string
+}
+
+func (s *SyncCommand) Flags(fs *flag.FlagSet) *flag.FlagSet {
+	s.to = fs.String("to", "", "destination dir path")
+	s.from = fs.String("from", "", "source dir path")
+	s.exclude = fs.String("exclude", "", "comma separated glob patterns of paths to skip")
+	return fs
+}
+
+func (s *SyncCommand) Run(args []string) {
+	communicator, err := connect()
+	if err != nil {
+		fail("unable to connect: %s", err)
+	}
+	defer communicator.Close()
+
+	copied, err := communicator.SyncDir(*s.to, *s.from, splitList(*s.exclude))
+	if err != nil {
+		fail("unable to sync dir: %s", err)
+	}
+
+	for _, path := range copied {
+		fmt.Println(path)
+	}
+	fmt.Fprintf(os.Stderr, "%d files copied\n", len(copied))
+}
+
+// remoteBase returns the last element of a path on the guest.
+func remoteBase(path string) string {
+	path = strings.TrimRight(path, `\/`)
+	if i := strings.LastIndexAny(path, `\/`); i >= 0 {
+		path = path[i+1:]
+	}
+	return path
+}
+
+// splitList splits a comma separated flag value, ignoring empty items.
+func splitList(s string) []string {
+	var items []string
+	for _, item := range strings.Split(s, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
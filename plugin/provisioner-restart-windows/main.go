@@ -1,7 +1,10 @@
 package main
 
 import (
+	"os"
+
 	"github.com/mitchellh/packer/packer/plugin"
+	"github.com/packer-community/packer-windows-plugins/common/redact"
 	restartwindows "github.com/packer-community/packer-windows-plugins/provisioner/restart"
 )
 
@@ -11,6 +14,7 @@ func main() {
 	if err != nil {
 		panic(err)
 	}
+	redact.SetLogOutput(os.Stderr)
 	server.RegisterProvisioner(new(restartwindows.Provisioner))
 	server.Serve()
 }
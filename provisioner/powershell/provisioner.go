@@ -12,6 +12,7 @@ import (
 	"os"
 	"sort"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/mitchellh/packer/common"
@@ -19,6 +20,8 @@ import (
 	"github.com/mitchellh/packer/helper/config"
 	"github.com/mitchellh/packer/packer"
 	"github.com/mitchellh/packer/template/interpolate"
+	wincommon "github.com/packer-community/packer-windows-plugins/common"
+	"github.com/packer-community/packer-windows-plugins/common/redact"
 )
 
 const DefaultRemotePath = "c:/Windows/Temp/script.ps1"
@@ -66,6 +69,10 @@ type Config struct {
 	// This can be set high to allow for reboots.
 	RawStartRetryTimeout string `mapstructure:"start_retry_timeout"`
 
+	// The timeout for a script to finish once it has started. A script
+	// that runs for longer is terminated. By default there is no timeout.
+	RawExecutionTimeout string `mapstructure:"execution_timeout"`
+
 	// This is used in the template generation to format environment variables
 	// inside the `ExecuteCommand` template.
 	EnvVarFormat string
@@ -85,11 +92,19 @@ type Config struct {
 	// such as 3010 - "The requested operation is successful. Changes will not be effective until the system is rebooted."
 	ValidExitCodes []int `mapstructure:"valid_exit_codes"`
 
+	// The names of environment variables in environment_vars whose values
+	// are secrets. They are masked in the log and the UI, like the
+	// elevated password.
+	SensitiveVars []string `mapstructure:"sensitive_environment_vars"`
+
 	startRetryTimeout time.Duration
+	executionTimeout  time.Duration
 }
 
 type Provisioner struct {
 	config       Config
+	cancel       chan struct{}
+	cancelLock   sync.Mutex
 	communicator packer.Communicator
 }
 
@@ -193,6 +208,17 @@ func (p *Provisioner) Prepare(raws ...interface{}) error {
 		}
 	}
 
+	redact.Add(p.config.ElevatedPassword)
+	for _, name := range p.config.SensitiveVars {
+		value, ok := p.envVar(name)
+		if !ok {
+			errs = packer.MultiErrorAppend(errs,
+				fmt.Errorf("Sensitive environment variable not in environment_vars: %s", name))
+			continue
+		}
+		redact.Add(value)
+	}
+
 	if p.config.RawStartRetryTimeout != "" {
 		p.config.startRetryTimeout, err = time.ParseDuration(p.config.RawStartRetryTimeout)
 		if err != nil {
@@ -201,6 +227,19 @@ func (p *Provisioner) Prepare(raws ...interface{}) error {
 		}
 	}
 
+	if p.config.RawExecutionTimeout != "" {
+		p.config.executionTimeout, err = time.ParseDuration(p.config.RawExecutionTimeout)
+		if err != nil {
+			errs = packer.MultiErrorAppend(
+				errs, fmt.Errorf("Failed parsing execution_timeout: %s", err))
+		} else if p.config.executionTimeout < 0 {
+			errs = packer.MultiErrorAppend(
+				errs, errors.New("execution_timeout must not be negative"))
+		}
+	}
+
+	p.cancel = make(chan struct{})
+
 	if errs != nil && len(errs.Errors) > 0 {
 		return errs
 	}
@@ -219,7 +258,7 @@ func extractScript(p *Provisioner) (string, error) {
 	defer temp.Close()
 	writer := bufio.NewWriter(temp)
 	for _, command := range p.config.Inline {
-		log.Printf("Found command: %s", command)
+		log.Printf("Found command: %s", redact.String(command))
 		if _, err := writer.WriteString(command + "\n"); err != nil {
 			return "", fmt.Errorf("Error preparing shell script: %s", err)
 		}
@@ -233,6 +272,7 @@ func extractScript(p *Provisioner) (string, error) {
 }
 
 func (p *Provisioner) Provision(ui packer.Ui, comm packer.Communicator) error {
+	ui = redact.Ui(ui)
 	ui.Say(fmt.Sprintf("Provisioning with Powershell..."))
 	p.communicator = comm
 
@@ -263,17 +303,18 @@ func (p *Provisioner) Provision(ui packer.Ui, comm packer.Communicator) error {
 		}
 		defer f.Close()
 
+		var cmd *packer.RemoteCmd
 		command, err := p.createCommandText()
 		if err != nil {
 			return fmt.Errorf("Error processing command: %s", err)
 		}
+		envScript := p.createEnvScript()
 
 		// Upload the file and run the command. Do this in the context of
 		// a single retryable function so that we don't end up with
 		// the case that the upload succeeded, a restart is initiated,
 		// and then the command is executed but the file doesn't exist
 		// any longer.
-		var cmd *packer.RemoteCmd
 		err = p.retryable(func() error {
 			if _, err := f.Seek(0, 0); err != nil {
 				return err
@@ -283,8 +324,16 @@ func (p *Provisioner) Provision(ui packer.Ui, comm packer.Communicator) error {
 				return fmt.Errorf("Error uploading script: %s", err)
 			}
 
+			// The script setting the sensitive variables deletes itself,
+			// so it is uploaded again for every attempt
+			if envScript != nil {
+				if err := comm.Upload(p.envScriptPath(), bytes.NewReader(envScript), nil); err != nil {
+					return fmt.Errorf("Error uploading environment script: %s", err)
+				}
+			}
+
 			cmd = &packer.RemoteCmd{Command: command}
-			return cmd.StartWithUi(comm, ui)
+			return wincommon.RunRemoteCmd(comm, cmd, ui, p.config.executionTimeout, p.cancel)
 		})
 		if err != nil {
 			return err
@@ -293,25 +342,39 @@ func (p *Provisioner) Provision(ui packer.Ui, comm packer.Communicator) error {
 		// Close the original file since we copied it
 		f.Close()
 
-		// Check exit code against allowed codes (likely just 0)
-		validExitCode := false
-		for _, v := range p.config.ValidExitCodes {
-			if cmd.ExitStatus == v {
-				validExitCode = true
-			}
-		}
-		if !validExitCode {
-			return fmt.Errorf("Script exited with non-zero exit status: %d. Allowed exit codes are: %s", cmd.ExitStatus, p.config.ValidExitCodes)
+		if err := p.checkExitCode(cmd); err != nil {
+			return err
 		}
 	}
 
 	return nil
 }
 
+// checkExitCode checks the exit code of a script against the allowed
+// codes (likely just 0).
+func (p *Provisioner) checkExitCode(cmd *packer.RemoteCmd) error {
+	for _, v := range p.config.ValidExitCodes {
+		if cmd.ExitStatus == v {
+			return nil
+		}
+	}
+	return fmt.Errorf("Script exited with non-zero exit status: %d. Allowed exit codes are: %s", cmd.ExitStatus, p.config.ValidExitCodes)
+}
+
 func (p *Provisioner) Cancel() {
-	// Just hard quit. It isn't a big deal if what we're doing keeps
-	// running on the other side.
-	os.Exit(0)
+	p.cancelLock.Lock()
+	defer p.cancelLock.Unlock()
+
+	// Stops the running script, or any further retries. There is nothing
+	// to stop before Prepare, and only the first call closes the channel.
+	if p.cancel == nil {
+		return
+	}
+	select {
+	case <-p.cancel:
+	default:
+		close(p.cancel)
+	}
 }
 
 // retryable will retry the given function over and over until a
@@ -324,6 +387,11 @@ func (p *Provisioner) retryable(f func() error) error {
 			return nil
 		}
 
+		// A command that started but was stopped is not retried
+		if _, ok := err.(*wincommon.RemoteCmdStoppedError); ok {
+			return err
+		}
+
 		// Create an error and log it
 		err = fmt.Errorf("Retryable error: %s", err)
 		log.Printf(err.Error())
@@ -334,14 +402,80 @@ func (p *Provisioner) retryable(f func() error) error {
 		select {
 		case <-startTimeout:
 			return err
-		default:
-			time.Sleep(retryableSleep)
+		case <-p.cancel:
+			return err
+		case <-time.After(retryableSleep):
 		}
 	}
 }
 
 func (p *Provisioner) createFlattenedEnvVars(elevated bool) (flattened string, err error) {
-	flattened = ""
+	envVars, err := p.envVars()
+	if err != nil {
+		return "", err
+	}
+
+	format := p.config.EnvVarFormat
+	if elevated {
+		format = p.config.ElevatedEnvVarFormat
+	}
+
+	// Re-assemble vars using OS specific format pattern and flatten.
+	// Sensitive ones are set by the environment script instead, so their
+	// values are not in the command line, which the communicator logs.
+	// The elevated command goes into the uploaded wrapper, not the
+	// command line.
+	for _, key := range sortedKeys(envVars) {
+		if elevated || !p.sensitive(key) {
+			flattened += fmt.Sprintf(format, key, envVars[key])
+		}
+	}
+	if !elevated && len(p.config.SensitiveVars) > 0 {
+		flattened += fmt.Sprintf(". %s; ", p.envScriptPath())
+	}
+	return
+}
+
+// createEnvScript returns the script that sets the sensitive environment
+// variables and then deletes itself, or nil if there are none or the
+// scripts run elevated.
+func (p *Provisioner) createEnvScript() []byte {
+	if len(p.config.SensitiveVars) == 0 || p.config.ElevatedUser != "" {
+		return nil
+	}
+
+	// The byte order mark has PowerShell read the file as UTF-8
+	script := bytes.NewBufferString("\xef\xbb\xbf")
+	for _, name := range p.config.SensitiveVars {
+		value, _ := p.envVar(name)
+		fmt.Fprintf(script, "$env:%s = '%s'\n", name, strings.Replace(value, "'", "''", -1))
+	}
+	fmt.Fprintf(script, "Remove-Item -Force -ErrorAction SilentlyContinue -LiteralPath \"%s\"\n", p.envScriptPath())
+	return script.Bytes()
+}
+
+// envScriptPath returns where the environment script is uploaded, next
+// to the script.
+func (p *Provisioner) envScriptPath() string {
+	path := p.config.RemotePath
+	if i := strings.LastIndexAny(path, `/\.`); i >= 0 && path[i] == '.' {
+		return path[:i] + "-env" + path[i:]
+	}
+	return path + "-env.ps1"
+}
+
+// sensitive reports whether name is one of sensitive_environment_vars.
+func (p *Provisioner) sensitive(name string) bool {
+	for _, s := range p.config.SensitiveVars {
+		if s == name {
+			return true
+		}
+	}
+	return false
+}
+
+// envVars returns the environment variables of the scripts.
+func (p *Provisioner) envVars() (map[string]string, error) {
 	envVars := make(map[string]string)
 
 	// Always available Packer provided env vars
@@ -352,28 +486,35 @@ func (p *Provisioner) createFlattenedEnvVars(elevated bool) (flattened string, e
 	for _, envVar := range p.config.Vars {
 		keyValue := strings.Split(envVar, "=")
 		if len(keyValue) != 2 {
-			err = errors.New("Shell provisioner environment variables must be in key=value format")
-			return
+			return nil, errors.New("Shell provisioner environment variables must be in key=value format")
 		}
 		envVars[keyValue[0]] = keyValue[1]
 	}
 
-	// Create a list of env var keys in sorted order
+	return envVars, nil
+}
+
+// envVar returns the value of the environment variable name in
+// environment_vars.
+func (p *Provisioner) envVar(name string) (string, bool) {
+	for _, kv := range p.config.Vars {
+		vs := strings.SplitN(kv, "=", 2)
+		if len(vs) == 2 && vs[0] == name {
+			return vs[1], true
+		}
+	}
+	return "", false
+}
+
+// sortedKeys returns the keys of a map of environment variables in
+// sorted order.
+func sortedKeys(envVars map[string]string) []string {
 	var keys []string
 	for k := range envVars {
 		keys = append(keys, k)
 	}
 	sort.Strings(keys)
-	format := p.config.EnvVarFormat
-	if elevated {
-		format = p.config.ElevatedEnvVarFormat
-	}
-
-	// Re-assemble vars using OS specific format pattern and flatten
-	for _, key := range keys {
-		flattened += fmt.Sprintf(format, key, envVars[key])
-	}
-	return
+	return keys
 }
 
 func (p *Provisioner) createCommandText() (command string, err error) {
@@ -421,7 +562,7 @@ func (p *Provisioner) createCommandText() (command string, err error) {
 }
 
 func (p *Provisioner) generateElevatedRunner(command string) (uploadedPath string, err error) {
-	log.Printf("Building elevated command wrapper for: %s", command)
+	log.Printf("Building elevated command wrapper for: %s", redact.String(command))
 
 	// generate command
 	var buffer bytes.Buffer
@@ -456,7 +597,7 @@ func (p *Provisioner) generateElevatedRunner(command string) (uploadedPath strin
 
 	uuid := uuid.TimeOrderedUUID()
 	path := fmt.Sprintf(`${env:TEMP}\packer-elevated-shell-%s.ps1`, uuid)
-	log.Printf("Uploading elevated shell wrapper for command [%s] to [%s] from [%s]", command, path, tmpFile.Name())
+	log.Printf("Uploading elevated shell wrapper for command [%s] to [%s] from [%s]", redact.String(command), path, tmpFile.Name())
 	err = p.communicator.Upload(path, f, nil)
 	if err != nil {
 		return "", fmt.Errorf("Error preparing elevated shell script: %s", err)
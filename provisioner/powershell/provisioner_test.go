@@ -13,6 +13,10 @@ import (
 	"time"
 
 	"github.com/mitchellh/packer/packer"
+	wincommon "github.com/packer-community/packer-windows-plugins/common"
+	"github.com/packer-community/packer-windows-plugins/common/commtest"
+	"github.com/packer-community/packer-windows-plugins/common/redact"
+	"github.com/packer-community/packer-windows-plugins/communicator/winrm/winrmtest"
 )
 
 func testConfig() map[string]interface{} {
@@ -282,6 +286,31 @@ func TestProvisionerPrepare_EnvironmentVars(t *testing.T) {
 	}
 }
 
+func TestProvisionerPrepare_SensitiveVars(t *testing.T) {
+	config := testConfig()
+	config["environment_vars"] = []string{"API_TOKEN=t0ken-s3cret", "FOO=bar"}
+
+	// Test with a name not in environment_vars
+	config["sensitive_environment_vars"] = []string{"API_KEY"}
+	p := new(Provisioner)
+	if err := p.Prepare(config); err == nil {
+		t.Fatal("should have error")
+	}
+
+	config["sensitive_environment_vars"] = []string{"API_TOKEN"}
+	config["elevated_user"] = "vagrant"
+	config["elevated_password"] = "elevated-s3cret"
+	p = new(Provisioner)
+	if err := p.Prepare(config); err != nil {
+		t.Fatalf("should not have error: %s", err)
+	}
+
+	actual := redact.String(`$env:API_TOKEN="t0ken-s3cret"; $env:FOO="bar"; -Password elevated-s3cret`)
+	if actual != `$env:API_TOKEN="[REDACTED]"; $env:FOO="bar"; -Password [REDACTED]` {
+		t.Fatalf("secrets should be masked: %s", actual)
+	}
+}
+
 func TestProvisionerQuote_EnvironmentVars(t *testing.T) {
 	config := testConfig()
 
@@ -476,6 +505,89 @@ func TestProvisionerProvision_ScriptsWithEnvVars(t *testing.T) {
 	}
 }
 
+func TestProvisionerProvision_WinRM(t *testing.T) {
+	r := winrmtest.NewRemote()
+	defer r.Close()
+
+	// The script succeeds the first time, and fails the second
+	exitCodes := make(chan int, 2)
+	exitCodes <- 0
+	exitCodes <- 1
+	r.CommandFunc(winrmtest.MatchPattern(`^powershell "& \{ .*c:/Windows/Temp/script.ps1; exit \$LastExitCode\}"$`), func(cmd *winrmtest.Cmd) int {
+		fmt.Fprint(cmd.Stdout, "hello from the guest\r\n")
+		return <-exitCodes
+	})
+
+	comm := commtest.ConnectWinRM(t, r)
+	defer comm.Close()
+
+	ui := testUi()
+	p := new(Provisioner)
+	if err := p.Prepare(testConfig()); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if err := p.Provision(ui, comm); err != nil {
+		t.Fatalf("should not have error: %s", err)
+	}
+
+	output := ui.Writer.(*bytes.Buffer).String()
+	if !strings.Contains(output, "hello from the guest") {
+		t.Fatalf("output should contain the script's: %s", output)
+	}
+
+	if err := p.Provision(ui, comm); err == nil || !strings.Contains(err.Error(), "non-zero exit status: 1") {
+		t.Fatalf("should have error: %v", err)
+	}
+}
+
+func TestProvisionerProvision_SensitiveVars(t *testing.T) {
+	config := testConfig()
+	config["environment_vars"] = []string{"TOKEN=it's secret", "PLAIN=visible"}
+	config["sensitive_environment_vars"] = []string{"TOKEN"}
+	config["packer_build_name"] = "foobuild"
+	config["packer_builder_type"] = "footype"
+
+	p := new(Provisioner)
+	if err := p.Prepare(config); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	comm := new(commtest.UploadsCommunicator)
+	if err := p.Provision(testUi(), comm); err != nil {
+		t.Fatalf("should not have error: %s", err)
+	}
+
+	// The secret is set by an uploaded script instead of the command line
+	expectedCommand := `powershell "& { $env:PACKER_BUILDER_TYPE=\"footype\"; $env:PACKER_BUILD_NAME=\"foobuild\"; ` +
+		`$env:PLAIN=\"visible\"; . c:/Windows/Temp/script-env.ps1; c:/Windows/Temp/script.ps1; exit $LastExitCode}"`
+	if comm.StartCmd.Command != expectedCommand {
+		t.Fatalf("Expect command to be %s NOT %s", expectedCommand, comm.StartCmd.Command)
+	}
+
+	expectedScript := "\xef\xbb\xbf$env:TOKEN = 'it''s secret'\n" +
+		"Remove-Item -Force -ErrorAction SilentlyContinue -LiteralPath \"c:/Windows/Temp/script-env.ps1\"\n"
+	if script := comm.Uploads["c:/Windows/Temp/script-env.ps1"]; script != expectedScript {
+		t.Fatalf("bad environment script: %q", script)
+	}
+
+	// Elevated scripts get every variable from the uploaded wrapper
+	config["elevated_user"] = "vagrant"
+	config["elevated_password"] = "vagrant"
+	if err := p.Prepare(config); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if p.createEnvScript() != nil {
+		t.Fatal("elevated scripts should not have an environment script")
+	}
+	vars, err := p.createFlattenedEnvVars(true)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if !strings.Contains(vars, `$env:TOKEN="it's secret"; `) {
+		t.Fatalf("bad elevated vars: %s", vars)
+	}
+}
+
 func TestProvisionerProvision_UISlurp(t *testing.T) {
 	// UI should be called n times
 
@@ -650,7 +762,66 @@ func TestRetryable(t *testing.T) {
 	}
 }
 
+func TestProvisionerProvision_ExecutionTimeout(t *testing.T) {
+	config := testConfig()
+	config["execution_timeout"] = "50ms"
+
+	p := new(Provisioner)
+	if err := p.Prepare(config); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	comm := new(commtest.HangingCommunicator)
+	err := p.Provision(testUi(), comm)
+	if _, ok := err.(*wincommon.RemoteCmdStoppedError); !ok {
+		t.Fatalf("should have timed out: %#v", err)
+	}
+	if comm.Stopped() == "" {
+		t.Fatal("command should be stopped")
+	}
+}
+
+func TestProvisionerPrepare_ExecutionTimeout(t *testing.T) {
+	config := testConfig()
+	config["execution_timeout"] = "bad"
+
+	p := new(Provisioner)
+	if err := p.Prepare(config); err == nil {
+		t.Fatal("should have error")
+	}
+}
+
+func TestCancel_Twice(t *testing.T) {
+	// Cancelling before Prepare has nothing to stop
+	p := new(Provisioner)
+	p.Cancel()
+
+	if err := p.Prepare(testConfig()); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	p.Cancel()
+	p.Cancel()
+}
+
 func TestCancel(t *testing.T) {
-	// Don't actually call Cancel() as it performs an os.Exit(0)
-	// which kills the 'go test' tool
+	config := testConfig()
+
+	p := new(Provisioner)
+	if err := p.Prepare(config); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		p.Cancel()
+	}()
+
+	comm := new(commtest.HangingCommunicator)
+	err := p.Provision(testUi(), comm)
+	if _, ok := err.(*wincommon.RemoteCmdStoppedError); !ok {
+		t.Fatalf("should have been cancelled: %#v", err)
+	}
+	if comm.Stopped() == "" {
+		t.Fatal("command should be stopped")
+	}
 }
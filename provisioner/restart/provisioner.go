@@ -3,17 +3,19 @@ package restart
 import (
 	"fmt"
 	"log"
+	"sync"
 	"time"
 
-	"github.com/masterzen/winrm/winrm"
 	"github.com/mitchellh/packer/common"
 	"github.com/mitchellh/packer/helper/config"
 	"github.com/mitchellh/packer/packer"
 	"github.com/mitchellh/packer/template/interpolate"
+	wincommon "github.com/packer-community/packer-windows-plugins/common"
+	"github.com/packer-community/packer-windows-plugins/common/powershell"
 )
 
 var DefaultRestartCommand = "shutdown /r /c \"packer restart\" /t 5 && net stop winrm"
-var DefaultRestartCheckCommand = winrm.Powershell(`echo "${env:COMPUTERNAME} restarted."`)
+var DefaultRestartCheckCommand = powershell.EncodedCommand(`echo "${env:COMPUTERNAME} restarted."`)
 var retryableSleep = 5 * time.Second
 
 type Config struct {
@@ -34,10 +36,11 @@ type Config struct {
 }
 
 type Provisioner struct {
-	config Config
-	comm   packer.Communicator
-	ui     packer.Ui
-	cancel chan struct{}
+	config     Config
+	comm       packer.Communicator
+	ui         packer.Ui
+	cancelLock sync.Mutex
+	cancel     chan struct{}
 }
 
 func (p *Provisioner) Prepare(raws ...interface{}) error {
@@ -83,13 +86,15 @@ func (p *Provisioner) Provision(ui packer.Ui, comm packer.Communicator) error {
 	ui.Say("Restarting Machine")
 	p.comm = comm
 	p.ui = ui
+	p.cancelLock.Lock()
 	p.cancel = make(chan struct{})
+	p.cancelLock.Unlock()
 
 	var cmd *packer.RemoteCmd
 	command := p.config.RestartCommand
 	err := p.retryable(func() error {
 		cmd = &packer.RemoteCmd{Command: command}
-		return cmd.StartWithUi(comm, ui)
+		return wincommon.RunRemoteCmd(comm, cmd, ui, 0, p.cancel)
 	})
 
 	if err != nil {
@@ -130,17 +135,16 @@ WaitLoop:
 			}
 
 			ui.Say("Machine successfully restarted, moving on")
-			close(p.cancel)
+			p.closeCancel()
 			break WaitLoop
 		case <-timeout:
 			err := fmt.Errorf("Timeout waiting for WinRM.")
 			ui.Error(err.Error())
-			close(p.cancel)
+			p.closeCancel()
 			return err
 		case <-p.cancel:
-			close(waitDone)
+			// waitDone is buffered, so the wait can still finish
 			return fmt.Errorf("Interrupt detected, quitting waiting for machine to restart")
-			break WaitLoop
 		}
 	}
 
@@ -176,7 +180,24 @@ var waitForCommunicator = func(p *Provisioner) error {
 
 func (p *Provisioner) Cancel() {
 	log.Printf("Received interrupt Cancel()")
-	close(p.cancel)
+	p.closeCancel()
+}
+
+// closeCancel stops the restart command and the wait for the machine,
+// whether they were interrupted or are done. There is nothing to stop
+// before Provision, and only the first call closes the channel.
+func (p *Provisioner) closeCancel() {
+	p.cancelLock.Lock()
+	defer p.cancelLock.Unlock()
+
+	if p.cancel == nil {
+		return
+	}
+	select {
+	case <-p.cancel:
+	default:
+		close(p.cancel)
+	}
 }
 
 // retryable will retry the given function over and over until a
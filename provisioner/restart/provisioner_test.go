@@ -5,6 +5,9 @@ import (
 	"errors"
 	"fmt"
 	"github.com/mitchellh/packer/packer"
+	"github.com/packer-community/packer-windows-plugins/common/commtest"
+	"github.com/packer-community/packer-windows-plugins/communicator/winrm/winrmtest"
+	"strings"
 	"testing"
 	"time"
 )
@@ -122,6 +125,32 @@ func TestProvisionerProvision_Success(t *testing.T) {
 	waitForCommunicator = waitForCommunicatorOld
 }
 
+func TestProvisionerProvision_WinRM(t *testing.T) {
+	r := winrmtest.NewRemote()
+	defer r.Close()
+	r.Command(winrmtest.MatchText(DefaultRestartCommand), "", 0)
+	r.Command(winrmtest.MatchScript(`restarted\.`), "WIN-PACKER restarted.\r\n", 0)
+
+	comm := commtest.ConnectWinRM(t, r)
+	defer comm.Close()
+
+	retryableSleepOld := retryableSleep
+	retryableSleep = 10 * time.Millisecond
+	defer func() { retryableSleep = retryableSleepOld }()
+
+	ui := testUi()
+	p := new(Provisioner)
+	p.Prepare(testConfig())
+	if err := p.Provision(ui, comm); err != nil {
+		t.Fatalf("should not have error: %s", err)
+	}
+
+	output := ui.Writer.(*bytes.Buffer).String()
+	if !strings.Contains(output, "WIN-PACKER restarted.") {
+		t.Fatalf("output should contain the check command's: %s", output)
+	}
+}
+
 func TestProvisionerProvision_CustomCommand(t *testing.T) {
 	config := testConfig()
 
@@ -333,27 +362,27 @@ func TestProvision_Cancel(t *testing.T) {
 
 	comm := new(packer.MockCommunicator)
 	p.Prepare(config)
+	waiting := make(chan bool)
 	waitDone := make(chan bool)
 
 	// Block until cancel comes through
+	waitForCommunicatorOld := waitForCommunicator
+	defer func() { waitForCommunicator = waitForCommunicatorOld }()
 	waitForCommunicator = func(p *Provisioner) error {
-		for {
-			select {
-			case <-waitDone:
-			}
-		}
+		waiting <- true
+		<-p.cancel
+		return fmt.Errorf("Communicator wait cancelled")
 	}
 
-	// Create two go routines to provision and cancel in parallel
-	// Provision will block until cancel happens
+	// Provision will block until cancel happens, which can only stop it
+	// once it is waiting for the machine
 	go func() {
 		err = p.Provision(ui, comm)
 		waitDone <- true
 	}()
 
-	go func() {
-		p.Cancel()
-	}()
+	<-waiting
+	p.Cancel()
 	<-waitDone
 
 	// Expect interupt error
@@ -361,3 +390,29 @@ func TestProvision_Cancel(t *testing.T) {
 		t.Fatal("should have error")
 	}
 }
+
+func TestProvision_CancelAfterRestart(t *testing.T) {
+	config := testConfig()
+
+	// Defaults provided by Packer
+	ui := testUi()
+	p := new(Provisioner)
+
+	// Nothing to stop yet
+	p.Cancel()
+
+	comm := new(packer.MockCommunicator)
+	p.Prepare(config)
+	waitForCommunicatorOld := waitForCommunicator
+	defer func() { waitForCommunicator = waitForCommunicatorOld }()
+	waitForCommunicator = func(p *Provisioner) error {
+		return nil
+	}
+	if err := p.Provision(ui, comm); err != nil {
+		t.Fatalf("should not have error: %s", err)
+	}
+
+	// The finished restart already closed the channel
+	p.Cancel()
+	p.Cancel()
+}
@@ -4,6 +4,7 @@ package shell
 
 import (
 	"bufio"
+	"bytes"
 	"errors"
 	"fmt"
 	"io/ioutil"
@@ -11,12 +12,15 @@ import (
 	"os"
 	"sort"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/mitchellh/packer/common"
 	"github.com/mitchellh/packer/helper/config"
 	"github.com/mitchellh/packer/packer"
 	"github.com/mitchellh/packer/template/interpolate"
+	wincommon "github.com/packer-community/packer-windows-plugins/common"
+	"github.com/packer-community/packer-windows-plugins/common/redact"
 )
 
 const DefaultRemotePath = "c:/Windows/Temp/script.bat"
@@ -45,6 +49,10 @@ type Config struct {
 	// your command(s) are executed.
 	Vars []string `mapstructure:"environment_vars"`
 
+	// The names of environment variables in environment_vars whose values
+	// are secrets. They are masked in the log and the UI.
+	SensitiveVars []string `mapstructure:"sensitive_environment_vars"`
+
 	// The remote path where the local shell script will be uploaded to.
 	// This should be set to a writable file that is in a pre-existing directory.
 	RemotePath string `mapstructure:"remote_path"`
@@ -59,15 +67,22 @@ type Config struct {
 	// This can be set high to allow for reboots.
 	RawStartRetryTimeout string `mapstructure:"start_retry_timeout"`
 
+	// The timeout for a script to finish once it has started. A script
+	// that runs for longer is terminated. By default there is no timeout.
+	RawExecutionTimeout string `mapstructure:"execution_timeout"`
+
 	// This is used in the template generation to format environment variables
 	// inside the `ExecuteCommand` template.
 	EnvVarFormat string
 
 	startRetryTimeout time.Duration
+	executionTimeout  time.Duration
 }
 
 type Provisioner struct {
-	config Config
+	config     Config
+	cancel     chan struct{}
+	cancelLock sync.Mutex
 }
 
 type ExecuteCommandTemplate struct {
@@ -148,6 +163,16 @@ func (p *Provisioner) Prepare(raws ...interface{}) error {
 		}
 	}
 
+	for _, name := range p.config.SensitiveVars {
+		value, ok := p.envVar(name)
+		if !ok {
+			errs = packer.MultiErrorAppend(errs,
+				fmt.Errorf("Sensitive environment variable not in environment_vars: %s", name))
+			continue
+		}
+		redact.Add(value)
+	}
+
 	if p.config.RawStartRetryTimeout != "" {
 		p.config.startRetryTimeout, err = time.ParseDuration(p.config.RawStartRetryTimeout)
 		if err != nil {
@@ -156,6 +181,19 @@ func (p *Provisioner) Prepare(raws ...interface{}) error {
 		}
 	}
 
+	if p.config.RawExecutionTimeout != "" {
+		p.config.executionTimeout, err = time.ParseDuration(p.config.RawExecutionTimeout)
+		if err != nil {
+			errs = packer.MultiErrorAppend(
+				errs, fmt.Errorf("Failed parsing execution_timeout: %s", err))
+		} else if p.config.executionTimeout < 0 {
+			errs = packer.MultiErrorAppend(
+				errs, errors.New("execution_timeout must not be negative"))
+		}
+	}
+
+	p.cancel = make(chan struct{})
+
 	if errs != nil && len(errs.Errors) > 0 {
 		return errs
 	}
@@ -174,7 +212,7 @@ func extractScript(p *Provisioner) (string, error) {
 	}
 	writer := bufio.NewWriter(temp)
 	for _, command := range p.config.Inline {
-		log.Printf("Found command: %s", command)
+		log.Printf("Found command: %s", redact.String(command))
 		if _, err := writer.WriteString(command + "\n"); err != nil {
 			return "", fmt.Errorf("Error preparing shell script: %s", err)
 		}
@@ -190,6 +228,7 @@ func extractScript(p *Provisioner) (string, error) {
 }
 
 func (p *Provisioner) Provision(ui packer.Ui, comm packer.Communicator) error {
+	ui = redact.Ui(ui)
 	ui.Say(fmt.Sprintf("Provisioning with windows-shell..."))
 	scripts := make([]string, len(p.config.Scripts))
 	copy(scripts, p.config.Scripts)
@@ -224,6 +263,10 @@ func (p *Provisioner) Provision(ui packer.Ui, comm packer.Communicator) error {
 		if err != nil {
 			return err
 		}
+		envScript, err := p.createEnvScript()
+		if err != nil {
+			return err
+		}
 
 		// Compile the command
 		p.config.ctx.Data = &ExecuteCommandTemplate{
@@ -250,8 +293,16 @@ func (p *Provisioner) Provision(ui packer.Ui, comm packer.Communicator) error {
 				return fmt.Errorf("Error uploading script: %s", err)
 			}
 
+			// The script setting the sensitive variables deletes itself,
+			// so it is uploaded again for every attempt
+			if envScript != nil {
+				if err := comm.Upload(p.envScriptPath(), bytes.NewReader(envScript), nil); err != nil {
+					return fmt.Errorf("Error uploading environment script: %s", err)
+				}
+			}
+
 			cmd = &packer.RemoteCmd{Command: command}
-			return cmd.StartWithUi(comm, ui)
+			return wincommon.RunRemoteCmd(comm, cmd, ui, p.config.executionTimeout, p.cancel)
 		})
 		if err != nil {
 			return err
@@ -269,9 +320,19 @@ func (p *Provisioner) Provision(ui packer.Ui, comm packer.Communicator) error {
 }
 
 func (p *Provisioner) Cancel() {
-	// Just hard quit. It isn't a big deal if what we're doing keeps
-	// running on the other side.
-	os.Exit(0)
+	p.cancelLock.Lock()
+	defer p.cancelLock.Unlock()
+
+	// Stops the running script, or any further retries. There is nothing
+	// to stop before Prepare, and only the first call closes the channel.
+	if p.cancel == nil {
+		return
+	}
+	select {
+	case <-p.cancel:
+	default:
+		close(p.cancel)
+	}
 }
 
 // retryable will retry the given function over and over until a
@@ -284,6 +345,11 @@ func (p *Provisioner) retryable(f func() error) error {
 			return nil
 		}
 
+		// A command that started but was stopped is not retried
+		if _, ok := err.(*wincommon.RemoteCmdStoppedError); ok {
+			return err
+		}
+
 		// Create an error and log it
 		err = fmt.Errorf("Retryable error: %s", err)
 		log.Printf(err.Error())
@@ -294,14 +360,15 @@ func (p *Provisioner) retryable(f func() error) error {
 		select {
 		case <-startTimeout:
 			return err
-		default:
-			time.Sleep(retryableSleep)
+		case <-p.cancel:
+			return err
+		case <-time.After(retryableSleep):
 		}
 	}
 }
 
-func (p *Provisioner) createFlattenedEnvVars() (flattened string, err error) {
-	flattened = ""
+// envVars returns the environment variables of the scripts.
+func (p *Provisioner) envVars() (map[string]string, error) {
 	envVars := make(map[string]string)
 
 	// Always available Packer provided env vars
@@ -312,20 +379,104 @@ func (p *Provisioner) createFlattenedEnvVars() (flattened string, err error) {
 	for _, envVar := range p.config.Vars {
 		keyValue := strings.Split(envVar, "=")
 		if len(keyValue) != 2 {
-			err = errors.New("Shell provisioner environment variables must be in key=value format")
-			return
+			return nil, errors.New("Shell provisioner environment variables must be in key=value format")
 		}
 		envVars[keyValue[0]] = keyValue[1]
 	}
+
+	return envVars, nil
+}
+
+// envVar returns the value of the environment variable name in
+// environment_vars.
+func (p *Provisioner) envVar(name string) (string, bool) {
+	for _, kv := range p.config.Vars {
+		vs := strings.SplitN(kv, "=", 2)
+		if len(vs) == 2 && vs[0] == name {
+			return vs[1], true
+		}
+	}
+	return "", false
+}
+
+func (p *Provisioner) createFlattenedEnvVars() (flattened string, err error) {
+	envVars, err := p.envVars()
+	if err != nil {
+		return "", err
+	}
+
 	// Create a list of env var keys in sorted order
 	var keys []string
 	for k := range envVars {
 		keys = append(keys, k)
 	}
 	sort.Strings(keys)
-	// Re-assemble vars using OS specific format pattern and flatten
+	// Re-assemble vars using OS specific format pattern and flatten.
+	// Sensitive ones are set by the environment script instead, so their
+	// values are not in the command line, which the communicator logs.
 	for _, key := range keys {
-		flattened += fmt.Sprintf(p.config.EnvVarFormat, key, envVars[key])
+		if !p.sensitive(key) {
+			flattened += fmt.Sprintf(p.config.EnvVarFormat, key, envVars[key])
+		}
+	}
+	if len(p.config.SensitiveVars) > 0 {
+		flattened += fmt.Sprintf(`call "%s" && `, p.envScriptPath())
 	}
 	return
 }
+
+// createEnvScript returns the batch file that sets the sensitive
+// environment variables and then deletes itself, or nil if there are
+// none.
+func (p *Provisioner) createEnvScript() ([]byte, error) {
+	if len(p.config.SensitiveVars) == 0 {
+		return nil, nil
+	}
+
+	var script bytes.Buffer
+	for _, name := range p.config.SensitiveVars {
+		value, _ := p.envVar(name)
+		if strings.ContainsAny(value, "\r\n") {
+			return nil, fmt.Errorf("Sensitive environment variable %s can't contain a line break", name)
+		}
+		fmt.Fprintf(&script, "@set %s=%s\r\n", name, batchEscape(value))
+	}
+	script.WriteString("@del \"%~f0\" & exit /b 0\r\n")
+	return script.Bytes(), nil
+}
+
+// envScriptPath returns where the environment script is uploaded, next
+// to the script.
+func (p *Provisioner) envScriptPath() string {
+	path := p.config.RemotePath
+	if i := strings.LastIndexAny(path, `/\.`); i >= 0 && path[i] == '.' {
+		return path[:i] + "-env" + path[i:]
+	}
+	return path + "-env.bat"
+}
+
+// sensitive reports whether name is one of sensitive_environment_vars.
+func (p *Provisioner) sensitive(name string) bool {
+	for _, s := range p.config.SensitiveVars {
+		if s == name {
+			return true
+		}
+	}
+	return false
+}
+
+// batchEscape escapes s for the value of a set command in a batch file,
+// so that it is taken as it is.
+func batchEscape(s string) string {
+	var escaped bytes.Buffer
+	for _, c := range s {
+		switch c {
+		case '^', '&', '|', '<', '>', '(', ')', '"':
+			escaped.WriteRune('^')
+		case '%':
+			escaped.WriteRune('%')
+		}
+		escaped.WriteRune(c)
+	}
+	return escaped.String()
+}
@@ -5,6 +5,9 @@ import (
 	"errors"
 	"fmt"
 	"github.com/mitchellh/packer/packer"
+	wincommon "github.com/packer-community/packer-windows-plugins/common"
+	"github.com/packer-community/packer-windows-plugins/common/commtest"
+	"github.com/packer-community/packer-windows-plugins/common/redact"
 	"io/ioutil"
 	"log"
 	"os"
@@ -209,6 +212,29 @@ func TestProvisionerPrepare_EnvironmentVars(t *testing.T) {
 	}
 }
 
+func TestProvisionerPrepare_SensitiveVars(t *testing.T) {
+	config := testConfig()
+	config["environment_vars"] = []string{"API_TOKEN=t0ken-s3cret", "FOO=bar"}
+
+	// Test with a name not in environment_vars
+	config["sensitive_environment_vars"] = []string{"API_KEY"}
+	p := new(Provisioner)
+	if err := p.Prepare(config); err == nil {
+		t.Fatal("should have error")
+	}
+
+	config["sensitive_environment_vars"] = []string{"API_TOKEN"}
+	p = new(Provisioner)
+	if err := p.Prepare(config); err != nil {
+		t.Fatalf("should not have error: %s", err)
+	}
+
+	actual := redact.String(`set "API_TOKEN=t0ken-s3cret" && set "FOO=bar"`)
+	if actual != `set "API_TOKEN=[REDACTED]" && set "FOO=bar"` {
+		t.Fatalf("secret should be masked: %s", actual)
+	}
+}
+
 func TestProvisionerQuote_EnvironmentVars(t *testing.T) {
 	config := testConfig()
 
@@ -357,6 +383,36 @@ func TestProvisionerProvision_ScriptsWithEnvVars(t *testing.T) {
 	}
 }
 
+func TestProvisionerProvision_SensitiveVars(t *testing.T) {
+	config := testConfig()
+	config["environment_vars"] = []string{`TOKEN=s3cr&t "100%"`, "PLAIN=visible"}
+	config["sensitive_environment_vars"] = []string{"TOKEN"}
+	config["packer_build_name"] = "foobuild"
+	config["packer_builder_type"] = "footype"
+
+	p := new(Provisioner)
+	if err := p.Prepare(config); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	comm := new(commtest.UploadsCommunicator)
+	if err := p.Provision(testUi(), comm); err != nil {
+		t.Fatalf("should not have error: %s", err)
+	}
+
+	// The secret is set by an uploaded script instead of the command line
+	expectedCommand := `set "PACKER_BUILDER_TYPE=footype" && set "PACKER_BUILD_NAME=foobuild" && set "PLAIN=visible" && ` +
+		`call "c:/Windows/Temp/script-env.bat" && "c:/Windows/Temp/script.bat"`
+	if comm.StartCmd.Command != expectedCommand {
+		t.Fatalf("Expect command to be %s NOT %s", expectedCommand, comm.StartCmd.Command)
+	}
+
+	expectedScript := "@set TOKEN=s3cr^&t ^\"100%%^\"\r\n@del \"%~f0\" & exit /b 0\r\n"
+	if script := comm.Uploads["c:/Windows/Temp/script-env.bat"]; script != expectedScript {
+		t.Fatalf("bad environment script: %q", script)
+	}
+}
+
 func TestProvisioner_createFlattenedEnvVars_windows(t *testing.T) {
 	config := testConfig()
 
@@ -435,7 +491,66 @@ func TestRetryable(t *testing.T) {
 	}
 }
 
+func TestProvisionerProvision_ExecutionTimeout(t *testing.T) {
+	config := testConfig()
+	config["execution_timeout"] = "50ms"
+
+	p := new(Provisioner)
+	if err := p.Prepare(config); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	comm := new(commtest.HangingCommunicator)
+	err := p.Provision(testUi(), comm)
+	if _, ok := err.(*wincommon.RemoteCmdStoppedError); !ok {
+		t.Fatalf("should have timed out: %#v", err)
+	}
+	if comm.Stopped() == "" {
+		t.Fatal("command should be stopped")
+	}
+}
+
+func TestProvisionerPrepare_ExecutionTimeout(t *testing.T) {
+	config := testConfig()
+	config["execution_timeout"] = "bad"
+
+	p := new(Provisioner)
+	if err := p.Prepare(config); err == nil {
+		t.Fatal("should have error")
+	}
+}
+
+func TestCancel_Twice(t *testing.T) {
+	// Cancelling before Prepare has nothing to stop
+	p := new(Provisioner)
+	p.Cancel()
+
+	if err := p.Prepare(testConfig()); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	p.Cancel()
+	p.Cancel()
+}
+
 func TestCancel(t *testing.T) {
-	// Don't actually call Cancel() as it performs an os.Exit(0)
-	// which kills the 'go test' tool
+	config := testConfig()
+
+	p := new(Provisioner)
+	if err := p.Prepare(config); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		p.Cancel()
+	}()
+
+	comm := new(commtest.HangingCommunicator)
+	err := p.Provision(testUi(), comm)
+	if _, ok := err.(*wincommon.RemoteCmdStoppedError); !ok {
+		t.Fatalf("should have been cancelled: %#v", err)
+	}
+	if comm.Stopped() == "" {
+		t.Fatal("command should be stopped")
+	}
 }